@@ -0,0 +1,472 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"k8s.io/apimachinery/pkg/util/validation"
+)
+
+const snapshotJobTimeout = 5 * time.Minute
+
+// snapshotEntry is one node of `restic ls --json`.
+type snapshotEntry struct {
+	Name  string `json:"name"`
+	Type  string `json:"type"`
+	Path  string `json:"path"`
+	Size  uint64 `json:"size,omitempty"`
+	Mode  uint32 `json:"mode,omitempty"`
+	MTime string `json:"mtime,omitempty"`
+}
+
+type apiError struct {
+	Error string `json:"error"`
+}
+
+// startAPIServer serves the snapshot browsing API:
+//
+//	GET /v1/namespaces/{ns}/pvcs/{pvc}/snapshots
+//	GET /v1/namespaces/{ns}/pvcs/{pvc}/snapshots/{id}/ls?path=/dir
+//	GET /v1/namespaces/{ns}/pvcs/{pvc}/snapshots/{id}/dump?path=/file
+//
+// Requests carry a Kubernetes bearer token. Listing snapshots requires get on
+// backuppolicies, browsing and downloading requires create on restorepolicies
+// in the namespace. The server speaks plain HTTP, so the tokens are only
+// protected by the transport in front of it: reach it through
+// `kubectl port-forward`, which tunnels through the API server, and never
+// expose the Service outside the cluster.
+//
+// A dump answers 200 as soon as the data starts to flow, so a failure during
+// the transfer cannot change the status. Its X-Backup-Result trailer, sent
+// after the body, is ok only when the whole stream arrived with a matching
+// sha256; clients must treat any other value, or a missing trailer, as failed.
+func startAPIServer(ctx context.Context, client *kubeClient, cfg Config) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v1/namespaces/", func(w http.ResponseWriter, r *http.Request) {
+		handleSnapshotAPI(client, cfg, w, r)
+	})
+	server := &http.Server{
+		Addr:              cfg.APIAddr,
+		Handler:           mux,
+		ReadHeaderTimeout: 5 * time.Second,
+	}
+	slog.Info("api server starting", "addr", cfg.APIAddr)
+	if err := serveUntilDone(ctx, server, server.ListenAndServe); err != nil {
+		slog.Error("api server stopped", logError, err)
+	}
+}
+
+func handleSnapshotAPI(client *kubeClient, cfg Config, w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	if r.Method != http.MethodGet {
+		writeAPIError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	// namespaces/{ns}/pvcs/{pvc}/snapshots[/{id}/{action}]
+	parts := strings.Split(strings.Trim(strings.TrimPrefix(r.URL.Path, "/v1/"), "/"), "/")
+	if len(parts) < 5 || parts[0] != "namespaces" || parts[2] != "pvcs" || parts[4] != "snapshots" {
+		writeAPIError(w, http.StatusNotFound, "not found")
+		return
+	}
+	ns, pvc := parts[1], parts[3]
+	// Both end up in API paths and Job names.
+	if len(validation.IsDNS1123Label(ns)) > 0 || len(validation.IsDNS1123Subdomain(pvc)) > 0 {
+		writeAPIError(w, http.StatusBadRequest, "invalid namespace or pvc name")
+		return
+	}
+
+	switch len(parts) {
+	case 5:
+		if !authorizeAPIRequest(ctx, client, w, r, ns, "get", "backuppolicies") {
+			return
+		}
+		offset, offsetErr := queryCount(r, "offset")
+		limit, limitErr := queryCount(r, "limit")
+		if offsetErr != nil || limitErr != nil {
+			writeAPIError(w, http.StatusBadRequest, "offset and limit must be non-negative integers")
+			return
+		}
+		serveSnapshotList(ctx, client, cfg, w, ns, pvc, offset, limit)
+	case 7:
+		snapshotID, action := parts[5], parts[6]
+		if !validSnapshotID(snapshotID) {
+			writeAPIError(w, http.StatusBadRequest, "invalid snapshot id")
+			return
+		}
+		if !authorizeAPIRequest(ctx, client, w, r, ns, "create", "restorepolicies") {
+			return
+		}
+		target := path.Clean("/" + r.URL.Query().Get("path"))
+		switch action {
+		case "ls":
+			serveSnapshotListing(ctx, client, cfg, w, ns, pvc, snapshotID, target)
+		case "dump":
+			serveSnapshotDump(ctx, client, cfg, w, ns, pvc, snapshotID, target)
+		default:
+			writeAPIError(w, http.StatusNotFound, "not found")
+		}
+	default:
+		writeAPIError(w, http.StatusNotFound, "not found")
+	}
+}
+
+// snapshotTotalHeader carries the number of snapshots of a volume on paged
+// snapshot lists.
+const snapshotTotalHeader = "X-Total-Count"
+
+// queryCount parses a non-negative integer query parameter, 0 when unset.
+func queryCount(r *http.Request, name string) (int, error) {
+	value := r.URL.Query().Get(name)
+	if value == "" {
+		return 0, nil
+	}
+	count, err := strconv.Atoi(value)
+	if err != nil || count < 0 {
+		return 0, fmt.Errorf("invalid %s %q", name, value)
+	}
+	return count, nil
+}
+
+// serveSnapshotList writes the snapshots of a volume newest first, skipping
+// offset snapshots and returning at most limit (all when 0).
+func serveSnapshotList(ctx context.Context, client *kubeClient, cfg Config, w http.ResponseWriter, ns, pvc string, offset, limit int) {
+	policy, secretName, err := repoSecretForPVC(ctx, client, ns, pvc)
+	if err != nil {
+		writeAPIError(w, http.StatusNotFound, err.Error())
+		return
+	}
+	snapshots, err := catalog.get(ctx, catalogKey{Namespace: ns, Policy: policy.Metadata.Name, PVC: pvc}, secretName)
+	if err != nil {
+		writeAPIError(w, http.StatusBadGateway, err.Error())
+		return
+	}
+	w.Header().Set(snapshotTotalHeader, strconv.Itoa(len(snapshots)))
+	writeAPIJSON(w, pageSnapshots(snapshots, offset, limit))
+}
+
+func serveSnapshotListing(ctx context.Context, client *kubeClient, cfg Config, w http.ResponseWriter, ns, pvc, snapshotID, target string) {
+	policy, secretName, err := repoSecretForPVC(ctx, client, ns, pvc)
+	if err != nil {
+		writeAPIError(w, http.StatusNotFound, err.Error())
+		return
+	}
+
+	jobName := sanitizeName(fmt.Sprintf("backup-browse-%s-%d", pvc, time.Now().UTC().UnixNano()))
+	env := map[string]string{"SNAPSHOT_ID": snapshotID, "TARGET_PATH": target, resticLimitEnv: resticLimitArgs(policy.Spec.Mover)}
+	script := `restic ${RESTIC_LIMIT_ARGS} ls --json "${SNAPSHOT_ID}" "${TARGET_PATH}"`
+	if err := ensureResticJob(ctx, client, cfg, ns, jobName, secretName, script, env); err != nil {
+		writeAPIError(w, http.StatusBadGateway, err.Error())
+		return
+	}
+	defer cleanupJob(client, ns, jobName)
+
+	if err := waitForJobCompletion(ctx, client, ns, jobName, snapshotJobTimeout); err != nil {
+		writeAPIError(w, http.StatusBadGateway, err.Error())
+		return
+	}
+	logs, err := getJobLogs(ctx, client, ns, jobName)
+	if err != nil {
+		writeAPIError(w, http.StatusBadGateway, err.Error())
+		return
+	}
+
+	// The first line describes the snapshot, every following line one node.
+	entries := []snapshotEntry{}
+	scanner := bufio.NewScanner(strings.NewReader(logs))
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		var entry snapshotEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil || entry.Path == "" {
+			continue
+		}
+		if entry.Path == target || path.Dir(entry.Path) != target {
+			continue
+		}
+		entries = append(entries, entry)
+	}
+	writeAPIJSON(w, entries)
+}
+
+// serveSnapshotDump streams a file, or a tar archive for directories, out of a
+// snapshot. The Job base64-encodes `restic dump` into its log so the stream
+// survives the text-based log endpoint, and hashes it in the same pass. The
+// response is committed with 200 before the data is read, so the outcome is
+// only reported in the X-Backup-Result trailer after the body.
+func serveSnapshotDump(ctx context.Context, client *kubeClient, cfg Config, w http.ResponseWriter, ns, pvc, snapshotID, target string) {
+	policy, secretName, err := repoSecretForPVC(ctx, client, ns, pvc)
+	if err != nil {
+		writeAPIError(w, http.StatusNotFound, err.Error())
+		return
+	}
+
+	jobName := sanitizeName(fmt.Sprintf("backup-dump-%s-%d", pvc, time.Now().UTC().UnixNano()))
+	env := map[string]string{"SNAPSHOT_ID": snapshotID, "TARGET_PATH": target, resticLimitEnv: resticLimitArgs(policy.Spec.Mover)}
+	job := snapshotDumpJobObject(cfg, ns, jobName, secretName, env)
+	if err := client.apply(ctx, namespacedPath("/apis/batch/v1", ns, "jobs", jobName), job, nil); err != nil {
+		writeAPIError(w, http.StatusBadGateway, err.Error())
+		return
+	}
+	defer cleanupJob(client, ns, jobName)
+
+	podName, err := waitForJobPodStarted(ctx, client, ns, jobName, snapshotJobTimeout)
+	if err != nil {
+		writeAPIError(w, http.StatusBadGateway, err.Error())
+		return
+	}
+	logPath := fmt.Sprintf("/api/v1/namespaces/%s/pods/%s/log?follow=true", ns, podName)
+	body, status, err := client.stream(ctx, logPath)
+	if err != nil {
+		writeAPIError(w, http.StatusBadGateway, err.Error())
+		return
+	}
+	if status != http.StatusOK {
+		writeAPIError(w, http.StatusBadGateway, fmt.Sprintf("get failed: %s status=%d", logPath, status))
+		return
+	}
+	defer body.Close()
+
+	name := path.Base(target)
+	if name == "/" || name == "." {
+		name = pvc
+	}
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", name))
+	w.Header().Set("Trailer", "X-Backup-Result")
+	w.WriteHeader(http.StatusOK)
+
+	result, output := copySnapshotDump(w, body)
+	if output != "" {
+		slog.Error("snapshot dump failed", logNamespace, ns, logVolume, pvc, "output", output)
+	}
+	w.Header().Set("X-Backup-Result", result)
+}
+
+// noLogCollectionLabel marks pods whose log carries snapshot data. Promtail
+// drops them, so file contents don't end up in Loki; the log itself goes with
+// the pod when the Job is cleaned up.
+const noLogCollectionLabel = "backup.homelab/no-log-collection"
+
+// snapshotDumpScript writes `restic dump` base64-encoded to its log and then
+// its sha256. tee feeds the hash through a FIFO, so the data is read once and
+// never stored in the pod. A failing dump exits before the sha256 line.
+func snapshotDumpScript() string {
+	return strings.TrimSpace(`
+set -eu -o pipefail
+mkfifo /tmp/dump.fifo
+sha256sum < /tmp/dump.fifo > /tmp/dump.sha256 &
+restic ${RESTIC_LIMIT_ARGS} dump "${SNAPSHOT_ID}" "${TARGET_PATH}" | tee /tmp/dump.fifo | base64
+wait $!
+echo "sha256:$(cut -d' ' -f1 /tmp/dump.sha256)"
+`)
+}
+
+// snapshotDumpJobObject returns the restic Job that runs snapshotDumpScript,
+// with its pod labelled to keep its log out of log collection.
+func snapshotDumpJobObject(cfg Config, ns, jobName, secretName string, env map[string]string) map[string]interface{} {
+	job := resticJobObject(cfg, ns, jobName, secretName, snapshotDumpScript(), env)
+	template := job["spec"].(map[string]interface{})["template"].(map[string]interface{})
+	template["metadata"] = map[string]interface{}{
+		"labels": map[string]interface{}{noLogCollectionLabel: "true"},
+	}
+	return job
+}
+
+// copySnapshotDump decodes the log of snapshotDumpScript into w and returns
+// the X-Backup-Result of the transfer: ok when the data matched the sha256
+// line, checksum-mismatch, failed with the offending output when the log had
+// restic errors, or incomplete when it ended early.
+func copySnapshotDump(w io.Writer, logs io.Reader) (string, string) {
+	hash := sha256.New()
+	expected := ""
+	scanner := bufio.NewScanner(logs)
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if strings.HasPrefix(line, "sha256:") {
+			expected = strings.TrimPrefix(line, "sha256:")
+			continue
+		}
+		if line == "" {
+			continue
+		}
+		chunk, err := base64.StdEncoding.DecodeString(line)
+		if err != nil {
+			// restic errors end up in the same log stream.
+			return "failed", line
+		}
+		hash.Write(chunk)
+		if _, err := w.Write(chunk); err != nil {
+			return "incomplete", ""
+		}
+	}
+	switch {
+	case expected == "":
+		return "incomplete", ""
+	case expected == hex.EncodeToString(hash.Sum(nil)):
+		return "ok", ""
+	}
+	return "checksum-mismatch", ""
+}
+
+// repoSecretForPVC finds the BackupPolicy in ns that backs up pvc and returns
+// it with the restic repository secret of that volume.
+func repoSecretForPVC(ctx context.Context, client *kubeClient, ns, pvc string) (BackupPolicy, string, error) {
+	policy, err := policyForPVC(ctx, client, ns, pvc)
+	if err != nil {
+		return BackupPolicy{}, "", err
+	}
+	return policy, repoSecretName(policy.Metadata.Name, pvc, false), nil
+}
+
+func waitForJobPodStarted(ctx context.Context, client *kubeClient, ns, jobName string, timeout time.Duration) (string, error) {
+	selector := url.QueryEscape(fmt.Sprintf("job-name=%s", jobName))
+	listPath := fmt.Sprintf("/api/v1/namespaces/%s/pods?labelSelector=%s", ns, selector)
+	deadline := time.Now().Add(timeout)
+	for {
+		body, status, err := client.doRequest(ctx, "GET", listPath, nil)
+		if err != nil {
+			return "", err
+		}
+		if status != http.StatusOK {
+			return "", fmt.Errorf("get failed: %s status=%d", listPath, status)
+		}
+		var pods struct {
+			Items []struct {
+				Metadata struct {
+					Name string `json:"name"`
+				} `json:"metadata"`
+				Status struct {
+					Phase string `json:"phase"`
+				} `json:"status"`
+			} `json:"items"`
+		}
+		if err := json.Unmarshal(body, &pods); err != nil {
+			return "", err
+		}
+		for _, pod := range pods.Items {
+			switch pod.Status.Phase {
+			case "Running", "Succeeded":
+				return pod.Metadata.Name, nil
+			case "Failed":
+				return "", fmt.Errorf("job %s failed", jobName)
+			}
+		}
+		if time.Now().After(deadline) {
+			return "", fmt.Errorf("timed out waiting for job %s to start", jobName)
+		}
+		if err := sleepContext(ctx, 2*time.Second); err != nil {
+			return "", err
+		}
+	}
+}
+
+// authorizeAPIRequest authenticates the bearer token with a TokenReview and
+// checks the verb on resource in ns with a SubjectAccessReview.
+func authorizeAPIRequest(ctx context.Context, client *kubeClient, w http.ResponseWriter, r *http.Request, ns, verb, resource string) bool {
+	token := strings.TrimSpace(strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer "))
+	if token == "" || token == r.Header.Get("Authorization") {
+		writeAPIError(w, http.StatusUnauthorized, "missing bearer token")
+		return false
+	}
+
+	review := map[string]interface{}{
+		"apiVersion": "authentication.k8s.io/v1",
+		"kind":       "TokenReview",
+		"spec":       map[string]interface{}{"token": token},
+	}
+	body, status, err := client.doRequest(ctx, "POST", "/apis/authentication.k8s.io/v1/tokenreviews", review)
+	if err != nil || status != http.StatusCreated {
+		writeAPIError(w, http.StatusBadGateway, fmt.Sprintf("token review failed: status=%d", status))
+		return false
+	}
+	var tokenReview struct {
+		Status struct {
+			Authenticated bool `json:"authenticated"`
+			User          struct {
+				Username string              `json:"username"`
+				UID      string              `json:"uid"`
+				Groups   []string            `json:"groups"`
+				Extra    map[string][]string `json:"extra"`
+			} `json:"user"`
+		} `json:"status"`
+	}
+	if err := json.Unmarshal(body, &tokenReview); err != nil || !tokenReview.Status.Authenticated {
+		writeAPIError(w, http.StatusUnauthorized, "invalid token")
+		return false
+	}
+
+	user := tokenReview.Status.User
+	access := map[string]interface{}{
+		"apiVersion": "authorization.k8s.io/v1",
+		"kind":       "SubjectAccessReview",
+		"spec": map[string]interface{}{
+			"user":   user.Username,
+			"uid":    user.UID,
+			"groups": user.Groups,
+			"extra":  user.Extra,
+			"resourceAttributes": map[string]interface{}{
+				"namespace": ns,
+				"verb":      verb,
+				"group":     backupPolicyGroup,
+				"resource":  resource,
+			},
+		},
+	}
+	body, status, err = client.doRequest(ctx, "POST", "/apis/authorization.k8s.io/v1/subjectaccessreviews", access)
+	if err != nil || status != http.StatusCreated {
+		writeAPIError(w, http.StatusBadGateway, fmt.Sprintf("access review failed: status=%d", status))
+		return false
+	}
+	var accessReview struct {
+		Status struct {
+			Allowed bool `json:"allowed"`
+		} `json:"status"`
+	}
+	if err := json.Unmarshal(body, &accessReview); err != nil || !accessReview.Status.Allowed {
+		writeAPIError(w, http.StatusForbidden, fmt.Sprintf("%s cannot %s %s in namespace %s", user.Username, verb, resource, ns))
+		return false
+	}
+	return true
+}
+
+func validSnapshotID(id string) bool {
+	if id == "latest" {
+		return true
+	}
+	if len(id) < 8 || len(id) > 64 {
+		return false
+	}
+	for _, c := range id {
+		if !strings.ContainsRune("0123456789abcdef", c) {
+			return false
+		}
+	}
+	return true
+}
+
+func writeAPIJSON(w http.ResponseWriter, value interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(value); err != nil {
+		slog.Error("api response failed", logError, err)
+	}
+}
+
+func writeAPIError(w http.ResponseWriter, status int, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(apiError{Error: message})
+}
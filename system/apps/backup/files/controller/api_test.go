@@ -0,0 +1,173 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// fakeAPIServer authenticates the token "good" and allows it to get
+// backuppolicies but not to create restorepolicies. It records the paths it
+// was asked for.
+func fakeAPIServer(t *testing.T) (*kubeClient, *[]string) {
+	var paths []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		paths = append(paths, r.URL.Path)
+		var review struct {
+			Spec struct {
+				Token              string `json:"token"`
+				ResourceAttributes struct {
+					Verb string `json:"verb"`
+				} `json:"resourceAttributes"`
+			} `json:"spec"`
+		}
+		_ = json.NewDecoder(r.Body).Decode(&review)
+		switch r.URL.Path {
+		case "/apis/authentication.k8s.io/v1/tokenreviews":
+			w.WriteHeader(http.StatusCreated)
+			json.NewEncoder(w).Encode(map[string]interface{}{"status": map[string]interface{}{
+				"authenticated": review.Spec.Token == "good",
+				"user":          map[string]string{"username": "alice"},
+			}})
+		case "/apis/authorization.k8s.io/v1/subjectaccessreviews":
+			w.WriteHeader(http.StatusCreated)
+			json.NewEncoder(w).Encode(map[string]interface{}{"status": map[string]bool{
+				"allowed": review.Spec.ResourceAttributes.Verb == "get",
+			}})
+		default:
+			w.Write([]byte(`{"items": []}`))
+		}
+	}))
+	t.Cleanup(server.Close)
+	return &kubeClient{baseURL: server.URL, client: server.Client()}, &paths
+}
+
+func TestValidSnapshotID(t *testing.T) {
+	for id, want := range map[string]bool{
+		"latest":                true,
+		"1a2b3c4d":              true,
+		strings.Repeat("f", 64): true,
+		"1a2b3c4":               false,
+		strings.Repeat("f", 65): false,
+		"1A2B3C4D":              false,
+		"../../etc":             false,
+		"":                      false,
+	} {
+		if got := validSnapshotID(id); got != want {
+			t.Errorf("validSnapshotID(%q) = %v, want %v", id, got, want)
+		}
+	}
+}
+
+func TestAuthorizeAPIRequest(t *testing.T) {
+	client, _ := fakeAPIServer(t)
+	for _, tc := range []struct {
+		header string
+		verb   string
+		status int
+	}{
+		{"", "get", http.StatusUnauthorized},
+		{"Basic good", "get", http.StatusUnauthorized},
+		{"Bearer bad", "get", http.StatusUnauthorized},
+		{"Bearer good", "create", http.StatusForbidden},
+		{"Bearer good", "get", http.StatusOK},
+	} {
+		r := httptest.NewRequest("GET", "/v1/namespaces/apps/pvcs/data/snapshots", nil)
+		if tc.header != "" {
+			r.Header.Set("Authorization", tc.header)
+		}
+		recorder := httptest.NewRecorder()
+		allowed := authorizeAPIRequest(r.Context(), client, recorder, r, "apps", tc.verb, "backuppolicies")
+		if allowed != (tc.status == http.StatusOK) || recorder.Code != tc.status {
+			t.Errorf("%q %s: allowed=%v status=%d, want status %d", tc.header, tc.verb, allowed, recorder.Code, tc.status)
+		}
+	}
+}
+
+func TestHandleSnapshotAPI(t *testing.T) {
+	for _, tc := range []struct {
+		method string
+		target string
+		token  string
+		status int
+		calls  bool
+	}{
+		{"POST", "/v1/namespaces/apps/pvcs/data/snapshots", "good", http.StatusMethodNotAllowed, false},
+		{"GET", "/v1/namespaces/apps/pvcs/data", "good", http.StatusNotFound, false},
+		{"GET", "/v1/namespaces/apps/volumes/data/snapshots", "good", http.StatusNotFound, false},
+		{"GET", "/v1/namespaces/Apps/pvcs/data/snapshots", "good", http.StatusBadRequest, false},
+		{"GET", "/v1/namespaces/apps/pvcs/da_ta/snapshots", "good", http.StatusBadRequest, false},
+		{"GET", "/v1/namespaces/apps/pvcs/data/snapshots/xyz/ls", "good", http.StatusBadRequest, false},
+		{"GET", "/v1/namespaces/apps/pvcs/data/snapshots", "", http.StatusUnauthorized, false},
+		{"GET", "/v1/namespaces/apps/pvcs/data/snapshots?limit=-1", "good", http.StatusBadRequest, true},
+		{"GET", "/v1/namespaces/apps/pvcs/data/snapshots/latest/ls", "good", http.StatusForbidden, true},
+		{"GET", "/v1/namespaces/apps/pvcs/data/snapshots/latest/cat", "bad", http.StatusUnauthorized, true},
+		// No BackupPolicy in the fake covers the PVC.
+		{"GET", "/v1/namespaces/apps/pvcs/data/snapshots", "good", http.StatusNotFound, true},
+	} {
+		client, paths := fakeAPIServer(t)
+		r := httptest.NewRequest(tc.method, tc.target, nil)
+		if tc.token != "" {
+			r.Header.Set("Authorization", "Bearer "+tc.token)
+		}
+		recorder := httptest.NewRecorder()
+		handleSnapshotAPI(client, Config{}, recorder, r)
+		if recorder.Code != tc.status || (len(*paths) > 0) != tc.calls {
+			t.Errorf("%s %s: status=%d calls=%q, want status %d", tc.method, tc.target, recorder.Code, *paths, tc.status)
+		}
+	}
+
+	client, paths := fakeAPIServer(t)
+	r := httptest.NewRequest("GET", "/v1/namespaces/apps/pvcs/data/snapshots", nil)
+	r.Header.Set("Authorization", "Bearer good")
+	handleSnapshotAPI(client, Config{}, httptest.NewRecorder(), r)
+	if want := "/apis/backup.homelab/v1alpha1/namespaces/apps/backuppolicies"; !strings.Contains(strings.Join(*paths, " "), want) {
+		t.Errorf("allowed list requested %q, want %s", *paths, want)
+	}
+}
+
+func TestCopySnapshotDump(t *testing.T) {
+	data := []byte("snapshot file contents")
+	encoded := base64.StdEncoding.EncodeToString(data)
+	sum := sha256.Sum256(data)
+	checksum := "sha256:" + hex.EncodeToString(sum[:])
+	for _, tc := range []struct {
+		name   string
+		logs   string
+		result string
+		output string
+	}{
+		{"ok", encoded[:20] + "\n" + encoded[20:] + "\n" + checksum + "\n", "ok", ""},
+		{"mismatch", encoded + "\nsha256:" + strings.Repeat("0", 64) + "\n", "checksum-mismatch", ""},
+		{"cut off", encoded + "\n", "incomplete", ""},
+		{"restic error", encoded + "\nFatal: repository does not exist\n", "failed", "Fatal: repository does not exist"},
+	} {
+		var out bytes.Buffer
+		result, output := copySnapshotDump(&out, strings.NewReader(tc.logs))
+		if result != tc.result || output != tc.output {
+			t.Errorf("%s: got %q, %q, want %q, %q", tc.name, result, output, tc.result, tc.output)
+		}
+		if tc.result == "ok" && !bytes.Equal(out.Bytes(), data) {
+			t.Errorf("%s: wrote %q", tc.name, out.Bytes())
+		}
+	}
+}
+
+func TestSnapshotDumpJobObject(t *testing.T) {
+	job := snapshotDumpJobObject(Config{RepoMountPath: "repo", RepoPVCName: "backup-repo"}, "apps", "backup-dump-data-1", "backup-repo-app-data", nil)
+	template := job["spec"].(map[string]interface{})["template"].(map[string]interface{})
+	labels := template["metadata"].(map[string]interface{})["labels"].(map[string]interface{})
+	if labels[noLogCollectionLabel] != "true" {
+		t.Errorf("pod labels = %v, want %s", labels, noLogCollectionLabel)
+	}
+	container := template["spec"].(map[string]interface{})["containers"].([]map[string]interface{})[0]
+	if script := container["args"].([]string)[0]; strings.Contains(script, "> /tmp/dump\n") || !strings.Contains(script, "| tee /tmp/dump.fifo | base64") {
+		t.Errorf("dump is not streamed in one pass:\n%s", script)
+	}
+}
@@ -0,0 +1,412 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/url"
+	"reflect"
+	"sync"
+	"time"
+)
+
+// resticJobLabel is set on the restic Jobs the controller starts, with the
+// name of the controller pod as its value, and resticProcessLabel with the
+// controllerProcess that started them. Jobs of pods that no longer exist, and
+// Jobs of this pod from an earlier process, are left over from a crash and
+// deleted at startup.
+const (
+	resticJobLabel     = "backup.homelab/started-by"
+	resticProcessLabel = "backup.homelab/process"
+)
+
+// controllerPod is the name of this controller pod, from POD_NAME.
+var controllerPod string
+
+// controllerProcess identifies this controller process. A container restarted
+// in the same pod gets a new one.
+var controllerProcess = newProcessID()
+
+func newProcessID() string {
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		return fmt.Sprintf("%x", time.Now().UnixNano())
+	}
+	return hex.EncodeToString(id)
+}
+
+// catalogKey identifies the snapshots of one volume of a BackupPolicy.
+type catalogKey struct {
+	Namespace string
+	Policy    string
+	PVC       string
+}
+
+// catalogEntry is the last successful snapshot listing of a volume.
+type catalogEntry struct {
+	Snapshots []BackupSnapshot
+	// RepositorySize is the deduplicated size of the volume's repository,
+	// from `restic stats --mode raw-data`.
+	RepositorySize uint64
+	// LastSync is the volume's last sync when the listing was fetched.
+	LastSync string
+	Fetched  time.Time
+}
+
+// snapshotCatalog caches the restic snapshot listings of volumes. Listings
+// are refreshed in the background by at most as many restic Jobs at a time
+// as it has slots, so a reconcile only reads the cache.
+type snapshotCatalog struct {
+	ttl   time.Duration
+	slots chan struct{}
+	now   func() time.Time
+	fetch func(ctx context.Context, key catalogKey, secretName string) ([]BackupSnapshot, uint64, error)
+
+	mu      sync.Mutex
+	entries map[catalogKey]catalogEntry
+	pending map[catalogKey]bool
+	running sync.WaitGroup
+}
+
+var catalog = newSnapshotCatalog(nil, Config{CatalogConcurrency: 2, CatalogTTL: time.Hour})
+
+func newSnapshotCatalog(client *kubeClient, cfg Config) *snapshotCatalog {
+	concurrency := cfg.CatalogConcurrency
+	if concurrency < 1 {
+		concurrency = 1
+	}
+	return &snapshotCatalog{
+		ttl:   cfg.CatalogTTL,
+		slots: make(chan struct{}, concurrency),
+		now:   time.Now,
+		fetch: func(ctx context.Context, key catalogKey, secretName string) ([]BackupSnapshot, uint64, error) {
+			return fetchSnapshots(ctx, client, cfg, key.Namespace, key.Policy, key.PVC, secretName)
+		},
+		entries: map[catalogKey]catalogEntry{},
+		pending: map[catalogKey]bool{},
+	}
+}
+
+// lookup returns the cached listing of key and queues a refresh when there is
+// none, the volume synced since, or the listing is older than the TTL.
+func (c *snapshotCatalog) lookup(ctx context.Context, key catalogKey, secretName, lastSync string) (catalogEntry, bool) {
+	c.mu.Lock()
+	entry, ok := c.entries[key]
+	c.mu.Unlock()
+	if !ok || entry.LastSync != lastSync || c.now().Sub(entry.Fetched) >= c.ttl {
+		c.refresh(ctx, key, secretName, lastSync)
+	}
+	return entry, ok
+}
+
+// refresh fetches the listing of key in the background, unless a refresh of
+// key is already queued or running. Failures are logged and retried on the
+// next lookup.
+func (c *snapshotCatalog) refresh(ctx context.Context, key catalogKey, secretName, lastSync string) {
+	c.mu.Lock()
+	if c.pending[key] {
+		c.mu.Unlock()
+		return
+	}
+	c.pending[key] = true
+	c.running.Add(1)
+	c.mu.Unlock()
+
+	go func() {
+		defer c.running.Done()
+		defer func() {
+			c.mu.Lock()
+			delete(c.pending, key)
+			c.mu.Unlock()
+		}()
+		if _, err := c.load(ctx, key, secretName, lastSync); err != nil && ctx.Err() == nil {
+			slog.Warn("snapshot catalog refresh failed", logNamespace, key.Namespace, logPolicy, key.Policy, logVolume, key.PVC, logError, err)
+		}
+	}()
+}
+
+// get returns the listing of key, from the cache when it is younger than the
+// TTL and otherwise fetched now within the catalog's concurrency limit.
+func (c *snapshotCatalog) get(ctx context.Context, key catalogKey, secretName string) ([]BackupSnapshot, error) {
+	c.mu.Lock()
+	entry, ok := c.entries[key]
+	c.mu.Unlock()
+	if ok && c.now().Sub(entry.Fetched) < c.ttl {
+		return entry.Snapshots, nil
+	}
+	entry, err := c.load(ctx, key, secretName, entry.LastSync)
+	return entry.Snapshots, err
+}
+
+func (c *snapshotCatalog) load(ctx context.Context, key catalogKey, secretName, lastSync string) (catalogEntry, error) {
+	select {
+	case c.slots <- struct{}{}:
+	case <-ctx.Done():
+		return catalogEntry{}, ctx.Err()
+	}
+	defer func() { <-c.slots }()
+
+	start := c.now()
+	snapshots, size, err := c.fetch(ctx, key, secretName)
+	if err != nil {
+		return catalogEntry{}, err
+	}
+	entry := catalogEntry{Snapshots: snapshots, RepositorySize: size, LastSync: lastSync, Fetched: c.now()}
+	c.mu.Lock()
+	c.entries[key] = entry
+	c.mu.Unlock()
+	slog.Debug("snapshot catalog refreshed", logNamespace, key.Namespace, logPolicy, key.Policy, logVolume, key.PVC, "snapshots", len(snapshots), logDuration, c.now().Sub(start))
+	return entry, nil
+}
+
+// retain drops the listings of volumes that are not in keep.
+func (c *snapshotCatalog) retain(keep map[catalogKey]bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for key := range c.entries {
+		if !keep[key] {
+			delete(c.entries, key)
+		}
+	}
+}
+
+// wait blocks until the running refreshes returned.
+func (c *snapshotCatalog) wait() {
+	c.running.Wait()
+}
+
+// statusSnapshots is how many of the newest snapshots of a volume are kept in
+// the BackupPolicy status. The full list is in the volume's catalog ConfigMap.
+const statusSnapshots = 5
+
+// maxCatalogBytes keeps catalog ConfigMaps below the 1 MiB object limit.
+const maxCatalogBytes = 900 << 10
+
+const catalogDataKey = "snapshots.json"
+
+func snapshotCatalogName(policy, pvc string) string {
+	return sanitizeName(fmt.Sprintf("backup-snapshots-%s-%s", policy, pvc))
+}
+
+func snapshotSnippet(snapshotTime, id string) string {
+	return fmt.Sprintf("restoreAsOf: \"%s\"  # %s", snapshotTime, id)
+}
+
+// summarizeSnapshots sets the snapshot summary of status from snapshots, which
+// are in restic order, oldest first, and the size of their repository.
+func summarizeSnapshots(status *BackupPolicyVolumeStatus, policy string, snapshots []BackupSnapshot, repositorySize uint64) {
+	status.SnapshotCount = len(snapshots)
+	status.OldestSnapshot = ""
+	status.NewestSnapshot = ""
+	status.TotalSize = repositorySize
+	status.SnapshotCatalog = snapshotCatalogName(policy, status.PVC)
+	status.Snapshots = nil
+	if len(snapshots) == 0 {
+		return
+	}
+	status.OldestSnapshot = snapshots[0].Time
+	status.NewestSnapshot = snapshots[len(snapshots)-1].Time
+	newest := snapshots
+	if len(newest) > statusSnapshots {
+		newest = newest[len(newest)-statusSnapshots:]
+	}
+	status.Snapshots = append([]BackupSnapshot(nil), newest...)
+}
+
+// updateSnapshotStatus summarizes snapshots into status and writes them to the
+// volume's catalog ConfigMap. It reports whether the summary changed; the
+// ConfigMap is only written then.
+func updateSnapshotStatus(ctx context.Context, client *kubeClient, policy BackupPolicy, status *BackupPolicyVolumeStatus, entry catalogEntry) (bool, error) {
+	updated := *status
+	summarizeSnapshots(&updated, policy.Metadata.Name, entry.Snapshots, entry.RepositorySize)
+	if reflect.DeepEqual(updated, *status) {
+		return false, nil
+	}
+	if err := writeSnapshotCatalog(ctx, client, policy, status.PVC, entry.Snapshots); err != nil {
+		return false, err
+	}
+	*status = updated
+	return true, nil
+}
+
+// writeSnapshotCatalog applies the catalog ConfigMap of a volume, owned by the
+// policy. Snippets are left out, and the oldest snapshots are dropped when the
+// list would not fit in a ConfigMap.
+func writeSnapshotCatalog(ctx context.Context, client *kubeClient, policy BackupPolicy, pvc string, snapshots []BackupSnapshot) error {
+	stored := make([]BackupSnapshot, len(snapshots))
+	for i, snapshot := range snapshots {
+		snapshot.Snippet = ""
+		stored[i] = snapshot
+	}
+	data, err := json.Marshal(stored)
+	if err != nil {
+		return err
+	}
+	for len(data) > maxCatalogBytes && len(stored) > 1 {
+		stored = stored[len(stored)/10+1:]
+		if data, err = json.Marshal(stored); err != nil {
+			return err
+		}
+	}
+	if len(stored) < len(snapshots) {
+		policyLog(policy.Metadata.Namespace, policy.Metadata.Name).Warn("snapshot catalog truncated",
+			logVolume, pvc, "snapshots", len(snapshots), "stored", len(stored))
+	}
+
+	if policy.APIVersion == "" {
+		policy.APIVersion = fmt.Sprintf("%s/%s", backupPolicyGroup, backupPolicyVersion)
+	}
+	if policy.Kind == "" {
+		policy.Kind = "BackupPolicy"
+	}
+	name := snapshotCatalogName(policy.Metadata.Name, pvc)
+	configMap := map[string]interface{}{
+		"apiVersion": "v1",
+		"kind":       "ConfigMap",
+		"metadata": map[string]interface{}{
+			"name":      name,
+			"namespace": policy.Metadata.Namespace,
+			"labels": map[string]interface{}{
+				"app.kubernetes.io/managed-by": "backup-controller",
+				"backup.homelab/policy":        policy.Metadata.Name,
+				"backup.homelab/pvc":           pvc,
+			},
+		},
+		"data": map[string]interface{}{
+			catalogDataKey: string(data),
+		},
+	}
+	return client.apply(ctx, namespacedPath("/api/v1", policy.Metadata.Namespace, "configmaps", name), configMap, &policy)
+}
+
+// readSnapshotCatalog returns every recorded snapshot of a volume, oldest
+// first, from its catalog ConfigMap, or from the status of policies written
+// before the catalog existed.
+func readSnapshotCatalog(ctx context.Context, client *kubeClient, policy BackupPolicy, pvc string) ([]BackupSnapshot, error) {
+	var status *BackupPolicyVolumeStatus
+	for i := range policy.Status.Volumes {
+		if policy.Status.Volumes[i].PVC == pvc {
+			status = &policy.Status.Volumes[i]
+		}
+	}
+	if status == nil {
+		return nil, nil
+	}
+	if status.SnapshotCatalog == "" {
+		return status.Snapshots, nil
+	}
+
+	var configMap struct {
+		Data map[string]string `json:"data"`
+	}
+	if err := getJSON(ctx, client, namespacedPath("/api/v1", policy.Metadata.Namespace, "configmaps", status.SnapshotCatalog), &configMap); err != nil {
+		return nil, err
+	}
+	var snapshots []BackupSnapshot
+	if err := json.Unmarshal([]byte(configMap.Data[catalogDataKey]), &snapshots); err != nil {
+		return nil, fmt.Errorf("parse snapshot catalog %s/%s: %w", policy.Metadata.Namespace, status.SnapshotCatalog, err)
+	}
+	for i := range snapshots {
+		snapshots[i].Snippet = snapshotSnippet(snapshots[i].Time, snapshots[i].ID)
+	}
+	return snapshots, nil
+}
+
+// pageSnapshots returns up to limit snapshots, newest first, after skipping
+// the offset newest ones. A limit of 0 returns the rest.
+func pageSnapshots(snapshots []BackupSnapshot, offset, limit int) []BackupSnapshot {
+	page := make([]BackupSnapshot, 0, len(snapshots))
+	for i := len(snapshots) - 1 - offset; i >= 0; i-- {
+		if limit > 0 && len(page) == limit {
+			break
+		}
+		page = append(page, snapshots[i])
+	}
+	return page
+}
+
+// checkSnapshots updates the snapshot summaries and catalogs of the policy's
+// volumes from the cached listings when they changed, and queues refreshes of
+// listings that are missing or outdated. Volumes without a status entry yet
+// are left to the reconcile of the policy.
+func checkSnapshots(ctx context.Context, client *kubeClient, policy BackupPolicy) error {
+	ns, name := policy.Metadata.Namespace, policy.Metadata.Name
+	volumes := append([]BackupPolicyVolumeStatus(nil), policy.Status.Volumes...)
+	changed := false
+	for i, vol := range volumes {
+		result, endTime, err := getReplicationSourceStatus(ctx, client, ns, backupSourceName(name, vol.PVC, false))
+		if err != nil {
+			return err
+		}
+		if result != "Successful" || endTime == "" {
+			continue
+		}
+		key := catalogKey{Namespace: ns, Policy: name, PVC: vol.PVC}
+		secretName := repoSecretName(name, vol.PVC, false)
+		entry, ok := catalog.lookup(ctx, key, secretName, normalizeTime(endTime))
+		if !ok {
+			continue
+		}
+		updated, err := updateSnapshotStatus(ctx, client, policy, &volumes[i], entry)
+		if err != nil {
+			return err
+		}
+		if updated && entry.LastSync != "" {
+			volumes[i].LastSync = entry.LastSync
+		}
+		changed = changed || updated
+	}
+	if !changed {
+		return nil
+	}
+	return patchBackupPolicyStatus(ctx, client, ns, name, map[string]interface{}{
+		"volumes":          volumes,
+		"lastSnapshotSync": time.Now().UTC().Format(time.RFC3339),
+	})
+}
+
+// collectResticJobs deletes restic Jobs started by controller pods that no
+// longer exist or by an earlier process of this pod, which a crash left behind
+// before the Jobs were cleaned up.
+func collectResticJobs(ctx context.Context, client *kubeClient, cfg Config) error {
+	var jobs struct {
+		Items []struct {
+			Metadata struct {
+				Name      string            `json:"name"`
+				Namespace string            `json:"namespace"`
+				Labels    map[string]string `json:"labels"`
+			} `json:"metadata"`
+		} `json:"items"`
+	}
+	if err := getJSON(ctx, client, "/apis/batch/v1/jobs?labelSelector="+url.QueryEscape(resticJobLabel), &jobs); err != nil {
+		return err
+	}
+
+	// This pod is alive, but only the Jobs of this process are in use.
+	alive := map[string]bool{controllerPod: false}
+	for _, job := range jobs.Items {
+		pod := job.Metadata.Labels[resticJobLabel]
+		if pod == controllerPod && job.Metadata.Labels[resticProcessLabel] == controllerProcess {
+			continue
+		}
+		exists, checked := alive[pod]
+		if !checked {
+			var err error
+			if exists, err = objectExists(ctx, client, namespacedPath("/api/v1", cfg.Namespace, "pods", pod)); err != nil {
+				return err
+			}
+			alive[pod] = exists
+		}
+		if exists {
+			continue
+		}
+		slog.Info("deleting leftover restic job", logNamespace, job.Metadata.Namespace, logResource, job.Metadata.Name, "started_by", pod)
+		if err := deleteJob(ctx, client, job.Metadata.Namespace, job.Metadata.Name); err != nil {
+			return fmt.Errorf("delete job %s/%s: %w", job.Metadata.Namespace, job.Metadata.Name, err)
+		}
+	}
+	return nil
+}
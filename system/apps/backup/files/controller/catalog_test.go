@@ -0,0 +1,221 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func testCatalog(concurrency int64, fetch func(ctx context.Context, key catalogKey, secretName string) ([]BackupSnapshot, uint64, error)) *snapshotCatalog {
+	c := newSnapshotCatalog(nil, Config{CatalogConcurrency: concurrency, CatalogTTL: time.Hour})
+	c.fetch = fetch
+	return c
+}
+
+func TestCatalogLookupRefreshesInBackground(t *testing.T) {
+	var calls atomic.Int32
+	c := testCatalog(1, func(ctx context.Context, key catalogKey, secretName string) ([]BackupSnapshot, uint64, error) {
+		calls.Add(1)
+		return []BackupSnapshot{{ID: "abc", Time: "2024-05-01T03:00:00Z"}}, 0, nil
+	})
+	key := catalogKey{Namespace: "gitea", Policy: "gitea", PVC: "data"}
+	ctx := context.Background()
+
+	if _, ok := c.lookup(ctx, key, "secret", "2024-05-01T03:00:00Z"); ok {
+		t.Fatal("got a listing before the first refresh")
+	}
+	c.wait()
+	entry, ok := c.lookup(ctx, key, "secret", "2024-05-01T03:00:00Z")
+	c.wait()
+	if !ok || len(entry.Snapshots) != 1 || entry.LastSync != "2024-05-01T03:00:00Z" {
+		t.Fatalf("got %+v, %t after the refresh", entry, ok)
+	}
+	if calls.Load() != 1 {
+		t.Fatalf("got %d fetches, want 1 while the listing is current", calls.Load())
+	}
+
+	c.lookup(ctx, key, "secret", "2024-05-02T03:00:00Z")
+	c.wait()
+	if calls.Load() != 2 {
+		t.Fatalf("got %d fetches, want a refresh after a new sync", calls.Load())
+	}
+
+	c.now = func() time.Time { return time.Now().Add(2 * time.Hour) }
+	c.lookup(ctx, key, "secret", "2024-05-02T03:00:00Z")
+	c.wait()
+	if calls.Load() != 3 {
+		t.Fatalf("got %d fetches, want a refresh after the TTL", calls.Load())
+	}
+}
+
+func TestCatalogLimitsConcurrentFetches(t *testing.T) {
+	var mu sync.Mutex
+	var running, peak int
+	release := make(chan struct{})
+	c := testCatalog(2, func(ctx context.Context, key catalogKey, secretName string) ([]BackupSnapshot, uint64, error) {
+		mu.Lock()
+		running++
+		if running > peak {
+			peak = running
+		}
+		mu.Unlock()
+		<-release
+		mu.Lock()
+		running--
+		mu.Unlock()
+		return nil, 0, nil
+	})
+
+	for _, pvc := range []string{"a", "b", "c", "d", "e"} {
+		c.lookup(context.Background(), catalogKey{Namespace: "media", Policy: "media", PVC: pvc}, "secret", "")
+	}
+	// A second lookup of a volume with a refresh in flight is not queued again.
+	c.lookup(context.Background(), catalogKey{Namespace: "media", Policy: "media", PVC: "a"}, "secret", "")
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+	c.wait()
+
+	if peak != 2 {
+		t.Fatalf("got %d concurrent fetches, want 2", peak)
+	}
+	if len(c.entries) != 5 {
+		t.Fatalf("got %d entries, want 5", len(c.entries))
+	}
+}
+
+func TestCatalogGetServesFreshEntries(t *testing.T) {
+	var calls int
+	c := testCatalog(1, func(ctx context.Context, key catalogKey, secretName string) ([]BackupSnapshot, uint64, error) {
+		calls++
+		return []BackupSnapshot{{ID: "abc"}}, 0, nil
+	})
+	key := catalogKey{Namespace: "gitea", Policy: "gitea", PVC: "data"}
+	for i := 0; i < 2; i++ {
+		snapshots, err := c.get(context.Background(), key, "secret")
+		if err != nil || len(snapshots) != 1 {
+			t.Fatalf("got %v, %v", snapshots, err)
+		}
+	}
+	if calls != 1 {
+		t.Fatalf("got %d fetches, want 1", calls)
+	}
+
+	c.retain(map[catalogKey]bool{})
+	if len(c.entries) != 0 {
+		t.Fatalf("got %d entries after retain, want 0", len(c.entries))
+	}
+}
+
+func TestSummarizeSnapshots(t *testing.T) {
+	var snapshots []BackupSnapshot
+	for day := 1; day <= 8; day++ {
+		snapshots = append(snapshots, BackupSnapshot{
+			ID:   fmt.Sprintf("snap%d", day),
+			Time: fmt.Sprintf("2024-05-%02dT03:00:00Z", day),
+			Size: 100,
+		})
+	}
+	status := BackupPolicyVolumeStatus{PVC: "data"}
+	summarizeSnapshots(&status, "gitea", snapshots, 250)
+
+	if status.SnapshotCount != 8 || status.TotalSize != 250 {
+		t.Fatalf("got count=%d size=%d, want 8 and the repository size 250", status.SnapshotCount, status.TotalSize)
+	}
+	if status.OldestSnapshot != "2024-05-01T03:00:00Z" || status.NewestSnapshot != "2024-05-08T03:00:00Z" {
+		t.Fatalf("got oldest=%s newest=%s", status.OldestSnapshot, status.NewestSnapshot)
+	}
+	if status.SnapshotCatalog != "backup-snapshots-gitea-data" {
+		t.Fatalf("got catalog %s", status.SnapshotCatalog)
+	}
+	if len(status.Snapshots) != statusSnapshots || status.Snapshots[0].ID != "snap4" || status.Snapshots[statusSnapshots-1].ID != "snap8" {
+		t.Fatalf("got %+v, want the newest %d snapshots", status.Snapshots, statusSnapshots)
+	}
+}
+
+func TestPageSnapshots(t *testing.T) {
+	snapshots := []BackupSnapshot{{ID: "a"}, {ID: "b"}, {ID: "c"}, {ID: "d"}}
+	cases := []struct {
+		offset, limit int
+		want          string
+	}{
+		{0, 0, "dcba"},
+		{0, 2, "dc"},
+		{2, 2, "ba"},
+		{3, 2, "a"},
+		{5, 2, ""},
+	}
+	for _, c := range cases {
+		var got string
+		for _, snapshot := range pageSnapshots(snapshots, c.offset, c.limit) {
+			got += snapshot.ID
+		}
+		if got != c.want {
+			t.Errorf("pageSnapshots(offset=%d, limit=%d) = %q, want %q", c.offset, c.limit, got, c.want)
+		}
+	}
+}
+
+func TestParseSnapshotListing(t *testing.T) {
+	logs := `[{"id":"abc","time":"2024-05-01T03:00:00Z","size":100},{"id":"def","time":"2024-05-02T03:00:00Z","size":100}]
+{"total_size":150,"total_uncompressed_size":300,"snapshots_count":2}
+`
+	raw, size, rest, err := parseSnapshotListing(logs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(raw) != 2 || size != 150 || rest != "" {
+		t.Fatalf("got %d snapshots, size %d and %q, want 2, 150 and nothing", len(raw), size, rest)
+	}
+	_, _, rest, err = parseSnapshotListing(`[]
+{"total_size":0}
+unable to remove stale lock: permission denied
+Fatal: unable to create lock in backend: repository is already locked
+`)
+	if err != nil || !strings.HasPrefix(rest, "unable to remove") || !strings.HasSuffix(rest, "already locked") {
+		t.Fatalf("trailing output %q, %v", rest, err)
+	}
+	if _, _, _, err := parseSnapshotListing(`[]`); err == nil {
+		t.Fatal("parsed a listing without stats")
+	}
+}
+
+func TestCollectResticJobs(t *testing.T) {
+	controllerPod, controllerProcess = "controller-a", "current"
+	defer func() { controllerPod, controllerProcess = "", newProcessID() }()
+
+	var deleted []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.Method == "DELETE":
+			deleted = append(deleted, path.Base(r.URL.Path))
+		case r.URL.Path == "/apis/batch/v1/jobs":
+			w.Write([]byte(`{"items": [
+				{"metadata": {"name": "running", "namespace": "apps", "labels": {"backup.homelab/started-by": "controller-a", "backup.homelab/process": "current"}}},
+				{"metadata": {"name": "restarted", "namespace": "apps", "labels": {"backup.homelab/started-by": "controller-a", "backup.homelab/process": "earlier"}}},
+				{"metadata": {"name": "unlabelled", "namespace": "apps", "labels": {"backup.homelab/started-by": "controller-a"}}},
+				{"metadata": {"name": "other-replica", "namespace": "apps", "labels": {"backup.homelab/started-by": "controller-b", "backup.homelab/process": "other"}}},
+				{"metadata": {"name": "gone", "namespace": "apps", "labels": {"backup.homelab/started-by": "controller-c", "backup.homelab/process": "other"}}}
+			]}`))
+		case r.URL.Path == "/api/v1/namespaces/backup/pods/controller-b":
+			w.Write([]byte(`{}`))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	client := &kubeClient{baseURL: server.URL, client: server.Client()}
+	if err := collectResticJobs(context.Background(), client, Config{Namespace: "backup"}); err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"restarted", "unlabelled", "gone"}; strings.Join(deleted, ",") != strings.Join(want, ",") {
+		t.Errorf("deleted %v, want %v", deleted, want)
+	}
+}
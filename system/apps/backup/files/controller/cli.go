@@ -0,0 +1,75 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// runCLI handles `backup-controller <command> ...` invocations. It returns false
+// when no command was given so main starts the controller instead.
+func runCLI(args []string) bool {
+	if len(args) == 0 {
+		return false
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	var err error
+	switch args[0] {
+	case "policies":
+		err = runPoliciesCommand(ctx, args[1:])
+	case "run":
+		err = runRunCommand(ctx, args[1:])
+	case "restore":
+		err = runRestoreCommand(ctx, args[1:])
+	case "coverage":
+		err = runCoverageCommand(ctx, args[1:])
+	case "render":
+		err = runRenderCommand(ctx, args[1:])
+	case "diff":
+		err = runDiffCommand(ctx, args[1:])
+	case "snapshots":
+		err = runSnapshotsCommand(ctx, args[1:])
+	case "help", "-h", "--help":
+		printCLIUsage()
+	default:
+		printCLIUsage()
+		err = fmt.Errorf("unknown command %q", args[0])
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error: %v\n", err)
+		os.Exit(1)
+	}
+	return true
+}
+
+func printCLIUsage() {
+	fmt.Fprint(os.Stderr, `Usage: backupctl <command> [options]
+
+Commands:
+  policies [--namespace <ns> | --all-namespaces]
+      List BackupPolicies with the age of their last sync and their health.
+  run --policy <name> [--namespace <ns>] [--offsite] [--run-type <type>] [--follow]
+      Start a backup from the policy's CronJob, optionally streaming its logs.
+  snapshots list --pvc <pvc> [--namespace <ns>] [--live]
+  snapshots ls   --pvc <pvc> [--namespace <ns>] --snapshot <id> [--path <dir>]
+  snapshots dump --pvc <pvc> [--namespace <ns>] --snapshot <id> --path <path> [--output <file>]
+      List, browse and download snapshots. ls, dump and list --live use the backup API.
+  restore --pvc <pvc> [--namespace <ns>] [--snapshot <id> | --as-of <time>] [--apply | --wait]
+      Print, create or create and wait for a RestorePolicy.
+  coverage [--ignore-namespace <ns>]
+      List PVCs that no BackupPolicy backs up and that are not excluded.
+  render -f <file> [-f <file> ...] [--values <chart values>]
+      Print the objects the controller creates for BackupPolicy/RestorePolicy files.
+  diff -f <file> [-f <file> ...] [--values <chart values>]
+      Compare those objects with the cluster.
+
+Cluster access uses --kubeconfig and --context, or KUBECONFIG.
+The backup API uses --server and --token, or BACKUP_API_SERVER and
+BACKUP_API_TOKEN (default server: http://localhost:8081).
+`)
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"text/tabwriter"
+)
+
+type pvcList struct {
+	Items []struct {
+		Metadata struct {
+			Name        string            `json:"name"`
+			Namespace   string            `json:"namespace"`
+			Labels      map[string]string `json:"labels"`
+			Annotations map[string]string `json:"annotations"`
+		} `json:"metadata"`
+		Spec struct {
+			StorageClassName string `json:"storageClassName"`
+			Resources        struct {
+				Requests map[string]string `json:"requests"`
+			} `json:"resources"`
+		} `json:"spec"`
+	} `json:"items"`
+}
+
+// runCoverageCommand lists PVCs across the cluster that no BackupPolicy backs
+// up and that are not excluded with the backup.homelab/policy annotation. PVCs
+// created by VolSync and by restore tests are not counted.
+func runCoverageCommand(ctx context.Context, args []string) error {
+	var opts kubeOptions
+	var ignored stringList
+	flags := flag.NewFlagSet("coverage", flag.ContinueOnError)
+	opts.register(flags)
+	flags.Var(&ignored, "ignore-namespace", "namespace to leave out of the report, repeatable")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	client, err := opts.client()
+	if err != nil {
+		return err
+	}
+
+	var policies BackupPolicyList
+	if err := getJSON(ctx, client, fmt.Sprintf("/apis/%s/%s/backuppolicies", backupPolicyGroup, backupPolicyVersion), &policies); err != nil {
+		return err
+	}
+	var pvcs pvcList
+	if err := getJSON(ctx, client, "/api/v1/persistentvolumeclaims", &pvcs); err != nil {
+		return err
+	}
+	covered := policyOwners(policies.Items, pvcs, func(BackupPolicy) bool { return false })
+	var namespaces namespaceList
+	if err := getJSON(ctx, client, "/api/v1/namespaces", &namespaces); err != nil {
+		return err
+	}
+	nsAnnotations := map[string]map[string]string{}
+	for _, ns := range namespaces.Items {
+		nsAnnotations[ns.Metadata.Name] = ns.Metadata.Annotations
+	}
+	skip := map[string]bool{}
+	for _, ns := range ignored {
+		skip[ns] = true
+	}
+
+	total, excluded := 0, 0
+	type uncoveredPVC struct{ ns, name, size, storageClass, tier string }
+	var uncovered []uncoveredPVC
+	for _, pvc := range pvcs.Items {
+		meta := pvc.Metadata
+		if skip[meta.Namespace] || ignoredPVC(meta.Name, meta.Labels) {
+			continue
+		}
+		total++
+		if _, ok := covered[meta.Namespace+"/"+meta.Name]; ok {
+			continue
+		}
+		tier, isExcluded := discoveryTier(nsAnnotations[meta.Namespace], meta.Annotations)
+		if isExcluded {
+			excluded++
+			continue
+		}
+		if tier == "" {
+			tier = "-"
+		}
+		uncovered = append(uncovered, uncoveredPVC{
+			ns:           meta.Namespace,
+			name:         meta.Name,
+			size:         pvc.Spec.Resources.Requests["storage"],
+			storageClass: pvc.Spec.StorageClassName,
+			tier:         tier,
+		})
+	}
+	sort.Slice(uncovered, func(i, j int) bool {
+		if uncovered[i].ns != uncovered[j].ns {
+			return uncovered[i].ns < uncovered[j].ns
+		}
+		return uncovered[i].name < uncovered[j].name
+	})
+
+	if len(uncovered) > 0 {
+		table := tabwriter.NewWriter(os.Stdout, 0, 2, 2, ' ', 0)
+		fmt.Fprintln(table, "NAMESPACE\tPVC\tSIZE\tSTORAGECLASS\tTIER")
+		for _, pvc := range uncovered {
+			fmt.Fprintf(table, "%s\t%s\t%s\t%s\t%s\n", pvc.ns, pvc.name, pvc.size, pvc.storageClass, pvc.tier)
+		}
+		if err := table.Flush(); err != nil {
+			return err
+		}
+		fmt.Println()
+	}
+	fmt.Printf("%d of %d PVCs covered by a BackupPolicy, %d excluded\n", total-len(uncovered)-excluded, total, excluded)
+	return nil
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"time"
+
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/clientcmd"
+)
+
+type kubeOptions struct {
+	kubeconfig string
+	context    string
+}
+
+func (o *kubeOptions) register(flags *flag.FlagSet) {
+	flags.StringVar(&o.kubeconfig, "kubeconfig", "", "path to the kubeconfig file (default: KUBECONFIG or ~/.kube/config)")
+	flags.StringVar(&o.context, "context", "", "kubeconfig context to use")
+}
+
+// client builds a kubeClient from the kubeconfig, so the CLI talks to the API
+// server through the same helpers as the controller.
+func (o *kubeOptions) client() (*kubeClient, error) {
+	config, err := o.restConfig()
+	if err != nil {
+		return nil, err
+	}
+	return newKubeClientFor(config)
+}
+
+func (o *kubeOptions) loader() clientcmd.ClientConfig {
+	rules := clientcmd.NewDefaultClientConfigLoadingRules()
+	if o.kubeconfig != "" {
+		rules.ExplicitPath = o.kubeconfig
+	}
+	overrides := &clientcmd.ConfigOverrides{CurrentContext: o.context}
+	return clientcmd.NewNonInteractiveDeferredLoadingClientConfig(rules, overrides)
+}
+
+func (o *kubeOptions) restConfig() (*rest.Config, error) {
+	return o.loader().ClientConfig()
+}
+
+// defaultNamespace returns the namespace of the current kubeconfig context.
+func (o *kubeOptions) defaultNamespace() string {
+	ns, _, err := o.loader().Namespace()
+	if err != nil || ns == "" {
+		return "default"
+	}
+	return ns
+}
+
+func formatAge(value string, now time.Time) string {
+	if value == "" {
+		return "never"
+	}
+	parsed, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		return value
+	}
+	age := now.Sub(parsed)
+	switch {
+	case age < time.Minute:
+		return fmt.Sprintf("%ds", int(age.Seconds()))
+	case age < time.Hour:
+		return fmt.Sprintf("%dm", int(age.Minutes()))
+	case age < 48*time.Hour:
+		return fmt.Sprintf("%dh", int(age.Hours()))
+	default:
+		return fmt.Sprintf("%dd", int(age.Hours()/24))
+	}
+}
@@ -0,0 +1,235 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"text/tabwriter"
+	"time"
+)
+
+func runPoliciesCommand(ctx context.Context, args []string) error {
+	var opts kubeOptions
+	var ns string
+	var allNamespaces bool
+	flags := flag.NewFlagSet("policies", flag.ContinueOnError)
+	opts.register(flags)
+	flags.StringVar(&ns, "namespace", "", "namespace (default: current context)")
+	flags.BoolVar(&allNamespaces, "all-namespaces", false, "list policies in all namespaces")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	client, err := opts.client()
+	if err != nil {
+		return err
+	}
+
+	listPath := fmt.Sprintf("/apis/%s/%s/backuppolicies", backupPolicyGroup, backupPolicyVersion)
+	if !allNamespaces {
+		if ns == "" {
+			ns = opts.defaultNamespace()
+		}
+		listPath = namespacedPath(fmt.Sprintf("/apis/%s/%s", backupPolicyGroup, backupPolicyVersion), ns, "backuppolicies")
+	}
+	var list BackupPolicyList
+	if err := getJSON(ctx, client, listPath, &list); err != nil {
+		return err
+	}
+
+	now := time.Now().UTC()
+	table := tabwriter.NewWriter(os.Stdout, 0, 2, 2, ' ', 0)
+	fmt.Fprintln(table, "NAMESPACE\tNAME\tSCHEDULE\tVOLUMES\tLAST SYNC\tRESTORE TEST\tHEALTH")
+	for _, policy := range list.Items {
+		lastSync := oldestVolumeSync(policy)
+		restoreTest := "-"
+		if policy.Status.RestoreTest != nil && policy.Status.RestoreTest.Result != "" {
+			restoreTest = policy.Status.RestoreTest.Result
+		}
+		fmt.Fprintf(table, "%s\t%s\t%s\t%d\t%s\t%s\t%s\n",
+			policy.Metadata.Namespace,
+			policy.Metadata.Name,
+			policy.Spec.Schedule,
+			len(policy.Spec.Volumes),
+			formatAge(lastSync, now),
+			restoreTest,
+			policyHealth(policy, lastSync, now),
+		)
+	}
+	return table.Flush()
+}
+
+// oldestVolumeSync returns the last sync of the volume that was backed up
+// longest ago, or an empty string when a volume was never backed up.
+func oldestVolumeSync(policy BackupPolicy) string {
+	synced := map[string]string{}
+	for _, vol := range policy.Status.Volumes {
+		synced[vol.PVC] = vol.LastSync
+	}
+	oldest := ""
+	for _, vol := range policy.Spec.Volumes {
+		lastSync := synced[vol.PVC]
+		if lastSync == "" {
+			return ""
+		}
+		if oldest == "" || lastSync < oldest {
+			oldest = lastSync
+		}
+	}
+	return oldest
+}
+
+// policyHealth reports Stale when the controller set the BackupStale condition
+// or a whole scheduled run was missed since the oldest volume was last synced.
+func policyHealth(policy BackupPolicy, lastSync string, now time.Time) string {
+	if lastSync == "" {
+		return "NeverSynced"
+	}
+	if test := policy.Status.RestoreTest; test != nil && (test.Result == restoreTestFailed || test.Result == restoreTestError) {
+		return "RestoreTestFailed"
+	}
+	if stale := findCondition(policy.Status.Conditions, backupStaleCondition); stale != nil && stale.Status == "True" {
+		return "Stale"
+	}
+	synced, err := time.Parse(time.RFC3339, lastSync)
+	if err != nil {
+		return "Unknown"
+	}
+	schedule, err := expandHashedSchedule(policy.Spec.Schedule, policy.Metadata.Namespace+"/"+policy.Metadata.Name)
+	if err != nil {
+		return "InvalidSchedule"
+	}
+	sched, err := parseCronSchedule(schedule, policy.Spec.TimeZone)
+	if err != nil {
+		return "InvalidSchedule"
+	}
+	missed := sched.Next(sched.Next(synced))
+	if !missed.IsZero() && now.After(missed) {
+		return "Stale"
+	}
+	return "Healthy"
+}
+
+func runRunCommand(ctx context.Context, args []string) error {
+	var opts kubeOptions
+	var ns, policyName, runType string
+	var offsite, follow bool
+	var timeout time.Duration
+	flags := flag.NewFlagSet("run", flag.ContinueOnError)
+	opts.register(flags)
+	flags.StringVar(&ns, "namespace", "", "namespace (default: current context)")
+	flags.StringVar(&policyName, "policy", "", "BackupPolicy name")
+	flags.StringVar(&runType, "run-type", "manual", "run type tag for the snapshots, e.g. pre-upgrade")
+	flags.BoolVar(&offsite, "offsite", false, "run the offsite backup instead")
+	flags.BoolVar(&follow, "follow", false, "stream the logs and wait for the run to finish")
+	flags.DurationVar(&timeout, "timeout", 2*time.Hour, "how long to wait with --follow")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if policyName == "" {
+		return fmt.Errorf("--policy is required")
+	}
+	client, err := opts.client()
+	if err != nil {
+		return err
+	}
+	if ns == "" {
+		ns = opts.defaultNamespace()
+	}
+
+	jobName, err := createRunJob(ctx, client, ns, policyName, runType, offsite)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "created job %s/%s\n", ns, jobName)
+	if !follow {
+		return nil
+	}
+
+	podName, err := waitForJobPodStarted(ctx, client, ns, jobName, timeout)
+	if err != nil {
+		return err
+	}
+	logPath := fmt.Sprintf("/api/v1/namespaces/%s/pods/%s/log?follow=true", ns, podName)
+	body, status, err := client.stream(ctx, logPath)
+	if err != nil {
+		return err
+	}
+	if status != http.StatusOK {
+		return fmt.Errorf("get failed: %s status=%d", logPath, status)
+	}
+	scanner := bufio.NewScanner(body)
+	for scanner.Scan() {
+		fmt.Println(scanner.Text())
+	}
+	body.Close()
+	if err := scanner.Err(); err != nil && err != io.EOF {
+		fmt.Fprintf(os.Stderr, "log stream interrupted: %v\n", err)
+	}
+
+	if err := waitForJobCompletion(ctx, client, ns, jobName, timeout); err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "job %s/%s succeeded\n", ns, jobName)
+	return nil
+}
+
+// createRunJob starts a Job from the policy's CronJob the way
+// `kubectl create job --from=cronjob/...` does, annotated with the run type.
+func createRunJob(ctx context.Context, client *kubeClient, ns, policyName, runType string, offsite bool) (string, error) {
+	cronJobName := sanitizeName(fmt.Sprintf("backup-%s", policyName))
+	if offsite {
+		cronJobName = sanitizeName(fmt.Sprintf("backup-%s-offsite", policyName))
+	}
+
+	var cronJob map[string]interface{}
+	if err := getJSON(ctx, client, namespacedPath("/apis/batch/v1", ns, "cronjobs", cronJobName), &cronJob); err != nil {
+		return "", err
+	}
+	metadata, _ := cronJob["metadata"].(map[string]interface{})
+	spec, _ := cronJob["spec"].(map[string]interface{})
+	jobTemplate, _ := spec["jobTemplate"].(map[string]interface{})
+	jobSpec, _ := jobTemplate["spec"].(map[string]interface{})
+	if jobSpec == nil {
+		return "", fmt.Errorf("cronjob %s/%s has no job template", ns, cronJobName)
+	}
+
+	templateMetadata, _ := jobTemplate["metadata"].(map[string]interface{})
+
+	jobName := sanitizeName(fmt.Sprintf("%s-%s-%s", cronJobName, runType, time.Now().UTC().Format("20060102150405")))
+	job := map[string]interface{}{
+		"apiVersion": "batch/v1",
+		"kind":       "Job",
+		"metadata": map[string]interface{}{
+			"name":      jobName,
+			"namespace": ns,
+			"labels":    templateMetadata["labels"],
+			"annotations": map[string]interface{}{
+				"cronjob.kubernetes.io/instantiate": "manual",
+				runTypeAnnotation:                   runType,
+			},
+			"ownerReferences": []map[string]interface{}{
+				{
+					"apiVersion": "batch/v1",
+					"kind":       "CronJob",
+					"name":       cronJobName,
+					"uid":        metadata["uid"],
+				},
+			},
+		},
+		"spec": jobSpec,
+	}
+
+	collectionPath := namespacedPath("/apis/batch/v1", ns, "jobs")
+	body, status, err := client.doRequest(ctx, "POST", collectionPath, job)
+	if err != nil {
+		return "", err
+	}
+	if status < 200 || status >= 300 {
+		return "", fmt.Errorf("create failed: %s status=%d body=%s", collectionPath, status, string(body))
+	}
+	return jobName, nil
+}
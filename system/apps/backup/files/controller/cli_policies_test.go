@@ -0,0 +1,45 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestPolicyHealth(t *testing.T) {
+	now := time.Date(2024, 5, 2, 12, 0, 0, 0, time.UTC)
+	for _, tc := range []struct {
+		name     string
+		lastSync string
+		now      time.Time
+		edit     func(*BackupPolicy)
+		want     string
+	}{
+		{"never synced", "", now, nil, "NeverSynced"},
+		{"synced last night", "2024-05-02T02:00:05Z", now, nil, "Healthy"},
+		{"one run missed", "2024-05-02T02:00:05Z", now.Add(24 * time.Hour), nil, "Healthy"},
+		{"two runs missed", "2024-05-02T02:00:05Z", now.Add(48 * time.Hour), nil, "Stale"},
+		{"stale condition", "2024-05-02T02:00:05Z", now, func(p *BackupPolicy) {
+			p.Status.Conditions = []Condition{{Type: backupStaleCondition, Status: "True"}}
+		}, "Stale"},
+		{"fresh condition", "2024-05-02T02:00:05Z", now, func(p *BackupPolicy) {
+			p.Status.Conditions = []Condition{{Type: backupStaleCondition, Status: "False"}}
+		}, "Healthy"},
+		{"restore test failed", "2024-05-02T02:00:05Z", now, func(p *BackupPolicy) {
+			p.Status.RestoreTest = &RestoreTestStatus{Result: restoreTestFailed}
+		}, "RestoreTestFailed"},
+		{"restore test error", "2024-05-02T02:00:05Z", now, func(p *BackupPolicy) {
+			p.Status.RestoreTest = &RestoreTestStatus{Result: restoreTestError}
+		}, "RestoreTestFailed"},
+		{"unparsable sync", "yesterday", now, nil, "Unknown"},
+		{"invalid schedule", "2024-05-02T02:00:05Z", now, func(p *BackupPolicy) { p.Spec.Schedule = "0 25 * * *" }, "InvalidSchedule"},
+	} {
+		policy := testBackupPolicy("app", "data")
+		policy.Spec.TimeZone = "UTC"
+		if tc.edit != nil {
+			tc.edit(&policy)
+		}
+		if got := policyHealth(policy, tc.lastSync, tc.now); got != tc.want {
+			t.Errorf("%s: policyHealth = %s, want %s", tc.name, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,355 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"sigs.k8s.io/yaml"
+)
+
+// valuesEnv maps chart values under backupController to the environment
+// variables the Deployment sets from them.
+var valuesEnv = map[string]string{
+	"REPO_PVC_NAME":                 "repo.pvcName",
+	"REPO_PVC_SIZE":                 "repo.pvcSize",
+	"REPO_STORAGE_CLASS":            "repo.storageClass",
+	"REPO_MOUNT_PATH":               "repo.mountPath",
+	"PRUNE_INTERVAL_DAYS":           "restic.pruneIntervalDays",
+	"RETAIN_HOURLY":                 "restic.retain.hourly",
+	"RETAIN_DAILY":                  "restic.retain.daily",
+	"RETAIN_WEEKLY":                 "restic.retain.weekly",
+	"RETAIN_MONTHLY":                "restic.retain.monthly",
+	"RETAIN_YEARLY":                 "restic.retain.yearly",
+	"EXTERNAL_SECRET_STORE_NAME":    "externalSecret.storeName",
+	"EXTERNAL_SECRET_STORE_KIND":    "externalSecret.storeKind",
+	"EXTERNAL_SECRET_KEY":           "externalSecret.remoteKey",
+	"RESTIC_PASSWORD_PROPERTY":      "externalSecret.properties.password",
+	"RESTIC_S3_BUCKET_PROPERTY":     "externalSecret.properties.s3Bucket",
+	"RESTIC_S3_ACCESS_KEY_PROPERTY": "externalSecret.properties.s3AccessKey",
+	"RESTIC_S3_SECRET_KEY_PROPERTY": "externalSecret.properties.s3SecretKey",
+	"RUNNER_IMAGE":                  "runner.image",
+	"RUNNER_IMAGE_PULL_POLICY":      "runner.imagePullPolicy",
+	"RESTIC_IMAGE":                  "restic.image",
+	"SCALE_DOWN_TIMEOUT_SECONDS":    "timeouts.scaleDownSeconds",
+	"EXPORT_TIMEOUT_SECONDS":        "timeouts.exportSeconds",
+	"BACKUP_TIMEOUT_SECONDS":        "timeouts.backupSeconds",
+	"QUEUE_TIMEOUT_SECONDS":         "timeouts.queueSeconds",
+	"RESTORE_TEST_TIMEOUT_SECONDS":  "timeouts.restoreTestSeconds",
+	"OFFSITE_ENABLED":               "offsite.enabled",
+	"OFFSITE_SCHEDULE":              "offsite.schedule",
+	"OFFSITE_TIME_ZONE":             "offsite.timeZone",
+	"COPY_METHODS":                  "copyMethods",
+	"EXPORT_IMAGES":                 "export.images",
+}
+
+// configFromValues builds the controller configuration from a chart values
+// file, falling back to the controller defaults for keys it does not set.
+func configFromValues(data []byte) (Config, error) {
+	var values struct {
+		BackupController map[string]interface{} `json:"backupController"`
+	}
+	if err := yaml.Unmarshal(data, &values); err != nil {
+		return Config{}, err
+	}
+	return loadConfigFrom(func(key string) string {
+		path, ok := valuesEnv[key]
+		if !ok {
+			return ""
+		}
+		var value interface{} = values.BackupController
+		for _, part := range strings.Split(path, ".") {
+			parent, _ := value.(map[string]interface{})
+			value = parent[part]
+		}
+		if value == nil {
+			return ""
+		}
+		if nested, ok := value.(map[string]interface{}); ok {
+			data, _ := json.Marshal(nested)
+			return string(data)
+		}
+		return fmt.Sprint(value)
+	}), nil
+}
+
+// renderInputs parses multi-document YAML into policies and the PVCs that
+// restore targets are sized from.
+func renderInputs(data []byte) ([]BackupPolicy, []RestorePolicy, map[string]map[string]interface{}, error) {
+	var backups []BackupPolicy
+	var restores []RestorePolicy
+	pvcs := map[string]map[string]interface{}{}
+	for _, doc := range splitYAMLDocuments(data) {
+		raw, err := yaml.YAMLToJSON(doc)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		var meta struct {
+			Kind     string `json:"kind"`
+			Metadata struct {
+				Name      string `json:"name"`
+				Namespace string `json:"namespace"`
+			} `json:"metadata"`
+		}
+		if err := json.Unmarshal(raw, &meta); err != nil {
+			return nil, nil, nil, err
+		}
+		switch meta.Kind {
+		case "BackupPolicy":
+			var policy BackupPolicy
+			if err := json.Unmarshal(raw, &policy); err != nil {
+				return nil, nil, nil, err
+			}
+			backups = append(backups, policy)
+		case "RestorePolicy":
+			var policy RestorePolicy
+			if err := json.Unmarshal(raw, &policy); err != nil {
+				return nil, nil, nil, err
+			}
+			restores = append(restores, policy)
+		case "PersistentVolumeClaim":
+			var pvc map[string]interface{}
+			if err := json.Unmarshal(raw, &pvc); err != nil {
+				return nil, nil, nil, err
+			}
+			pvcs[meta.Metadata.Namespace+"/"+meta.Metadata.Name] = pvc
+		}
+	}
+	return backups, restores, pvcs, nil
+}
+
+// pvcListFrom converts the PVCs of the render inputs for volume selectors.
+func pvcListFrom(pvcs map[string]map[string]interface{}) (pvcList, error) {
+	items := make([]map[string]interface{}, 0, len(pvcs))
+	for _, pvc := range pvcs {
+		items = append(items, pvc)
+	}
+	var list pvcList
+	data, err := json.Marshal(map[string]interface{}{"items": items})
+	if err != nil {
+		return list, err
+	}
+	err = json.Unmarshal(data, &list)
+	return list, err
+}
+
+func splitYAMLDocuments(data []byte) [][]byte {
+	var docs [][]byte
+	for _, doc := range strings.Split("\n"+string(data), "\n---") {
+		if strings.TrimSpace(doc) == "" {
+			continue
+		}
+		docs = append(docs, []byte(doc))
+	}
+	return docs
+}
+
+// renderAll renders every policy in the inputs, BackupPolicies first.
+func renderAll(cfg Config, backups []BackupPolicy, restores []RestorePolicy, pvcs map[string]map[string]interface{}) ([]renderedObject, error) {
+	var objects []renderedObject
+	selectable, err := pvcListFrom(pvcs)
+	if err != nil {
+		return nil, err
+	}
+	resolved := make([]BackupPolicy, 0, len(backups))
+	for _, policy := range backups {
+		volumes, err := policyVolumes(policy, selectable)
+		if err != nil {
+			return nil, fmt.Errorf("backuppolicy %s/%s: %w", policy.Metadata.Namespace, policy.Metadata.Name, err)
+		}
+		policy.Spec.Volumes = volumes
+		resolved = append(resolved, policy)
+		rendered, err := renderBackupPolicy(cfg, policy)
+		if err != nil {
+			return nil, fmt.Errorf("backuppolicy %s/%s: %w", policy.Metadata.Namespace, policy.Metadata.Name, err)
+		}
+		objects = append(objects, rendered...)
+	}
+	for _, policy := range restores {
+		rendered, err := renderRestorePolicy(cfg, policy, pvcs, nil, restoreLimitArgs(policy, resolved))
+		if err != nil {
+			return nil, fmt.Errorf("restorepolicy %s/%s: %w", policy.Metadata.Namespace, policy.Metadata.Name, err)
+		}
+		objects = append(objects, rendered...)
+	}
+	return objects, nil
+}
+
+func writeRenderedYAML(out io.Writer, objects []renderedObject) error {
+	for i, rendered := range objects {
+		payload, err := yaml.Marshal(rendered.Object)
+		if err != nil {
+			return err
+		}
+		if i > 0 {
+			if _, err := io.WriteString(out, "---\n"); err != nil {
+				return err
+			}
+		}
+		if _, err := out.Write(payload); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type renderOptions struct {
+	files  stringList
+	values string
+}
+
+func (o *renderOptions) register(flags *flag.FlagSet) {
+	flags.Var(&o.files, "f", "BackupPolicy/RestorePolicy YAML file, repeatable (- for stdin)")
+	flags.StringVar(&o.values, "values", "", "chart values file with the controller configuration (default: controller defaults)")
+}
+
+func (o *renderOptions) render() ([]renderedObject, error) {
+	if len(o.files) == 0 {
+		return nil, fmt.Errorf("at least one -f is required")
+	}
+	cfg := loadConfigFrom(func(string) string { return "" })
+	if o.values != "" {
+		data, err := os.ReadFile(o.values)
+		if err != nil {
+			return nil, err
+		}
+		if cfg, err = configFromValues(data); err != nil {
+			return nil, fmt.Errorf("%s: %w", o.values, err)
+		}
+	}
+
+	var input bytes.Buffer
+	for _, file := range o.files {
+		var data []byte
+		var err error
+		if file == "-" {
+			data, err = io.ReadAll(os.Stdin)
+		} else {
+			data, err = os.ReadFile(file)
+		}
+		if err != nil {
+			return nil, err
+		}
+		input.Write(data)
+		input.WriteString("\n---\n")
+	}
+	backups, restores, pvcs, err := renderInputs(input.Bytes())
+	if err != nil {
+		return nil, err
+	}
+	return renderAll(cfg, backups, restores, pvcs)
+}
+
+func runRenderCommand(ctx context.Context, args []string) error {
+	var opts renderOptions
+	flags := flag.NewFlagSet("render", flag.ContinueOnError)
+	opts.register(flags)
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	objects, err := opts.render()
+	if err != nil {
+		return err
+	}
+	return writeRenderedYAML(os.Stdout, objects)
+}
+
+// runDiffCommand compares the rendered objects with the live ones, limited to
+// the fields the controller sets, and prints a unified diff. Objects that are
+// only ever created are compared when they are missing.
+func runDiffCommand(ctx context.Context, args []string) error {
+	var opts renderOptions
+	var kube kubeOptions
+	flags := flag.NewFlagSet("diff", flag.ContinueOnError)
+	opts.register(flags)
+	kube.register(flags)
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	objects, err := opts.render()
+	if err != nil {
+		return err
+	}
+	client, err := kube.client()
+	if err != nil {
+		return err
+	}
+
+	dir, err := os.MkdirTemp("", "backupctl-diff-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+	liveDir := filepath.Join(dir, "live")
+	renderedDir := filepath.Join(dir, "rendered")
+	for _, d := range []string{liveDir, renderedDir} {
+		if err := os.Mkdir(d, 0o700); err != nil {
+			return err
+		}
+	}
+
+	for _, rendered := range objects {
+		itemPath, _, err := objectPaths(rendered.Object)
+		if err != nil {
+			return err
+		}
+		body, status, err := client.doRequest(ctx, "GET", itemPath, nil)
+		if err != nil {
+			return err
+		}
+		var live interface{}
+		switch status {
+		case http.StatusOK:
+			if rendered.CreateOnly {
+				continue
+			}
+			var obj interface{}
+			if err := json.Unmarshal(body, &obj); err != nil {
+				return err
+			}
+			live = pruneToShape(obj, rendered.Object)
+		case http.StatusNotFound:
+		default:
+			return fmt.Errorf("get failed: %s status=%d", itemPath, status)
+		}
+
+		file := strings.ReplaceAll(strings.ToLower(objectRef(rendered.Object)), " ", "-")
+		file = strings.ReplaceAll(file, "/", "-") + ".yaml"
+		if live != nil {
+			if err := writeYAMLFile(filepath.Join(liveDir, file), live); err != nil {
+				return err
+			}
+		}
+		if err := writeYAMLFile(filepath.Join(renderedDir, file), rendered.Object); err != nil {
+			return err
+		}
+	}
+
+	cmd := exec.Command("diff", "-u", "-N", "-r", "live", "rendered")
+	cmd.Dir = dir
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	err = cmd.Run()
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) && exitErr.ExitCode() == 1 {
+		return fmt.Errorf("live objects differ from the rendered ones")
+	}
+	return err
+}
+
+func writeYAMLFile(path string, obj interface{}) error {
+	payload, err := yaml.Marshal(obj)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, payload, 0o600)
+}
@@ -0,0 +1,236 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"sigs.k8s.io/yaml"
+)
+
+type stringList []string
+
+func (l *stringList) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *stringList) Set(value string) error {
+	*l = append(*l, value)
+	return nil
+}
+
+func runRestoreCommand(ctx context.Context, args []string) error {
+	var opts kubeOptions
+	var ns, pvc, snapshotID, asOf, targetNamespace, targetPVC, targetSubPath, name string
+	var includes, excludes stringList
+	var apply, wait bool
+	var timeout time.Duration
+	flags := flag.NewFlagSet("restore", flag.ContinueOnError)
+	opts.register(flags)
+	flags.StringVar(&ns, "namespace", "", "namespace of the backed up PVC (default: current context)")
+	flags.StringVar(&pvc, "pvc", "", "backed up PVC")
+	flags.StringVar(&snapshotID, "snapshot", "", "snapshot ID (or prefix) from `backupctl snapshots list`")
+	flags.StringVar(&asOf, "as-of", "", "restore the newest snapshot at or before this RFC3339 time")
+	flags.StringVar(&targetNamespace, "target-namespace", "", "namespace to restore into (default: --namespace)")
+	flags.StringVar(&targetPVC, "target-pvc", "", "PVC to restore into (default: --pvc)")
+	flags.StringVar(&targetSubPath, "target-sub-path", "", "directory inside the target PVC to restore into")
+	flags.StringVar(&name, "name", "", "RestorePolicy name (default: restore-<pvc>-<timestamp>)")
+	flags.Var(&includes, "include", "path or pattern to restore, repeatable")
+	flags.Var(&excludes, "exclude", "path or pattern to skip, repeatable")
+	flags.BoolVar(&apply, "apply", false, "create the RestorePolicy instead of printing it")
+	flags.BoolVar(&wait, "wait", false, "create the RestorePolicy and wait for the restore to finish")
+	flags.DurationVar(&timeout, "timeout", time.Hour, "how long to wait with --wait")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if pvc == "" {
+		return fmt.Errorf("--pvc is required")
+	}
+	if snapshotID != "" && asOf != "" {
+		return fmt.Errorf("--snapshot and --as-of are mutually exclusive")
+	}
+	client, err := opts.client()
+	if err != nil {
+		return err
+	}
+	if ns == "" {
+		ns = opts.defaultNamespace()
+	}
+	if targetNamespace == "" {
+		targetNamespace = ns
+	}
+	if targetPVC == "" {
+		targetPVC = pvc
+	}
+	if name == "" {
+		name = sanitizeName(fmt.Sprintf("restore-%s-%s", pvc, time.Now().UTC().Format("20060102150405")))
+	}
+
+	if snapshotID != "" {
+		snapshot, err := findSnapshot(ctx, client, ns, pvc, snapshotID)
+		if err != nil {
+			return err
+		}
+		asOf = snapshot.Time
+	} else if asOf != "" {
+		if _, err := time.Parse(time.RFC3339, asOf); err != nil {
+			return fmt.Errorf("invalid --as-of %q: %w", asOf, err)
+		}
+	}
+
+	vol := RestoreVolume{
+		SourcePVC:     pvc,
+		TargetPVC:     targetPVC,
+		RestoreAsOf:   asOf,
+		IncludePaths:  includes,
+		ExcludePaths:  excludes,
+		TargetSubPath: targetSubPath,
+	}
+	policy := map[string]interface{}{
+		"apiVersion": fmt.Sprintf("%s/%s", backupPolicyGroup, backupPolicyVersion),
+		"kind":       "RestorePolicy",
+		"metadata": map[string]interface{}{
+			"name":      name,
+			"namespace": targetNamespace,
+		},
+		"spec": RestorePolicySpec{
+			SourceNamespace: ns,
+			Volumes:         []RestoreVolume{vol},
+		},
+	}
+
+	if !apply && !wait {
+		out, err := yaml.Marshal(policy)
+		if err != nil {
+			return err
+		}
+		_, err = os.Stdout.Write(out)
+		return err
+	}
+
+	collectionPath := namespacedPath(fmt.Sprintf("/apis/%s/%s", backupPolicyGroup, backupPolicyVersion), targetNamespace, "restorepolicies")
+	body, status, err := client.doRequest(ctx, "POST", collectionPath, policy)
+	if err != nil {
+		return err
+	}
+	if status < 200 || status >= 300 {
+		return fmt.Errorf("create failed: %s status=%d body=%s", collectionPath, status, strings.TrimSpace(string(body)))
+	}
+	fmt.Fprintf(os.Stderr, "created restorepolicy %s/%s\n", targetNamespace, name)
+	if !wait {
+		return nil
+	}
+
+	if err := waitForRestorePolicyReady(ctx, client, targetNamespace, name, timeout); err != nil {
+		return err
+	}
+	restoreName := restoreResourceName(name, targetPVC)
+	if vol.partial() {
+		jobName, err := partialRestoreJobName(restoreName, vol)
+		if err != nil {
+			return err
+		}
+		if err := waitForJobCompletion(ctx, client, targetNamespace, jobName, timeout); err != nil {
+			logs, logErr := getJobLogs(ctx, client, targetNamespace, jobName)
+			if logErr == nil && strings.TrimSpace(logs) != "" {
+				return fmt.Errorf("%w: %s", err, tailString(strings.TrimSpace(logs), 1024))
+			}
+			return err
+		}
+	} else if err := waitForReplicationDestination(ctx, client, targetNamespace, restoreName, "init", timeout); err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "restore of %s/%s into %s/%s finished\n", ns, pvc, targetNamespace, targetPVC)
+	return nil
+}
+
+// findSnapshot looks the snapshot up in the snapshot catalog of the
+// BackupPolicy that covers pvc, matching full IDs and short ID prefixes.
+func findSnapshot(ctx context.Context, client *kubeClient, ns, pvc, snapshotID string) (BackupSnapshot, error) {
+	policy, err := policyForPVC(ctx, client, ns, pvc)
+	if err != nil {
+		return BackupSnapshot{}, err
+	}
+	snapshots, err := readSnapshotCatalog(ctx, client, policy, pvc)
+	if err != nil {
+		return BackupSnapshot{}, err
+	}
+	var matches []BackupSnapshot
+	for _, snapshot := range snapshots {
+		if strings.HasPrefix(snapshot.ID, snapshotID) {
+			matches = append(matches, snapshot)
+		}
+	}
+	switch len(matches) {
+	case 0:
+		return BackupSnapshot{}, fmt.Errorf("snapshot %s not found in the snapshot catalog of backuppolicy %s/%s", snapshotID, ns, policy.Metadata.Name)
+	case 1:
+		return matches[0], nil
+	default:
+		return BackupSnapshot{}, fmt.Errorf("snapshot prefix %s is ambiguous", snapshotID)
+	}
+}
+
+func policyForPVC(ctx context.Context, client *kubeClient, ns, pvc string) (BackupPolicy, error) {
+	var list BackupPolicyList
+	listPath := namespacedPath(fmt.Sprintf("/apis/%s/%s", backupPolicyGroup, backupPolicyVersion), ns, "backuppolicies")
+	if err := getJSON(ctx, client, listPath, &list); err != nil {
+		return BackupPolicy{}, err
+	}
+	for _, policy := range list.Items {
+		for _, vol := range policy.Spec.Volumes {
+			if vol.PVC == pvc {
+				return policy, nil
+			}
+		}
+	}
+	return BackupPolicy{}, fmt.Errorf("no BackupPolicy in namespace %s covers pvc %s", ns, pvc)
+}
+
+// waitForRestorePolicyReady waits until the controller created the restore
+// objects of the policy. Ready stays False while the recorded metadata or the
+// snapshots to restore are read and while the restore runs, so the pending
+// reasons keep the wait going and Restoring or RestoreFailed end it; the
+// caller then follows the Job or ReplicationDestination itself.
+func waitForRestorePolicyReady(ctx context.Context, client *kubeClient, ns, name string, timeout time.Duration) error {
+	itemPath := namespacedPath(fmt.Sprintf("/apis/%s/%s", backupPolicyGroup, backupPolicyVersion), ns, "restorepolicies", name)
+	deadline := time.Now().Add(timeout)
+	for {
+		body, status, err := client.doRequest(ctx, "GET", itemPath, nil)
+		if err != nil {
+			return err
+		}
+		if status != http.StatusOK {
+			return fmt.Errorf("get failed: %s status=%d", itemPath, status)
+		}
+		var policy RestorePolicy
+		if err := json.Unmarshal(body, &policy); err != nil {
+			return err
+		}
+		if policy.Status.ObservedGeneration >= policy.Metadata.Generation {
+			for _, condition := range policy.Status.Conditions {
+				if condition.Type != "Ready" {
+					continue
+				}
+				switch {
+				case condition.Status == "True", condition.Reason == "Restoring", condition.Reason == "RestoreFailed":
+					return nil
+				case condition.Reason == "MetadataPending", condition.Reason == "SnapshotPending":
+					continue
+				}
+				return fmt.Errorf("restorepolicy %s/%s: %s: %s", ns, name, condition.Reason, condition.Message)
+			}
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("timed out waiting for restorepolicy %s/%s", ns, name)
+		}
+		if err := sleepContext(ctx, 2*time.Second); err != nil {
+			return err
+		}
+	}
+}
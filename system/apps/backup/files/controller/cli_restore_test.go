@@ -0,0 +1,48 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestFindSnapshot(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"items": [{
+			"metadata": {"name": "app", "namespace": "apps"},
+			"spec": {"schedule": "0 2 * * *", "volumes": [{"pvc": "data"}]},
+			"status": {"volumes": [{"pvc": "data", "snapshots": [
+				{"id": "1a2b3c4d5e6f", "time": "2024-05-01T02:00:00Z"},
+				{"id": "1a2bffff0000", "time": "2024-05-02T02:00:00Z"},
+				{"id": "9f8e7d6c5b4a", "time": "2024-05-03T02:00:00Z"}
+			]}]}
+		}]}`))
+	}))
+	defer server.Close()
+	client := &kubeClient{baseURL: server.URL, client: server.Client()}
+
+	for _, tc := range []struct {
+		pvc, id string
+		want    string
+		err     string
+	}{
+		{"data", "9f8e7d6c5b4a", "9f8e7d6c5b4a", ""},
+		{"data", "1a2b3c", "1a2b3c4d5e6f", ""},
+		{"data", "1a2b", "", "ambiguous"},
+		{"data", "deadbeef", "", "not found in the snapshot catalog of backuppolicy apps/app"},
+		{"media", "9f8e7d6c", "", "no BackupPolicy in namespace apps covers pvc media"},
+	} {
+		got, err := findSnapshot(context.Background(), client, "apps", tc.pvc, tc.id)
+		if tc.err != "" {
+			if err == nil || !strings.Contains(err.Error(), tc.err) {
+				t.Errorf("findSnapshot(%s, %s) error %v, want %q", tc.pvc, tc.id, err, tc.err)
+			}
+			continue
+		}
+		if err != nil || got.ID != tc.want {
+			t.Errorf("findSnapshot(%s, %s) = %s, %v, want %s", tc.pvc, tc.id, got.ID, err, tc.want)
+		}
+	}
+}
@@ -0,0 +1,230 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+)
+
+type apiClientOptions struct {
+	server string
+	token  string
+}
+
+func (o *apiClientOptions) register(flags *flag.FlagSet) {
+	flags.StringVar(&o.server, "server", getenv("BACKUP_API_SERVER", "http://localhost:8081"), "backup API base URL")
+	flags.StringVar(&o.token, "token", os.Getenv("BACKUP_API_TOKEN"), "Kubernetes bearer token")
+}
+
+func (o *apiClientOptions) get(apiPath string, query url.Values) (*http.Response, error) {
+	if o.token == "" {
+		return nil, fmt.Errorf("a token is required (--token or BACKUP_API_TOKEN)")
+	}
+	target := strings.TrimRight(o.server, "/") + apiPath
+	if len(query) > 0 {
+		target += "?" + query.Encode()
+	}
+	req, err := http.NewRequest("GET", target, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+o.token)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		defer resp.Body.Close()
+		var apiErr apiError
+		if err := json.NewDecoder(resp.Body).Decode(&apiErr); err == nil && apiErr.Error != "" {
+			return nil, fmt.Errorf("%s (status=%d)", apiErr.Error, resp.StatusCode)
+		}
+		return nil, fmt.Errorf("request failed: %s status=%d", apiPath, resp.StatusCode)
+	}
+	return resp, nil
+}
+
+func runSnapshotsCommand(ctx context.Context, args []string) error {
+	if len(args) == 0 {
+		printCLIUsage()
+		return fmt.Errorf("snapshots requires a subcommand")
+	}
+
+	var opts apiClientOptions
+	var kube kubeOptions
+	var ns, pvc, snapshotID, target, output string
+	var live bool
+	var limit, offset int
+	flags := flag.NewFlagSet("snapshots "+args[0], flag.ContinueOnError)
+	opts.register(flags)
+	kube.register(flags)
+	flags.BoolVar(&live, "live", false, "list snapshots from the restic repository through the backup API instead of the snapshot catalog")
+	flags.IntVar(&limit, "limit", 20, "number of snapshots to list, newest first (0 for all)")
+	flags.IntVar(&offset, "offset", 0, "number of newest snapshots to skip")
+	flags.StringVar(&ns, "namespace", "", "namespace of the PVC")
+	flags.StringVar(&pvc, "pvc", "", "PVC name")
+	flags.StringVar(&snapshotID, "snapshot", "latest", "snapshot ID")
+	flags.StringVar(&target, "path", "/", "path inside the snapshot")
+	flags.StringVar(&output, "output", "", "file to write to (default: stdout)")
+	if err := flags.Parse(args[1:]); err != nil {
+		return err
+	}
+	if pvc == "" {
+		return fmt.Errorf("--pvc is required")
+	}
+	if ns == "" {
+		ns = kube.defaultNamespace()
+	}
+
+	base := fmt.Sprintf("/v1/namespaces/%s/pvcs/%s/snapshots", url.PathEscape(ns), url.PathEscape(pvc))
+	switch args[0] {
+	case "list":
+		if !live {
+			return listCatalogSnapshotsCommand(ctx, &kube, ns, pvc, offset, limit)
+		}
+		return listSnapshotsCommand(&opts, base, offset, limit)
+	case "ls":
+		return browseSnapshotCommand(&opts, fmt.Sprintf("%s/%s/ls", base, url.PathEscape(snapshotID)), target)
+	case "dump":
+		if target == "/" && output == "" {
+			return fmt.Errorf("dumping a whole snapshot requires --output")
+		}
+		return dumpSnapshotCommand(&opts, fmt.Sprintf("%s/%s/dump", base, url.PathEscape(snapshotID)), target, output)
+	default:
+		printCLIUsage()
+		return fmt.Errorf("unknown snapshots subcommand %q", args[0])
+	}
+}
+
+func listSnapshotsCommand(opts *apiClientOptions, apiPath string, offset, limit int) error {
+	query := url.Values{"offset": {strconv.Itoa(offset)}, "limit": {strconv.Itoa(limit)}}
+	resp, err := opts.get(apiPath, query)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	var snapshots []BackupSnapshot
+	if err := json.NewDecoder(resp.Body).Decode(&snapshots); err != nil {
+		return err
+	}
+	if err := printSnapshots(snapshots); err != nil {
+		return err
+	}
+	printPageHint(resp.Header.Get(snapshotTotalHeader), offset, len(snapshots))
+	return nil
+}
+
+// listCatalogSnapshotsCommand prints the snapshots the controller recorded in
+// the snapshot catalog of the volume, which needs no restic Job.
+func listCatalogSnapshotsCommand(ctx context.Context, kube *kubeOptions, ns, pvc string, offset, limit int) error {
+	client, err := kube.client()
+	if err != nil {
+		return err
+	}
+	policy, err := policyForPVC(ctx, client, ns, pvc)
+	if err != nil {
+		return err
+	}
+	snapshots, err := readSnapshotCatalog(ctx, client, policy, pvc)
+	if err != nil {
+		return err
+	}
+	page := pageSnapshots(snapshots, offset, limit)
+	if err := printSnapshots(page); err != nil {
+		return err
+	}
+	printPageHint(strconv.Itoa(len(snapshots)), offset, len(page))
+	return nil
+}
+
+// printPageHint tells on stderr how to list the next page, if there is one.
+func printPageHint(total string, offset, listed int) {
+	count, err := strconv.Atoi(total)
+	if err != nil || offset+listed >= count {
+		return
+	}
+	fmt.Fprintf(os.Stderr, "%d of %d snapshots listed, next page: --offset %d\n", offset+listed, count, offset+listed)
+}
+
+func printSnapshots(snapshots []BackupSnapshot) error {
+	table := tabwriter.NewWriter(os.Stdout, 0, 2, 2, ' ', 0)
+	fmt.Fprintln(table, "ID\tTIME\tSIZE\tTAGS")
+	for _, snapshot := range snapshots {
+		fmt.Fprintf(table, "%s\t%s\t%d\t%s\n", shortID(snapshot.ID), snapshot.Time, snapshot.Size, strings.Join(snapshot.Tags, ","))
+	}
+	return table.Flush()
+}
+
+func shortID(id string) string {
+	if len(id) > 8 {
+		return id[:8]
+	}
+	return id
+}
+
+func browseSnapshotCommand(opts *apiClientOptions, apiPath, target string) error {
+	resp, err := opts.get(apiPath, url.Values{"path": {target}})
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	var entries []snapshotEntry
+	if err := json.NewDecoder(resp.Body).Decode(&entries); err != nil {
+		return err
+	}
+	table := tabwriter.NewWriter(os.Stdout, 0, 2, 2, ' ', 0)
+	fmt.Fprintln(table, "TYPE\tSIZE\tMODIFIED\tPATH")
+	for _, entry := range entries {
+		fmt.Fprintf(table, "%s\t%d\t%s\t%s\n", entry.Type, entry.Size, entry.MTime, entry.Path)
+	}
+	return table.Flush()
+}
+
+func dumpSnapshotCommand(opts *apiClientOptions, apiPath, target, output string) error {
+	resp, err := opts.get(apiPath, url.Values{"path": {target}})
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	var out io.Writer = os.Stdout
+	var file *os.File
+	if output != "" {
+		if file, err = os.Create(output); err != nil {
+			return err
+		}
+		out = file
+	}
+	written, err := io.Copy(out, resp.Body)
+	// The trailer is only available once the body was read.
+	if result := resp.Trailer.Get("X-Backup-Result"); err == nil && result != "ok" {
+		if result == "" {
+			result = "incomplete"
+		}
+		err = fmt.Errorf("dump of %s did not complete: %s", target, result)
+	}
+	if file != nil {
+		if closeErr := file.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			// A partial or corrupt file must not pass for the restored one.
+			os.Remove(output)
+		}
+	}
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "restored %s (%d bytes)\n", target, written)
+	return nil
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestDumpSnapshotCommand(t *testing.T) {
+	for _, tc := range []struct {
+		result string
+		keep   bool
+	}{
+		{"ok", true},
+		{"checksum-mismatch", false},
+		{"", false},
+	} {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Trailer", "X-Backup-Result")
+			w.Write([]byte("contents"))
+			if tc.result != "" {
+				w.Header().Set("X-Backup-Result", tc.result)
+			}
+		}))
+		output := filepath.Join(t.TempDir(), "app.db")
+		opts := &apiClientOptions{server: server.URL, token: "token"}
+		err := dumpSnapshotCommand(opts, "/v1/namespaces/apps/pvcs/data/snapshots/latest/dump", "/app.db", output)
+		server.Close()
+		if (err == nil) != tc.keep {
+			t.Errorf("result %q: err = %v", tc.result, err)
+		}
+		if _, statErr := os.Stat(output); (statErr == nil) != tc.keep {
+			t.Errorf("result %q: output kept = %v, want %v", tc.result, statErr == nil, tc.keep)
+		}
+	}
+}
@@ -0,0 +1,295 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+)
+
+const clusterPolicyLabel = "backup.homelab/cluster-policy"
+
+type ClusterBackupPolicy struct {
+	APIVersion string `json:"apiVersion"`
+	Kind       string `json:"kind"`
+	Metadata   struct {
+		Name       string `json:"name"`
+		UID        string `json:"uid"`
+		Generation int64  `json:"generation"`
+	} `json:"metadata"`
+	Spec   ClusterBackupPolicySpec   `json:"spec"`
+	Status ClusterBackupPolicyStatus `json:"status,omitempty"`
+}
+
+type ClusterBackupPolicyList struct {
+	Items []ClusterBackupPolicy `json:"items"`
+}
+
+type ClusterBackupPolicySpec struct {
+	NamespaceSelector *metav1.LabelSelector `json:"namespaceSelector,omitempty"`
+	// PVCSelector selects PVCs in the matched namespaces, all when empty.
+	PVCSelector       *metav1.LabelSelector `json:"pvcSelector,omitempty"`
+	ExcludeNamespaces []string              `json:"excludeNamespaces,omitempty"`
+	// ExcludePVCs holds PVC names, excluded in every namespace, or
+	// namespace/name entries.
+	ExcludePVCs []string `json:"excludePVCs,omitempty"`
+	// Defaults are the settings of the generated BackupPolicies.
+	Defaults BackupTier `json:"defaults"`
+}
+
+type ClusterBackupPolicyStatus struct {
+	ObservedGeneration int64                                `json:"observedGeneration,omitempty"`
+	Conditions         []Condition                          `json:"conditions,omitempty"`
+	Namespaces         []ClusterBackupPolicyNamespaceStatus `json:"namespaces,omitempty"`
+}
+
+// ClusterBackupPolicyNamespaceStatus summarizes the BackupPolicy generated in
+// one namespace.
+type ClusterBackupPolicyNamespaceStatus struct {
+	Namespace        string `json:"namespace"`
+	Policy           string `json:"policy"`
+	Volumes          int    `json:"volumes"`
+	Ready            string `json:"ready"`
+	Message          string `json:"message,omitempty"`
+	LastSnapshotSync string `json:"lastSnapshotSync,omitempty"`
+	Stale            bool   `json:"stale,omitempty"`
+}
+
+func clusterPolicyName(name string) string {
+	return sanitizeName("cluster-" + name)
+}
+
+func clusterGeneratedPolicy(policy BackupPolicy) bool {
+	return managedPolicy(policy) && policy.Metadata.Labels[clusterPolicyLabel] != ""
+}
+
+func selectorFor(selector *metav1.LabelSelector) (labels.Selector, error) {
+	if selector == nil {
+		return labels.Everything(), nil
+	}
+	return metav1.LabelSelectorAsSelector(selector)
+}
+
+// planClusterPolicies expands ClusterBackupPolicies into one BackupPolicy per
+// matched namespace. PVCs listed in hand-written policies, excluded with the
+// backup.homelab/policy annotation or matched by an earlier ClusterBackupPolicy
+// (by name) are left out and reported in skipped.
+func planClusterPolicies(clusterPolicies []ClusterBackupPolicy, namespaces namespaceList, pvcs pvcList, policies []BackupPolicy) (discoveryPlan, []string, error) {
+	sort.Slice(clusterPolicies, func(i, j int) bool { return clusterPolicies[i].Metadata.Name < clusterPolicies[j].Metadata.Name })
+	covered := policyOwners(policies, pvcs, managedPolicy)
+	reserved := handWritten(policies)
+	nsAnnotations := map[string]map[string]string{}
+	for _, ns := range namespaces.Items {
+		nsAnnotations[ns.Metadata.Name] = ns.Metadata.Annotations
+	}
+
+	var plan discoveryPlan
+	var skipped []string
+	wanted := map[string]bool{}
+	claimed := map[string]string{}
+	for _, cluster := range clusterPolicies {
+		nsSelector, err := selectorFor(cluster.Spec.NamespaceSelector)
+		if err != nil {
+			return plan, skipped, fmt.Errorf("ClusterBackupPolicy %s: namespaceSelector: %w", cluster.Metadata.Name, err)
+		}
+		pvcSelector, err := selectorFor(cluster.Spec.PVCSelector)
+		if err != nil {
+			return plan, skipped, fmt.Errorf("ClusterBackupPolicy %s: pvcSelector: %w", cluster.Metadata.Name, err)
+		}
+		matched := map[string]bool{}
+		for _, ns := range namespaces.Items {
+			if nsSelector.Matches(labels.Set(ns.Metadata.Labels)) && !containsString(cluster.Spec.ExcludeNamespaces, ns.Metadata.Name) {
+				matched[ns.Metadata.Name] = true
+			}
+		}
+
+		name := clusterPolicyName(cluster.Metadata.Name)
+		volumes := map[string][]string{}
+		for _, pvc := range pvcs.Items {
+			meta := pvc.Metadata
+			key := meta.Namespace + "/" + meta.Name
+			if !matched[meta.Namespace] || ignoredPVC(meta.Name, meta.Labels) || !pvcSelector.Matches(labels.Set(meta.Labels)) {
+				continue
+			}
+			if containsString(cluster.Spec.ExcludePVCs, meta.Name) || containsString(cluster.Spec.ExcludePVCs, key) {
+				continue
+			}
+			if _, excluded := discoveryTier(nsAnnotations[meta.Namespace], meta.Annotations); excluded {
+				continue
+			}
+			if owner, ok := covered[key]; ok {
+				// Every ClusterBackupPolicy matching the PVC finds the same owner.
+				if reason := fmt.Sprintf("%s (backed up by BackupPolicy %s)", key, owner); !containsString(skipped, reason) {
+					skipped = append(skipped, reason)
+				}
+				continue
+			}
+			if owner, ok := claimed[key]; ok {
+				skipped = append(skipped, fmt.Sprintf("%s (matched by ClusterBackupPolicy %s)", key, owner))
+				continue
+			}
+			claimed[key] = cluster.Metadata.Name
+			volumes[meta.Namespace] = append(volumes[meta.Namespace], meta.Name)
+		}
+
+		nsNames := make([]string, 0, len(volumes))
+		for ns := range volumes {
+			nsNames = append(nsNames, ns)
+		}
+		sort.Strings(nsNames)
+		for _, ns := range nsNames {
+			if reserved[ns+"/"+name] {
+				skipped = append(skipped, fmt.Sprintf("%s/%s (a hand-written BackupPolicy has that name)", ns, name))
+				continue
+			}
+			wanted[ns+"/"+name] = true
+			policyLabels := map[string]interface{}{managedLabel: fieldManager, clusterPolicyLabel: cluster.Metadata.Name}
+			obj := generatedPolicyObject(ns, name, policyLabels, cluster.Spec.Defaults, volumes[ns])
+			// Garbage collection removes the generated policies with the
+			// ClusterBackupPolicy.
+			obj["metadata"].(map[string]interface{})["ownerReferences"] = []map[string]interface{}{
+				{
+					"apiVersion": fmt.Sprintf("%s/%s", backupPolicyGroup, backupPolicyVersion),
+					"kind":       "ClusterBackupPolicy",
+					"name":       cluster.Metadata.Name,
+					"uid":        cluster.Metadata.UID,
+				},
+			}
+			plan.Apply = append(plan.Apply, obj)
+		}
+	}
+	for _, policy := range policies {
+		if clusterGeneratedPolicy(policy) && !wanted[policy.Metadata.Namespace+"/"+policy.Metadata.Name] {
+			plan.Delete = append(plan.Delete, policy)
+		}
+	}
+	return plan, skipped, nil
+}
+
+// clusterPolicyStatus aggregates the status of the BackupPolicies generated
+// for cluster.
+func clusterPolicyStatus(cluster ClusterBackupPolicy, policies []BackupPolicy) ([]ClusterBackupPolicyNamespaceStatus, Condition) {
+	var namespaces []ClusterBackupPolicyNamespaceStatus
+	var notReady []string
+	for _, policy := range policies {
+		if !clusterGeneratedPolicy(policy) || policy.Metadata.Labels[clusterPolicyLabel] != cluster.Metadata.Name {
+			continue
+		}
+		entry := ClusterBackupPolicyNamespaceStatus{
+			Namespace:        policy.Metadata.Namespace,
+			Policy:           policy.Metadata.Name,
+			Volumes:          len(policy.Spec.Volumes),
+			Ready:            "Unknown",
+			LastSnapshotSync: policy.Status.LastSnapshotSync,
+		}
+		if ready := findCondition(policy.Status.Conditions, "Ready"); ready != nil {
+			entry.Ready = ready.Status
+			if ready.Status != "True" {
+				entry.Message = ready.Message
+			}
+		}
+		if stale := findCondition(policy.Status.Conditions, backupStaleCondition); stale != nil && stale.Status == "True" {
+			entry.Stale = true
+			entry.Message = stale.Message
+		}
+		if entry.Ready != "True" || entry.Stale {
+			notReady = append(notReady, entry.Namespace)
+		}
+		namespaces = append(namespaces, entry)
+	}
+	sort.Slice(namespaces, func(i, j int) bool { return namespaces[i].Namespace < namespaces[j].Namespace })
+	sort.Strings(notReady)
+
+	condition := Condition{Type: "Ready", Status: "True", Reason: "Reconciled", Message: fmt.Sprintf("%d namespaces ready", len(namespaces))}
+	switch {
+	case len(namespaces) == 0:
+		condition.Reason = "NoMatches"
+		condition.Message = "no PVCs match the selectors"
+	case len(notReady) > 0:
+		condition.Status = "False"
+		condition.Reason = "NamespacesNotReady"
+		condition.Message = fmt.Sprintf("%d of %d namespaces not ready or stale: %s", len(notReady), len(namespaces), strings.Join(notReady, ", "))
+	}
+	return namespaces, condition
+}
+
+// ClusterBackupPolicyHandler expands ClusterBackupPolicies into generated
+// BackupPolicies and reports their status.
+type ClusterBackupPolicyHandler struct{}
+
+func (h *ClusterBackupPolicyHandler) Reconcile(ctx context.Context, client *kubeClient, cfg Config) error {
+	var clusterPolicies ClusterBackupPolicyList
+	if err := getJSON(ctx, client, fmt.Sprintf("/apis/%s/%s/clusterbackuppolicies", backupPolicyGroup, backupPolicyVersion), &clusterPolicies); err != nil {
+		slog.Error("listing ClusterBackupPolicies failed", logError, err)
+		return err
+	}
+	var policies BackupPolicyList
+	if err := getJSON(ctx, client, fmt.Sprintf("/apis/%s/%s/backuppolicies", backupPolicyGroup, backupPolicyVersion), &policies); err != nil {
+		slog.Error("listing BackupPolicies failed", logError, err)
+		return err
+	}
+	if len(clusterPolicies.Items) == 0 && !anyPolicy(policies.Items, clusterGeneratedPolicy) {
+		return nil
+	}
+	slog.Debug("reconciling ClusterBackupPolicies", "count", len(clusterPolicies.Items))
+
+	var namespaces namespaceList
+	if err := getJSON(ctx, client, "/api/v1/namespaces", &namespaces); err != nil {
+		return err
+	}
+	var pvcs pvcList
+	if err := getJSON(ctx, client, "/api/v1/persistentvolumeclaims", &pvcs); err != nil {
+		return err
+	}
+	plan, skipped, err := planClusterPolicies(clusterPolicies.Items, namespaces, pvcs, policies.Items)
+	if err != nil {
+		slog.Error("cluster policies failed", logError, err)
+		return err
+	}
+	for _, pvc := range skipped {
+		slog.Info("cluster policies skipped volume", logVolume, pvc)
+	}
+	if err := applyPlan(ctx, client, "cluster policies", plan); err != nil {
+		slog.Error("cluster policies failed", logError, err)
+		return err
+	}
+
+	for _, cluster := range clusterPolicies.Items {
+		if err := updateClusterPolicyStatus(ctx, client, cluster, policies.Items); err != nil {
+			slog.Error("ClusterBackupPolicy status update failed", logPolicy, cluster.Metadata.Name, logError, err)
+			return err
+		}
+	}
+	return nil
+}
+
+// updateClusterPolicyStatus writes the aggregated status of cluster when it
+// changed. Policies generated in this pass are reported from the next one on.
+func updateClusterPolicyStatus(ctx context.Context, client *kubeClient, cluster ClusterBackupPolicy, policies []BackupPolicy) error {
+	namespaces, ready := clusterPolicyStatus(cluster, policies)
+	existing := findCondition(cluster.Status.Conditions, "Ready")
+	if existing != nil && existing.Status == ready.Status && existing.Message == ready.Message &&
+		cluster.Status.ObservedGeneration == cluster.Metadata.Generation && reflect.DeepEqual(cluster.Status.Namespaces, namespaces) {
+		return nil
+	}
+	return patchPolicyStatus(ctx, client, "clusterbackuppolicies", "", cluster.Metadata.Name, map[string]interface{}{
+		"observedGeneration": cluster.Metadata.Generation,
+		"conditions":         setCondition(cluster.Status.Conditions, ready, time.Now()),
+		"namespaces":         namespaces,
+	})
+}
+
+func anyPolicy(policies []BackupPolicy, match func(BackupPolicy) bool) bool {
+	for _, policy := range policies {
+		if match(policy) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestPlanClusterPolicies(t *testing.T) {
+	var clusterPolicies ClusterBackupPolicyList
+	mustUnmarshal(t, `{"items": [
+		{"metadata": {"name": "critical", "uid": "u1"}, "spec": {
+			"namespaceSelector": {"matchLabels": {"tier": "critical"}},
+			"excludeNamespaces": ["vault"],
+			"excludePVCs": ["cache", "db/scratch"],
+			"defaults": {"schedule": "0 1 * * *", "maxAge": "26h"}
+		}},
+		{"metadata": {"name": "all-data", "uid": "u2"}, "spec": {
+			"namespaceSelector": {"matchExpressions": [{"key": "tier", "operator": "Exists"}]},
+			"pvcSelector": {"matchLabels": {"backup": "true"}},
+			"defaults": {"schedule": "0 3 * * *"}
+		}}
+	]}`, &clusterPolicies)
+	var namespaces namespaceList
+	mustUnmarshal(t, `{"items": [
+		{"metadata": {"name": "db", "labels": {"tier": "critical"}}},
+		{"metadata": {"name": "git", "labels": {"tier": "critical"}}},
+		{"metadata": {"name": "vault", "labels": {"tier": "critical"}}},
+		{"metadata": {"name": "media", "labels": {"tier": "bulk"}}},
+		{"metadata": {"name": "old", "labels": {"tier": "bulk"}}}
+	]}`, &namespaces)
+	var pvcs pvcList
+	mustUnmarshal(t, `{"items": [
+		{"metadata": {"name": "data", "namespace": "db"}},
+		{"metadata": {"name": "scratch", "namespace": "db"}},
+		{"metadata": {"name": "cache", "namespace": "db"}},
+		{"metadata": {"name": "repos", "namespace": "git", "labels": {"backup": "true"}}},
+		{"metadata": {"name": "lfs", "namespace": "git", "annotations": {"backup.homelab/policy": "none"}}},
+		{"metadata": {"name": "secrets", "namespace": "vault"}},
+		{"metadata": {"name": "photos", "namespace": "media", "labels": {"backup": "true"}}},
+		{"metadata": {"name": "movies", "namespace": "media"}}
+	]}`, &pvcs)
+	var policies BackupPolicyList
+	mustUnmarshal(t, `{"items": [
+		{"metadata": {"name": "git", "namespace": "git"}, "spec": {"volumes": [{"pvc": "repos"}]}},
+		{"metadata": {"name": "cluster-all-data", "namespace": "old", "labels": {"backup.homelab/managed-by": "backup-controller", "backup.homelab/cluster-policy": "all-data"}}}
+	]}`, &policies)
+
+	plan, skipped, err := planClusterPolicies(clusterPolicies.Items, namespaces, pvcs, policies.Items)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var applied []string
+	for _, obj := range plan.Apply {
+		metadata := obj["metadata"].(map[string]interface{})
+		spec := obj["spec"].(map[string]interface{})
+		entry := metadata["namespace"].(string) + "/" + metadata["name"].(string)
+		for _, vol := range spec["volumes"].([]map[string]interface{}) {
+			entry += " " + vol["pvc"].(string)
+		}
+		applied = append(applied, entry)
+	}
+	want := []string{"media/cluster-all-data photos", "db/cluster-critical data"}
+	if !reflect.DeepEqual(applied, want) {
+		t.Errorf("applied %v, want %v", applied, want)
+	}
+	if len(plan.Delete) != 1 || plan.Delete[0].Metadata.Namespace != "old" {
+		t.Errorf("delete %v, want old/cluster-all-data", plan.Delete)
+	}
+	if want := []string{"git/repos (backed up by BackupPolicy git)"}; !reflect.DeepEqual(skipped, want) {
+		t.Errorf("skipped %v, want %v", skipped, want)
+	}
+}
+
+func TestClusterPolicyStatus(t *testing.T) {
+	var cluster ClusterBackupPolicy
+	cluster.Metadata.Name = "critical"
+	var policies BackupPolicyList
+	mustUnmarshal(t, `{"items": [
+		{"metadata": {"name": "cluster-critical", "namespace": "db", "labels": {"backup.homelab/managed-by": "backup-controller", "backup.homelab/cluster-policy": "critical"}},
+		 "spec": {"volumes": [{"pvc": "data"}]},
+		 "status": {"conditions": [{"type": "Ready", "status": "True"}]}},
+		{"metadata": {"name": "cluster-critical", "namespace": "git", "labels": {"backup.homelab/managed-by": "backup-controller", "backup.homelab/cluster-policy": "critical"}},
+		 "spec": {"volumes": [{"pvc": "repos"}, {"pvc": "lfs"}]},
+		 "status": {"conditions": [{"type": "Ready", "status": "True"}, {"type": "BackupStale", "status": "True", "message": "repos last synced yesterday"}]}},
+		{"metadata": {"name": "cluster-other", "namespace": "git", "labels": {"backup.homelab/managed-by": "backup-controller", "backup.homelab/cluster-policy": "other"}}}
+	]}`, &policies)
+
+	namespaces, ready := clusterPolicyStatus(cluster, policies.Items)
+	if len(namespaces) != 2 || namespaces[1].Volumes != 2 || !namespaces[1].Stale {
+		t.Fatalf("unexpected namespaces %+v", namespaces)
+	}
+	if ready.Status != "False" || ready.Message != "1 of 2 namespaces not ready or stale: git" {
+		t.Errorf("unexpected condition %+v", ready)
+	}
+}
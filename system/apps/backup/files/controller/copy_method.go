@@ -0,0 +1,82 @@
+package main
+
+import "fmt"
+
+// VolSync copy methods. Snapshot and Clone copy the source PVC before the
+// mover reads it; Direct reads the live PVC.
+const (
+	copyMethodSnapshot = "Snapshot"
+	copyMethodClone    = "Clone"
+	copyMethodDirect   = "Direct"
+)
+
+// CopyMethod is how the mover gets a stable copy of a volume.
+type CopyMethod struct {
+	Method string `json:"method,omitempty"`
+	// VolumeSnapshotClassName is used by Snapshot. Empty uses the cluster
+	// default VolumeSnapshotClass.
+	VolumeSnapshotClassName string `json:"volumeSnapshotClassName,omitempty"`
+}
+
+// CopyMethodConfig maps storage classes to copy methods, set from
+// backupController.copyMethods in the chart values.
+type CopyMethodConfig struct {
+	Default        CopyMethod            `json:"default,omitempty"`
+	StorageClasses map[string]CopyMethod `json:"storageClasses,omitempty"`
+}
+
+func validCopyMethod(method string) bool {
+	return method == copyMethodSnapshot || method == copyMethodClone || method == copyMethodDirect
+}
+
+func (c CopyMethodConfig) validate() error {
+	if c.Default.Method != "" && !validCopyMethod(c.Default.Method) {
+		return fmt.Errorf("default: unknown copy method %q", c.Default.Method)
+	}
+	for class, method := range c.StorageClasses {
+		if method.Method != "" && !validCopyMethod(method.Method) {
+			return fmt.Errorf("storageClasses.%s: unknown copy method %q", class, method.Method)
+		}
+	}
+	return nil
+}
+
+// copyMethodFor returns the copy method of vol: its own copyMethod, else the
+// one configured for its storage class, else the default, else Snapshot.
+func copyMethodFor(cfg Config, vol BackupVolume) CopyMethod {
+	method := cfg.CopyMethods.Default
+	if classMethod, ok := cfg.CopyMethods.StorageClasses[vol.StorageClass]; ok && vol.StorageClass != "" {
+		method = classMethod
+	}
+	if vol.CopyMethod != "" && vol.CopyMethod != method.Method {
+		method = CopyMethod{Method: vol.CopyMethod}
+	}
+	if vol.VolumeSnapshotClassName != "" {
+		method.VolumeSnapshotClassName = vol.VolumeSnapshotClassName
+	}
+	if method.Method == "" {
+		method.Method = copyMethodSnapshot
+	}
+	if method.Method != copyMethodSnapshot {
+		method.VolumeSnapshotClassName = ""
+	}
+	return method
+}
+
+// filterCopyError reports a filtered volume whose copy method is Direct.
+// Filters are applied to a CSI clone of the PVC, which storage classes mapped
+// to Direct can't provide.
+func filterCopyError(cfg Config, vol BackupVolume) error {
+	if vol.VolumeFilter.empty() || copyMethodFor(cfg, vol).Method != copyMethodDirect {
+		return nil
+	}
+	return fmt.Errorf("PVC %s uses the Direct copy method, so its exclude and excludeIfPresent filters can't be applied", vol.PVC)
+}
+
+// setCopyMethod sets the copy method fields of a ReplicationSource restic spec.
+func setCopyMethod(resticSpec map[string]interface{}, method CopyMethod) {
+	resticSpec["copyMethod"] = method.Method
+	if method.VolumeSnapshotClassName != "" {
+		resticSpec["volumeSnapshotClassName"] = method.VolumeSnapshotClassName
+	}
+}
@@ -0,0 +1,57 @@
+package main
+
+import "testing"
+
+func TestCopyMethodFor(t *testing.T) {
+	var cfg Config
+	mustUnmarshal(t, `{"default": {"method": "Clone"}, "storageClasses": {
+		"ceph-block": {"method": "Snapshot", "volumeSnapshotClassName": "csi-rbdplugin-snapclass"},
+		"nfs-client": {"method": "Direct"}
+	}}`, &cfg.CopyMethods)
+
+	for _, tc := range []struct {
+		vol  BackupVolume
+		want CopyMethod
+	}{
+		{BackupVolume{StorageClass: "longhorn"}, CopyMethod{Method: "Clone"}},
+		{BackupVolume{StorageClass: "nfs-client"}, CopyMethod{Method: "Direct"}},
+		{BackupVolume{StorageClass: "ceph-block"}, CopyMethod{Method: "Snapshot", VolumeSnapshotClassName: "csi-rbdplugin-snapclass"}},
+		{BackupVolume{StorageClass: "ceph-block", CopyMethod: "Direct"}, CopyMethod{Method: "Direct"}},
+		{BackupVolume{StorageClass: "ceph-block", VolumeSnapshotClassName: "fast"}, CopyMethod{Method: "Snapshot", VolumeSnapshotClassName: "fast"}},
+		{BackupVolume{StorageClass: "nfs-client", CopyMethod: "Snapshot", VolumeSnapshotClassName: "nfs-snap"}, CopyMethod{Method: "Snapshot", VolumeSnapshotClassName: "nfs-snap"}},
+	} {
+		if got := copyMethodFor(cfg, tc.vol); got != tc.want {
+			t.Errorf("copyMethodFor(%+v) = %+v, want %+v", tc.vol, got, tc.want)
+		}
+	}
+
+	if got := copyMethodFor(Config{}, BackupVolume{}); got.Method != "Snapshot" {
+		t.Errorf("default copy method %q, want Snapshot", got.Method)
+	}
+	if err := (CopyMethodConfig{StorageClasses: map[string]CopyMethod{"nfs": {Method: "Rsync"}}}).validate(); err == nil {
+		t.Error("unknown copy method was accepted")
+	}
+}
+
+func TestFilterCopyError(t *testing.T) {
+	var cfg Config
+	mustUnmarshal(t, `{"storageClasses": {"nfs-client": {"method": "Direct"}}}`, &cfg.CopyMethods)
+	filter := VolumeFilter{Exclude: []string{"/cache"}}
+
+	if err := filterCopyError(cfg, BackupVolume{PVC: "data", StorageClass: "nfs-client", VolumeFilter: filter}); err == nil {
+		t.Error("filters on a Direct storage class were accepted")
+	}
+	if err := filterCopyError(cfg, BackupVolume{PVC: "data", StorageClass: "nfs-client"}); err != nil {
+		t.Errorf("unfiltered Direct volume: %v", err)
+	}
+	if err := filterCopyError(cfg, BackupVolume{PVC: "data", StorageClass: "longhorn", VolumeFilter: filter}); err != nil {
+		t.Errorf("filtered volume on a cloneable class: %v", err)
+	}
+
+	policy := testBackupPolicy("app", "data")
+	policy.Spec.Volumes[0].StorageClass = "nfs-client"
+	policy.Spec.Volumes[0].VolumeFilter = filter
+	if _, err := renderBackupPolicy(cfg, policy); err == nil {
+		t.Error("rendered a clone of a Direct volume")
+	}
+}
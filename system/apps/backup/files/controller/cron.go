@@ -0,0 +1,244 @@
+package main
+
+import (
+	"fmt"
+	"hash/fnv"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type cronSchedule struct {
+	minute   uint64
+	hour     uint64
+	dom      uint64
+	month    uint64
+	dow      uint64
+	domStar  bool
+	dowStar  bool
+	location *time.Location
+}
+
+type cronField struct {
+	name  string
+	min   int
+	max   int
+	names map[string]int
+}
+
+var cronFields = []cronField{
+	{name: "minute", min: 0, max: 59},
+	{name: "hour", min: 0, max: 23},
+	{name: "day-of-month", min: 1, max: 31},
+	{name: "month", min: 1, max: 12, names: map[string]int{
+		"jan": 1, "feb": 2, "mar": 3, "apr": 4, "may": 5, "jun": 6,
+		"jul": 7, "aug": 8, "sep": 9, "oct": 10, "nov": 11, "dec": 12,
+	}},
+	{name: "day-of-week", min: 0, max: 7, names: map[string]int{
+		"sun": 0, "mon": 1, "tue": 2, "wed": 3, "thu": 4, "fri": 5, "sat": 6,
+	}},
+}
+
+var cronMacros = map[string]string{
+	"@yearly":   "0 0 1 1 *",
+	"@annually": "0 0 1 1 *",
+	"@monthly":  "0 0 1 * *",
+	"@weekly":   "0 0 * * 0",
+	"@daily":    "0 0 * * *",
+	"@midnight": "0 0 * * *",
+	"@hourly":   "0 * * * *",
+}
+
+// hashedFieldMax is the highest value H picks for each field. Days of the
+// month stop at 28 so the schedule runs every month.
+var hashedFieldMax = []int{59, 23, 28, 12, 6}
+
+// expandHashedSchedule replaces H and H(a-b) fields of expr with a value
+// derived from seed, so policies sharing a schedule such as "H 2 * * *" are
+// spread over the hour but each keeps a stable time. Other fields and macros
+// are returned unchanged.
+func expandHashedSchedule(expr, seed string) (string, error) {
+	if !strings.Contains(expr, "H") {
+		return expr, nil
+	}
+	parts := strings.Fields(expr)
+	if len(parts) != len(cronFields) {
+		return "", fmt.Errorf("schedule %q must have %d fields, got %d", expr, len(cronFields), len(parts))
+	}
+	for i, part := range parts {
+		if !strings.HasPrefix(part, "H") {
+			continue
+		}
+		lo, hi := cronFields[i].min, hashedFieldMax[i]
+		if rangePart := strings.TrimPrefix(part, "H"); rangePart != "" {
+			if !strings.HasPrefix(rangePart, "(") || !strings.HasSuffix(rangePart, ")") {
+				return "", fmt.Errorf("schedule %q: invalid %s %q, use H or H(a-b)", expr, cronFields[i].name, part)
+			}
+			from, to, ok := strings.Cut(strings.Trim(rangePart, "()"), "-")
+			var errFrom, errTo error
+			lo, errFrom = strconv.Atoi(from)
+			hi, errTo = strconv.Atoi(to)
+			if !ok || errFrom != nil || errTo != nil || lo > hi || lo < cronFields[i].min || hi > cronFields[i].max {
+				return "", fmt.Errorf("schedule %q: invalid %s range %q", expr, cronFields[i].name, part)
+			}
+		}
+		hash := fnv.New32a()
+		fmt.Fprintf(hash, "%s/%d", seed, i)
+		parts[i] = strconv.Itoa(lo + int(hash.Sum32()%uint32(hi-lo+1)))
+	}
+	return strings.Join(parts, " "), nil
+}
+
+// parseCronSchedule parses a standard five-field cron expression, as accepted
+// by Kubernetes CronJobs, evaluated in the given time zone (UTC when empty).
+func parseCronSchedule(expr, timeZone string) (*cronSchedule, error) {
+	location := time.UTC
+	if timeZone != "" {
+		loc, err := time.LoadLocation(timeZone)
+		if err != nil {
+			return nil, fmt.Errorf("unknown time zone %q: %w", timeZone, err)
+		}
+		location = loc
+	}
+
+	spec := strings.TrimSpace(expr)
+	if macro, ok := cronMacros[strings.ToLower(spec)]; ok {
+		spec = macro
+	}
+	parts := strings.Fields(spec)
+	if len(parts) != len(cronFields) {
+		return nil, fmt.Errorf("schedule %q must have %d fields, got %d", expr, len(cronFields), len(parts))
+	}
+
+	bits := make([]uint64, len(cronFields))
+	for i, part := range parts {
+		value, err := parseCronField(part, cronFields[i])
+		if err != nil {
+			return nil, fmt.Errorf("schedule %q: %w", expr, err)
+		}
+		bits[i] = value
+	}
+
+	// Day-of-week accepts both 0 and 7 for Sunday.
+	if bits[4]&(1<<7) != 0 {
+		bits[4] |= 1
+	}
+
+	sched := &cronSchedule{
+		minute:   bits[0],
+		hour:     bits[1],
+		dom:      bits[2],
+		month:    bits[3],
+		dow:      bits[4],
+		domStar:  parts[2] == "*" || parts[2] == "?",
+		dowStar:  parts[4] == "*" || parts[4] == "?",
+		location: location,
+	}
+	// Days that don't exist in the selected months, such as 30 2, never match.
+	if sched.Next(time.Now()).IsZero() {
+		return nil, fmt.Errorf("schedule %q never runs", expr)
+	}
+	return sched, nil
+}
+
+func parseCronField(value string, field cronField) (uint64, error) {
+	var bits uint64
+	for _, item := range strings.Split(value, ",") {
+		if item == "" {
+			return 0, fmt.Errorf("empty %s entry", field.name)
+		}
+		rangePart, stepPart, hasStep := strings.Cut(item, "/")
+		step := 1
+		if hasStep {
+			parsed, err := strconv.Atoi(stepPart)
+			if err != nil || parsed <= 0 {
+				return 0, fmt.Errorf("invalid %s step %q", field.name, stepPart)
+			}
+			step = parsed
+		}
+
+		start, end := field.min, field.max
+		switch {
+		case rangePart == "*" || rangePart == "?":
+		case strings.Contains(rangePart, "-"):
+			lo, hi, _ := strings.Cut(rangePart, "-")
+			var err error
+			if start, err = parseCronValue(lo, field); err != nil {
+				return 0, err
+			}
+			if end, err = parseCronValue(hi, field); err != nil {
+				return 0, err
+			}
+			if start > end {
+				return 0, fmt.Errorf("invalid %s range %q", field.name, rangePart)
+			}
+		default:
+			parsed, err := parseCronValue(rangePart, field)
+			if err != nil {
+				return 0, err
+			}
+			start = parsed
+			if !hasStep {
+				end = parsed
+			}
+		}
+
+		for v := start; v <= end; v += step {
+			bits |= 1 << uint(v)
+		}
+	}
+	return bits, nil
+}
+
+func parseCronValue(value string, field cronField) (int, error) {
+	if field.names != nil {
+		if named, ok := field.names[strings.ToLower(value)]; ok {
+			return named, nil
+		}
+	}
+	parsed, err := strconv.Atoi(value)
+	if err != nil {
+		return 0, fmt.Errorf("invalid %s value %q", field.name, value)
+	}
+	if parsed < field.min || parsed > field.max {
+		return 0, fmt.Errorf("%s value %d out of range %d-%d", field.name, parsed, field.min, field.max)
+	}
+	return parsed, nil
+}
+
+// Next returns the first activation strictly after the given time, or the
+// zero time when there is none within five years.
+func (s *cronSchedule) Next(after time.Time) time.Time {
+	t := after.In(s.location).Truncate(time.Minute).Add(time.Minute)
+	limit := t.AddDate(5, 0, 0)
+
+	for t.Before(limit) {
+		if s.month&(1<<uint(t.Month())) == 0 {
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, s.location)
+			continue
+		}
+		if !s.dayMatches(t) {
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, s.location)
+			continue
+		}
+		if s.hour&(1<<uint(t.Hour())) == 0 {
+			t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, s.location)
+			continue
+		}
+		if s.minute&(1<<uint(t.Minute())) == 0 {
+			t = t.Add(time.Minute)
+			continue
+		}
+		return t
+	}
+	return time.Time{}
+}
+
+func (s *cronSchedule) dayMatches(t time.Time) bool {
+	domMatch := s.dom&(1<<uint(t.Day())) != 0
+	dowMatch := s.dow&(1<<uint(t.Weekday())) != 0
+	if s.domStar || s.dowStar {
+		return domMatch && dowMatch
+	}
+	return domMatch || dowMatch
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCronScheduleNext(t *testing.T) {
+	// 2024-05-01 is a Wednesday.
+	for _, tc := range []struct {
+		expr     string
+		timeZone string
+		after    string
+		want     string
+	}{
+		{"*/15 * * * *", "", "2024-05-01T10:07:00Z", "2024-05-01T10:15:00Z"},
+		{"0 9-17/4 * * *", "", "2024-05-01T10:00:00Z", "2024-05-01T13:00:00Z"},
+		{"0 2 * * *", "", "2024-05-01T02:00:00Z", "2024-05-02T02:00:00Z"},
+		{"30 2 * * 1-5", "", "2024-05-03T03:00:00Z", "2024-05-06T02:30:00Z"},
+		{"0 0 * * 7", "", "2024-05-01T00:00:00Z", "2024-05-05T00:00:00Z"},
+		{"0 0 * * sun", "", "2024-05-01T00:00:00Z", "2024-05-05T00:00:00Z"},
+		{"0 0 1 jan-mar,jul *", "", "2024-04-01T00:00:00Z", "2024-07-01T00:00:00Z"},
+		{"@monthly", "", "2024-05-15T00:00:00Z", "2024-06-01T00:00:00Z"},
+		// With both restricted, day-of-month and day-of-week match either.
+		{"0 0 13 * 5", "", "2024-05-01T00:00:00Z", "2024-05-03T00:00:00Z"},
+		{"0 0 13 * 5", "", "2024-05-11T00:00:00Z", "2024-05-13T00:00:00Z"},
+		// With one of them *, only the other restricts the day.
+		{"0 0 13 * *", "", "2024-05-01T00:00:00Z", "2024-05-13T00:00:00Z"},
+		{"0 0 29 2 *", "", "2024-03-01T00:00:00Z", "2028-02-29T00:00:00Z"},
+		{"0 2 * * *", "Europe/Amsterdam", "2024-05-01T00:00:00Z", "2024-05-02T00:00:00Z"},
+	} {
+		sched, err := parseCronSchedule(tc.expr, tc.timeZone)
+		if err != nil {
+			t.Errorf("parseCronSchedule(%q): %v", tc.expr, err)
+			continue
+		}
+		after, _ := time.Parse(time.RFC3339, tc.after)
+		if got := sched.Next(after).UTC().Format(time.RFC3339); got != tc.want {
+			t.Errorf("%q after %s = %s, want %s", tc.expr, tc.after, got, tc.want)
+		}
+	}
+}
+
+func TestParseCronScheduleErrors(t *testing.T) {
+	for _, tc := range []struct {
+		expr     string
+		timeZone string
+	}{
+		{"0 0 30 2 *", ""},
+		{"0 0 31 4,6,9,11 *", ""},
+		{"60 * * * *", ""},
+		{"0 0 * *", ""},
+		{"5-1 * * * *", ""},
+		{"*/0 * * * *", ""},
+		{"0 0 * * fri-", ""},
+		{"0 2 * * *", "Mars/Olympus"},
+	} {
+		if _, err := parseCronSchedule(tc.expr, tc.timeZone); err == nil {
+			t.Errorf("parseCronSchedule(%q, %q) succeeded", tc.expr, tc.timeZone)
+		}
+	}
+	if err := validateSchedule("0 0 30 2 *", ""); err == nil {
+		t.Error("validateSchedule accepted a schedule that never runs")
+	}
+}
@@ -0,0 +1,270 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"sort"
+	"strings"
+)
+
+const (
+	// discoveryAnnotation on a PVC or namespace selects the tier a PVC is
+	// backed up with. The PVC's annotation wins over its namespace's.
+	discoveryAnnotation = "backup.homelab/policy"
+	// discoveryExcluded as the annotation value opts a PVC out.
+	discoveryExcluded = "none"
+	managedLabel      = "backup.homelab/managed-by"
+	tierLabel         = "backup.homelab/tier"
+)
+
+// BackupTier is a template for generated BackupPolicies, set from
+// backupController.tiers in the chart values or a ClusterBackupPolicy's
+// defaults.
+type BackupTier struct {
+	Schedule      string                `json:"schedule"`
+	TimeZone      string                `json:"timeZone,omitempty"`
+	Retention     *RetentionSpec        `json:"retention,omitempty"`
+	Offsite       *bool                 `json:"offsite,omitempty"`
+	MaxAge        string                `json:"maxAge,omitempty"`
+	Notifications *NotificationOverride `json:"notifications,omitempty"`
+	Mover         *MoverSpec            `json:"mover,omitempty"`
+}
+
+type namespaceList struct {
+	Items []struct {
+		Metadata struct {
+			Name        string            `json:"name"`
+			Labels      map[string]string `json:"labels"`
+			Annotations map[string]string `json:"annotations"`
+		} `json:"metadata"`
+	} `json:"items"`
+}
+
+// ignoredPVC reports whether a PVC is created by VolSync or a restore test and
+// is never backed up itself.
+func ignoredPVC(name string, labels map[string]string) bool {
+	return labels["app.kubernetes.io/created-by"] == "volsync" || labels[cloneOfLabel] != "" || strings.HasPrefix(name, "restore-test-")
+}
+
+// discoveryTier returns the tier a PVC is annotated with, directly or through
+// its namespace, and whether it is explicitly excluded.
+func discoveryTier(namespaceAnnotations, pvcAnnotations map[string]string) (string, bool) {
+	tier, ok := pvcAnnotations[discoveryAnnotation]
+	if !ok {
+		tier = namespaceAnnotations[discoveryAnnotation]
+	}
+	tier = strings.TrimSpace(tier)
+	if tier == discoveryExcluded {
+		return "", true
+	}
+	return tier, false
+}
+
+func managedPolicyName(tier string) string {
+	return sanitizeName("auto-" + tier)
+}
+
+// managedPolicy reports whether the controller generated policy, from
+// discovery or a ClusterBackupPolicy.
+func managedPolicy(policy BackupPolicy) bool {
+	return policy.Metadata.Labels[managedLabel] == fieldManager
+}
+
+func discoveredPolicy(policy BackupPolicy) bool {
+	return managedPolicy(policy) && policy.Metadata.Labels[tierLabel] != ""
+}
+
+// policyOwners maps namespace/pvc to the policy backing it up, leaving out
+// policies skip matches. Volume selectors are matched against pvcs.
+func policyOwners(policies []BackupPolicy, pvcs pvcList, skip func(BackupPolicy) bool) map[string]string {
+	owners := map[string]string{}
+	for _, policy := range policies {
+		if skip(policy) {
+			continue
+		}
+		volumes, _ := policyVolumes(policy, pvcs)
+		for _, vol := range volumes {
+			owners[policy.Metadata.Namespace+"/"+vol.PVC] = policy.Metadata.Name
+		}
+	}
+	return owners
+}
+
+// handWritten returns the namespace/name of policies the controller did not
+// generate, which generated policies must not replace.
+func handWritten(policies []BackupPolicy) map[string]bool {
+	names := map[string]bool{}
+	for _, policy := range policies {
+		if !managedPolicy(policy) {
+			names[policy.Metadata.Namespace+"/"+policy.Metadata.Name] = true
+		}
+	}
+	return names
+}
+
+// discoveryPlan is the managed BackupPolicies discovery wants to exist and the
+// existing ones it no longer needs.
+type discoveryPlan struct {
+	Apply  []map[string]interface{}
+	Delete []BackupPolicy
+}
+
+// planDiscovery groups annotated PVCs by namespace and tier into managed
+// BackupPolicies. PVCs already listed in another policy are left to that
+// policy, and PVCs that cannot be backed up are reported in skipped.
+func planDiscovery(tiers map[string]BackupTier, namespaces namespaceList, pvcs pvcList, policies []BackupPolicy) (discoveryPlan, []string) {
+	nsAnnotations := map[string]map[string]string{}
+	for _, ns := range namespaces.Items {
+		nsAnnotations[ns.Metadata.Name] = ns.Metadata.Annotations
+	}
+	covered := policyOwners(policies, pvcs, discoveredPolicy)
+	reserved := handWritten(policies)
+
+	type policyKey struct{ ns, tier string }
+	volumes := map[policyKey][]string{}
+	var skipped []string
+	for _, pvc := range pvcs.Items {
+		meta := pvc.Metadata
+		if _, ok := covered[meta.Namespace+"/"+meta.Name]; ok || ignoredPVC(meta.Name, meta.Labels) {
+			continue
+		}
+		tier, excluded := discoveryTier(nsAnnotations[meta.Namespace], meta.Annotations)
+		if excluded || tier == "" {
+			continue
+		}
+		if _, ok := tiers[tier]; !ok {
+			skipped = append(skipped, fmt.Sprintf("%s/%s (no tier %q in backupController.tiers)", meta.Namespace, meta.Name, tier))
+			continue
+		}
+		key := policyKey{meta.Namespace, tier}
+		volumes[key] = append(volumes[key], meta.Name)
+	}
+
+	var plan discoveryPlan
+	wanted := map[string]bool{}
+	keys := make([]policyKey, 0, len(volumes))
+	for key := range volumes {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].ns != keys[j].ns {
+			return keys[i].ns < keys[j].ns
+		}
+		return keys[i].tier < keys[j].tier
+	})
+	for _, key := range keys {
+		name := managedPolicyName(key.tier)
+		if reserved[key.ns+"/"+name] {
+			skipped = append(skipped, fmt.Sprintf("%s/%s (a hand-written BackupPolicy has that name)", key.ns, name))
+			continue
+		}
+		wanted[key.ns+"/"+name] = true
+		labels := map[string]interface{}{managedLabel: fieldManager, tierLabel: key.tier}
+		plan.Apply = append(plan.Apply, generatedPolicyObject(key.ns, name, labels, tiers[key.tier], volumes[key]))
+	}
+	for _, policy := range policies {
+		if discoveredPolicy(policy) && !wanted[policy.Metadata.Namespace+"/"+policy.Metadata.Name] {
+			plan.Delete = append(plan.Delete, policy)
+		}
+	}
+	sort.Strings(skipped)
+	return plan, skipped
+}
+
+// generatedPolicyObject returns a BackupPolicy backing up pvcs with the
+// settings of tier.
+func generatedPolicyObject(ns, name string, labels map[string]interface{}, tier BackupTier, pvcs []string) map[string]interface{} {
+	sort.Strings(pvcs)
+	volumes := make([]map[string]interface{}, 0, len(pvcs))
+	for _, pvc := range pvcs {
+		volumes = append(volumes, map[string]interface{}{"pvc": pvc})
+	}
+	spec := map[string]interface{}{
+		"schedule": tier.Schedule,
+		"volumes":  volumes,
+	}
+	if tier.TimeZone != "" {
+		spec["timeZone"] = tier.TimeZone
+	}
+	if tier.Retention != nil {
+		spec["retention"] = tier.Retention
+	}
+	if tier.Offsite != nil {
+		spec["offsite"] = *tier.Offsite
+	}
+	if tier.MaxAge != "" {
+		spec["maxAge"] = tier.MaxAge
+	}
+	if tier.Notifications != nil {
+		spec["notifications"] = tier.Notifications
+	}
+	if tier.Mover != nil {
+		spec["mover"] = tier.Mover
+	}
+	return map[string]interface{}{
+		"apiVersion": fmt.Sprintf("%s/%s", backupPolicyGroup, backupPolicyVersion),
+		"kind":       "BackupPolicy",
+		"metadata": map[string]interface{}{
+			"name":      name,
+			"namespace": ns,
+			"labels":    labels,
+		},
+		"spec": spec,
+	}
+}
+
+// DiscoveryHandler creates, updates and deletes the managed BackupPolicies of
+// annotated PVCs. It does nothing when no tiers are configured.
+type DiscoveryHandler struct{}
+
+func (h *DiscoveryHandler) Reconcile(ctx context.Context, client *kubeClient, cfg Config) error {
+	if err := discoverPolicies(ctx, client, cfg); err != nil {
+		slog.Error("discovery failed", logError, err)
+		return err
+	}
+	return nil
+}
+
+func discoverPolicies(ctx context.Context, client *kubeClient, cfg Config) error {
+	if len(cfg.BackupTiers) == 0 {
+		return nil
+	}
+	var namespaces namespaceList
+	if err := getJSON(ctx, client, "/api/v1/namespaces", &namespaces); err != nil {
+		return err
+	}
+	var pvcs pvcList
+	if err := getJSON(ctx, client, "/api/v1/persistentvolumeclaims", &pvcs); err != nil {
+		return err
+	}
+	var policies BackupPolicyList
+	if err := getJSON(ctx, client, fmt.Sprintf("/apis/%s/%s/backuppolicies", backupPolicyGroup, backupPolicyVersion), &policies); err != nil {
+		return err
+	}
+
+	plan, skipped := planDiscovery(cfg.BackupTiers, namespaces, pvcs, policies.Items)
+	for _, pvc := range skipped {
+		slog.Info("discovery skipped volume", logVolume, pvc)
+	}
+	return applyPlan(ctx, client, "discovery", plan)
+}
+
+// applyPlan applies and deletes the generated BackupPolicies of plan.
+func applyPlan(ctx context.Context, client *kubeClient, source string, plan discoveryPlan) error {
+	base := fmt.Sprintf("/apis/%s/%s", backupPolicyGroup, backupPolicyVersion)
+	for _, obj := range plan.Apply {
+		metadata := obj["metadata"].(map[string]interface{})
+		ns, name := metadata["namespace"].(string), metadata["name"].(string)
+		if err := client.apply(ctx, namespacedPath(base, ns, "backuppolicies", name), obj, nil); err != nil {
+			return err
+		}
+	}
+	for _, policy := range plan.Delete {
+		policyLog(policy.Metadata.Namespace, policy.Metadata.Name).Info("deleting generated policy, no PVCs left", "source", source)
+		if err := client.delete(ctx, namespacedPath(base, policy.Metadata.Namespace, "backuppolicies", policy.Metadata.Name)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func mustUnmarshal(t *testing.T, data string, out interface{}) {
+	t.Helper()
+	if err := json.Unmarshal([]byte(data), out); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestPlanDiscovery(t *testing.T) {
+	tiers := map[string]BackupTier{
+		"daily":  {Schedule: "0 2 * * *", MaxAge: "26h"},
+		"hourly": {Schedule: "0 * * * *"},
+	}
+	var namespaces namespaceList
+	mustUnmarshal(t, `{"items": [
+		{"metadata": {"name": "media", "annotations": {"backup.homelab/policy": "daily"}}},
+		{"metadata": {"name": "tools"}}
+	]}`, &namespaces)
+	var pvcs pvcList
+	mustUnmarshal(t, `{"items": [
+		{"metadata": {"name": "photos", "namespace": "media"}},
+		{"metadata": {"name": "cache", "namespace": "media", "annotations": {"backup.homelab/policy": "none"}}},
+		{"metadata": {"name": "db", "namespace": "media", "annotations": {"backup.homelab/policy": "hourly"}}},
+		{"metadata": {"name": "library", "namespace": "media"}},
+		{"metadata": {"name": "restore-test-photos", "namespace": "media"}},
+		{"metadata": {"name": "notes", "namespace": "tools"}},
+		{"metadata": {"name": "wiki", "namespace": "tools", "annotations": {"backup.homelab/policy": "weekly"}}}
+	]}`, &pvcs)
+	var policies BackupPolicyList
+	mustUnmarshal(t, `{"items": [
+		{"metadata": {"name": "library", "namespace": "media"}, "spec": {"volumes": [{"pvc": "library"}]}},
+		{"metadata": {"name": "auto-daily", "namespace": "tools", "labels": {"backup.homelab/managed-by": "backup-controller", "backup.homelab/tier": "daily"}}}
+	]}`, &policies)
+
+	plan, unknown := planDiscovery(tiers, namespaces, pvcs, policies.Items)
+
+	var applied []string
+	for _, obj := range plan.Apply {
+		metadata := obj["metadata"].(map[string]interface{})
+		spec := obj["spec"].(map[string]interface{})
+		var volumes []string
+		for _, vol := range spec["volumes"].([]map[string]interface{}) {
+			volumes = append(volumes, vol["pvc"].(string))
+		}
+		applied = append(applied, metadata["namespace"].(string)+"/"+metadata["name"].(string)+" "+spec["schedule"].(string)+" "+volumes[0])
+	}
+	want := []string{"media/auto-daily 0 2 * * * photos", "media/auto-hourly 0 * * * * db"}
+	if !reflect.DeepEqual(applied, want) {
+		t.Errorf("applied %v, want %v", applied, want)
+	}
+	if len(plan.Delete) != 1 || plan.Delete[0].Metadata.Namespace != "tools" {
+		t.Errorf("delete %v, want tools/auto-daily", plan.Delete)
+	}
+	if want := []string{`tools/wiki (no tier "weekly" in backupController.tiers)`}; !reflect.DeepEqual(unknown, want) {
+		t.Errorf("unknown %v, want %v", unknown, want)
+	}
+}
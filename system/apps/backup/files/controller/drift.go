@@ -0,0 +1,222 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// correctDrift compares the live objects of an already reconciled policy with
+// their rendering and re-applies the ones that drifted. Matching objects are
+// not written, and the live spec.trigger.manual of ReplicationSources is kept,
+// so running it every interval does not start backups. It returns the number
+// of corrected objects.
+func correctDrift(ctx context.Context, client *kubeClient, cfg Config, policy BackupPolicy) (int, error) {
+	if policy.APIVersion == "" {
+		policy.APIVersion = fmt.Sprintf("%s/%s", backupPolicyGroup, backupPolicyVersion)
+	}
+	if policy.Kind == "" {
+		policy.Kind = "BackupPolicy"
+	}
+	objects, err := renderBackupPolicy(cfg, policy)
+	if err != nil {
+		return 0, err
+	}
+
+	corrected := 0
+	for _, rendered := range objects {
+		changes, err := objectDrift(ctx, client, rendered)
+		if err != nil {
+			return corrected, err
+		}
+		if len(changes) == 0 {
+			continue
+		}
+		if err := applyRendered(ctx, client, []renderedObject{rendered}, &policy); err != nil {
+			return corrected, err
+		}
+		corrected++
+		message := fmt.Sprintf("Restored %s: %s", objectRef(rendered.Object), strings.Join(changes, ", "))
+		policyLog(policy.Metadata.Namespace, policy.Metadata.Name).Info("drift corrected", "message", message)
+		if err := recordEvent(ctx, client, policy, "Normal", "DriftCorrected", message); err != nil {
+			policyLog(policy.Metadata.Namespace, policy.Metadata.Name).Error("drift event failed", logError, err)
+		}
+	}
+
+	if corrected > 0 {
+		total := policy.Status.DriftCorrected + int64(corrected)
+		if err := patchBackupPolicyStatus(ctx, client, policy.Metadata.Namespace, policy.Metadata.Name, map[string]interface{}{
+			"driftCorrected": total,
+		}); err != nil {
+			return corrected, err
+		}
+	}
+	return corrected, nil
+}
+
+// driftCheckFailedReason marks a Ready condition set by a failed drift check,
+// which the next successful check clears again.
+const driftCheckFailedReason = "DriftCheckFailed"
+
+// recordDriftCheck reflects the outcome of correctDrift in the policy's Ready
+// condition.
+func recordDriftCheck(ctx context.Context, client *kubeClient, policy BackupPolicy, driftErr error) error {
+	condition := driftReadyCondition(policy.Status.Conditions, driftErr)
+	if condition == nil {
+		return nil
+	}
+	return patchBackupPolicyStatus(ctx, client, policy.Metadata.Namespace, policy.Metadata.Name, map[string]interface{}{
+		"conditions": setCondition(policy.Status.Conditions, *condition, time.Now()),
+	})
+}
+
+// driftReadyCondition returns the Ready condition after a drift check, or nil
+// when it does not change. A failure marks the policy not ready; a success
+// only restores Ready when a failed drift check had cleared it.
+func driftReadyCondition(conditions []Condition, driftErr error) *Condition {
+	existing := findCondition(conditions, "Ready")
+	if driftErr != nil {
+		condition := Condition{Type: "Ready", Status: "False", Reason: driftCheckFailedReason, Message: driftErr.Error()}
+		if existing != nil && existing.Status == condition.Status && existing.Reason == condition.Reason && existing.Message == condition.Message {
+			return nil
+		}
+		return &condition
+	}
+	if existing == nil || existing.Reason != driftCheckFailedReason {
+		return nil
+	}
+	return &Condition{Type: "Ready", Status: "True", Reason: "Reconciled", Message: "Reconcile successful"}
+}
+
+// objectDrift returns the fields of the rendered object whose live value
+// differs, or "missing" when the object does not exist. Create-only objects
+// only drift by going missing.
+func objectDrift(ctx context.Context, client *kubeClient, rendered renderedObject) ([]string, error) {
+	itemPath, _, err := objectPaths(rendered.Object)
+	if err != nil {
+		return nil, err
+	}
+	body, status, err := client.doRequest(ctx, "GET", itemPath, nil)
+	if err != nil {
+		return nil, err
+	}
+	if status == http.StatusNotFound {
+		return []string{"missing"}, nil
+	}
+	if status != http.StatusOK {
+		return nil, fmt.Errorf("get failed: %s status=%d", itemPath, status)
+	}
+	if rendered.CreateOnly {
+		return nil, nil
+	}
+
+	var live map[string]interface{}
+	if err := json.Unmarshal(body, &live); err != nil {
+		return nil, err
+	}
+	desired := normalizeObject(rendered.Object)
+	if rendered.KeepTrigger {
+		copyLiveTrigger(live, desired)
+	}
+	return driftPaths(pruneToShape(live, desired), desired, ""), nil
+}
+
+// driftPaths lists the dotted paths where live differs from desired. Lists of
+// different lengths are reported as a whole.
+func driftPaths(live, desired interface{}, path string) []string {
+	switch d := desired.(type) {
+	case map[string]interface{}:
+		l, ok := live.(map[string]interface{})
+		if !ok {
+			return []string{displayPath(path)}
+		}
+		keys := make([]string, 0, len(d))
+		for key := range d {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		var paths []string
+		for _, key := range keys {
+			paths = append(paths, driftPaths(l[key], d[key], path+"."+key)...)
+		}
+		return paths
+	case []interface{}:
+		l, ok := live.([]interface{})
+		if !ok || len(l) != len(d) {
+			return []string{displayPath(path)}
+		}
+		var paths []string
+		for i := range d {
+			paths = append(paths, driftPaths(l[i], d[i], path+"["+strconv.Itoa(i)+"]")...)
+		}
+		return paths
+	}
+	if !reflect.DeepEqual(live, desired) {
+		return []string{displayPath(path)}
+	}
+	return nil
+}
+
+func displayPath(path string) string {
+	if path == "" {
+		return "."
+	}
+	return strings.TrimPrefix(path, ".")
+}
+
+// recordEvent creates an Event on the policy, shown by kubectl describe.
+func recordEvent(ctx context.Context, client *kubeClient, policy BackupPolicy, eventType, reason, message string) error {
+	now := time.Now().UTC().Format(time.RFC3339)
+	event := map[string]interface{}{
+		"apiVersion": "v1",
+		"kind":       "Event",
+		"metadata": map[string]interface{}{
+			"name":      fmt.Sprintf("%s.%x", policy.Metadata.Name, time.Now().UnixNano()),
+			"namespace": policy.Metadata.Namespace,
+		},
+		"involvedObject": map[string]interface{}{
+			"apiVersion": policy.APIVersion,
+			"kind":       policy.Kind,
+			"name":       policy.Metadata.Name,
+			"namespace":  policy.Metadata.Namespace,
+			"uid":        policy.Metadata.UID,
+		},
+		"type":           eventType,
+		"reason":         reason,
+		"message":        message,
+		"firstTimestamp": now,
+		"lastTimestamp":  now,
+		"count":          1,
+		"source":         map[string]interface{}{"component": fieldManager},
+	}
+	collectionPath := namespacedPath("/api/v1", policy.Metadata.Namespace, "events")
+	_, status, err := client.doRequest(ctx, "POST", collectionPath, event)
+	if err != nil {
+		return err
+	}
+	if status < 200 || status >= 300 {
+		return fmt.Errorf("create failed: %s status=%d", collectionPath, status)
+	}
+	return nil
+}
+
+// startResyncLoop runs a full reconcile every interval. Policies whose spec
+// changed are reconciled, the others are checked for drift.
+func startResyncLoop(ctx context.Context, client *kubeClient, cfg Config) {
+	ticker := time.NewTicker(cfg.ReconcileInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		reconcile(ctx, client, cfg)
+	}
+}
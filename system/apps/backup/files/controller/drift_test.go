@@ -0,0 +1,68 @@
+package main
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestDriftPaths(t *testing.T) {
+	var desired, live map[string]interface{}
+	mustUnmarshal(t, `{"metadata": {"name": "backup-app-data", "labels": {"app": "web"}},
+		"spec": {"sourcePVC": "data", "restic": {"pruneIntervalDays": 7, "retain": {"daily": 7}},
+			"trigger": {"schedule": "0 2 * * *"}, "mounts": [{"path": "/a"}, {"path": "/b"}]}}`, &desired)
+	mustUnmarshal(t, `{"metadata": {"name": "backup-app-data", "uid": "1234", "resourceVersion": "9",
+			"labels": {"app": "web", "extra": "kept"}},
+		"spec": {"sourcePVC": "data", "restic": {"pruneIntervalDays": 7, "retain": {"daily": 3}, "cacheCapacity": "1Gi"},
+			"trigger": {"schedule": "0 2 * * *", "manual": "abc"}, "mounts": [{"path": "/a"}, {"path": "/c", "readOnly": true}]},
+		"status": {"lastSyncTime": "2024-05-01T00:00:00Z"}}`, &live)
+
+	if got := driftPaths(pruneToShape(desired, desired), desired, ""); got != nil {
+		t.Errorf("desired drifts from itself: %v", got)
+	}
+	want := []string{"spec.mounts[1].path", "spec.restic.retain.daily"}
+	if got := driftPaths(pruneToShape(live, desired), desired, ""); !reflect.DeepEqual(got, want) {
+		t.Errorf("drift %v, want %v", got, want)
+	}
+
+	live["spec"].(map[string]interface{})["mounts"] = []interface{}{map[string]interface{}{"path": "/a"}}
+	delete(live["metadata"].(map[string]interface{}), "labels")
+	want = []string{"metadata.labels", "spec.mounts", "spec.restic.retain.daily"}
+	if got := driftPaths(pruneToShape(live, desired), desired, ""); !reflect.DeepEqual(got, want) {
+		t.Errorf("drift %v, want %v", got, want)
+	}
+	if got := driftPaths("x", "y", ""); !reflect.DeepEqual(got, []string{"."}) {
+		t.Errorf("scalar drift %v", got)
+	}
+}
+
+func TestPruneToShape(t *testing.T) {
+	var desired, live, want map[string]interface{}
+	mustUnmarshal(t, `{"spec": {"a": 1, "list": [{"x": 1}], "other": [1, 2]}}`, &desired)
+	mustUnmarshal(t, `{"kind": "X", "spec": {"a": 2, "b": 3, "list": [{"x": 1, "y": 2}], "other": [1]}}`, &live)
+	mustUnmarshal(t, `{"spec": {"a": 2, "list": [{"x": 1}], "other": [1]}}`, &want)
+	if got := pruneToShape(live, desired); !reflect.DeepEqual(got, want) {
+		t.Errorf("pruned %v, want %v", got, want)
+	}
+}
+
+func TestDriftReadyCondition(t *testing.T) {
+	ready := []Condition{{Type: "Ready", Status: "True", Reason: "Reconciled"}}
+	if got := driftReadyCondition(ready, nil); got != nil {
+		t.Errorf("successful check changed Ready: %+v", got)
+	}
+	failed := driftReadyCondition(ready, errors.New("get failed"))
+	if failed == nil || failed.Status != "False" || failed.Reason != driftCheckFailedReason || failed.Message != "get failed" {
+		t.Fatalf("failed check set %+v", failed)
+	}
+	marked := []Condition{*failed}
+	if got := driftReadyCondition(marked, errors.New("get failed")); got != nil {
+		t.Errorf("repeated failure patched Ready again: %+v", got)
+	}
+	if got := driftReadyCondition(marked, nil); got == nil || got.Status != "True" || got.Reason != "Reconciled" {
+		t.Errorf("recovery set %+v", got)
+	}
+	if got := driftReadyCondition([]Condition{{Type: "Ready", Status: "False", Reason: "ReconcileError"}}, nil); got != nil {
+		t.Errorf("successful check cleared a reconcile error: %+v", got)
+	}
+}
@@ -0,0 +1,666 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"path"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Built-in export kinds.
+const (
+	exportPostgres = "postgres"
+	exportMySQL    = "mysql"
+	exportSQLite   = "sqlite"
+	exportRedis    = "redis"
+)
+
+// Exports that run a Job the policy describes.
+const (
+	exportTemplate = "template"
+	exportJobRef   = "jobRef"
+)
+
+// exportLogLines and exportLogBytes bound the export log kept in the status.
+const (
+	exportLogLines = 20
+	exportLogBytes = 2048
+)
+
+// exportDumpDir is where export Jobs mount the dump volume.
+const exportDumpDir = "/dump"
+
+// defaultExportImages are the images of the built-in export kinds, overridden
+// by backupController.export.images in the chart values.
+var defaultExportImages = map[string]string{
+	exportPostgres: "postgres:16-alpine",
+	exportMySQL:    "mysql:8.4",
+	exportSQLite:   "keinos/sqlite3:3.46.1",
+	exportRedis:    "redis:7-alpine",
+}
+
+// ExportSpec runs an export before the volumes are synced: an existing
+// CronJob named by JobRef, a Job from the pod Template, or one of the
+// built-in database dumps, which write to Volume.
+type ExportSpec struct {
+	JobRef   *ExportJobRef          `json:"jobRef,omitempty"`
+	Template map[string]interface{} `json:"template,omitempty"`
+	Postgres *DatabaseExport        `json:"postgres,omitempty"`
+	MySQL    *DatabaseExport        `json:"mysql,omitempty"`
+	SQLite   *SQLiteExport          `json:"sqlite,omitempty"`
+	Redis    *DatabaseExport        `json:"redis,omitempty"`
+	Volume   *ExportVolume          `json:"volume,omitempty"`
+	// Image overrides the image of the built-in export kind.
+	Image string `json:"image,omitempty"`
+	// ArtifactVolume is where a jobRef or template export writes. It is
+	// backed up with the policy's volumes, and KeepLast rotates its files
+	// that match the volume's Pattern.
+	ArtifactVolume *ArtifactVolume `json:"artifactVolume,omitempty"`
+	KeepLast       int64           `json:"keepLast,omitempty"`
+}
+
+type ExportJobRef struct {
+	Name string `json:"name"`
+}
+
+// DatabaseExport dumps a database served by a Service in the policy's
+// namespace. An empty Database dumps all databases.
+type DatabaseExport struct {
+	Service   string           `json:"service"`
+	Port      int64            `json:"port,omitempty"`
+	Database  string           `json:"database,omitempty"`
+	SecretRef *ExportSecretRef `json:"secretRef,omitempty"`
+}
+
+// ExportSecretRef names the Secret holding the database credentials.
+type ExportSecretRef struct {
+	Name        string `json:"name"`
+	UsernameKey string `json:"usernameKey,omitempty"`
+	PasswordKey string `json:"passwordKey,omitempty"`
+}
+
+// SQLiteExport copies the database at Path on PVC with the online backup API.
+type SQLiteExport struct {
+	PVC  string `json:"pvc"`
+	Path string `json:"path"`
+}
+
+// ExportVolume is the PVC dumps are written to. It is backed up with the
+// policy's volumes. The controller creates it when Size is set.
+type ExportVolume struct {
+	PVC              string `json:"pvc"`
+	Size             string `json:"size,omitempty"`
+	StorageClassName string `json:"storageClassName,omitempty"`
+}
+
+// ArtifactVolume is a directory on a PVC that exports write artifacts to.
+// Pattern is a shell glob matching the names of the artifacts.
+type ArtifactVolume struct {
+	PVC     string `json:"pvc"`
+	Path    string `json:"path,omitempty"`
+	Pattern string `json:"pattern,omitempty"`
+}
+
+type ExportStatus struct {
+	Kind            string `json:"kind,omitempty"`
+	Job             string `json:"job,omitempty"`
+	Result          string `json:"result,omitempty"`
+	Finished        string `json:"finished,omitempty"`
+	DurationSeconds int64  `json:"durationSeconds,omitempty"`
+	SizeBytes       int64  `json:"sizeBytes,omitempty"`
+	File            string `json:"file,omitempty"`
+	Message         string `json:"message,omitempty"`
+	// Reason is why the export container exited, for failed runs.
+	Reason string `json:"reason,omitempty"`
+	// Log is the end of the export container log.
+	Log string `json:"log,omitempty"`
+}
+
+// kind returns the export kind of the spec, or "" when it has none.
+func (e *ExportSpec) kind() string {
+	switch {
+	case e == nil:
+		return ""
+	case e.JobRef != nil:
+		return exportJobRef
+	case e.Template != nil:
+		return exportTemplate
+	case e.Postgres != nil:
+		return exportPostgres
+	case e.MySQL != nil:
+		return exportMySQL
+	case e.SQLite != nil:
+		return exportSQLite
+	case e.Redis != nil:
+		return exportRedis
+	}
+	return ""
+}
+
+// builtIn reports whether the spec is one of the database dumps.
+func (e *ExportSpec) builtIn() bool {
+	kind := e.kind()
+	return kind != "" && kind != exportJobRef && kind != exportTemplate
+}
+
+// kinds lists every export the spec sets, for validation.
+func (e *ExportSpec) kinds() []string {
+	var kinds []string
+	for kind, set := range map[string]bool{
+		exportJobRef:   e.JobRef != nil,
+		exportTemplate: e.Template != nil,
+		exportPostgres: e.Postgres != nil,
+		exportMySQL:    e.MySQL != nil,
+		exportSQLite:   e.SQLite != nil,
+		exportRedis:    e.Redis != nil,
+	} {
+		if set {
+			kinds = append(kinds, kind)
+		}
+	}
+	sort.Strings(kinds)
+	return kinds
+}
+
+// exportCronJobName is the suspended CronJob of a template or built-in
+// export.
+func exportCronJobName(policyName string) string {
+	return sanitizeName(fmt.Sprintf("backup-%s-export", policyName))
+}
+
+// exportJobName is the CronJob the backup runner creates the export Job from,
+// or "" when the policy has no export.
+func exportJobName(policy BackupPolicy) string {
+	switch export := policy.Spec.Export; export.kind() {
+	case "":
+		return ""
+	case exportJobRef:
+		return export.JobRef.Name
+	default:
+		return exportCronJobName(policy.Metadata.Name)
+	}
+}
+
+// exportVolumePVC is the volume the export writes to: the dump volume of a
+// built-in export or the artifact volume of the others, or "".
+func exportVolumePVC(policy BackupPolicy) string {
+	export := policy.Spec.Export
+	switch {
+	case export.builtIn() && export.Volume != nil:
+		return export.Volume.PVC
+	case export.kind() != "" && !export.builtIn() && export.ArtifactVolume != nil:
+		return export.ArtifactVolume.PVC
+	}
+	return ""
+}
+
+func exportImage(cfg Config, export *ExportSpec) string {
+	if export.Image != "" {
+		return export.Image
+	}
+	if image := cfg.ExportImages[export.kind()]; image != "" {
+		return image
+	}
+	return defaultExportImages[export.kind()]
+}
+
+func mustExportImages(value string) map[string]string {
+	images := map[string]string{}
+	if err := json.Unmarshal([]byte(value), &images); err != nil {
+		panic(fmt.Errorf("EXPORT_IMAGES: %w", err))
+	}
+	for kind := range images {
+		if _, ok := defaultExportImages[kind]; !ok {
+			panic(fmt.Errorf("EXPORT_IMAGES: unknown export kind %q", kind))
+		}
+	}
+	return images
+}
+
+// exportObjects renders the suspended CronJob of a template or built-in
+// export and, when a size is set, the dump volume of a built-in export.
+func exportObjects(cfg Config, policy BackupPolicy) []renderedObject {
+	export := policy.Spec.Export
+	switch kind := export.kind(); {
+	case kind == exportTemplate:
+		return []renderedObject{{Object: exportCronJob(policy, kind, templatePod(export.Template)), Owned: true}}
+	case !export.builtIn() || export.Volume == nil || export.Volume.PVC == "":
+		return nil
+	}
+	kind := export.kind()
+	ns := policy.Metadata.Namespace
+
+	var objects []renderedObject
+	if export.Volume.Size != "" {
+		pvcSpec := map[string]interface{}{
+			"accessModes": []string{"ReadWriteOnce"},
+			"resources": map[string]interface{}{
+				"requests": map[string]interface{}{
+					"storage": export.Volume.Size,
+				},
+			},
+		}
+		if export.Volume.StorageClassName != "" {
+			pvcSpec["storageClassName"] = export.Volume.StorageClassName
+		}
+		objects = append(objects, renderedObject{Object: map[string]interface{}{
+			"apiVersion": "v1",
+			"kind":       "PersistentVolumeClaim",
+			"metadata": map[string]interface{}{
+				"name":      export.Volume.PVC,
+				"namespace": ns,
+				"labels": map[string]interface{}{
+					"backup-policy/name":      policy.Metadata.Name,
+					"backup-policy/namespace": ns,
+				},
+			},
+			"spec": pvcSpec,
+		}, CreateOnly: true})
+	}
+
+	env, volumes, mounts := exportEnv(export)
+	volumes = append([]map[string]interface{}{{
+		"name":                  "dump",
+		"persistentVolumeClaim": map[string]interface{}{"claimName": export.Volume.PVC},
+	}}, volumes...)
+	mounts = append([]map[string]interface{}{{"name": "dump", "mountPath": exportDumpDir}}, mounts...)
+	env = append([]map[string]interface{}{{"name": "DUMP_DIR", "value": exportDumpDir}}, env...)
+
+	podSpec := map[string]interface{}{
+		"restartPolicy": "Never",
+		"containers": []map[string]interface{}{
+			{
+				"name":            "export",
+				"image":           exportImage(cfg, export),
+				"imagePullPolicy": "IfNotPresent",
+				"command":         []string{"/bin/sh", "-c"},
+				"args":            []string{exportScript(kind)},
+				"env":             env,
+				"volumeMounts":    mounts,
+			},
+		},
+		"volumes": volumes,
+	}
+	setPodPlacement(podSpec, policy.Spec.Mover)
+
+	return append(objects, renderedObject{Object: exportCronJob(policy, kind, map[string]interface{}{"spec": podSpec}), Owned: true})
+}
+
+// templatePod returns a copy of the pod template of a template export, which
+// restarts never unless it says otherwise.
+func templatePod(template map[string]interface{}) map[string]interface{} {
+	// Copy so the policy spec is not modified.
+	pod := map[string]interface{}{}
+	data, _ := json.Marshal(template)
+	_ = json.Unmarshal(data, &pod)
+	podSpec, _ := pod["spec"].(map[string]interface{})
+	if podSpec == nil {
+		podSpec = map[string]interface{}{}
+		pod["spec"] = podSpec
+	}
+	if _, ok := podSpec["restartPolicy"]; !ok {
+		podSpec["restartPolicy"] = "Never"
+	}
+	return pod
+}
+
+// exportCronJob wraps the export pod template in the suspended CronJob the
+// backup runner creates export Jobs from.
+func exportCronJob(policy BackupPolicy, kind string, pod map[string]interface{}) map[string]interface{} {
+	ns := policy.Metadata.Namespace
+	podLabels := map[string]interface{}{
+		"backup-policy/name":      policy.Metadata.Name,
+		"backup-policy/namespace": ns,
+		"backup.homelab/export":   kind,
+	}
+	metadata, _ := pod["metadata"].(map[string]interface{})
+	if metadata == nil {
+		metadata = map[string]interface{}{}
+		pod["metadata"] = metadata
+	}
+	templateLabels, _ := metadata["labels"].(map[string]interface{})
+	if templateLabels == nil {
+		templateLabels = map[string]interface{}{}
+		metadata["labels"] = templateLabels
+	}
+	for key, value := range podLabels {
+		templateLabels[key] = value
+	}
+
+	return map[string]interface{}{
+		"apiVersion": "batch/v1",
+		"kind":       "CronJob",
+		"metadata": map[string]interface{}{
+			"name":      exportCronJobName(policy.Metadata.Name),
+			"namespace": ns,
+			"labels":    podLabels,
+		},
+		"spec": map[string]interface{}{
+			// The backup runner creates Jobs from the CronJob; it never runs
+			// on its own.
+			"schedule":                   "0 0 1 1 *",
+			"suspend":                    true,
+			"concurrencyPolicy":          "Forbid",
+			"successfulJobsHistoryLimit": 2,
+			"failedJobsHistoryLimit":     2,
+			"jobTemplate": map[string]interface{}{
+				"metadata": map[string]interface{}{"labels": podLabels},
+				"spec": map[string]interface{}{
+					"backoffLimit":            0,
+					"ttlSecondsAfterFinished": 86400,
+					"template":                pod,
+				},
+			},
+		},
+	}
+}
+
+// exportEnv returns the environment, extra volumes and mounts of the export
+// container.
+func exportEnv(export *ExportSpec) ([]map[string]interface{}, []map[string]interface{}, []map[string]interface{}) {
+	var env, volumes, mounts []map[string]interface{}
+	value := func(name, value string) {
+		env = append(env, map[string]interface{}{"name": name, "value": value})
+	}
+	secret := func(name string, ref *ExportSecretRef, key, fallback string) {
+		if ref == nil || ref.Name == "" {
+			return
+		}
+		if key == "" {
+			key = fallback
+		}
+		env = append(env, map[string]interface{}{"name": name, "valueFrom": map[string]interface{}{
+			"secretKeyRef": map[string]interface{}{"name": ref.Name, "key": key},
+		}})
+	}
+	port := func(db *DatabaseExport, fallback int64) string {
+		if db.Port != 0 {
+			return fmt.Sprintf("%d", db.Port)
+		}
+		return fmt.Sprintf("%d", fallback)
+	}
+
+	switch export.kind() {
+	case exportPostgres:
+		db := export.Postgres
+		value("PGHOST", db.Service)
+		value("PGPORT", port(db, 5432))
+		value("PGDATABASE", db.Database)
+		if db.SecretRef != nil {
+			secret("PGUSER", db.SecretRef, db.SecretRef.UsernameKey, "username")
+			secret("PGPASSWORD", db.SecretRef, db.SecretRef.PasswordKey, "password")
+		}
+	case exportMySQL:
+		db := export.MySQL
+		value("MYSQL_HOST", db.Service)
+		value("MYSQL_TCP_PORT", port(db, 3306))
+		value("MYSQL_DATABASE", db.Database)
+		if db.SecretRef != nil {
+			secret("MYSQL_USER", db.SecretRef, db.SecretRef.UsernameKey, "username")
+			secret("MYSQL_PWD", db.SecretRef, db.SecretRef.PasswordKey, "password")
+		}
+	case exportRedis:
+		db := export.Redis
+		value("REDIS_HOST", db.Service)
+		value("REDIS_PORT", port(db, 6379))
+		if db.SecretRef != nil {
+			secret("REDISCLI_AUTH", db.SecretRef, db.SecretRef.PasswordKey, "password")
+		}
+	case exportSQLite:
+		value("SQLITE_PATH", path.Join("/source", export.SQLite.Path))
+		volumes = append(volumes, map[string]interface{}{
+			"name":                  "source",
+			"persistentVolumeClaim": map[string]interface{}{"claimName": export.SQLite.PVC},
+		})
+		mounts = append(mounts, map[string]interface{}{"name": "source", "mountPath": "/source"})
+	}
+	return env, volumes, mounts
+}
+
+// exportScript dumps to a temporary file, moves it in place and writes the
+// file and its size to the termination message for checkExport.
+func exportScript(kind string) string {
+	dump := map[string]string{
+		exportPostgres: `
+if [ -n "${PGDATABASE}" ]; then
+  file="${DUMP_DIR}/postgres-${PGDATABASE}.dump"
+  pg_dump --format=custom --file="${file}.tmp"
+else
+  unset PGDATABASE
+  file="${DUMP_DIR}/postgres-all.sql"
+  pg_dumpall --file="${file}.tmp"
+fi
+`,
+		exportMySQL: `
+if [ -n "${MYSQL_DATABASE}" ]; then
+  file="${DUMP_DIR}/mysql-${MYSQL_DATABASE}.sql"
+  set -- --databases "${MYSQL_DATABASE}"
+else
+  file="${DUMP_DIR}/mysql-all.sql"
+  set -- --all-databases
+fi
+# The client reads MYSQL_PWD and MYSQL_TCP_PORT, but not the user.
+if [ -n "${MYSQL_USER:-}" ]; then
+  set -- --user="${MYSQL_USER}" "$@"
+fi
+mysqldump --host="${MYSQL_HOST}" --single-transaction --routines --events "$@" > "${file}.tmp"
+`,
+		exportSQLite: `
+file="${DUMP_DIR}/sqlite-$(basename "${SQLITE_PATH}")"
+sqlite3 "${SQLITE_PATH}" ".backup '${file}.tmp'"
+`,
+		exportRedis: `
+file="${DUMP_DIR}/redis.rdb"
+redis-cli -h "${REDIS_HOST}" -p "${REDIS_PORT}" --rdb "${file}.tmp"
+`,
+	}[kind]
+
+	return strings.TrimSpace(`
+set -eu
+
+start="$(date +%s)"
+` + strings.TrimSpace(dump) + `
+mv "${file}.tmp" "${file}"
+
+size="$(wc -c < "${file}" | tr -d ' ')"
+seconds="$(( $(date +%s) - start ))"
+echo "Wrote ${file}: ${size} bytes in ${seconds}s"
+printf '{"file":"%s","bytes":%s,"seconds":%s}' "${file}" "${size}" "${seconds}" > /dev/termination-log
+`)
+}
+
+type podList struct {
+	Items []struct {
+		Status struct {
+			ContainerStatuses []struct {
+				Name  string `json:"name"`
+				State struct {
+					Terminated *struct {
+						ExitCode int64  `json:"exitCode"`
+						Reason   string `json:"reason"`
+						Message  string `json:"message"`
+					} `json:"terminated"`
+				} `json:"state"`
+			} `json:"containerStatuses"`
+		} `json:"status"`
+	} `json:"items"`
+}
+
+// exportPodResult reads the exit reason of the failed container of an export
+// Job and the termination message the built-in export script wrote.
+func exportPodResult(ctx context.Context, client *kubeClient, ns, job string, status *ExportStatus) error {
+	var pods podList
+	query := "?labelSelector=" + url.QueryEscape("job-name="+job)
+	if err := getJSON(ctx, client, namespacedPath("/api/v1", ns, "pods")+query, &pods); err != nil {
+		return err
+	}
+	for _, pod := range pods.Items {
+		for _, container := range pod.Status.ContainerStatuses {
+			terminated := container.State.Terminated
+			if terminated == nil {
+				continue
+			}
+			if terminated.ExitCode != 0 && status.Reason == "" {
+				status.Reason = fmt.Sprintf("%s: %s exited with code %d", terminated.Reason, container.Name, terminated.ExitCode)
+			}
+			var result struct {
+				File    string `json:"file"`
+				Bytes   int64  `json:"bytes"`
+				Seconds int64  `json:"seconds"`
+			}
+			if container.Name == "export" && json.Unmarshal([]byte(terminated.Message), &result) == nil {
+				status.File = result.File
+				status.SizeBytes = result.Bytes
+				status.DurationSeconds = result.Seconds
+			}
+		}
+	}
+	return nil
+}
+
+// logTail returns the last exportLogLines lines of logs, at most
+// exportLogBytes long.
+func logTail(logs string) string {
+	lines := strings.Split(strings.TrimRight(logs, "\n"), "\n")
+	if len(lines) > exportLogLines {
+		lines = lines[len(lines)-exportLogLines:]
+	}
+	tail := strings.Join(lines, "\n")
+	if len(tail) > exportLogBytes {
+		tail = tail[len(tail)-exportLogBytes:]
+	}
+	return tail
+}
+
+// checkExport records the outcome of the last export Job in status.export:
+// its exit reason and log, and the dump size and duration of built-in
+// exports. Each Job is recorded once, while its pod still exists.
+func checkExport(ctx context.Context, client *kubeClient, policy BackupPolicy) error {
+	kind := policy.Spec.Export.kind()
+	if kind == "" {
+		return nil
+	}
+	ns := policy.Metadata.Namespace
+	run, err := lastFinishedJob(ctx, client, ns, map[string]bool{exportJobName(policy): true})
+	if err != nil || run == nil {
+		return err
+	}
+	if policy.Status.Export != nil && policy.Status.Export.Job == run.Job {
+		return nil
+	}
+
+	status := ExportStatus{
+		Kind:     kind,
+		Job:      run.Job,
+		Result:   "Succeeded",
+		Finished: run.Finished.UTC().Format(time.RFC3339),
+	}
+	if err := exportPodResult(ctx, client, ns, run.Job, &status); err != nil {
+		return err
+	}
+	if run.Failed {
+		status.Result = "Failed"
+		status.Message = run.Message
+		if status.Reason == "" {
+			status.Reason = run.Reason
+		}
+	}
+	if logs, err := getJobLogs(ctx, client, ns, run.Job); err == nil {
+		status.Log = logTail(logs)
+	}
+	if run.Failed {
+		policyLog(ns, policy.Metadata.Name).Warn("export failed", "job", run.Job, logTriggerID, run.TriggerID, "reason", status.Reason)
+	}
+	return patchBackupPolicyStatus(ctx, client, ns, policy.Metadata.Name, map[string]interface{}{
+		"export": status,
+	})
+}
+
+// rotateJobManifest renders the Job the runner creates after the export to
+// delete all but the newest KeepLast artifacts on the artifact volume, or "".
+func rotateJobManifest(cfg Config, policy BackupPolicy) (string, error) {
+	export := policy.Spec.Export
+	if export == nil || export.KeepLast <= 0 || export.ArtifactVolume == nil || export.ArtifactVolume.PVC == "" {
+		return "", nil
+	}
+	ns := policy.Metadata.Namespace
+	podSpec := map[string]interface{}{
+		"restartPolicy": "Never",
+		"containers": []map[string]interface{}{
+			{
+				"name":            "rotate",
+				"image":           cfg.ResticImage,
+				"imagePullPolicy": "IfNotPresent",
+				"command":         []string{"/bin/sh", "-c"},
+				"args":            []string{rotateScript()},
+				"env": []map[string]interface{}{
+					{"name": "ARTIFACT_DIR", "value": path.Join("/artifacts", export.ArtifactVolume.Path)},
+					{"name": "ARTIFACT_PATTERN", "value": export.ArtifactVolume.Pattern},
+					{"name": "KEEP_LAST", "value": fmt.Sprintf("%d", export.KeepLast)},
+				},
+				"volumeMounts": []map[string]interface{}{
+					{"name": "artifacts", "mountPath": "/artifacts"},
+				},
+			},
+		},
+		"volumes": []map[string]interface{}{
+			{
+				"name": "artifacts",
+				"persistentVolumeClaim": map[string]interface{}{
+					"claimName": export.ArtifactVolume.PVC,
+				},
+			},
+		},
+	}
+	setPodPlacement(podSpec, policy.Spec.Mover)
+
+	payload, err := json.Marshal(map[string]interface{}{
+		"apiVersion": "batch/v1",
+		"kind":       "Job",
+		"metadata": map[string]interface{}{
+			"generateName": sanitizeName(fmt.Sprintf("backup-%s-rotate", policy.Metadata.Name)) + "-",
+			"namespace":    ns,
+			"labels": map[string]interface{}{
+				"backup-policy/name":      policy.Metadata.Name,
+				"backup-policy/namespace": ns,
+			},
+			"annotations": map[string]interface{}{
+				"backup.homelab/trigger-id": triggerIDPlaceholder,
+			},
+		},
+		"spec": map[string]interface{}{
+			"backoffLimit":            0,
+			"ttlSecondsAfterFinished": 86400,
+			"template": map[string]interface{}{
+				"spec": podSpec,
+			},
+		},
+	})
+	if err != nil {
+		return "", err
+	}
+	return string(payload), nil
+}
+
+// rotateScript only considers regular files directly in ARTIFACT_DIR whose
+// names match ARTIFACT_PATTERN, so directories and other data on the volume
+// are never deleted.
+func rotateScript() string {
+	return strings.TrimSpace(`
+set -eu
+
+if [ ! -d "${ARTIFACT_DIR}" ]; then
+  echo "${ARTIFACT_DIR} does not exist, nothing to rotate"
+  exit 0
+fi
+cd "${ARTIFACT_DIR}"
+find . -maxdepth 1 -type f -name "${ARTIFACT_PATTERN:?}" -exec ls -1t {} + | tail -n +"$(( KEEP_LAST + 1 ))" | while IFS= read -r name; do
+  echo "Removing old export artifact ${name#./}"
+  rm -f "./${name#./}"
+done
+`)
+}
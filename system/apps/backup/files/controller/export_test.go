@@ -0,0 +1,165 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestExportObjects(t *testing.T) {
+	policy := testBackupPolicy("nextcloud", "data")
+	mustUnmarshal(t, `{
+		"postgres": {"service": "nextcloud-db", "database": "nextcloud", "secretRef": {"name": "nextcloud-db", "usernameKey": "user"}},
+		"volume": {"pvc": "nextcloud-dump", "size": "5Gi"}
+	}`, &policy.Spec.Export)
+
+	objects := exportObjects(Config{}, policy)
+	if len(objects) != 2 || !objects[0].CreateOnly || !objects[1].Owned {
+		t.Fatalf("expected a create-only PVC and an owned CronJob, got %+v", objects)
+	}
+	cron := objects[1].Object
+	if name := cron["metadata"].(map[string]interface{})["name"]; name != "backup-nextcloud-export" {
+		t.Errorf("unexpected CronJob name %v", name)
+	}
+	if exportJobName(policy) != "backup-nextcloud-export" {
+		t.Errorf("runner does not start the built-in export, got %q", exportJobName(policy))
+	}
+
+	container := cron["spec"].(map[string]interface{})["jobTemplate"].(map[string]interface{})["spec"].(map[string]interface{})["template"].(map[string]interface{})["spec"].(map[string]interface{})["containers"].([]map[string]interface{})[0]
+	if container["image"] != "postgres:16-alpine" {
+		t.Errorf("unexpected image %v", container["image"])
+	}
+	env := map[string]interface{}{}
+	for _, variable := range container["env"].([]map[string]interface{}) {
+		if value, ok := variable["value"]; ok {
+			env[variable["name"].(string)] = value
+		} else {
+			env[variable["name"].(string)] = variable["valueFrom"].(map[string]interface{})["secretKeyRef"].(map[string]interface{})["key"]
+		}
+	}
+	for name, want := range map[string]string{"PGHOST": "nextcloud-db", "PGPORT": "5432", "PGDATABASE": "nextcloud", "PGUSER": "user", "PGPASSWORD": "password", "DUMP_DIR": "/dump"} {
+		if env[name] != want {
+			t.Errorf("%s = %v, want %s", name, env[name], want)
+		}
+	}
+	if !strings.Contains(container["args"].([]string)[0], "pg_dump --format=custom") {
+		t.Errorf("postgres export does not run pg_dump")
+	}
+
+	volumes, err := policyVolumes(policy, pvcList{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(volumes) != 2 || volumes[1].PVC != "nextcloud-dump" {
+		t.Errorf("dump volume is not backed up: %+v", volumes)
+	}
+}
+
+func TestExportMySQLUser(t *testing.T) {
+	script := exportScript(exportMySQL)
+	if !strings.Contains(script, `--user="${MYSQL_USER}"`) {
+		t.Errorf("mysql export does not pass the username:\n%s", script)
+	}
+	if !strings.Contains(script, `mysqldump --host="${MYSQL_HOST}" --single-transaction --routines --events "$@"`) {
+		t.Errorf("mysqldump does not get the arguments:\n%s", script)
+	}
+}
+
+func TestExportJobRef(t *testing.T) {
+	policy := testBackupPolicy("gitea", "data")
+	policy.Spec.Export = &ExportSpec{JobRef: &ExportJobRef{Name: "gitea-export"}}
+	if objects := exportObjects(Config{}, policy); len(objects) != 0 {
+		t.Errorf("jobRef exports render nothing, got %+v", objects)
+	}
+	if exportJobName(policy) != "gitea-export" {
+		t.Errorf("unexpected export job %q", exportJobName(policy))
+	}
+}
+
+func TestExportTemplate(t *testing.T) {
+	policy := testBackupPolicy("gitea", "data")
+	mustUnmarshal(t, `{
+		"template": {"metadata": {"labels": {"app": "gitea"}}, "spec": {"containers": [{"name": "dump", "image": "gitea"}]}},
+		"artifactVolume": {"pvc": "gitea-dump", "path": "dumps", "pattern": "gitea-dump-*.zip"},
+		"keepLast": 3
+	}`, &policy.Spec.Export)
+
+	objects := exportObjects(Config{}, policy)
+	if len(objects) != 1 || !objects[0].Owned {
+		t.Fatalf("expected an owned CronJob, got %+v", objects)
+	}
+	pod := objects[0].Object["spec"].(map[string]interface{})["jobTemplate"].(map[string]interface{})["spec"].(map[string]interface{})["template"].(map[string]interface{})
+	labels := pod["metadata"].(map[string]interface{})["labels"].(map[string]interface{})
+	if labels["app"] != "gitea" || labels["backup.homelab/export"] != "template" {
+		t.Errorf("unexpected pod labels %v", labels)
+	}
+	if pod["spec"].(map[string]interface{})["restartPolicy"] != "Never" {
+		t.Errorf("export pods must not restart, got %v", pod["spec"])
+	}
+	if _, ok := policy.Spec.Export.Template["metadata"].(map[string]interface{})["labels"].(map[string]interface{})["backup.homelab/export"]; ok {
+		t.Errorf("policy template was modified")
+	}
+	if exportVolumePVC(policy) != "gitea-dump" {
+		t.Errorf("artifact volume is not backed up, got %q", exportVolumePVC(policy))
+	}
+
+	manifest, err := rotateJobManifest(Config{ResticImage: "restic"}, policy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{`{"name":"ARTIFACT_DIR","value":"/artifacts/dumps"}`, `{"name":"ARTIFACT_PATTERN","value":"gitea-dump-*.zip"}`, `{"name":"KEEP_LAST","value":"3"}`, `"claimName":"gitea-dump"`} {
+		if !strings.Contains(manifest, want) {
+			t.Errorf("rotate Job is missing %s: %s", want, manifest)
+		}
+	}
+	policy.Spec.Export.KeepLast = 0
+	if manifest, _ := rotateJobManifest(Config{}, policy); manifest != "" {
+		t.Errorf("rotation without keepLast: %s", manifest)
+	}
+}
+
+func TestLogTail(t *testing.T) {
+	var lines []string
+	for i := 0; i < 30; i++ {
+		lines = append(lines, fmt.Sprintf("line %d", i))
+	}
+	tail := logTail(strings.Join(lines, "\n") + "\n")
+	if !strings.HasPrefix(tail, "line 10\n") || !strings.HasSuffix(tail, "line 29") {
+		t.Errorf("unexpected tail %q", tail)
+	}
+	if tail := logTail(strings.Repeat("x", 3000)); len(tail) != exportLogBytes {
+		t.Errorf("tail is %d bytes", len(tail))
+	}
+}
+
+func TestValidateExport(t *testing.T) {
+	for _, tc := range []struct {
+		export string
+		want   string
+	}{
+		{`{"jobRef": {"name": "export"}}`, ""},
+		{`{"redis": {"service": "redis"}, "volume": {"pvc": "dump"}}`, ""},
+		{`{"template": {"spec": {"containers": [{"name": "dump"}]}}, "artifactVolume": {"pvc": "dump", "pattern": "dump-*.zip"}, "keepLast": 2}`, ""},
+		{`{"jobRef": {"name": "export"}, "artifactVolume": {"pvc": "dump"}, "keepLast": 2}`, "keepLast requires artifactVolume.pattern"},
+		{`{"jobRef": {"name": "export"}, "artifactVolume": {"pvc": "data", "pattern": "*.zip"}, "keepLast": 2}`, "spec.volumes[0]: data is the artifact volume"},
+		{`{"jobRef": {"name": "export"}, "artifactVolume": {"pvc": "data"}}`, ""},
+		{`{"jobRef": {"name": "export"}, "artifactVolume": {"pvc": "dump", "pattern": "x/*.zip"}, "keepLast": 2}`, "must be a file name pattern"},
+		{`{}`, "set one of"},
+		{`{"template": {"spec": {}}}`, "spec.export.template.spec.containers is required"},
+		{`{"jobRef": {"name": "export"}, "keepLast": 2}`, "keepLast requires artifactVolume.pvc"},
+		{`{"jobRef": {"name": "export"}, "artifactVolume": {"pvc": "dump", "path": "../x"}}`, "must stay on the volume"},
+		{`{"redis": {"service": "redis"}, "volume": {"pvc": "dump"}, "keepLast": 2}`, "remove artifactVolume and keepLast"},
+		{`{"jobRef": {"name": "export"}, "mysql": {"service": "db"}, "volume": {"pvc": "dump"}}`, "only one export may be set, found jobRef, mysql"},
+		{`{"postgres": {"service": "db"}}`, "spec.export.volume.pvc is required for postgres exports"},
+		{`{"mysql": {}, "volume": {"pvc": "dump"}}`, "spec.export.mysql.service is required"},
+		{`{"sqlite": {"pvc": "data"}, "volume": {"pvc": "dump"}}`, "pvc and path are required"},
+		{`{"sqlite": {"pvc": "data", "path": "app.db"}, "volume": {"pvc": "data"}}`, "dump to a different PVC"},
+	} {
+		var export ExportSpec
+		mustUnmarshal(t, tc.export, &export)
+		got := joined(validateExport(&export, []BackupVolume{{PVC: "data"}}))
+		if tc.want == "" && got != "" || !strings.Contains(got, tc.want) {
+			t.Errorf("%s: got %q, want %q", tc.export, got, tc.want)
+		}
+	}
+}
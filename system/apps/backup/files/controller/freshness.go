@@ -0,0 +1,207 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+const backupStaleCondition = "BackupStale"
+
+// setCondition replaces the condition of the same type, keeping its
+// lastTransitionTime when the status did not change.
+func setCondition(conditions []Condition, condition Condition, now time.Time) []Condition {
+	out := append([]Condition{}, conditions...)
+	for i, existing := range out {
+		if existing.Type != condition.Type {
+			continue
+		}
+		if existing.Status == condition.Status && existing.LastTransitionTime != "" {
+			condition.LastTransitionTime = existing.LastTransitionTime
+		}
+		if condition.LastTransitionTime == "" {
+			condition.LastTransitionTime = now.UTC().Format(time.RFC3339)
+		}
+		out[i] = condition
+		return out
+	}
+	if condition.LastTransitionTime == "" {
+		condition.LastTransitionTime = now.UTC().Format(time.RFC3339)
+	}
+	return append(out, condition)
+}
+
+func findCondition(conditions []Condition, conditionType string) *Condition {
+	for i := range conditions {
+		if conditions[i].Type == conditionType {
+			return &conditions[i]
+		}
+	}
+	return nil
+}
+
+// staleVolume is a volume whose last successful sync is older than maxAge.
+type staleVolume struct {
+	PVC      string
+	LastSync time.Time
+}
+
+// staleVolumes returns the volumes of policy whose last successful sync is
+// older than maxAge at now. Volumes that never synced count from the
+// creation of the policy, so new policies get one maxAge to run.
+func staleVolumes(policy BackupPolicy, maxAge time.Duration, lastSyncs map[string]time.Time, now time.Time) []staleVolume {
+	created, _ := time.Parse(time.RFC3339, policy.Metadata.CreationTimestamp)
+	var stale []staleVolume
+	for _, vol := range policy.Spec.Volumes {
+		if vol.PVC == "" {
+			continue
+		}
+		since := lastSyncs[vol.PVC]
+		if since.IsZero() {
+			since = created
+		}
+		if now.Sub(since) > maxAge {
+			stale = append(stale, staleVolume{PVC: vol.PVC, LastSync: lastSyncs[vol.PVC]})
+		}
+	}
+	return stale
+}
+
+func staleMessage(stale []staleVolume, maxAge time.Duration) string {
+	parts := make([]string, 0, len(stale))
+	for _, vol := range stale {
+		if vol.LastSync.IsZero() {
+			parts = append(parts, fmt.Sprintf("%s never synced", vol.PVC))
+			continue
+		}
+		parts = append(parts, fmt.Sprintf("%s last synced %s", vol.PVC, vol.LastSync.UTC().Format(time.RFC3339)))
+	}
+	sort.Strings(parts)
+	return fmt.Sprintf("%s (maxAge %s)", strings.Join(parts, ", "), maxAge)
+}
+
+// checkFreshness compares the last successful sync of each volume with
+// spec.maxAge, records it in the metrics and sets the BackupStale condition.
+// Transitions are reported as Events and notifications. It returns the policy's conditions after
+// the check.
+func checkFreshness(ctx context.Context, client *kubeClient, policy BackupPolicy, now time.Time) ([]Condition, error) {
+	lastSyncs := map[string]time.Time{}
+	for _, vol := range policy.Spec.Volumes {
+		if vol.PVC == "" {
+			continue
+		}
+		lastSync, err := lastSuccessfulSync(ctx, client, policy.Metadata.Namespace, backupSourceName(policy.Metadata.Name, vol.PVC, false))
+		if err != nil {
+			return policy.Status.Conditions, err
+		}
+		if !lastSync.IsZero() {
+			lastSyncs[vol.PVC] = lastSync
+		}
+	}
+
+	var maxAge time.Duration
+	if policy.Spec.MaxAge != "" {
+		parsed, err := time.ParseDuration(policy.Spec.MaxAge)
+		if err != nil || parsed <= 0 {
+			return policy.Status.Conditions, fmt.Errorf("invalid spec.maxAge %q", policy.Spec.MaxAge)
+		}
+		maxAge = parsed
+	}
+
+	var stale []staleVolume
+	if maxAge > 0 {
+		stale = staleVolumes(policy, maxAge, lastSyncs, now)
+	}
+	backupMetrics.setPolicy(policy.Metadata.Namespace, policy.Metadata.Name, maxAge, len(stale) > 0, lastSyncs)
+
+	existing := findCondition(policy.Status.Conditions, backupStaleCondition)
+	if maxAge == 0 {
+		if existing == nil {
+			return policy.Status.Conditions, nil
+		}
+		conditions := make([]Condition, 0, len(policy.Status.Conditions))
+		for _, condition := range policy.Status.Conditions {
+			if condition.Type != backupStaleCondition {
+				conditions = append(conditions, condition)
+			}
+		}
+		if err := patchBackupPolicyStatus(ctx, client, policy.Metadata.Namespace, policy.Metadata.Name, map[string]interface{}{
+			"conditions": conditions,
+		}); err != nil {
+			return policy.Status.Conditions, err
+		}
+		return conditions, nil
+	}
+
+	condition := Condition{
+		Type:    backupStaleCondition,
+		Status:  "False",
+		Reason:  "WithinMaxAge",
+		Message: fmt.Sprintf("all volumes synced within %s", maxAge),
+	}
+	if len(stale) > 0 {
+		condition.Status = "True"
+		condition.Reason = "MaxAgeExceeded"
+		condition.Message = staleMessage(stale, maxAge)
+	}
+	if existing != nil && existing.Status == condition.Status && existing.Reason == condition.Reason && existing.Message == condition.Message {
+		return policy.Status.Conditions, nil
+	}
+
+	becameStale := condition.Status == "True" && (existing == nil || existing.Status != "True")
+	recovered := condition.Status == "False" && existing != nil && existing.Status == "True"
+	conditions := setCondition(policy.Status.Conditions, condition, now)
+	if err := patchBackupPolicyStatus(ctx, client, policy.Metadata.Namespace, policy.Metadata.Name, map[string]interface{}{
+		"conditions": conditions,
+	}); err != nil {
+		return policy.Status.Conditions, err
+	}
+
+	switch {
+	case becameStale:
+		policyLog(policy.Metadata.Namespace, policy.Metadata.Name).Warn("backup is stale", "message", condition.Message)
+		if err := recordEvent(ctx, client, policy, "Warning", "BackupStale", condition.Message); err != nil {
+			policyLog(policy.Metadata.Namespace, policy.Metadata.Name).Error("freshness event failed", logError, err)
+		}
+		notifications.notify(policyNotification(policy, notifyBackupStale, condition.Message, false), policy.Spec.Notifications)
+	case recovered:
+		policyLog(policy.Metadata.Namespace, policy.Metadata.Name).Info("backup is fresh again")
+		if err := recordEvent(ctx, client, policy, "Normal", "BackupFresh", condition.Message); err != nil {
+			policyLog(policy.Metadata.Namespace, policy.Metadata.Name).Error("freshness event failed", logError, err)
+		}
+		notifications.notify(policyNotification(policy, notifyBackupStale, condition.Message, true), policy.Spec.Notifications)
+	}
+	return conditions, nil
+}
+
+// lastSuccessfulSync returns status.lastSyncTime of a ReplicationSource, which
+// VolSync only advances after a successful sync.
+func lastSuccessfulSync(ctx context.Context, client *kubeClient, ns, name string) (time.Time, error) {
+	itemPath := namespacedPath("/apis/volsync.backube/v1alpha1", ns, "replicationsources", name)
+	body, status, err := client.doRequest(ctx, "GET", itemPath, nil)
+	if err != nil {
+		return time.Time{}, err
+	}
+	if status == http.StatusNotFound {
+		return time.Time{}, nil
+	}
+	if status != http.StatusOK {
+		return time.Time{}, fmt.Errorf("get failed: %s status=%d", itemPath, status)
+	}
+	var source struct {
+		Status struct {
+			LastSyncTime string `json:"lastSyncTime"`
+		} `json:"status"`
+	}
+	if err := json.Unmarshal(body, &source); err != nil {
+		return time.Time{}, err
+	}
+	if source.Status.LastSyncTime == "" {
+		return time.Time{}, nil
+	}
+	return time.Parse(time.RFC3339, source.Status.LastSyncTime)
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestSetCondition(t *testing.T) {
+	now := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	earlier := "2024-04-01T00:00:00Z"
+	existing := []Condition{
+		{Type: "Ready", Status: "True", Reason: "Reconciled", LastTransitionTime: earlier},
+		{Type: backupStaleCondition, Status: "False", Reason: "WithinMaxAge", LastTransitionTime: earlier},
+		{Type: backupRunFailedCondition, Status: "False", LastTransitionTime: earlier},
+	}
+
+	// The status is written with a merge patch, which replaces the whole list:
+	// every other condition has to come back unchanged and in place.
+	got := setCondition(existing, Condition{Type: backupStaleCondition, Status: "True", Reason: "MaxAgeExceeded"}, now)
+	want := []Condition{
+		existing[0],
+		{Type: backupStaleCondition, Status: "True", Reason: "MaxAgeExceeded", LastTransitionTime: "2024-05-01T12:00:00Z"},
+		existing[2],
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("status change: got %+v, want %+v", got, want)
+	}
+	if existing[1].Status != "False" {
+		t.Error("setCondition modified the conditions it was given")
+	}
+
+	got = setCondition(existing, Condition{Type: "Ready", Status: "True", Reason: "Restored", Message: "done"}, now)
+	if got[0].LastTransitionTime != earlier || got[0].Reason != "Restored" || len(got) != 3 {
+		t.Errorf("same status: got %+v, want the old transition time and the new reason", got)
+	}
+
+	got = setCondition(existing, Condition{Type: restoredCondition, Status: "True", LastTransitionTime: earlier}, now)
+	if len(got) != 4 || got[3].Type != restoredCondition || got[3].LastTransitionTime != earlier {
+		t.Errorf("new condition: got %+v, want it appended with its own transition time", got)
+	}
+
+	got = setCondition(nil, Condition{Type: "Ready", Status: "False"}, now)
+	if len(got) != 1 || got[0].LastTransitionTime != "2024-05-01T12:00:00Z" {
+		t.Errorf("empty list: got %+v", got)
+	}
+}
+
+func TestFindCondition(t *testing.T) {
+	conditions := []Condition{{Type: "Ready", Status: "True"}, {Type: backupStaleCondition, Status: "False"}}
+	found := findCondition(conditions, backupStaleCondition)
+	if found == nil || found.Status != "False" {
+		t.Fatalf("findCondition(%s) = %+v", backupStaleCondition, found)
+	}
+	found.Status = "True"
+	if conditions[1].Status != "True" {
+		t.Error("findCondition does not point into the list")
+	}
+	if found := findCondition(conditions, restoredCondition); found != nil {
+		t.Errorf("findCondition(Restored) = %+v, want nil", found)
+	}
+	if found := findCondition(nil, "Ready"); found != nil {
+		t.Errorf("findCondition on nil = %+v, want nil", found)
+	}
+}
+
+func TestStaleVolumes(t *testing.T) {
+	now := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	policy := testBackupPolicy("app", "fresh", "old", "never", "")
+	policy.Metadata.CreationTimestamp = "2024-04-30T00:00:00Z"
+	lastSyncs := map[string]time.Time{
+		"fresh": now.Add(-time.Hour),
+		"old":   now.Add(-48 * time.Hour),
+	}
+
+	got := staleVolumes(policy, 24*time.Hour, lastSyncs, now)
+	want := []staleVolume{{PVC: "old", LastSync: now.Add(-48 * time.Hour)}, {PVC: "never"}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+
+	// A volume that never synced gets one maxAge from the policy's creation.
+	got = staleVolumes(policy, 48*time.Hour, lastSyncs, now)
+	if len(got) != 0 {
+		t.Errorf("within maxAge of the creation: got %+v, want none", got)
+	}
+
+	if got := staleMessage(want, 24*time.Hour); got != "never never synced, old last synced 2024-04-29T12:00:00Z (maxAge 24h0m0s)" {
+		t.Errorf("staleMessage = %q", got)
+	}
+}
@@ -1,10 +1,12 @@
 package main
 
 import (
+	"context"
 	"crypto/sha256"
 	"encoding/hex"
 	"encoding/json"
 	"fmt"
+	"log/slog"
 	"net/http"
 	"net/url"
 	"sort"
@@ -14,55 +16,95 @@ import (
 
 type BackupPolicyHandler struct{}
 
-func (h *BackupPolicyHandler) Reconcile(client *kubeClient, cfg Config) error {
+func (h *BackupPolicyHandler) Reconcile(ctx context.Context, client *kubeClient, cfg Config) error {
 	listPath := fmt.Sprintf("/apis/%s/%s/backuppolicies", backupPolicyGroup, backupPolicyVersion)
-	body, status, err := client.doRequest("GET", listPath, nil)
+	body, status, err := client.doRequest(ctx, "GET", listPath, nil)
 	if err != nil {
-		fmt.Printf("failed to list BackupPolicies: %v\n", err)
+		slog.Error("listing BackupPolicies failed", logError, err)
 		return err
 	}
 	if status != http.StatusOK {
 		err := fmt.Errorf("failed to list BackupPolicies: status=%d", status)
-		fmt.Println(err.Error())
+		slog.Error("listing BackupPolicies failed", logResource, listPath, logHTTPStatus, status)
 		return err
 	}
 
 	var list BackupPolicyList
 	if err := json.Unmarshal(body, &list); err != nil {
-		fmt.Printf("failed to parse BackupPolicies: %v\n", err)
+		slog.Error("parsing BackupPolicies failed", logError, err)
 		return err
 	}
-	fmt.Printf("reconcile: found %d BackupPolicies\n", len(list.Items))
+	slog.Debug("reconciling BackupPolicies", "count", len(list.Items))
 
+	seen := map[string]bool{}
 	for _, policy := range list.Items {
+		seen[policy.Metadata.Namespace+"/"+policy.Metadata.Name] = true
+	}
+	backupMetrics.retainPolicies(seen)
+
+	volumes := map[catalogKey]bool{}
+	defer catalog.retain(volumes)
+
+	for _, policy := range list.Items {
+		policy, err := resolveVolumes(ctx, client, policy)
+		if err != nil {
+			policyLog(policy.Metadata.Namespace, policy.Metadata.Name).Error("resolving volumes failed", logError, err)
+			continue
+		}
+		for _, vol := range policy.Spec.Volumes {
+			volumes[catalogKey{Namespace: policy.Metadata.Namespace, Policy: policy.Metadata.Name, PVC: vol.PVC}] = true
+		}
+		if err := checkSnapshots(ctx, client, policy); err != nil {
+			policyLog(policy.Metadata.Namespace, policy.Metadata.Name).Error("snapshot check failed", logError, err)
+		}
+		conditions, err := checkFreshness(ctx, client, policy, time.Now())
+		if err != nil {
+			policyLog(policy.Metadata.Namespace, policy.Metadata.Name).Error("freshness check failed", logError, err)
+		}
+		policy.Status.Conditions = conditions
+		conditions, err = checkLastRun(ctx, client, policy, time.Now())
+		if err != nil {
+			policyLog(policy.Metadata.Namespace, policy.Metadata.Name).Error("run check failed", logError, err)
+		}
+		policy.Status.Conditions = conditions
+		if err := checkExport(ctx, client, policy); err != nil {
+			policyLog(policy.Metadata.Namespace, policy.Metadata.Name).Error("export check failed", logError, err)
+		}
 		hash, err := policySpecHash(policy.Spec)
 		if err != nil {
-			fmt.Printf("reconcile failed for %s/%s: %v\n", policy.Metadata.Namespace, policy.Metadata.Name, err)
+			policyLog(policy.Metadata.Namespace, policy.Metadata.Name).Error("reconcile failed", logError, err)
 			return err
 		}
 		if policy.Metadata.Annotations != nil && policy.Metadata.Annotations[processedHashAnnotation] == hash {
+			_, driftErr := correctDrift(ctx, client, cfg, policy)
+			if driftErr != nil {
+				policyLog(policy.Metadata.Namespace, policy.Metadata.Name).Error("drift check failed", logError, driftErr)
+			}
+			if err := recordDriftCheck(ctx, client, policy, driftErr); err != nil {
+				policyLog(policy.Metadata.Namespace, policy.Metadata.Name).Error("status update failed", logError, err)
+			}
 			continue
 		}
 
-		volStatus, lastSnapshotSync, err := reconcileBackupPolicy(client, cfg, policy)
+		volStatus, lastSnapshotSync, err := reconcileBackupPolicy(ctx, client, cfg, policy)
 		if err != nil {
-			fmt.Printf("reconcile failed for %s/%s: %v\n", policy.Metadata.Namespace, policy.Metadata.Name, err)
-			if err := updateBackupPolicyStatus(client, policy, "False", "ReconcileError", err.Error(), volStatus, lastSnapshotSync); err != nil {
-				fmt.Printf("status update failed for %s/%s: %v\n", policy.Metadata.Namespace, policy.Metadata.Name, err)
+			policyLog(policy.Metadata.Namespace, policy.Metadata.Name).Error("reconcile failed", logError, err)
+			if err := updateBackupPolicyStatus(ctx, client, policy, "False", "ReconcileError", err.Error(), volStatus, lastSnapshotSync); err != nil {
+				policyLog(policy.Metadata.Namespace, policy.Metadata.Name).Error("status update failed", logError, err)
 				return err
 			}
-			if err := updateProcessedHash(client, "backuppolicies", policy.Metadata.Namespace, policy.Metadata.Name, hash); err != nil {
-				fmt.Printf("processed hash update failed for %s/%s: %v\n", policy.Metadata.Namespace, policy.Metadata.Name, err)
+			if err := updateProcessedHash(ctx, client, "backuppolicies", policy.Metadata.Namespace, policy.Metadata.Name, hash); err != nil {
+				policyLog(policy.Metadata.Namespace, policy.Metadata.Name).Error("processed hash update failed", logError, err)
 				return err
 			}
 			return err
 		}
-		if err := updateBackupPolicyStatus(client, policy, "True", "Reconciled", "Reconcile successful", volStatus, lastSnapshotSync); err != nil {
-			fmt.Printf("status update failed for %s/%s: %v\n", policy.Metadata.Namespace, policy.Metadata.Name, err)
+		if err := updateBackupPolicyStatus(ctx, client, policy, "True", "Reconciled", "Reconcile successful", volStatus, lastSnapshotSync); err != nil {
+			policyLog(policy.Metadata.Namespace, policy.Metadata.Name).Error("status update failed", logError, err)
 			return err
 		}
-		if err := updateProcessedHash(client, "backuppolicies", policy.Metadata.Namespace, policy.Metadata.Name, hash); err != nil {
-			fmt.Printf("processed hash update failed for %s/%s: %v\n", policy.Metadata.Namespace, policy.Metadata.Name, err)
+		if err := updateProcessedHash(ctx, client, "backuppolicies", policy.Metadata.Namespace, policy.Metadata.Name, hash); err != nil {
+			policyLog(policy.Metadata.Namespace, policy.Metadata.Name).Error("processed hash update failed", logError, err)
 			return err
 		}
 	}
@@ -70,7 +112,7 @@ func (h *BackupPolicyHandler) Reconcile(client *kubeClient, cfg Config) error {
 	return nil
 }
 
-func reconcileBackupPolicy(client *kubeClient, cfg Config, policy BackupPolicy) ([]BackupPolicyVolumeStatus, string, error) {
+func reconcileBackupPolicy(ctx context.Context, client *kubeClient, cfg Config, policy BackupPolicy) ([]BackupPolicyVolumeStatus, string, error) {
 	ns := policy.Metadata.Namespace
 	name := policy.Metadata.Name
 	if policy.APIVersion == "" {
@@ -80,13 +122,13 @@ func reconcileBackupPolicy(client *kubeClient, cfg Config, policy BackupPolicy)
 		policy.Kind = "BackupPolicy"
 	}
 
-	fmt.Printf("reconcile policy %s/%s: %d volumes\n", ns, name, len(policy.Spec.Volumes))
+	policyLog(ns, name).Debug("reconciling policy", "volumes", len(policy.Spec.Volumes))
 
-	if err := ensureRepoPVC(client, cfg, ns); err != nil {
+	objects, err := renderBackupPolicy(cfg, policy)
+	if err != nil {
 		return nil, policy.Status.LastSnapshotSync, err
 	}
-
-	if err := ensureRunnerRBAC(client, ns); err != nil {
+	if err := applyRendered(ctx, client, objects, &policy); err != nil {
 		return nil, policy.Status.LastSnapshotSync, err
 	}
 
@@ -95,39 +137,25 @@ func reconcileBackupPolicy(client *kubeClient, cfg Config, policy BackupPolicy)
 		existingStatus[vol.PVC] = vol
 	}
 
-	primarySources := make([]string, 0, len(policy.Spec.Volumes))
-	offsiteSources := make([]string, 0, len(policy.Spec.Volumes))
 	volumeStatuses := make([]BackupPolicyVolumeStatus, 0, len(policy.Spec.Volumes))
 	lastSnapshotSync := policy.Status.LastSnapshotSync
 	snapshotsUpdated := false
 
 	for _, vol := range policy.Spec.Volumes {
 		if vol.PVC == "" {
-			fmt.Printf("reconcile policy %s/%s: skipping empty pvc entry\n", ns, name)
 			continue
 		}
-		fmt.Printf("reconcile policy %s/%s: ensuring volume %s\n", ns, name, vol.PVC)
-		baseName := sanitizeName(fmt.Sprintf("backup-%s-%s", name, vol.PVC))
-		secretName := sanitizeName(fmt.Sprintf("backup-repo-%s-%s", name, vol.PVC))
-
-		fmt.Printf("reconcile policy %s/%s: ensuring ExternalSecret %s\n", ns, name, secretName)
-		if err := ensureExternalSecret(client, cfg, ns, secretName, vol.PVC, false, policy); err != nil {
-			return volumeStatuses, lastSnapshotSync, err
-		}
-		fmt.Printf("reconcile policy %s/%s: ensuring ReplicationSource %s\n", ns, name, baseName)
-		if err := ensureReplicationSource(client, cfg, ns, baseName, secretName, vol.PVC, policy, true); err != nil {
-			return volumeStatuses, lastSnapshotSync, err
-		}
-		primarySources = append(primarySources, baseName)
+		baseName := backupSourceName(name, vol.PVC, false)
+		secretName := repoSecretName(name, vol.PVC, false)
 
-		statusEntry := BackupPolicyVolumeStatus{PVC: vol.PVC}
+		statusEntry := BackupPolicyVolumeStatus{PVC: vol.PVC, CopyMethod: volumeCopyMethod(cfg, vol)}
 		existingEntry, hasExisting := existingStatus[vol.PVC]
 		if hasExisting {
-			statusEntry.Snapshots = existingEntry.Snapshots
-			statusEntry.LastSync = existingEntry.LastSync
+			statusEntry = existingEntry
+			statusEntry.CopyMethod = volumeCopyMethod(cfg, vol)
 		}
 
-		result, endTime, err := getReplicationSourceStatus(client, ns, baseName)
+		result, endTime, err := getReplicationSourceStatus(ctx, client, ns, baseName)
 		if err != nil {
 			return volumeStatuses, lastSnapshotSync, err
 		}
@@ -136,38 +164,17 @@ func reconcileBackupPolicy(client *kubeClient, cfg Config, policy BackupPolicy)
 		}
 
 		if result == "Successful" && endTime != "" {
-			if !hasExisting || existingEntry.LastSync != statusEntry.LastSync || len(existingEntry.Snapshots) == 0 {
-				snapshots, err := fetchSnapshots(client, cfg, ns, policy.Metadata.Name, vol.PVC, secretName)
+			key := catalogKey{Namespace: ns, Policy: name, PVC: vol.PVC}
+			if entry, ok := catalog.lookup(ctx, key, secretName, statusEntry.LastSync); ok {
+				updated, err := updateSnapshotStatus(ctx, client, policy, &statusEntry, entry)
 				if err != nil {
 					return volumeStatuses, lastSnapshotSync, err
 				}
-				statusEntry.Snapshots = snapshots
-				snapshotsUpdated = true
+				snapshotsUpdated = snapshotsUpdated || updated
 			}
 		}
 
 		volumeStatuses = append(volumeStatuses, statusEntry)
-
-		if cfg.OffsiteEnabled {
-			offsiteName := sanitizeName(fmt.Sprintf("backup-offsite-%s-%s", name, vol.PVC))
-			offsiteSecret := sanitizeName(fmt.Sprintf("backup-repo-offsite-%s-%s", name, vol.PVC))
-			if err := ensureExternalSecret(client, cfg, ns, offsiteSecret, vol.PVC, true, policy); err != nil {
-				return volumeStatuses, lastSnapshotSync, err
-			}
-			if err := ensureReplicationSource(client, cfg, ns, offsiteName, offsiteSecret, vol.PVC, policy, false); err != nil {
-				return volumeStatuses, lastSnapshotSync, err
-			}
-			offsiteSources = append(offsiteSources, offsiteName)
-		}
-	}
-
-	if err := ensureCronJob(client, cfg, ns, policy, primarySources, false); err != nil {
-		return volumeStatuses, lastSnapshotSync, err
-	}
-	if cfg.OffsiteEnabled {
-		if err := ensureCronJob(client, cfg, ns, policy, offsiteSources, true); err != nil {
-			return volumeStatuses, lastSnapshotSync, err
-		}
 	}
 
 	if snapshotsUpdated {
@@ -177,8 +184,8 @@ func reconcileBackupPolicy(client *kubeClient, cfg Config, policy BackupPolicy)
 	return volumeStatuses, lastSnapshotSync, nil
 }
 
-func ensureRepoPVC(client *kubeClient, cfg Config, ns string) error {
-	pvc := map[string]interface{}{
+func repoPVCObject(cfg Config, ns string) map[string]interface{} {
+	return map[string]interface{}{
 		"apiVersion": "v1",
 		"kind":       "PersistentVolumeClaim",
 		"metadata": map[string]interface{}{
@@ -195,30 +202,9 @@ func ensureRepoPVC(client *kubeClient, cfg Config, ns string) error {
 			"storageClassName": cfg.RepoStorageClass,
 		},
 	}
-
-	itemPath := namespacedPath("/api/v1", ns, "persistentvolumeclaims", cfg.RepoPVCName)
-	collectionPath := namespacedPath("/api/v1", ns, "persistentvolumeclaims")
-	_, status, err := client.doRequest("GET", itemPath, nil)
-	if err != nil {
-		return err
-	}
-	if status == http.StatusOK {
-		return nil
-	}
-	if status != http.StatusNotFound {
-		return fmt.Errorf("get failed: %s status=%d", itemPath, status)
-	}
-	_, createStatus, err := client.doRequest("POST", collectionPath, pvc)
-	if err != nil {
-		return err
-	}
-	if createStatus < 200 || createStatus >= 300 {
-		return fmt.Errorf("create failed: %s status=%d", collectionPath, createStatus)
-	}
-	return nil
 }
 
-func ensureRunnerRBAC(client *kubeClient, ns string) error {
+func runnerRBACObjects(ns string) []map[string]interface{} {
 	sa := map[string]interface{}{
 		"apiVersion": "v1",
 		"kind":       "ServiceAccount",
@@ -227,11 +213,6 @@ func ensureRunnerRBAC(client *kubeClient, ns string) error {
 			"namespace": ns,
 		},
 	}
-	if err := client.upsert(namespacedPath("/api/v1", ns, "serviceaccounts", "backup-runner"),
-		namespacedPath("/api/v1", ns, "serviceaccounts"), sa, nil); err != nil {
-		return err
-	}
-
 	role := map[string]interface{}{
 		"apiVersion": "rbac.authorization.k8s.io/v1",
 		"kind":       "Role",
@@ -255,13 +236,18 @@ func ensureRunnerRBAC(client *kubeClient, ns string) error {
 				"resources": []string{"replicationsources"},
 				"verbs":     []string{"get", "list", "watch", "patch", "update"},
 			},
+			{
+				"apiGroups": []string{""},
+				"resources": []string{"pods", "pods/log"},
+				"verbs":     []string{"get", "list"},
+			},
+			{
+				"apiGroups": []string{""},
+				"resources": []string{"persistentvolumeclaims"},
+				"verbs":     []string{"get", "create", "delete"},
+			},
 		},
 	}
-	if err := client.upsert(namespacedPath("/apis/rbac.authorization.k8s.io/v1", ns, "roles", "backup-runner"),
-		namespacedPath("/apis/rbac.authorization.k8s.io/v1", ns, "roles"), role, nil); err != nil {
-		return err
-	}
-
 	binding := map[string]interface{}{
 		"apiVersion": "rbac.authorization.k8s.io/v1",
 		"kind":       "RoleBinding",
@@ -283,11 +269,10 @@ func ensureRunnerRBAC(client *kubeClient, ns string) error {
 		},
 	}
 
-	return client.upsert(namespacedPath("/apis/rbac.authorization.k8s.io/v1", ns, "rolebindings", "backup-runner"),
-		namespacedPath("/apis/rbac.authorization.k8s.io/v1", ns, "rolebindings"), binding, nil)
+	return []map[string]interface{}{sa, role, binding}
 }
 
-func ensureExternalSecret(client *kubeClient, cfg Config, ns, secretName, pvc string, offsite bool, policy BackupPolicy) error {
+func externalSecretObject(cfg Config, ns, secretName, pvc string, offsite bool, policy BackupPolicy) map[string]interface{} {
 	secretData := []map[string]interface{}{
 		{
 			"remoteRef": map[string]interface{}{"key": cfg.ExternalSecretKey, "property": cfg.ResticPasswordProperty},
@@ -322,7 +307,7 @@ func ensureExternalSecret(client *kubeClient, cfg Config, ns, secretName, pvc st
 		templateData["RESTIC_REPOSITORY"] = repoPath
 	}
 
-	obj := map[string]interface{}{
+	return map[string]interface{}{
 		"apiVersion": "external-secrets.io/v1beta1",
 		"kind":       "ExternalSecret",
 		"metadata": map[string]interface{}{
@@ -346,24 +331,22 @@ func ensureExternalSecret(client *kubeClient, cfg Config, ns, secretName, pvc st
 			},
 		},
 	}
-
-	return client.upsert(namespacedPath("/apis/external-secrets.io/v1beta1", ns, "externalsecrets", secretName),
-		namespacedPath("/apis/external-secrets.io/v1beta1", ns, "externalsecrets"), obj, &policy)
 }
 
-func ensureReplicationSource(client *kubeClient, cfg Config, ns, name, secretName, pvc string, policy BackupPolicy, useMover bool) error {
+func replicationSourceObject(cfg Config, ns string, source backupSource, policy BackupPolicy, useMover bool) map[string]interface{} {
+	repository := offsiteRepository
+	if useMover {
+		repository = cfg.RepoStorageClass
+	}
 	resticSpec := map[string]interface{}{
-		"repository":        secretName,
-		"copyMethod":        "Snapshot",
+		"repository":        source.Secret,
 		"pruneIntervalDays": cfg.PruneIntervalDays,
-		"retain": map[string]interface{}{
-			"hourly":  cfg.RetainHourly,
-			"daily":   cfg.RetainDaily,
-			"weekly":  cfg.RetainWeekly,
-			"monthly": cfg.RetainMonthly,
-			"yearly":  cfg.RetainYearly,
-		},
 	}
+	setCopyMethod(resticSpec, source.Copy)
+	if retention := retentionFor(cfg, policy); retention.volsyncManaged() {
+		resticSpec["retain"] = retention.retainSpec()
+	}
+	setMoverFields(resticSpec, policy.Spec.Mover)
 
 	if useMover {
 		mountPath := cfg.RepoMountPath
@@ -380,36 +363,52 @@ func ensureReplicationSource(client *kubeClient, cfg Config, ns, name, secretNam
 		}
 	}
 
-	obj := map[string]interface{}{
+	spec := map[string]interface{}{
+		"sourcePVC": source.PVC,
+		"trigger": map[string]interface{}{
+			"manual": "init",
+		},
+		"restic": resticSpec,
+	}
+	if source.Clone != "" {
+		// The runner creates the clone and unpauses the source for each run.
+		spec["sourcePVC"] = source.Clone
+		spec["paused"] = true
+	}
+
+	return map[string]interface{}{
 		"apiVersion": "volsync.backube/v1alpha1",
 		"kind":       "ReplicationSource",
 		"metadata": map[string]interface{}{
-			"name":      name,
+			"name":      source.Name,
 			"namespace": ns,
 			"labels": map[string]interface{}{
 				"backup-policy/name":      policy.Metadata.Name,
 				"backup-policy/namespace": ns,
+				repositoryLabel:           repository,
 			},
 		},
-		"spec": map[string]interface{}{
-			"sourcePVC": pvc,
-			"trigger": map[string]interface{}{
-				"manual": "init",
-			},
-			"restic": resticSpec,
-		},
+		"spec": spec,
 	}
-
-	if err := client.upsert(namespacedPath("/apis/volsync.backube/v1alpha1", ns, "replicationsources", name),
-		namespacedPath("/apis/volsync.backube/v1alpha1", ns, "replicationsources"), obj, &policy); err != nil {
-		return err
-	}
-	return nil
 }
 
-func ensureCronJob(client *kubeClient, cfg Config, ns string, policy BackupPolicy, sources []string, offsite bool) error {
-	if len(sources) == 0 {
-		return nil
+func cronJobObject(cfg Config, ns string, policy BackupPolicy, sources []backupSource, offsite bool) (map[string]interface{}, error) {
+
+	sourceNames := make([]string, 0, len(sources))
+	for _, source := range sources {
+		sourceNames = append(sourceNames, source.Name)
+	}
+	tagJob, err := tagJobManifest(cfg, ns, policy, sources, offsite)
+	if err != nil {
+		return nil, err
+	}
+	prepareJobs, err := prepareJobsManifest(cfg, ns, policy, sources)
+	if err != nil {
+		return nil, err
+	}
+	rotateJob, err := rotateJobManifest(cfg, policy)
+	if err != nil {
+		return nil, err
 	}
 
 	jobName := sanitizeName(fmt.Sprintf("backup-%s", policy.Metadata.Name))
@@ -420,6 +419,10 @@ func ensureCronJob(client *kubeClient, cfg Config, ns string, policy BackupPolic
 		schedule = cfg.OffsiteSchedule
 		timeZone = cfg.OffsiteTimeZone
 	}
+	schedule, err = expandHashedSchedule(schedule, ns+"/"+policy.Metadata.Name)
+	if err != nil {
+		return nil, err
+	}
 
 	scaleTargets := []string{}
 	if policy.Spec.Quiesce != nil {
@@ -433,11 +436,6 @@ func ensureCronJob(client *kubeClient, cfg Config, ns string, policy BackupPolic
 	}
 	sort.Strings(scaleTargets)
 
-	exportJob := ""
-	if policy.Spec.Export != nil && policy.Spec.Export.JobRef != nil {
-		exportJob = policy.Spec.Export.JobRef.Name
-	}
-
 	cron := map[string]interface{}{
 		"apiVersion": "batch/v1",
 		"kind":       "CronJob",
@@ -458,7 +456,11 @@ func ensureCronJob(client *kubeClient, cfg Config, ns string, policy BackupPolic
 			"successfulJobsHistoryLimit": 2,
 			"failedJobsHistoryLimit":     2,
 			"jobTemplate": map[string]interface{}{
+				"metadata": map[string]interface{}{
+					"labels": map[string]interface{}{runnerJobLabel: "true"},
+				},
 				"spec": map[string]interface{}{
+					"activeDeadlineSeconds": runnerDeadlineSeconds(cfg, policy, sources),
 					"template": map[string]interface{}{
 						"spec": map[string]interface{}{
 							"serviceAccountName": "backup-runner",
@@ -472,12 +474,23 @@ func ensureCronJob(client *kubeClient, cfg Config, ns string, policy BackupPolic
 									"args":            []string{backupScript()},
 									"env": []map[string]interface{}{
 										{"name": "NAMESPACE", "value": ns},
+										{"name": "POLICY", "value": policy.Metadata.Name},
+										{"name": "JOB_NAME", "valueFrom": map[string]interface{}{
+											"fieldRef": map[string]interface{}{"fieldPath": "metadata.labels['job-name']"},
+										}},
 										{"name": "SCALE_DOWN_TARGETS", "value": strings.Join(scaleTargets, " ")},
-										{"name": "EXPORT_JOB_NAME", "value": exportJob},
-										{"name": "REPLICATION_SOURCES", "value": strings.Join(sources, " ")},
+										{"name": "EXPORT_JOB_NAME", "value": exportJobName(policy)},
+										{"name": "ROTATE_JOB_MANIFEST", "value": rotateJob},
+										{"name": "REPLICATION_SOURCES", "value": strings.Join(sourceNames, " ")},
+										{"name": "TAG_JOB_MANIFEST", "value": tagJob},
+										{"name": "SOURCE_PVCS", "value": sourcePVCs(sources)},
+										{"name": "CLONE_VOLUMES", "value": cloneVolumes(sources)},
+										{"name": "PREPARE_JOB_MANIFEST", "value": prepareJobs},
 										{"name": "SCALE_DOWN_TIMEOUT_SECONDS", "value": fmt.Sprintf("%d", cfg.ScaleDownTimeoutSeconds)},
 										{"name": "EXPORT_TIMEOUT_SECONDS", "value": fmt.Sprintf("%d", cfg.ExportTimeoutSeconds)},
 										{"name": "BACKUP_TIMEOUT_SECONDS", "value": fmt.Sprintf("%d", cfg.BackupTimeoutSeconds)},
+										{"name": "QUEUE_TIMEOUT_SECONDS", "value": fmt.Sprintf("%d", cfg.QueueTimeoutSeconds)},
+										{"name": "QUEUE_TRIGGERS", "value": fmt.Sprintf("%t", cfg.Concurrency.enabled())},
 									},
 								},
 							},
@@ -492,9 +505,35 @@ func ensureCronJob(client *kubeClient, cfg Config, ns string, policy BackupPolic
 		cronSpec := cron["spec"].(map[string]interface{})
 		cronSpec["timeZone"] = timeZone
 	}
+	jobSpec := cron["spec"].(map[string]interface{})["jobTemplate"].(map[string]interface{})["spec"].(map[string]interface{})
+	setPodPlacement(jobSpec["template"].(map[string]interface{})["spec"].(map[string]interface{}), policy.Spec.Mover)
+
+	return cron, nil
+}
 
-	return client.upsert(namespacedPath("/apis/batch/v1", ns, "cronjobs", jobName),
-		namespacedPath("/apis/batch/v1", ns, "cronjobs"), cron, &policy)
+// runnerJobLabel marks the Jobs of backup runs, so the trigger queue can list
+// them without reading every Job of the cluster.
+const runnerJobLabel = "backup.homelab/runner"
+
+// runnerDeadlineSeconds is the activeDeadlineSeconds of a backup run: the sum
+// of the timeouts of its steps plus some slack for the kubectl calls between
+// them. It ends runners that hang outside those timeouts, which would
+// otherwise block every later run of the CronJob.
+func runnerDeadlineSeconds(cfg Config, policy BackupPolicy, sources []backupSource) int64 {
+	deadline := int64(600) + 2*cfg.ExportTimeoutSeconds + cfg.BackupTimeoutSeconds
+	if policy.Spec.Quiesce != nil {
+		deadline += int64(len(policy.Spec.Quiesce.ScaleDown)) * cfg.ScaleDownTimeoutSeconds
+	}
+	for _, source := range sources {
+		deadline += 300 + cfg.BackupTimeoutSeconds
+		if source.Clone != "" {
+			deadline += cfg.BackupTimeoutSeconds
+		}
+		if cfg.Concurrency.enabled() {
+			deadline += cfg.QueueTimeoutSeconds
+		}
+	}
+	return deadline
 }
 
 func backupScript() string {
@@ -502,13 +541,69 @@ func backupScript() string {
 set -euo pipefail
 
 scaled_file="$(mktemp)"
+clones_file="$(mktemp)"
+queued_file="$(mktemp)"
+trigger_id="$(date -u +%Y%m%d%H%M%S)"
 
-echo "Backup job starting in namespace ${NAMESPACE}"
-echo "Replication sources: ${REPLICATION_SOURCES}"
-echo "Scale down targets: ${SCALE_DOWN_TARGETS:-<none>}"
-echo "Export job: ${EXPORT_JOB_NAME:-<none>}"
+run_type="scheduled"
+if [ -n "${JOB_NAME:-}" ]; then
+  requested_type="$(kubectl -n "${NAMESPACE}" get job "${JOB_NAME}" -o jsonpath='{.metadata.annotations.backup\.homelab/run-type}' 2>/dev/null || true)"
+  instantiate="$(kubectl -n "${NAMESPACE}" get job "${JOB_NAME}" -o jsonpath='{.metadata.annotations.cronjob\.kubernetes\.io/instantiate}' 2>/dev/null || true)"
+  if [ -n "${requested_type}" ]; then
+    run_type="${requested_type}"
+  elif [ "${instantiate}" = "manual" ]; then
+    run_type="manual"
+  fi
+fi
+run_type="$(printf '%s' "${run_type}" | tr -cd 'a-z0-9-')"
+
+# log writes a JSON line with the fields of the controller's logs, so a run
+# can be followed by its trigger ID.
+log() {
+  level="$1"
+  shift
+  message="$(printf '%s' "$*" | sed -e 's/\\/\\\\/g' -e 's/"/\\"/g')"
+  printf '{"time":"%s","level":"%s","msg":"%s","namespace":"%s","policy":"%s","trigger_id":"%s"}\n' \
+    "$(date -u +%Y-%m-%dT%H:%M:%SZ)" "${level}" "${message}" "${NAMESPACE}" "${POLICY:-}" "${trigger_id}"
+}
+
+`+pvcMetadataFunctions()+`
+
+log INFO "Backup run starting (${run_type})"
+log INFO "Replication sources: ${REPLICATION_SOURCES}"
+log INFO "Scale down targets: ${SCALE_DOWN_TARGETS:-<none>}"
+log INFO "Export job: ${EXPORT_JOB_NAME:-<none>}"
+
+if [ -n "${JOB_NAME:-}" ]; then
+  kubectl -n "${NAMESPACE}" annotate job "${JOB_NAME}" --overwrite \
+    "backup.homelab/trigger-id=${trigger_id}" \
+    "backup.homelab/run-type=${run_type}" >/dev/null || true
+fi
+
+cleanup_clones() {
+  if [ -s "${clones_file}" ]; then
+    while read -r source clone; do
+      kubectl -n "${NAMESPACE}" patch replicationsource "${source}" --type merge -p '{"spec":{"paused":true}}' >/dev/null 2>&1 || true
+      kubectl -n "${NAMESPACE}" delete pvc "${clone}" --ignore-not-found --wait=false >/dev/null 2>&1 || true
+    done < "${clones_file}"
+    : > "${clones_file}"
+  fi
+}
+
+# cleanup_requests withdraws queued triggers, so the controller doesn't start
+# a sync after the run gave up on it.
+cleanup_requests() {
+  if [ -s "${queued_file}" ]; then
+    while read -r source; do
+      kubectl -n "${NAMESPACE}" annotate replicationsource "${source}" "backup.homelab/trigger-request-" >/dev/null 2>&1 || true
+    done < "${queued_file}"
+    : > "${queued_file}"
+  fi
+}
 
 cleanup() {
+  cleanup_requests
+  cleanup_clones
   if [ -s "${scaled_file}" ]; then
     while read -r target replicas; do
       if [ -n "${target}" ] && [ -n "${replicas}" ]; then
@@ -519,18 +614,30 @@ cleanup() {
 }
 
 on_error() {
-  echo "Backup failed, restoring scaled workloads..." >&2
+  log ERROR "Backup failed, restoring scaled workloads..." >&2
   cleanup
 }
 
 trap on_error ERR
 trap cleanup EXIT
 
+# The PVCs are recorded before quiescing, while the pods mounting them run.
+# The tag Job writes the records next to the snapshots it tags.
+metadata_dir="$(mktemp -d)"
+index=0
+for pvc in ${SOURCE_PVCS}; do
+  if ! pvc_metadata "${pvc}" > "${metadata_dir}/${index}"; then
+    log WARN "Failed to read the metadata of PVC ${pvc}, keeping its last record"
+    : > "${metadata_dir}/${index}"
+  fi
+  index="$((index + 1))"
+done
+
 if [ -n "${SCALE_DOWN_TARGETS:-}" ]; then
   for target in ${SCALE_DOWN_TARGETS}; do
     replicas="$(kubectl -n "${NAMESPACE}" get "${target}" -o jsonpath='{.spec.replicas}' 2>/dev/null || true)"
     if [ -z "${replicas}" ]; then
-      echo "Failed to read replicas for ${target}"
+      log ERROR "Failed to read replicas for ${target}"
       exit 1
     fi
     echo "${target} ${replicas}" >> "${scaled_file}"
@@ -543,58 +650,143 @@ fi
 
 if [ -n "${EXPORT_JOB_NAME:-}" ]; then
   job_name="${EXPORT_JOB_NAME}-run-$(date -u +%Y%m%d%H%M%S)"
+  log INFO "Starting export job ${job_name}..."
   kubectl -n "${NAMESPACE}" create job "${job_name}" --from="cronjob/${EXPORT_JOB_NAME}"
+  kubectl -n "${NAMESPACE}" annotate job "${job_name}" "backup.homelab/trigger-id=${trigger_id}" >/dev/null || true
   if ! kubectl -n "${NAMESPACE}" wait --for=condition=complete "job/${job_name}" --timeout="${EXPORT_TIMEOUT_SECONDS}s"; then
     kubectl -n "${NAMESPACE}" logs "job/${job_name}" || true
     exit 1
   fi
 fi
 
-trigger_id="$(date -u +%Y%m%d%H%M%S)"
+if [ -n "${ROTATE_JOB_MANIFEST:-}" ]; then
+  log INFO "Removing old export artifacts..."
+  rotate_job="$(printf '%s' "${ROTATE_JOB_MANIFEST}" \
+    | sed -e "s/__TRIGGER_ID__/${trigger_id}/g" \
+    | kubectl -n "${NAMESPACE}" create -f - -o name)"
+  if ! kubectl -n "${NAMESPACE}" wait --for=condition=complete "${rotate_job}" --timeout="${EXPORT_TIMEOUT_SECONDS}s"; then
+    kubectl -n "${NAMESPACE}" logs "${rotate_job}" || true
+    exit 1
+  fi
+fi
+
 for source in ${REPLICATION_SOURCES}; do
-  echo "Waiting for ReplicationSource ${source} to exist..."
+  log INFO "Waiting for ReplicationSource ${source} to exist..."
   deadline="$(( $(date +%s) + 300 ))"
   while true; do
     if kubectl -n "${NAMESPACE}" get replicationsource "${source}" >/dev/null 2>&1; then
       break
     fi
     if [ "$(date +%s)" -ge "${deadline}" ]; then
-      echo "ReplicationSource ${source} not found before trigger."
-      echo "Available ReplicationSources:"
+      log ERROR "ReplicationSource ${source} not found before trigger."
+      log INFO "Available ReplicationSources:"
       kubectl -n "${NAMESPACE}" get replicationsources -o name || true
       exit 1
     fi
-    echo "ReplicationSource ${source} not found yet, retrying..."
+    log INFO "ReplicationSource ${source} not found yet, retrying..."
     sleep 2
   done
 done
-for source in ${REPLICATION_SOURCES}; do
-  kubectl -n "${NAMESPACE}" patch replicationsource "${source}" --type merge -p "{\"spec\":{\"trigger\":{\"manual\":\"${trigger_id}\"}}}"
-done
+
+if [ -n "${CLONE_VOLUMES:-}" ]; then
+  for entry in ${CLONE_VOLUMES}; do
+    source="${entry%%:*}"
+    rest="${entry#*:}"
+    pvc="${rest%%:*}"
+    clone="${rest#*:}"
+    storage_class="$(kubectl -n "${NAMESPACE}" get pvc "${pvc}" -o jsonpath='{.spec.storageClassName}')"
+    size="$(kubectl -n "${NAMESPACE}" get pvc "${pvc}" -o jsonpath='{.status.capacity.storage}')"
+    access_modes="$(kubectl -n "${NAMESPACE}" get pvc "${pvc}" -o jsonpath='{.spec.accessModes}')"
+    log INFO "Cloning ${pvc} to ${clone}..."
+    kubectl -n "${NAMESPACE}" delete pvc "${clone}" --ignore-not-found
+    echo "${source} ${clone}" >> "${clones_file}"
+    kubectl -n "${NAMESPACE}" create -f - <<EOF
+{"apiVersion":"v1","kind":"PersistentVolumeClaim","metadata":{"name":"${clone}","labels":{"backup.homelab/clone-of":"${pvc}","backup.homelab/trigger-id":"${trigger_id}"}},"spec":{"accessModes":${access_modes},"storageClassName":"${storage_class}","resources":{"requests":{"storage":"${size}"}},"dataSource":{"kind":"PersistentVolumeClaim","name":"${pvc}"}}}
+EOF
+  done
+  log INFO "Removing excluded files from the clones..."
+  prepare_jobs="$(printf '%s' "${PREPARE_JOB_MANIFEST}" \
+    | sed -e "s/__TRIGGER_ID__/${trigger_id}/g" \
+    | kubectl -n "${NAMESPACE}" create -f - -o name)"
+  for job in ${prepare_jobs}; do
+    if ! kubectl -n "${NAMESPACE}" wait --for=condition=complete "${job}" --timeout="${BACKUP_TIMEOUT_SECONDS}s"; then
+      kubectl -n "${NAMESPACE}" logs "${job}" || true
+      exit 1
+    fi
+  done
+  for entry in ${CLONE_VOLUMES}; do
+    kubectl -n "${NAMESPACE}" patch replicationsource "${entry%%:*}" --type merge -p '{"spec":{"paused":false}}'
+  done
+fi
+
+if [ "${QUEUE_TRIGGERS:-false}" = "true" ]; then
+  # The controller starts the syncs within its concurrency limits.
+  for source in ${REPLICATION_SOURCES}; do
+    echo "${source}" >> "${queued_file}"
+    kubectl -n "${NAMESPACE}" annotate replicationsource "${source}" --overwrite "backup.homelab/trigger-request=${trigger_id}"
+  done
+  log INFO "Queued trigger, waiting for the controller to start the syncs..."
+else
+  for source in ${REPLICATION_SOURCES}; do
+    kubectl -n "${NAMESPACE}" patch replicationsource "${source}" --type merge -p "{\"spec\":{\"trigger\":{\"manual\":\"${trigger_id}\"}}}"
+  done
+fi
 
 for source in ${REPLICATION_SOURCES}; do
-  deadline="$(( $(date +%s) + ${BACKUP_TIMEOUT_SECONDS} ))"
+  # A queued sync gets its full timeout once the controller started it, and
+  # waits at most QUEUE_TIMEOUT_SECONDS for that.
+  deadline=""
+  queue_deadline="$(( $(date +%s) + ${QUEUE_TIMEOUT_SECONDS} ))"
   while true; do
+    if [ -z "${deadline}" ]; then
+      manual="$(kubectl -n "${NAMESPACE}" get replicationsource "${source}" -o jsonpath='{.spec.trigger.manual}' 2>/dev/null || true)"
+      if [ "${manual}" = "${trigger_id}" ]; then
+        deadline="$(( $(date +%s) + ${BACKUP_TIMEOUT_SECONDS} ))"
+      fi
+    fi
     last_manual="$(kubectl -n "${NAMESPACE}" get replicationsource "${source}" -o jsonpath='{.status.lastManualSync}' 2>/dev/null || true)"
     result="$(kubectl -n "${NAMESPACE}" get replicationsource "${source}" -o jsonpath='{.status.latestMoverStatus.result}' 2>/dev/null || true)"
 
     if [ "${last_manual}" = "${trigger_id}" ] && [ -n "${result}" ]; then
       if [ "${result}" = "Successful" ]; then
-        echo "ReplicationSource ${source} completed successfully."
+        log INFO "ReplicationSource ${source} completed successfully."
         break
       fi
-      echo "ReplicationSource ${source} failed (result=${result})."
+      log ERROR "ReplicationSource ${source} failed (result=${result})."
       exit 1
     fi
 
-    if [ "$(date +%s)" -ge "${deadline}" ]; then
-      echo "Timed out waiting for ReplicationSource ${source}."
+    if [ -n "${deadline}" ] && [ "$(date +%s)" -ge "${deadline}" ]; then
+      log ERROR "Timed out waiting for ReplicationSource ${source}."
+      exit 1
+    fi
+    if [ -z "${deadline}" ] && [ "$(date +%s)" -ge "${queue_deadline}" ]; then
+      log ERROR "Timed out waiting for the controller to start ReplicationSource ${source}."
       exit 1
     fi
 
     sleep 10
   done
 done
+
+cleanup
+: > "${scaled_file}"
+
+if [ -n "${TAG_JOB_MANIFEST:-}" ]; then
+  log INFO "Tagging snapshots (${run_type})..."
+  tag_manifest="$(printf '%s' "${TAG_JOB_MANIFEST}" \
+    | sed -e "s/__TRIGGER_ID__/${trigger_id}/g" -e "s/__RUN_TYPE__/${run_type}/g")"
+  index=0
+  for pvc in ${SOURCE_PVCS}; do
+    tag_manifest="$(printf '%s' "${tag_manifest}" | sed -e "s|__PVC_METADATA_${index}__|$(cat "${metadata_dir}/${index}")|g")"
+    index="$((index + 1))"
+  done
+  tag_job="$(printf '%s' "${tag_manifest}" | kubectl -n "${NAMESPACE}" create -f - -o name)"
+  if ! kubectl -n "${NAMESPACE}" wait --for=condition=complete "${tag_job}" --timeout="${BACKUP_TIMEOUT_SECONDS}s"; then
+    kubectl -n "${NAMESPACE}" logs "${tag_job}" --all-containers || true
+    exit 1
+  fi
+fi
 `)
 }
 
@@ -603,9 +795,9 @@ func backupScriptHash() string {
 	return hex.EncodeToString(sum[:])
 }
 
-func getReplicationSourceStatus(client *kubeClient, ns, name string) (string, string, error) {
+func getReplicationSourceStatus(ctx context.Context, client *kubeClient, ns, name string) (string, string, error) {
 	itemPath := namespacedPath("/apis/volsync.backube/v1alpha1", ns, "replicationsources", name)
-	body, status, err := client.doRequest("GET", itemPath, nil)
+	body, status, err := client.doRequest(ctx, "GET", itemPath, nil)
 	if err != nil {
 		return "", "", err
 	}
@@ -659,72 +851,152 @@ func normalizeTime(value string) string {
 	return ""
 }
 
-func fetchSnapshots(client *kubeClient, cfg Config, ns, policyName, pvc, secretName string) ([]BackupSnapshot, error) {
+func fetchSnapshots(ctx context.Context, client *kubeClient, cfg Config, ns, policyName, pvc, secretName string) ([]BackupSnapshot, uint64, error) {
 	jobName := sanitizeName(fmt.Sprintf("backup-snapshots-%s-%s-%d", policyName, pvc, time.Now().UTC().Unix()))
-	if err := ensureSnapshotJob(client, cfg, ns, jobName, secretName); err != nil {
-		return nil, err
+	var policy BackupPolicy
+	policyPath := namespacedPath(fmt.Sprintf("/apis/%s/%s", backupPolicyGroup, backupPolicyVersion), ns, "backuppolicies", policyName)
+	if err := getJSON(ctx, client, policyPath, &policy); err != nil {
+		slog.Warn("policy lookup for restic limits failed", logNamespace, ns, logPolicy, policyName, logError, err)
 	}
-	defer func() {
-		_ = deleteJob(client, ns, jobName)
-	}()
+	env := map[string]string{resticLimitEnv: resticLimitArgs(policy.Spec.Mover)}
+	if err := ensureSnapshotJob(ctx, client, cfg, ns, jobName, secretName, env); err != nil {
+		return nil, 0, err
+	}
+	defer cleanupJob(client, ns, jobName)
 
-	if err := waitForJobCompletion(client, ns, jobName, 5*time.Minute); err != nil {
-		return nil, err
+	if err := waitForJobCompletion(ctx, client, ns, jobName, snapshotJobTimeout); err != nil {
+		return nil, 0, err
 	}
 
-	logs, err := getJobLogs(client, ns, jobName)
+	logs, err := getJobLogs(ctx, client, ns, jobName)
 	if err != nil {
-		return nil, err
+		return nil, 0, err
 	}
 
-	var raw []map[string]interface{}
-	if err := json.Unmarshal([]byte(logs), &raw); err != nil {
-		return nil, fmt.Errorf("failed to parse restic snapshots output: %w", err)
+	raw, size, rest, err := parseSnapshotListing(logs)
+	if err != nil {
+		return nil, 0, err
+	}
+	if rest != "" {
+		slog.Warn("snapshot listing reported errors", logNamespace, ns, logPolicy, policyName, logVolume, pvc, "output", rest)
 	}
 
 	snapshots := make([]BackupSnapshot, 0, len(raw))
 	for _, item := range raw {
-		id, _ := item["id"].(string)
-		timeVal, _ := item["time"].(string)
-		var size uint64
-		if sizeVal, ok := item["size"].(float64); ok {
-			if sizeVal > 0 {
-				size = uint64(sizeVal)
-			}
-		}
-		if id == "" || timeVal == "" {
+		if item.ID == "" || item.Time == "" {
 			continue
 		}
-		snapshots = append(snapshots, BackupSnapshot{
-			ID:      id,
-			Time:    timeVal,
-			Size:    size,
-			Snippet: fmt.Sprintf("restoreAsOf: \"%s\"  # %s", timeVal, id),
-		})
+		snapshot := BackupSnapshot{
+			ID:       item.ID,
+			Time:     item.Time,
+			Size:     item.Size,
+			Hostname: item.Hostname,
+			Paths:    item.Paths,
+			Tags:     item.Tags,
+			Snippet:  snapshotSnippet(item.Time, item.ID),
+		}
+		if item.Summary != nil {
+			snapshot.Summary = &SnapshotSummary{
+				FilesNew:            item.Summary.FilesNew,
+				FilesChanged:        item.Summary.FilesChanged,
+				FilesUnmodified:     item.Summary.FilesUnmodified,
+				DataAdded:           item.Summary.DataAdded,
+				TotalFilesProcessed: item.Summary.TotalFilesProcessed,
+				TotalBytesProcessed: item.Summary.TotalBytesProcessed,
+			}
+			if snapshot.Size == 0 {
+				snapshot.Size = item.Summary.TotalBytesProcessed
+			}
+		}
+		snapshots = append(snapshots, snapshot)
 	}
-	return snapshots, nil
+	return snapshots, size, nil
 }
 
-func ensureSnapshotJob(client *kubeClient, cfg Config, ns, jobName, secretName string) error {
+// parseSnapshotListing parses the output of snapshotListScript: the snapshots
+// followed by the stats of the repository. It also returns any output after
+// them, such as restic warnings.
+func parseSnapshotListing(logs string) ([]resticSnapshot, uint64, string, error) {
+	decoder := json.NewDecoder(strings.NewReader(logs))
+	var raw []resticSnapshot
+	if err := decoder.Decode(&raw); err != nil {
+		return nil, 0, "", fmt.Errorf("failed to parse restic snapshots output: %w", err)
+	}
+	var stats struct {
+		TotalSize uint64 `json:"total_size"`
+	}
+	if err := decoder.Decode(&stats); err != nil {
+		return nil, 0, "", fmt.Errorf("failed to parse restic stats output: %w", err)
+	}
+	return raw, stats.TotalSize, strings.TrimSpace(logs[decoder.InputOffset():]), nil
+}
+
+// resticSnapshot mirrors the fields of `restic snapshots --json` the
+// controller reports. The summary is only present for snapshots created by
+// restic 0.17 or newer.
+type resticSnapshot struct {
+	ID       string   `json:"id"`
+	Time     string   `json:"time"`
+	Size     uint64   `json:"size"`
+	Hostname string   `json:"hostname"`
+	Paths    []string `json:"paths"`
+	Tags     []string `json:"tags"`
+	Summary  *struct {
+		FilesNew            uint64 `json:"files_new"`
+		FilesChanged        uint64 `json:"files_changed"`
+		FilesUnmodified     uint64 `json:"files_unmodified"`
+		DataAdded           uint64 `json:"data_added"`
+		TotalFilesProcessed uint64 `json:"total_files_processed"`
+		TotalBytesProcessed uint64 `json:"total_bytes_processed"`
+	} `json:"summary"`
+}
+
+// snapshotListScript lists the snapshots of the repository and its
+// deduplicated size, as two JSON documents.
+const snapshotListScript = `restic ${RESTIC_LIMIT_ARGS} snapshots --json
+restic ${RESTIC_LIMIT_ARGS} stats --mode raw-data --json`
+
+func ensureSnapshotJob(ctx context.Context, client *kubeClient, cfg Config, ns, jobName, secretName string, env map[string]string) error {
+	return ensureResticJob(ctx, client, cfg, ns, jobName, secretName, snapshotListScript, env)
+}
+
+// ensureResticJob creates a short-lived Job that runs script with the restic
+// repository of secretName, the repository PVC and a scratch directory at /tmp.
+// Without a secretName the Job only has the repository PVC and runs as the
+// default ServiceAccount, so it also works in namespaces without backups.
+func ensureResticJob(ctx context.Context, client *kubeClient, cfg Config, ns, jobName, secretName, script string, env map[string]string) error {
+	return client.apply(ctx, namespacedPath("/apis/batch/v1", ns, "jobs", jobName), resticJobObject(cfg, ns, jobName, secretName, script, env), nil)
+}
+
+// resticJobObject returns the Job ensureResticJob applies.
+func resticJobObject(cfg Config, ns, jobName, secretName, script string, env map[string]string) map[string]interface{} {
 	mountPath := fmt.Sprintf("/mnt/%s", cfg.RepoMountPath)
+	envNames := make([]string, 0, len(env))
+	for name := range env {
+		envNames = append(envNames, name)
+	}
+	sort.Strings(envNames)
+	envVars := make([]map[string]interface{}, 0, len(env))
+	for _, name := range envNames {
+		envVars = append(envVars, map[string]interface{}{"name": name, "value": env[name]})
+	}
+
 	container := map[string]interface{}{
 		"name":            "restic",
 		"image":           cfg.ResticImage,
 		"imagePullPolicy": "IfNotPresent",
-		"envFrom": []map[string]interface{}{
-			{
-				"secretRef": map[string]interface{}{
-					"name": secretName,
-				},
-			},
-		},
-		"command": []string{"/bin/sh", "-c"},
-		"args":    []string{"restic snapshots --json"},
+		"env":             envVars,
+		"command":         []string{"/bin/sh", "-c"},
+		"args":            []string{script},
 		"volumeMounts": []map[string]interface{}{
 			{
 				"name":      "repo",
 				"mountPath": mountPath,
 			},
+			{
+				"name":      "scratch",
+				"mountPath": "/tmp",
+			},
 		},
 	}
 
@@ -736,37 +1008,54 @@ func ensureSnapshotJob(client *kubeClient, cfg Config, ns, jobName, secretName s
 				"readOnly":  false,
 			},
 		},
+		{
+			"name":     "scratch",
+			"emptyDir": map[string]interface{}{},
+		},
 	}
 
-	job := map[string]interface{}{
+	podSpec := map[string]interface{}{
+		"restartPolicy": "Never",
+		"containers":    []map[string]interface{}{container},
+		"volumes":       volumes,
+	}
+	if secretName != "" {
+		podSpec["serviceAccountName"] = "backup-runner"
+		container["envFrom"] = []map[string]interface{}{
+			{
+				"secretRef": map[string]interface{}{
+					"name": secretName,
+				},
+			},
+		}
+	}
+
+	return map[string]interface{}{
 		"apiVersion": "batch/v1",
 		"kind":       "Job",
 		"metadata": map[string]interface{}{
 			"name":      jobName,
 			"namespace": ns,
+			"labels": map[string]interface{}{
+				"app.kubernetes.io/managed-by": "backup-controller",
+				resticJobLabel:                 controllerPod,
+				resticProcessLabel:             controllerProcess,
+			},
 		},
 		"spec": map[string]interface{}{
 			"backoffLimit": 0,
 			"template": map[string]interface{}{
-				"spec": map[string]interface{}{
-					"serviceAccountName": "backup-runner",
-					"restartPolicy":      "Never",
-					"containers":         []map[string]interface{}{container},
-					"volumes":            volumes,
-				},
+				"spec": podSpec,
 			},
 		},
 	}
-
-	return client.upsert(namespacedPath("/apis/batch/v1", ns, "jobs", jobName),
-		namespacedPath("/apis/batch/v1", ns, "jobs"), job, nil)
 }
 
-func waitForJobCompletion(client *kubeClient, ns, jobName string, timeout time.Duration) error {
+func waitForJobCompletion(ctx context.Context, client *kubeClient, ns, jobName string, timeout time.Duration) error {
 	deadline := time.Now().Add(timeout)
 	for {
 		itemPath := namespacedPath("/apis/batch/v1", ns, "jobs", jobName)
-		body, status, err := client.doRequest("GET", itemPath, nil)
+		body, status, err := client.doRequest(ctx, "GET", itemPath, nil)
 		if err != nil {
 			return err
 		}
@@ -789,14 +1078,16 @@ func waitForJobCompletion(client *kubeClient, ns, jobName string, timeout time.D
 		if time.Now().After(deadline) {
 			return fmt.Errorf("timed out waiting for job %s", jobName)
 		}
-		time.Sleep(2 * time.Second)
+		if err := sleepContext(ctx, 2*time.Second); err != nil {
+			return err
+		}
 	}
 }
 
-func getJobLogs(client *kubeClient, ns, jobName string) (string, error) {
+func getJobLogs(ctx context.Context, client *kubeClient, ns, jobName string) (string, error) {
 	selector := url.QueryEscape(fmt.Sprintf("job-name=%s", jobName))
 	listPath := fmt.Sprintf("/api/v1/namespaces/%s/pods?labelSelector=%s", ns, selector)
-	body, status, err := client.doRequest("GET", listPath, nil)
+	body, status, err := client.doRequest(ctx, "GET", listPath, nil)
 	if err != nil {
 		return "", err
 	}
@@ -818,7 +1109,7 @@ func getJobLogs(client *kubeClient, ns, jobName string) (string, error) {
 		return "", fmt.Errorf("pod name not found for job %s", jobName)
 	}
 	logPath := fmt.Sprintf("/api/v1/namespaces/%s/pods/%s/log", ns, podName)
-	logBody, logStatus, err := client.doRequest("GET", logPath, nil)
+	logBody, logStatus, err := client.doRequest(ctx, "GET", logPath, nil)
 	if err != nil {
 		return "", err
 	}
@@ -828,102 +1119,80 @@ func getJobLogs(client *kubeClient, ns, jobName string) (string, error) {
 	return string(logBody), nil
 }
 
-func deleteJob(client *kubeClient, ns, jobName string) error {
-	itemPath := namespacedPath("/apis/batch/v1", ns, "jobs", jobName)
-	_, status, err := client.doRequest("DELETE", itemPath, nil)
-	if err != nil {
-		return err
-	}
-	if status == http.StatusNotFound {
-		return nil
-	}
-	if status < 200 || status >= 300 {
-		return fmt.Errorf("delete failed: %s status=%d", itemPath, status)
+func deleteJob(ctx context.Context, client *kubeClient, ns, jobName string) error {
+	return client.delete(ctx, namespacedPath("/apis/batch/v1", ns, "jobs", jobName))
+}
+
+// cleanupJob deletes a Job the controller started, also when the caller's
+// context was cancelled by a disconnect or a shutdown.
+func cleanupJob(client *kubeClient, ns, jobName string) {
+	ctx, cancel := cleanupContext()
+	defer cancel()
+	if err := deleteJob(ctx, client, ns, jobName); err != nil {
+		slog.Error("deleting job failed", logNamespace, ns, logResource, jobName, logError, err)
 	}
-	return nil
 }
 
-func updateBackupPolicyStatus(client *kubeClient, policy BackupPolicy, status, reason, message string, volumes []BackupPolicyVolumeStatus, lastSnapshotSync string) error {
+func updateBackupPolicyStatus(ctx context.Context, client *kubeClient, policy BackupPolicy, status, reason, message string, volumes []BackupPolicyVolumeStatus, lastSnapshotSync string) error {
 	if policy.Metadata.Name == "" || policy.Metadata.Namespace == "" {
 		return fmt.Errorf("missing policy name/namespace for status update")
 	}
-	statusPath := namespacedPath(
-		fmt.Sprintf("/apis/%s/%s", backupPolicyGroup, backupPolicyVersion),
-		policy.Metadata.Namespace,
-		"backuppolicies",
-		policy.Metadata.Name,
-	) + "/status"
 
-	condition := map[string]interface{}{
-		"type":               "Ready",
-		"status":             status,
-		"reason":             reason,
-		"message":            message,
-		"lastTransitionTime": time.Now().UTC().Format(time.RFC3339),
-	}
+	conditions := setCondition(policy.Status.Conditions, Condition{
+		Type:    "Ready",
+		Status:  status,
+		Reason:  reason,
+		Message: message,
+	}, time.Now())
 
 	statusMap := map[string]interface{}{
 		"observedGeneration": policy.Metadata.Generation,
-		"conditions":         []map[string]interface{}{condition},
+		"conditions":         conditions,
 		"volumes":            volumes,
 	}
 	if lastSnapshotSync != "" {
 		statusMap["lastSnapshotSync"] = lastSnapshotSync
 	}
+	return patchBackupPolicyStatus(ctx, client, policy.Metadata.Namespace, policy.Metadata.Name, statusMap)
+}
 
-	payload := map[string]interface{}{
-		"apiVersion": policy.APIVersion,
-		"kind":       policy.Kind,
-		"metadata": map[string]interface{}{
-			"name":            policy.Metadata.Name,
-			"namespace":       policy.Metadata.Namespace,
-			"resourceVersion": policy.Metadata.ResourceVersion,
-		},
-		"status": statusMap,
-	}
-
-	respBody, updateStatus, err := client.doRequest("PUT", statusPath, payload)
+func listBackupPolicies(ctx context.Context, client *kubeClient) ([]BackupPolicy, error) {
+	listPath := fmt.Sprintf("/apis/%s/%s/backuppolicies", backupPolicyGroup, backupPolicyVersion)
+	body, status, err := client.doRequest(ctx, "GET", listPath, nil)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	if updateStatus < 200 || updateStatus >= 300 {
-		if updateStatus == http.StatusConflict {
-			latest, err := fetchBackupPolicy(client, policy.Metadata.Namespace, policy.Metadata.Name)
-			if err != nil {
-				return err
-			}
-			policy.Metadata.ResourceVersion = latest.Metadata.ResourceVersion
-			payload["metadata"].(map[string]interface{})["resourceVersion"] = policy.Metadata.ResourceVersion
-			respBody, updateStatus, err = client.doRequest("PUT", statusPath, payload)
-			if err != nil {
-				return err
-			}
-			if updateStatus >= 200 && updateStatus < 300 {
-				return nil
-			}
-		}
-		return fmt.Errorf("status update failed: %s status=%d body=%s", statusPath, updateStatus, strings.TrimSpace(string(respBody)))
+	if status != http.StatusOK {
+		return nil, fmt.Errorf("get failed: %s status=%d", listPath, status)
 	}
-	return nil
+	var list BackupPolicyList
+	if err := json.Unmarshal(body, &list); err != nil {
+		return nil, err
+	}
+	return list.Items, nil
 }
 
-func fetchBackupPolicy(client *kubeClient, ns, name string) (BackupPolicy, error) {
-	itemPath := namespacedPath(
-		fmt.Sprintf("/apis/%s/%s", backupPolicyGroup, backupPolicyVersion),
-		ns,
-		"backuppolicies",
-		name,
-	)
-	body, status, err := client.doRequest("GET", itemPath, nil)
-	if err != nil {
-		return BackupPolicy{}, err
+func patchBackupPolicyStatus(ctx context.Context, client *kubeClient, ns, name string, status map[string]interface{}) error {
+	return patchPolicyStatus(ctx, client, "backuppolicies", ns, name, status)
+}
+
+// patchPolicyStatus merge-patches the status subresource, leaving status
+// fields it does not set, such as restoreTest, untouched. Cluster-scoped
+// policies have an empty ns.
+func patchPolicyStatus(ctx context.Context, client *kubeClient, resource, ns, name string, status map[string]interface{}) error {
+	base := fmt.Sprintf("/apis/%s/%s", backupPolicyGroup, backupPolicyVersion)
+	statusPath := fmt.Sprintf("%s/%s/%s/status", base, resource, name)
+	if ns != "" {
+		statusPath = namespacedPath(base, ns, resource, name) + "/status"
 	}
-	if status != http.StatusOK {
-		return BackupPolicy{}, fmt.Errorf("get failed: %s status=%d", itemPath, status)
+
+	payload := map[string]interface{}{"status": status}
+	respBody, patchStatus, err := client.doRequestWithContentType(ctx, "PATCH", statusPath, "application/merge-patch+json", payload)
+	if err != nil {
+		return err
 	}
-	var policy BackupPolicy
-	if err := json.Unmarshal(body, &policy); err != nil {
-		return BackupPolicy{}, err
+	if patchStatus < 200 || patchStatus >= 300 {
+		return fmt.Errorf("status patch failed: %s status=%d body=%s", statusPath, patchStatus, strings.TrimSpace(string(respBody)))
 	}
-	return policy, nil
+	return nil
 }
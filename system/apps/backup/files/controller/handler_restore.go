@@ -1,63 +1,73 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"log/slog"
 	"net/http"
+	"path"
 	"strings"
 	"time"
 )
 
 type RestorePolicyHandler struct{}
 
-func (h *RestorePolicyHandler) Reconcile(client *kubeClient, cfg Config) error {
+func (h *RestorePolicyHandler) Reconcile(ctx context.Context, client *kubeClient, cfg Config) error {
 	listPath := fmt.Sprintf("/apis/%s/%s/restorepolicies", backupPolicyGroup, backupPolicyVersion)
-	body, status, err := client.doRequest("GET", listPath, nil)
+	body, status, err := client.doRequest(ctx, "GET", listPath, nil)
 	if err != nil {
-		fmt.Printf("failed to list RestorePolicies: %v\n", err)
+		slog.Error("listing RestorePolicies failed", logError, err)
 		return err
 	}
 	if status != http.StatusOK {
 		err := fmt.Errorf("failed to list RestorePolicies: status=%d", status)
-		fmt.Println(err.Error())
+		slog.Error("listing RestorePolicies failed", logResource, listPath, logHTTPStatus, status)
 		return err
 	}
 
 	var list RestorePolicyList
 	if err := json.Unmarshal(body, &list); err != nil {
-		fmt.Printf("failed to parse RestorePolicies: %v\n", err)
+		slog.Error("parsing RestorePolicies failed", logError, err)
 		return err
 	}
-	fmt.Printf("reconcile: found %d RestorePolicies\n", len(list.Items))
+	slog.Debug("reconciling RestorePolicies", "count", len(list.Items))
 
 	for _, policy := range list.Items {
 		hash, err := policySpecHash(policy.Spec)
 		if err != nil {
-			fmt.Printf("restore reconcile failed for %s/%s: %v\n", policy.Metadata.Namespace, policy.Metadata.Name, err)
+			policyLog(policy.Metadata.Namespace, policy.Metadata.Name).Error("restore reconcile failed", logError, err)
 			return err
 		}
 		if policy.Metadata.Annotations != nil && policy.Metadata.Annotations[processedHashAnnotation] == hash {
+			if err := checkRestoreCompletion(ctx, client, policy, time.Now()); err != nil {
+				policyLog(policy.Metadata.Namespace, policy.Metadata.Name).Error("restore completion check failed", logError, err)
+			}
 			continue
 		}
 
-		if err := reconcileRestorePolicy(client, cfg, policy); err != nil {
-			fmt.Printf("restore reconcile failed for %s/%s: %v\n", policy.Metadata.Namespace, policy.Metadata.Name, err)
-			if err := updateRestoreStatus(client, policy, "False", "ReconcileError", err.Error()); err != nil {
-				fmt.Printf("restore status update failed for %s/%s: %v\n", policy.Metadata.Namespace, policy.Metadata.Name, err)
+		if err := reconcileRestorePolicy(ctx, client, cfg, policy); restorePendingReason(err) != "" {
+			markRestorePending(ctx, client, policy, err)
+			continue
+		} else if err != nil {
+			policyLog(policy.Metadata.Namespace, policy.Metadata.Name).Error("restore reconcile failed", logError, err)
+			if err := updateRestoreStatus(ctx, client, policy, "False", "ReconcileError", err.Error()); err != nil {
+				policyLog(policy.Metadata.Namespace, policy.Metadata.Name).Error("restore status update failed", logError, err)
 				return err
 			}
-			if err := updateProcessedHash(client, "restorepolicies", policy.Metadata.Namespace, policy.Metadata.Name, hash); err != nil {
-				fmt.Printf("processed hash update failed for %s/%s: %v\n", policy.Metadata.Namespace, policy.Metadata.Name, err)
+			if err := updateProcessedHash(ctx, client, "restorepolicies", policy.Metadata.Namespace, policy.Metadata.Name, hash); err != nil {
+				policyLog(policy.Metadata.Namespace, policy.Metadata.Name).Error("processed hash update failed", logError, err)
 				return err
 			}
 			return err
 		}
-		if err := updateRestoreStatus(client, policy, "True", "Reconciled", "Reconcile successful"); err != nil {
-			fmt.Printf("restore status update failed for %s/%s: %v\n", policy.Metadata.Namespace, policy.Metadata.Name, err)
+		if err := updateRestoreStatus(ctx, client, policy, "False", "Restoring", "Waiting for the restore to finish"); err != nil {
+			policyLog(policy.Metadata.Namespace, policy.Metadata.Name).Error("restore status update failed", logError, err)
 			return err
 		}
-		if err := updateProcessedHash(client, "restorepolicies", policy.Metadata.Namespace, policy.Metadata.Name, hash); err != nil {
-			fmt.Printf("processed hash update failed for %s/%s: %v\n", policy.Metadata.Namespace, policy.Metadata.Name, err)
+		if err := updateProcessedHash(ctx, client, "restorepolicies", policy.Metadata.Namespace, policy.Metadata.Name, hash); err != nil {
+			policyLog(policy.Metadata.Namespace, policy.Metadata.Name).Error("processed hash update failed", logError, err)
 			return err
 		}
 	}
@@ -65,9 +75,8 @@ func (h *RestorePolicyHandler) Reconcile(client *kubeClient, cfg Config) error {
 	return nil
 }
 
-func reconcileRestorePolicy(client *kubeClient, cfg Config, policy RestorePolicy) error {
+func reconcileRestorePolicy(ctx context.Context, client *kubeClient, cfg Config, policy RestorePolicy) error {
 	ns := policy.Metadata.Namespace
-	name := policy.Metadata.Name
 	if policy.APIVersion == "" {
 		policy.APIVersion = fmt.Sprintf("%s/%s", backupPolicyGroup, backupPolicyVersion)
 	}
@@ -79,29 +88,292 @@ func reconcileRestorePolicy(client *kubeClient, cfg Config, policy RestorePolicy
 		return fmt.Errorf("spec.sourceNamespace is required")
 	}
 
+	sourcePVCs := map[string]map[string]interface{}{}
 	for _, vol := range policy.Spec.Volumes {
 		if vol.SourcePVC == "" || vol.TargetPVC == "" {
 			continue
 		}
-		secretName := sanitizeName(fmt.Sprintf("restore-repo-%s-%s", name, vol.SourcePVC))
-		if err := ensureRestoreExternalSecret(client, cfg, ns, secretName, policy.Spec.SourceNamespace, vol.SourcePVC, policy); err != nil {
+		exists, err := objectExists(ctx, client, namespacedPath("/api/v1", ns, "persistentvolumeclaims", vol.TargetPVC))
+		if err != nil {
 			return err
 		}
+		if exists {
+			continue
+		}
+		src, err := sourcePVCObject(ctx, client, ns, policy.Spec.SourceNamespace, vol.SourcePVC, pvcMetadataRecords.lookup)
+		if err != nil {
+			return err
+		}
+		sourcePVCs[policy.Spec.SourceNamespace+"/"+vol.SourcePVC] = src
+	}
 
-		if err := ensureTargetPVC(client, cfg, ns, policy.Spec.SourceNamespace, vol.SourcePVC, vol.TargetPVC); err != nil {
+	// Partial restores pick their snapshot from a listing of the repository,
+	// which needs the repository secret, so the other objects are applied
+	// while it runs.
+	snapshots := map[string]string{}
+	limitArgs, err := sourceLimitArgs(ctx, client, policy)
+	if err != nil {
+		return err
+	}
+	var listings []string
+	var pending error
+	for _, vol := range policy.Spec.Volumes {
+		if vol.SourcePVC == "" || vol.TargetPVC == "" || !vol.partial() {
+			continue
+		}
+		restoreName := restoreResourceName(policy.Metadata.Name, vol.TargetPVC)
+		jobName, err := partialRestoreJobName(restoreName, vol)
+		if err != nil {
+			return err
+		}
+		exists, err := objectExists(ctx, client, namespacedPath("/apis/batch/v1", ns, "jobs", jobName))
+		if err != nil {
+			return err
+		}
+		if exists {
+			continue
+		}
+		secretName := restoreSecretName(policy.Metadata.Name, vol.SourcePVC)
+		snapshot, err := restoreSnapshot(ctx, client, cfg, ns, restoreName, secretName, limitArgs[vol.SourcePVC], vol, restoreLabels(policy))
+		if errors.Is(err, errRestoreSnapshotPending) {
+			pending = err
+			continue
+		}
+		if err != nil {
 			return err
 		}
+		snapshots[vol.TargetPVC] = snapshot
+		listing, _ := restoreSnapshotsJobName(restoreName, vol)
+		listings = append(listings, listing)
+	}
 
-		restoreName := sanitizeName(fmt.Sprintf("restore-%s-%s", name, vol.TargetPVC))
-		if err := ensureReplicationDestination(client, cfg, ns, restoreName, secretName, vol.TargetPVC, vol.RestoreAsOf, policy); err != nil {
+	objects, err := renderRestorePolicy(cfg, policy, sourcePVCs, snapshots, limitArgs)
+	if err != nil {
+		return err
+	}
+	if pending != nil {
+		var waiting []renderedObject
+		for _, rendered := range objects {
+			if rendered.Object["kind"] != "Job" {
+				waiting = append(waiting, rendered)
+			}
+		}
+		if err := applyRendered(ctx, client, waiting, nil); err != nil {
 			return err
 		}
+		return pending
+	}
+	if err := applyRendered(ctx, client, objects, nil); err != nil {
+		return err
+	}
+	for _, listing := range listings {
+		cleanupJob(client, ns, listing)
+	}
+	return nil
+}
+
+// sourceLimitArgs returns the restic bandwidth flags of the BackupPolicies
+// that back up the partially restored volumes of policy, keyed by source PVC.
+// Volumes no policy covers any more restore without limits.
+func sourceLimitArgs(ctx context.Context, client *kubeClient, policy RestorePolicy) (map[string]string, error) {
+	partial := false
+	for _, vol := range policy.Spec.Volumes {
+		partial = partial || vol.partial()
+	}
+	if !partial {
+		return nil, nil
+	}
+	var sources BackupPolicyList
+	listPath := namespacedPath(fmt.Sprintf("/apis/%s/%s", backupPolicyGroup, backupPolicyVersion), policy.Spec.SourceNamespace, "backuppolicies")
+	if err := getJSON(ctx, client, listPath, &sources); err != nil {
+		return nil, err
+	}
+	return restoreLimitArgs(policy, sources.Items), nil
+}
+
+// restoreLimitArgs returns the restic bandwidth flags of the BackupPolicies in
+// the source namespace of policy, keyed by the PVCs they back up.
+func restoreLimitArgs(policy RestorePolicy, sources []BackupPolicy) map[string]string {
+	limitArgs := map[string]string{}
+	for _, source := range sources {
+		if source.Metadata.Namespace != policy.Spec.SourceNamespace {
+			continue
+		}
+		for _, vol := range source.Spec.Volumes {
+			limitArgs[vol.PVC] = resticLimitArgs(source.Spec.Mover)
+		}
 	}
+	return limitArgs
+}
 
+func restoreSecretName(policyName, sourcePVC string) string {
+	return sanitizeName(fmt.Sprintf("restore-repo-%s-%s", policyName, sourcePVC))
+}
+
+func restoreLabels(policy RestorePolicy) map[string]interface{} {
+	return map[string]interface{}{
+		"restore-policy/name":      policy.Metadata.Name,
+		"restore-policy/namespace": policy.Metadata.Namespace,
+	}
+}
+
+// restorePendingReason returns the Ready reason of a reconcile that waits for
+// the recorded metadata of a source PVC or for a snapshot listing, or "".
+func restorePendingReason(err error) string {
+	switch {
+	case errors.Is(err, errPVCMetadataPending):
+		return "MetadataPending"
+	case errors.Is(err, errRestoreSnapshotPending):
+		return "SnapshotPending"
+	}
+	return ""
+}
+
+// markRestorePending sets the Ready reason of a reconcile that waits. The
+// policy is not marked as processed, so a later reconcile continues once the
+// wait is over.
+func markRestorePending(ctx context.Context, client *kubeClient, policy RestorePolicy, err error) {
+	policyLog(policy.Metadata.Namespace, policy.Metadata.Name).Info("restore waiting", "message", err.Error())
+	if err := updateRestoreStatus(ctx, client, policy, "False", restorePendingReason(err), err.Error()); err != nil {
+		policyLog(policy.Metadata.Namespace, policy.Metadata.Name).Error("restore status update failed", logError, err)
+	}
+}
+
+const restoredCondition = "Restored"
+
+// checkRestoreCompletion sets the Restored condition once every volume of the
+// policy finished restoring and notifies about the outcome.
+func checkRestoreCompletion(ctx context.Context, client *kubeClient, policy RestorePolicy, now time.Time) error {
+	if findCondition(policy.Status.Conditions, restoredCondition) != nil {
+		return nil
+	}
+	ns := policy.Metadata.Namespace
+	var restored, failed []string
+	for _, vol := range policy.Spec.Volumes {
+		if vol.SourcePVC == "" || vol.TargetPVC == "" {
+			continue
+		}
+		restoreName := restoreResourceName(policy.Metadata.Name, vol.TargetPVC)
+		var result string
+		var err error
+		if vol.partial() {
+			var jobName string
+			if jobName, err = partialRestoreJobName(restoreName, vol); err == nil {
+				result, err = jobResult(ctx, client, ns, jobName)
+			}
+		} else {
+			result, err = replicationDestinationResult(ctx, client, ns, restoreName, "init")
+		}
+		if err != nil {
+			return err
+		}
+		switch result {
+		case "":
+			return nil
+		case "Successful":
+			restored = append(restored, vol.TargetPVC)
+		default:
+			failed = append(failed, vol.TargetPVC)
+		}
+	}
+	if len(restored) == 0 && len(failed) == 0 {
+		return nil
+	}
+
+	conditions, condition := restoreCompletionConditions(policy.Status.Conditions, restored, failed, now)
+	event := notifyRestoreCompleted
+	if len(failed) > 0 {
+		event = notifyRestoreFailed
+	}
+	if err := patchPolicyStatus(ctx, client, "restorepolicies", ns, policy.Metadata.Name, map[string]interface{}{
+		"conditions": conditions,
+	}); err != nil {
+		return err
+	}
+	policyLog(ns, policy.Metadata.Name).Info("restore finished", "reason", condition.Reason, "message", condition.Message)
+	notifications.notify(notification{
+		Event:     event,
+		Kind:      "RestorePolicy",
+		Namespace: ns,
+		Name:      policy.Metadata.Name,
+		Message:   condition.Message,
+	}, policy.Spec.Notifications)
 	return nil
 }
 
-func ensureReplicationDestination(client *kubeClient, cfg Config, ns, name, secretName, pvc, restoreAsOf string, policy RestorePolicy) error {
+// restoreCompletionConditions sets the Restored condition from the outcome of
+// the restore, and Ready, which stays False while the restore runs.
+func restoreCompletionConditions(conditions []Condition, restored, failed []string, now time.Time) ([]Condition, Condition) {
+	condition := Condition{
+		Type:    restoredCondition,
+		Status:  "True",
+		Reason:  "Completed",
+		Message: fmt.Sprintf("restored %s", strings.Join(restored, ", ")),
+	}
+	ready := Condition{Type: "Ready", Status: "True", Reason: "Restored", Message: condition.Message}
+	if len(failed) > 0 {
+		condition.Status = "False"
+		condition.Reason = "Failed"
+		condition.Message = fmt.Sprintf("failed to restore %s", strings.Join(failed, ", "))
+		ready = Condition{Type: "Ready", Status: "False", Reason: "RestoreFailed", Message: condition.Message}
+	}
+	return setCondition(setCondition(conditions, condition, now), ready, now), condition
+}
+
+// jobResult returns Successful or Failed once the Job finished, or an empty
+// string while it runs.
+func jobResult(ctx context.Context, client *kubeClient, ns, name string) (string, error) {
+	var job struct {
+		Status struct {
+			Succeeded int64 `json:"succeeded"`
+			Failed    int64 `json:"failed"`
+		} `json:"status"`
+	}
+	if err := getJSON(ctx, client, namespacedPath("/apis/batch/v1", ns, "jobs", name), &job); err != nil {
+		return "", err
+	}
+	switch {
+	case job.Status.Succeeded > 0:
+		return "Successful", nil
+	case job.Status.Failed > 0:
+		return "Failed", nil
+	}
+	return "", nil
+}
+
+// replicationDestinationResult returns the mover result of the sync started
+// by trigger, or an empty string while it runs.
+func replicationDestinationResult(ctx context.Context, client *kubeClient, ns, name, trigger string) (string, error) {
+	var rd struct {
+		Status struct {
+			LastManualSync    string `json:"lastManualSync"`
+			LatestMoverStatus struct {
+				Result string `json:"result"`
+			} `json:"latestMoverStatus"`
+		} `json:"status"`
+	}
+	if err := getJSON(ctx, client, namespacedPath("/apis/volsync.backube/v1alpha1", ns, "replicationdestinations", name), &rd); err != nil {
+		return "", err
+	}
+	if rd.Status.LastManualSync != trigger {
+		return "", nil
+	}
+	return rd.Status.LatestMoverStatus.Result, nil
+}
+
+func restoreResourceName(policyName, targetPVC string) string {
+	return sanitizeName(fmt.Sprintf("restore-%s-%s", policyName, targetPVC))
+}
+
+func ensureReplicationDestination(ctx context.Context, client *kubeClient, cfg Config, ns, name, secretName, pvc, restoreAsOf, trigger string, labels map[string]interface{}, owner *BackupPolicy) error {
+	obj := replicationDestinationObject(cfg, ns, name, secretName, pvc, restoreAsOf, trigger, labels)
+	if owner != nil {
+		setMoverFields(obj["spec"].(map[string]interface{})["restic"].(map[string]interface{}), owner.Spec.Mover)
+	}
+	return client.apply(ctx, namespacedPath("/apis/volsync.backube/v1alpha1", ns, "replicationdestinations", name), obj, owner)
+}
+
+func replicationDestinationObject(cfg Config, ns, name, secretName, pvc, restoreAsOf, trigger string, labels map[string]interface{}) map[string]interface{} {
 	resticSpec := map[string]interface{}{
 		"repository":     secretName,
 		"copyMethod":     "Direct",
@@ -123,30 +395,252 @@ func ensureReplicationDestination(client *kubeClient, cfg Config, ns, name, secr
 		},
 	}
 
-	obj := map[string]interface{}{
+	return map[string]interface{}{
 		"apiVersion": "volsync.backube/v1alpha1",
 		"kind":       "ReplicationDestination",
 		"metadata": map[string]interface{}{
 			"name":      name,
 			"namespace": ns,
-			"labels": map[string]interface{}{
-				"restore-policy/name":      policy.Metadata.Name,
-				"restore-policy/namespace": ns,
-			},
+			"labels":    labels,
 		},
 		"spec": map[string]interface{}{
 			"trigger": map[string]interface{}{
-				"manual": "init",
+				"manual": trigger,
 			},
 			"restic": resticSpec,
 		},
 	}
+}
+
+// partialRestoreJobObject restores the include/exclude selection of snapshotID
+// into targetSubPath of the target PVC with a restic Job. Jobs are immutable, so
+// the name carries a hash of the volume spec and the Job is only created once.
+func partialRestoreJobObject(cfg Config, ns, name, secretName, snapshotID, limitArgs string, vol RestoreVolume, labels map[string]interface{}) (map[string]interface{}, error) {
+	subPath := strings.Trim(vol.TargetSubPath, "/")
+	if subPath != "" && strings.TrimPrefix(path.Clean("/"+subPath), "/") != subPath {
+		return nil, fmt.Errorf("targetSubPath %q must be a clean path inside the target volume", vol.TargetSubPath)
+	}
+	if vol.RestoreAsOf != "" {
+		if _, err := time.Parse(time.RFC3339, vol.RestoreAsOf); err != nil {
+			return nil, fmt.Errorf("invalid restoreAsOf %q: %w", vol.RestoreAsOf, err)
+		}
+	}
+
+	jobName, err := partialRestoreJobName(name, vol)
+	if err != nil {
+		return nil, err
+	}
 
-	return client.upsert(namespacedPath("/apis/volsync.backube/v1alpha1", ns, "replicationdestinations", name),
-		namespacedPath("/apis/volsync.backube/v1alpha1", ns, "replicationdestinations"), obj, nil)
+	target := "/restore"
+	if subPath != "" {
+		target = "/restore/" + subPath
+	}
+	return restoreResticJobObject(cfg, ns, jobName, secretName, vol.TargetPVC, partialRestoreScript(), []map[string]interface{}{
+		{"name": "SNAPSHOT_ID", "value": snapshotID},
+		{"name": "RESTORE_TARGET", "value": target},
+		{"name": "INCLUDE_PATHS", "value": strings.Join(vol.IncludePaths, "\n")},
+		{"name": "EXCLUDE_PATHS", "value": strings.Join(vol.ExcludePaths, "\n")},
+		{"name": resticLimitEnv, "value": limitArgs},
+	}, labels), nil
 }
 
-func ensureRestoreExternalSecret(client *kubeClient, cfg Config, ns, secretName, sourceNamespace, sourcePVC string, policy RestorePolicy) error {
+// restoreResticJobObject runs script with the restore repository secret and
+// the repository PVC, and with targetPVC mounted at /restore when it is set.
+func restoreResticJobObject(cfg Config, ns, jobName, secretName, targetPVC, script string, env []map[string]interface{}, labels map[string]interface{}) map[string]interface{} {
+	volumeMounts := []map[string]interface{}{
+		{
+			"name":      "repo",
+			"mountPath": fmt.Sprintf("/mnt/%s", cfg.RepoMountPath),
+		},
+	}
+	volumes := []map[string]interface{}{
+		{
+			"name": "repo",
+			"persistentVolumeClaim": map[string]interface{}{
+				"claimName": cfg.RepoPVCName,
+				"readOnly":  false,
+			},
+		},
+	}
+	if targetPVC != "" {
+		volumeMounts = append(volumeMounts, map[string]interface{}{
+			"name":      "target",
+			"mountPath": "/restore",
+		})
+		volumes = append(volumes, map[string]interface{}{
+			"name": "target",
+			"persistentVolumeClaim": map[string]interface{}{
+				"claimName": targetPVC,
+			},
+		})
+	}
+	container := map[string]interface{}{
+		"name":            "restore",
+		"image":           cfg.ResticImage,
+		"imagePullPolicy": "IfNotPresent",
+		"envFrom": []map[string]interface{}{
+			{
+				"secretRef": map[string]interface{}{
+					"name": secretName,
+				},
+			},
+		},
+		"env":          env,
+		"command":      []string{"/bin/sh", "-c"},
+		"args":         []string{script},
+		"volumeMounts": volumeMounts,
+	}
+
+	return map[string]interface{}{
+		"apiVersion": "batch/v1",
+		"kind":       "Job",
+		"metadata": map[string]interface{}{
+			"name":      jobName,
+			"namespace": ns,
+			"labels":    labels,
+		},
+		"spec": map[string]interface{}{
+			"backoffLimit": 0,
+			"template": map[string]interface{}{
+				"spec": map[string]interface{}{
+					"restartPolicy": "Never",
+					"containers":    []map[string]interface{}{container},
+					"volumes":       volumes,
+				},
+			},
+		},
+	}
+}
+
+func partialRestoreJobName(restoreName string, vol RestoreVolume) (string, error) {
+	hash, err := policySpecHash(vol)
+	if err != nil {
+		return "", err
+	}
+	return sanitizeName(fmt.Sprintf("%s-%s", restoreName, hash[:8])), nil
+}
+
+// partialRestoreScript restores SNAPSHOT_ID relative to the /data directory
+// the VolSync mover backs up, so include and exclude patterns match paths in
+// the volume.
+func partialRestoreScript() string {
+	return strings.TrimSpace(`
+set -eu
+
+if [ -z "${SNAPSHOT_ID}" ]; then
+  echo "no snapshot selected"
+  exit 1
+fi
+
+set --
+while IFS= read -r pattern; do
+  if [ -n "${pattern}" ]; then set -- "$@" --include "${pattern}"; fi
+done <<PATTERNS
+${INCLUDE_PATHS}
+PATTERNS
+while IFS= read -r pattern; do
+  if [ -n "${pattern}" ]; then set -- "$@" --exclude "${pattern}"; fi
+done <<PATTERNS
+${EXCLUDE_PATHS}
+PATTERNS
+
+mkdir -p "${RESTORE_TARGET}"
+echo "Restoring snapshot ${SNAPSHOT_ID} into ${RESTORE_TARGET}"
+restic ${RESTIC_LIMIT_ARGS} restore "${SNAPSHOT_ID}:/data" --target "${RESTORE_TARGET}" "$@"
+`)
+}
+
+// errRestoreSnapshotPending is returned while the snapshots a partial restore
+// picks from are listed.
+var errRestoreSnapshotPending = errors.New("listing snapshots to restore")
+
+// restoreSnapshotsJobName is the Job that lists the snapshots of a partial
+// restore's repository.
+func restoreSnapshotsJobName(restoreName string, vol RestoreVolume) (string, error) {
+	jobName, err := partialRestoreJobName(restoreName, vol)
+	if err != nil {
+		return "", err
+	}
+	return sanitizeName(jobName + "-snapshots"), nil
+}
+
+// restoreSnapshot returns the snapshot a partial restore of vol restores. It
+// starts a Job listing the VolSync snapshots of the repository and returns
+// errRestoreSnapshotPending until the Job finished. The Job is kept until the
+// restore Job was created, so the other volumes of the policy can wait for
+// their listing without listing this one again.
+func restoreSnapshot(ctx context.Context, client *kubeClient, cfg Config, ns, restoreName, secretName, limitArgs string, vol RestoreVolume, labels map[string]interface{}) (string, error) {
+	jobName, err := restoreSnapshotsJobName(restoreName, vol)
+	if err != nil {
+		return "", err
+	}
+	job := restoreResticJobObject(cfg, ns, jobName, secretName, "", "restic ${RESTIC_LIMIT_ARGS} snapshots --host volsync --json", []map[string]interface{}{
+		{"name": resticLimitEnv, "value": limitArgs},
+	}, labels)
+	job["spec"].(map[string]interface{})["ttlSecondsAfterFinished"] = 86400
+	itemPath, collectionPath, err := objectPaths(job)
+	if err != nil {
+		return "", err
+	}
+	if err := client.createIfMissing(ctx, itemPath, collectionPath, job); err != nil {
+		return "", err
+	}
+	result, err := jobResult(ctx, client, ns, jobName)
+	if err != nil {
+		return "", err
+	}
+	if result == "" {
+		return "", fmt.Errorf("%w for %s", errRestoreSnapshotPending, vol.TargetPVC)
+	}
+	logs, err := getJobLogs(ctx, client, ns, jobName)
+	if err != nil {
+		return "", err
+	}
+	if result != "Successful" {
+		return "", fmt.Errorf("listing snapshots for %s failed: %s", vol.TargetPVC, logTail(logs))
+	}
+	var snapshots []resticSnapshot
+	if err := json.Unmarshal([]byte(logs), &snapshots); err != nil {
+		return "", fmt.Errorf("failed to parse restic snapshots output: %w", err)
+	}
+	return pickRestoreSnapshot(snapshots, vol.RestoreAsOf)
+}
+
+// pickRestoreSnapshot returns the ID of the newest snapshot taken at or before
+// restoreAsOf, to the second, or of the newest snapshot when it is empty.
+func pickRestoreSnapshot(snapshots []resticSnapshot, restoreAsOf string) (string, error) {
+	var asOf time.Time
+	if restoreAsOf != "" {
+		parsed, err := time.Parse(time.RFC3339, restoreAsOf)
+		if err != nil {
+			return "", fmt.Errorf("invalid restoreAsOf %q: %w", restoreAsOf, err)
+		}
+		asOf = parsed
+	}
+	var picked string
+	var pickedTime time.Time
+	for _, snapshot := range snapshots {
+		taken, err := time.Parse(time.RFC3339Nano, snapshot.Time)
+		if err != nil || snapshot.ID == "" {
+			continue
+		}
+		if !asOf.IsZero() && taken.Truncate(time.Second).After(asOf) {
+			continue
+		}
+		if picked == "" || taken.After(pickedTime) {
+			picked, pickedTime = snapshot.ID, taken
+		}
+	}
+	if picked == "" {
+		if restoreAsOf == "" {
+			restoreAsOf = "now"
+		}
+		return "", fmt.Errorf("no snapshot found at or before %s", restoreAsOf)
+	}
+	return picked, nil
+}
+
+func restoreExternalSecretObject(cfg Config, ns, secretName, sourceNamespace, sourcePVC string, policy RestorePolicy) map[string]interface{} {
 	secretData := []map[string]interface{}{
 		{
 			"remoteRef": map[string]interface{}{"key": cfg.ExternalSecretKey, "property": cfg.ResticPasswordProperty},
@@ -159,7 +653,7 @@ func ensureRestoreExternalSecret(client *kubeClient, cfg Config, ns, secretName,
 		"RESTIC_REPOSITORY": fmt.Sprintf("/mnt/%s/%s/%s", cfg.RepoMountPath, sourceNamespace, sourcePVC),
 	}
 
-	obj := map[string]interface{}{
+	return map[string]interface{}{
 		"apiVersion": "external-secrets.io/v1beta1",
 		"kind":       "ExternalSecret",
 		"metadata": map[string]interface{}{
@@ -183,37 +677,28 @@ func ensureRestoreExternalSecret(client *kubeClient, cfg Config, ns, secretName,
 			},
 		},
 	}
-
-	return client.upsert(namespacedPath("/apis/external-secrets.io/v1beta1", ns, "externalsecrets", secretName),
-		namespacedPath("/apis/external-secrets.io/v1beta1", ns, "externalsecrets"), obj, nil)
 }
 
-func ensureTargetPVC(client *kubeClient, cfg Config, targetNamespace, sourceNamespace, sourcePVC, targetPVC string) error {
+func ensureTargetPVC(ctx context.Context, client *kubeClient, cfg Config, targetNamespace, sourceNamespace, sourcePVC, targetPVC string) error {
 	itemPath := namespacedPath("/api/v1", targetNamespace, "persistentvolumeclaims", targetPVC)
-	_, status, err := client.doRequest("GET", itemPath, nil)
-	if err != nil {
+	exists, err := objectExists(ctx, client, itemPath)
+	if err != nil || exists {
 		return err
 	}
-	if status == http.StatusOK {
-		return nil
-	}
-	if status != http.StatusNotFound {
-		return fmt.Errorf("get failed: %s status=%d", itemPath, status)
-	}
 
-	srcPath := namespacedPath("/api/v1", sourceNamespace, "persistentvolumeclaims", sourcePVC)
-	srcBody, srcStatus, err := client.doRequest("GET", srcPath, nil)
+	// The restore test runs in its own goroutine and can wait for the
+	// recorded metadata.
+	src, err := sourcePVCObject(ctx, client, targetNamespace, sourceNamespace, sourcePVC, func(ctx context.Context, key pvcMetadataKey) (*pvcMetadata, error) {
+		return readPVCMetadata(ctx, client, cfg, key.Namespace, key.SourceNamespace, key.PVC)
+	})
 	if err != nil {
 		return err
 	}
-	if srcStatus != http.StatusOK {
-		return fmt.Errorf("get failed: %s status=%d", srcPath, srcStatus)
-	}
+	return client.createIfMissing(ctx, itemPath, namespacedPath("/api/v1", targetNamespace, "persistentvolumeclaims"), targetPVCObject(src, targetNamespace, targetPVC))
+}
 
-	var src map[string]interface{}
-	if err := json.Unmarshal(srcBody, &src); err != nil {
-		return err
-	}
+// targetPVCObject sizes a restore target like the source PVC it restores.
+func targetPVCObject(src map[string]interface{}, targetNamespace, targetPVC string) map[string]interface{} {
 	srcSpec, _ := src["spec"].(map[string]interface{})
 	srcResources, _ := srcSpec["resources"].(map[string]interface{})
 	srcRequests, _ := srcResources["requests"].(map[string]interface{})
@@ -241,92 +726,27 @@ func ensureTargetPVC(client *kubeClient, cfg Config, targetNamespace, sourceName
 	if srcStorageClass != "" {
 		pvc["spec"].(map[string]interface{})["storageClassName"] = srcStorageClass
 	}
-
-	_, createStatus, err := client.doRequest("POST", namespacedPath("/api/v1", targetNamespace, "persistentvolumeclaims"), pvc)
-	if err != nil {
-		return err
-	}
-	if createStatus < 200 || createStatus >= 300 {
-		return fmt.Errorf("create failed: %s status=%d", targetNamespace, createStatus)
-	}
-	return nil
+	return pvc
 }
 
-func updateRestoreStatus(client *kubeClient, policy RestorePolicy, status, reason, message string) error {
+func updateRestoreStatus(ctx context.Context, client *kubeClient, policy RestorePolicy, status, reason, message string) error {
 	if policy.Metadata.Name == "" || policy.Metadata.Namespace == "" {
 		return fmt.Errorf("missing policy name/namespace for status update")
 	}
-	statusPath := namespacedPath(
-		fmt.Sprintf("/apis/%s/%s", backupPolicyGroup, backupPolicyVersion),
-		policy.Metadata.Namespace,
-		"restorepolicies",
-		policy.Metadata.Name,
-	) + "/status"
-
-	condition := map[string]interface{}{
-		"type":               "Ready",
-		"status":             status,
-		"reason":             reason,
-		"message":            message,
-		"lastTransitionTime": time.Now().UTC().Format(time.RFC3339),
-	}
-
-	payload := map[string]interface{}{
-		"apiVersion": policy.APIVersion,
-		"kind":       policy.Kind,
-		"metadata": map[string]interface{}{
-			"name":            policy.Metadata.Name,
-			"namespace":       policy.Metadata.Namespace,
-			"resourceVersion": policy.Metadata.ResourceVersion,
-		},
-		"status": map[string]interface{}{
-			"observedGeneration": policy.Metadata.Generation,
-			"conditions":         []map[string]interface{}{condition},
-		},
-	}
-
-	respBody, updateStatus, err := client.doRequest("PUT", statusPath, payload)
-	if err != nil {
-		return err
-	}
-	if updateStatus < 200 || updateStatus >= 300 {
-		if updateStatus == http.StatusConflict {
-			latest, err := fetchRestorePolicy(client, policy.Metadata.Namespace, policy.Metadata.Name)
-			if err != nil {
-				return err
-			}
-			policy.Metadata.ResourceVersion = latest.Metadata.ResourceVersion
-			payload["metadata"].(map[string]interface{})["resourceVersion"] = policy.Metadata.ResourceVersion
-			respBody, updateStatus, err = client.doRequest("PUT", statusPath, payload)
-			if err != nil {
-				return err
-			}
-			if updateStatus >= 200 && updateStatus < 300 {
-				return nil
-			}
+	// A changed spec restores again, so the Restored condition is reset.
+	var conditions []Condition
+	for _, condition := range policy.Status.Conditions {
+		if condition.Type != restoredCondition {
+			conditions = append(conditions, condition)
 		}
-		return fmt.Errorf("status update failed: %s status=%d body=%s", statusPath, updateStatus, strings.TrimSpace(string(respBody)))
-	}
-	return nil
-}
-
-func fetchRestorePolicy(client *kubeClient, ns, name string) (RestorePolicy, error) {
-	itemPath := namespacedPath(
-		fmt.Sprintf("/apis/%s/%s", backupPolicyGroup, backupPolicyVersion),
-		ns,
-		"restorepolicies",
-		name,
-	)
-	body, status, err := client.doRequest("GET", itemPath, nil)
-	if err != nil {
-		return RestorePolicy{}, err
-	}
-	if status != http.StatusOK {
-		return RestorePolicy{}, fmt.Errorf("get failed: %s status=%d", itemPath, status)
-	}
-	var policy RestorePolicy
-	if err := json.Unmarshal(body, &policy); err != nil {
-		return RestorePolicy{}, err
 	}
-	return policy, nil
+	return patchPolicyStatus(ctx, client, "restorepolicies", policy.Metadata.Namespace, policy.Metadata.Name, map[string]interface{}{
+		"observedGeneration": policy.Metadata.Generation,
+		"conditions": setCondition(conditions, Condition{
+			Type:    "Ready",
+			Status:  status,
+			Reason:  reason,
+			Message: message,
+		}, time.Now()),
+	})
 }
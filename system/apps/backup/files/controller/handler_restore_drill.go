@@ -0,0 +1,374 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	restoreTestPassed = "Passed"
+	restoreTestFailed = "Failed"
+	restoreTestError  = "Error"
+)
+
+var restoreTestsRunning = struct {
+	sync.Mutex
+	policies map[string]bool
+	// wg lets the scheduler wait for running tests to clean up on shutdown.
+	wg sync.WaitGroup
+}{policies: map[string]bool{}}
+
+// startRestoreTestScheduler periodically restores the latest snapshot of every
+// volume of policies with spec.restoreTest set, validates the restored data and
+// records the outcome in status.restoreTest.
+func startRestoreTestScheduler(ctx context.Context, client *kubeClient, cfg Config) {
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			restoreTestsRunning.wg.Wait()
+			return
+		case <-ticker.C:
+		}
+		scheduleRestoreTests(ctx, client, cfg, time.Now().UTC())
+	}
+}
+
+func scheduleRestoreTests(ctx context.Context, client *kubeClient, cfg Config, now time.Time) {
+	policies, err := listBackupPolicies(ctx, client)
+	if err != nil {
+		slog.Error("restore test: listing BackupPolicies failed", logError, err)
+		return
+	}
+
+	for _, policy := range policies {
+		spec := policy.Spec.RestoreTest
+		if spec == nil || spec.Schedule == "" {
+			continue
+		}
+		policy, err := resolveVolumes(ctx, client, policy)
+		if err != nil {
+			policyLog(policy.Metadata.Namespace, policy.Metadata.Name).Error("restore test: resolving volumes failed", logError, err)
+			continue
+		}
+		ns := policy.Metadata.Namespace
+		name := policy.Metadata.Name
+		timeZone := spec.TimeZone
+		if timeZone == "" {
+			timeZone = policy.Spec.TimeZone
+		}
+
+		current := policy.Status.RestoreTest
+		if current == nil {
+			current = &RestoreTestStatus{}
+		}
+
+		schedule, err := expandHashedSchedule(spec.Schedule, ns+"/"+name+"/restore-test")
+		var sched *cronSchedule
+		if err == nil {
+			sched, err = parseCronSchedule(schedule, timeZone)
+		}
+		if err != nil {
+			if current.Result == restoreTestError && current.Message == err.Error() {
+				continue
+			}
+			policyLog(ns, name).Warn("restore test: invalid schedule", logError, err)
+			if err := patchBackupPolicyStatus(ctx, client, ns, name, map[string]interface{}{
+				"restoreTest": map[string]interface{}{
+					"schedule": spec.Schedule,
+					"timeZone": timeZone,
+					"nextRun":  nil,
+					"result":   restoreTestError,
+					"message":  err.Error(),
+				},
+			}); err != nil {
+				policyLog(ns, name).Error("restore test: status update failed", logError, err)
+			}
+			continue
+		}
+
+		if current.Schedule != spec.Schedule || current.TimeZone != timeZone || current.NextRun == "" {
+			nextRun := sched.Next(now).UTC().Format(time.RFC3339)
+			policyLog(ns, name).Info("restore test scheduled", "next_run", nextRun)
+			if err := patchBackupPolicyStatus(ctx, client, ns, name, map[string]interface{}{
+				"restoreTest": map[string]interface{}{
+					"schedule": spec.Schedule,
+					"timeZone": timeZone,
+					"nextRun":  nextRun,
+				},
+			}); err != nil {
+				policyLog(ns, name).Error("restore test: status update failed", logError, err)
+			}
+			continue
+		}
+
+		nextRun, err := time.Parse(time.RFC3339, current.NextRun)
+		if err != nil || now.Before(nextRun) {
+			continue
+		}
+
+		key := ns + "/" + name
+		restoreTestsRunning.Lock()
+		if restoreTestsRunning.policies[key] {
+			restoreTestsRunning.Unlock()
+			continue
+		}
+		restoreTestsRunning.policies[key] = true
+		restoreTestsRunning.Unlock()
+
+		restoreTestsRunning.wg.Add(1)
+		go func(policy BackupPolicy, sched *cronSchedule, timeZone string) {
+			defer restoreTestsRunning.wg.Done()
+			defer func() {
+				restoreTestsRunning.Lock()
+				delete(restoreTestsRunning.policies, key)
+				restoreTestsRunning.Unlock()
+			}()
+			runRestoreTest(ctx, client, cfg, policy, sched, timeZone)
+		}(policy, sched, timeZone)
+	}
+}
+
+func runRestoreTest(ctx context.Context, client *kubeClient, cfg Config, policy BackupPolicy, sched *cronSchedule, timeZone string) {
+	ns := policy.Metadata.Namespace
+	name := policy.Metadata.Name
+	started := time.Now()
+	runID := fmt.Sprintf("restore-test-%s", started.UTC().Format("20060102150405"))
+	policyLog(ns, name).Info("restore test starting", "run", runID)
+
+	volumes := make([]RestoreTestVolumeStatus, 0, len(policy.Spec.Volumes))
+	failed := 0
+	for _, vol := range policy.Spec.Volumes {
+		if vol.PVC == "" {
+			continue
+		}
+		entry := RestoreTestVolumeStatus{PVC: vol.PVC, Result: restoreTestPassed, Message: "Restored and validated"}
+		if err := restoreTestVolume(ctx, client, cfg, policy, vol.PVC, runID); err != nil {
+			policyLog(ns, name).Warn("restore test volume failed", "run", runID, logVolume, vol.PVC, logError, err)
+			entry.Result = restoreTestFailed
+			entry.Message = err.Error()
+			failed++
+		}
+		volumes = append(volumes, entry)
+	}
+
+	result := restoreTestPassed
+	message := fmt.Sprintf("%d volume(s) restored and validated", len(volumes))
+	if failed > 0 {
+		result = restoreTestFailed
+		message = fmt.Sprintf("%d of %d volume(s) failed to restore or validate", failed, len(volumes))
+	}
+	finished := time.Now().UTC()
+	policyLog(ns, name).Info("restore test finished", "run", runID, "result", result, "message", message, logDuration, time.Since(started))
+
+	if err := patchBackupPolicyStatus(ctx, client, ns, name, map[string]interface{}{
+		"restoreTest": map[string]interface{}{
+			"schedule": policy.Spec.RestoreTest.Schedule,
+			"timeZone": timeZone,
+			"lastRun":  finished.Format(time.RFC3339),
+			"nextRun":  sched.Next(finished).UTC().Format(time.RFC3339),
+			"result":   result,
+			"message":  message,
+			"volumes":  volumes,
+		},
+	}); err != nil {
+		policyLog(ns, name).Error("restore test: status update failed", logError, err)
+	}
+
+	if send, resolved := restoreTestNotification(policy.Status.RestoreTest, result); send {
+		notifications.notify(policyNotification(policy, notifyIntegrityCheckFailed, message, resolved), policy.Spec.Notifications)
+	}
+}
+
+// restoreTestNotification reports whether a run with result is notified and
+// whether as the recovery of the previous run. Error results, such as an
+// invalid schedule, are never notified, so only a failed run is resolved.
+func restoreTestNotification(previous *RestoreTestStatus, result string) (send, resolved bool) {
+	switch {
+	case result == restoreTestFailed:
+		return true, false
+	case previous != nil && previous.Result == restoreTestFailed:
+		return true, true
+	}
+	return false, false
+}
+
+// restoreTestVolume restores the latest snapshot of pvc into a temporary PVC,
+// runs the validation Job against it and removes everything it created.
+func restoreTestVolume(ctx context.Context, client *kubeClient, cfg Config, policy BackupPolicy, pvc, runID string) error {
+	ns := policy.Metadata.Namespace
+	secretName := repoSecretName(policy.Metadata.Name, pvc, false)
+	tempName := sanitizeName(fmt.Sprintf("restore-test-%s-%s", policy.Metadata.Name, pvc))
+	timeout := time.Duration(cfg.RestoreTestTimeoutSeconds) * time.Second
+
+	defer cleanupRestoreTest(client, ns, tempName)
+
+	if err := ensureTargetPVC(ctx, client, cfg, ns, ns, pvc, tempName); err != nil {
+		return fmt.Errorf("temporary pvc: %w", err)
+	}
+
+	labels := map[string]interface{}{
+		"backup-policy/name":         policy.Metadata.Name,
+		"backup-policy/namespace":    ns,
+		"backup-policy/restore-test": runID,
+	}
+	if err := ensureReplicationDestination(ctx, client, cfg, ns, tempName, secretName, tempName, "", runID, labels, &policy); err != nil {
+		return fmt.Errorf("replication destination: %w", err)
+	}
+	if err := waitForReplicationDestination(ctx, client, ns, tempName, runID, timeout); err != nil {
+		return fmt.Errorf("restore: %w", err)
+	}
+
+	if err := ensureRestoreTestJob(ctx, client, cfg, policy, tempName, pvc, labels); err != nil {
+		return fmt.Errorf("validation job: %w", err)
+	}
+	if err := waitForJobCompletion(ctx, client, ns, tempName, timeout); err != nil {
+		logs, logErr := getJobLogs(ctx, client, ns, tempName)
+		if logErr == nil && strings.TrimSpace(logs) != "" {
+			return fmt.Errorf("validation: %w: %s", err, tailString(strings.TrimSpace(logs), 512))
+		}
+		return fmt.Errorf("validation: %w", err)
+	}
+	return nil
+}
+
+func ensureRestoreTestJob(ctx context.Context, client *kubeClient, cfg Config, policy BackupPolicy, name, pvc string, labels map[string]interface{}) error {
+	ns := policy.Metadata.Namespace
+	validation := policy.Spec.RestoreTest.Validation
+
+	mountPath := "/data"
+	image := cfg.ResticImage
+	command := []string{"/bin/sh", "-c"}
+	args := []string{`if [ -z "$(ls -A "${RESTORE_TEST_PATH}" | grep -v '^lost+found$')" ]; then echo "restored volume ${PVC_NAME} is empty"; exit 1; fi; echo "restored volume ${PVC_NAME} contains data"`}
+	if validation != nil {
+		image = validation.Image
+		command = validation.Command
+		args = validation.Args
+		if validation.MountPath != "" {
+			mountPath = validation.MountPath
+		}
+	}
+
+	container := map[string]interface{}{
+		"name":            "validate",
+		"image":           image,
+		"imagePullPolicy": "IfNotPresent",
+		"env": []map[string]interface{}{
+			{"name": "RESTORE_TEST_PATH", "value": mountPath},
+			{"name": "PVC_NAME", "value": pvc},
+		},
+		"volumeMounts": []map[string]interface{}{
+			{
+				"name":      "restored",
+				"mountPath": mountPath,
+			},
+		},
+	}
+	if len(command) > 0 {
+		container["command"] = command
+	}
+	if len(args) > 0 {
+		container["args"] = args
+	}
+
+	podSpec := map[string]interface{}{
+		"restartPolicy": "Never",
+		"containers":    []map[string]interface{}{container},
+		"volumes": []map[string]interface{}{
+			{
+				"name": "restored",
+				"persistentVolumeClaim": map[string]interface{}{
+					"claimName": name,
+				},
+			},
+		},
+	}
+	setPodPlacement(podSpec, policy.Spec.Mover)
+
+	job := map[string]interface{}{
+		"apiVersion": "batch/v1",
+		"kind":       "Job",
+		"metadata": map[string]interface{}{
+			"name":      name,
+			"namespace": ns,
+			"labels":    labels,
+		},
+		"spec": map[string]interface{}{
+			"backoffLimit": 0,
+			"template": map[string]interface{}{
+				"spec": podSpec,
+			},
+		},
+	}
+
+	return client.apply(ctx, namespacedPath("/apis/batch/v1", ns, "jobs", name), job, &policy)
+}
+
+func waitForReplicationDestination(ctx context.Context, client *kubeClient, ns, name, trigger string, timeout time.Duration) error {
+	itemPath := namespacedPath("/apis/volsync.backube/v1alpha1", ns, "replicationdestinations", name)
+	deadline := time.Now().Add(timeout)
+	for {
+		body, status, err := client.doRequest(ctx, "GET", itemPath, nil)
+		if err != nil {
+			return err
+		}
+		if status != http.StatusOK {
+			return fmt.Errorf("get failed: %s status=%d", itemPath, status)
+		}
+		var obj map[string]interface{}
+		if err := json.Unmarshal(body, &obj); err != nil {
+			return err
+		}
+		statusMap, _ := obj["status"].(map[string]interface{})
+		lastManual, _ := statusMap["lastManualSync"].(string)
+		latestMover, _ := statusMap["latestMoverStatus"].(map[string]interface{})
+		result, _ := latestMover["result"].(string)
+		if lastManual == trigger && result != "" {
+			if result == "Successful" {
+				return nil
+			}
+			logs, _ := latestMover["logs"].(string)
+			if logs != "" {
+				return fmt.Errorf("replication destination %s %s: %s", name, strings.ToLower(result), tailString(strings.TrimSpace(logs), 512))
+			}
+			return fmt.Errorf("replication destination %s %s", name, strings.ToLower(result))
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("timed out waiting for replication destination %s", name)
+		}
+		if err := sleepContext(ctx, 10*time.Second); err != nil {
+			return err
+		}
+	}
+}
+
+// cleanupRestoreTest deletes the objects of a restore test, also after ctx
+// was cancelled by a shutdown.
+func cleanupRestoreTest(client *kubeClient, ns, name string) {
+	ctx, cancel := cleanupContext()
+	defer cancel()
+	paths := []string{
+		namespacedPath("/apis/batch/v1", ns, "jobs", name),
+		namespacedPath("/apis/volsync.backube/v1alpha1", ns, "replicationdestinations", name),
+		namespacedPath("/api/v1", ns, "persistentvolumeclaims", name),
+	}
+	for _, itemPath := range paths {
+		if err := client.delete(ctx, itemPath); err != nil {
+			slog.Error("restore test cleanup failed", logResource, itemPath, logError, err)
+		}
+	}
+}
+
+func tailString(value string, max int) string {
+	if len(value) <= max {
+		return value
+	}
+	return "..." + value[len(value)-max:]
+}
@@ -0,0 +1,25 @@
+package main
+
+import "testing"
+
+func TestRestoreTestNotification(t *testing.T) {
+	for _, tc := range []struct {
+		previous *RestoreTestStatus
+		result   string
+		send     bool
+		resolved bool
+	}{
+		{nil, restoreTestPassed, false, false},
+		{nil, restoreTestFailed, true, false},
+		{&RestoreTestStatus{Result: restoreTestPassed}, restoreTestPassed, false, false},
+		{&RestoreTestStatus{Result: restoreTestFailed}, restoreTestFailed, true, false},
+		{&RestoreTestStatus{Result: restoreTestFailed}, restoreTestPassed, true, true},
+		// Nothing was sent for the invalid schedule, so there is nothing to resolve.
+		{&RestoreTestStatus{Result: restoreTestError}, restoreTestPassed, false, false},
+	} {
+		send, resolved := restoreTestNotification(tc.previous, tc.result)
+		if send != tc.send || resolved != tc.resolved {
+			t.Errorf("restoreTestNotification(%+v, %s) = %v, %v, want %v, %v", tc.previous, tc.result, send, resolved, tc.send, tc.resolved)
+		}
+	}
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPickRestoreSnapshot(t *testing.T) {
+	var snapshots []resticSnapshot
+	mustUnmarshal(t, `[
+		{"id": "aaa", "time": "2024-04-30T03:00:00.51234Z"},
+		{"id": "ccc", "time": "2024-05-02T05:00:00+02:00"},
+		{"id": "bbb", "time": "2024-05-01T03:00:00.987654321Z"},
+		{"id": "", "time": "2024-05-01T02:00:00Z"},
+		{"id": "ddd", "time": "not a time"}
+	]`, &snapshots)
+
+	for _, tc := range []struct {
+		asOf string
+		want string
+		err  string
+	}{
+		{"", "ccc", ""},
+		{"2024-05-01T03:00:00Z", "bbb", ""},
+		{"2024-05-01T05:00:00+02:00", "bbb", ""},
+		{"2024-05-01T02:59:59Z", "aaa", ""},
+		{"2024-05-02T03:00:00Z", "ccc", ""},
+		{"2024-04-01T00:00:00Z", "", "no snapshot found at or before 2024-04-01T00:00:00Z"},
+		{"yesterday", "", "invalid restoreAsOf"},
+	} {
+		got, err := pickRestoreSnapshot(snapshots, tc.asOf)
+		if tc.err != "" {
+			if err == nil || !strings.Contains(err.Error(), tc.err) {
+				t.Errorf("asOf %q: error %v, want %q", tc.asOf, err, tc.err)
+			}
+			continue
+		}
+		if err != nil || got != tc.want {
+			t.Errorf("asOf %q: got %q, %v, want %q", tc.asOf, got, err, tc.want)
+		}
+	}
+	if _, err := pickRestoreSnapshot(nil, ""); err == nil || !strings.Contains(err.Error(), "at or before now") {
+		t.Errorf("empty repository: %v", err)
+	}
+}
+
+func TestPartialRestoreJobObject(t *testing.T) {
+	vol := RestoreVolume{SourcePVC: "data", TargetPVC: "scratch", IncludePaths: []string{"/a", "/b"}, TargetSubPath: "restored"}
+	job, err := partialRestoreJobObject(Config{RepoMountPath: "repo", RepoPVCName: "backup-repo"}, "apps", "restore-app-scratch", "restore-repo-app-data", "0123abcd", "--limit-download=4096", vol, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pod := job["spec"].(map[string]interface{})["template"].(map[string]interface{})["spec"].(map[string]interface{})
+	container := pod["containers"].([]map[string]interface{})[0]
+	env := map[string]string{}
+	for _, e := range container["env"].([]map[string]interface{}) {
+		env[e["name"].(string)] = e["value"].(string)
+	}
+	if env["SNAPSHOT_ID"] != "0123abcd" || env["RESTORE_TARGET"] != "/restore/restored" || env["INCLUDE_PATHS"] != "/a\n/b" || env[resticLimitEnv] != "--limit-download=4096" {
+		t.Errorf("unexpected env %v", env)
+	}
+	if volumes := pod["volumes"].([]map[string]interface{}); len(volumes) != 2 {
+		t.Errorf("unexpected volumes %v", volumes)
+	}
+
+	vol.TargetSubPath = "../x"
+	if _, err := partialRestoreJobObject(Config{}, "apps", "restore-app-scratch", "secret", "0123abcd", "", vol, nil); err == nil {
+		t.Error("targetSubPath outside the volume was accepted")
+	}
+}
+
+func TestRestoreCompletionConditions(t *testing.T) {
+	now := time.Date(2024, 5, 1, 3, 0, 0, 0, time.UTC)
+	restoring := []Condition{{Type: "Ready", Status: "False", Reason: "Restoring", LastTransitionTime: "2024-05-01T02:00:00Z"}}
+
+	conditions, restored := restoreCompletionConditions(restoring, []string{"data", "config"}, nil, now)
+	ready := findCondition(conditions, "Ready")
+	if restored.Status != "True" || restored.Message != "restored data, config" || ready == nil || ready.Status != "True" || ready.Reason != "Restored" {
+		t.Errorf("successful restore set %+v and Ready %+v", restored, ready)
+	}
+
+	conditions, failed := restoreCompletionConditions(restoring, []string{"data"}, []string{"config"}, now)
+	ready = findCondition(conditions, "Ready")
+	if failed.Status != "False" || failed.Message != "failed to restore config" || ready == nil || ready.Status != "False" || ready.Reason != "RestoreFailed" {
+		t.Errorf("failed restore set %+v and Ready %+v", failed, ready)
+	}
+	if ready.LastTransitionTime != "2024-05-01T02:00:00Z" || len(conditions) != 2 {
+		t.Errorf("unexpected conditions %+v", conditions)
+	}
+}
@@ -1,10 +1,9 @@
 package main
 
 import (
+	"context"
 	"fmt"
-	"os"
-	"os/signal"
-	"syscall"
+	"log/slog"
 
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
@@ -16,7 +15,7 @@ import (
 	"k8s.io/client-go/tools/cache"
 )
 
-func startInformers(client *kubeClient, cfg Config) error {
+func startInformers(ctx context.Context, client *kubeClient, cfg Config) error {
 	config, err := rest.InClusterConfig()
 	if err != nil {
 		return err
@@ -40,72 +39,107 @@ func startInformers(client *kubeClient, cfg Config) error {
 		Resource: "restorepolicies",
 	}
 
+	clusterGVR := schema.GroupVersionResource{
+		Group:    backupPolicyGroup,
+		Version:  backupPolicyVersion,
+		Resource: "clusterbackuppolicies",
+	}
+
 	backupInformer := factory.ForResource(backupGVR).Informer()
 	restoreInformer := factory.ForResource(restoreGVR).Informer()
+	clusterInformer := factory.ForResource(clusterGVR).Informer()
 
-	if err := attachBackupHandlers(backupInformer, client, cfg); err != nil {
+	if err := attachBackupHandlers(ctx, backupInformer, client, cfg); err != nil {
 		return err
 	}
-	if err := attachRestoreHandlers(restoreInformer, client, cfg); err != nil {
+	if err := attachRestoreHandlers(ctx, restoreInformer, client, cfg); err != nil {
+		return err
+	}
+	if err := attachClusterHandlers(ctx, clusterInformer, client, cfg); err != nil {
 		return err
 	}
 
-	stopCh := make(chan struct{})
-	defer close(stopCh)
-
-	factory.Start(stopCh)
-	if !cache.WaitForCacheSync(stopCh, backupInformer.HasSynced, restoreInformer.HasSynced) {
+	factory.Start(ctx.Done())
+	defer factory.Shutdown()
+	if !cache.WaitForCacheSync(ctx.Done(), backupInformer.HasSynced, restoreInformer.HasSynced, clusterInformer.HasSynced) {
+		if ctx.Err() != nil {
+			return nil
+		}
 		return fmt.Errorf("timed out waiting for informer caches to sync")
 	}
 	reconcileHealthy.Store(true)
 
-	sigCh := make(chan os.Signal, 1)
-	signal.Notify(sigCh, syscall.SIGINT, syscall.SIGTERM)
-	<-sigCh
+	<-ctx.Done()
 	return nil
 }
 
-func attachBackupHandlers(informer cache.SharedIndexInformer, client *kubeClient, cfg Config) error {
+func attachBackupHandlers(ctx context.Context, informer cache.SharedIndexInformer, client *kubeClient, cfg Config) error {
 	_, err := informer.AddEventHandler(cache.ResourceEventHandlerFuncs{
 		AddFunc: func(obj interface{}) {
-			backupEventReconcile(obj, client, cfg)
+			backupEventReconcile(ctx, obj, client, cfg)
 		},
 		UpdateFunc: func(_, newObj interface{}) {
-			backupEventReconcile(newObj, client, cfg)
+			backupEventReconcile(ctx, newObj, client, cfg)
 		},
 	})
 	return err
 }
 
-func attachRestoreHandlers(informer cache.SharedIndexInformer, client *kubeClient, cfg Config) error {
+func attachRestoreHandlers(ctx context.Context, informer cache.SharedIndexInformer, client *kubeClient, cfg Config) error {
 	_, err := informer.AddEventHandler(cache.ResourceEventHandlerFuncs{
 		AddFunc: func(obj interface{}) {
-			restoreEventReconcile(obj, client, cfg)
+			restoreEventReconcile(ctx, obj, client, cfg)
 		},
 		UpdateFunc: func(_, newObj interface{}) {
-			restoreEventReconcile(newObj, client, cfg)
+			restoreEventReconcile(ctx, newObj, client, cfg)
 		},
 	})
 	return err
 }
 
-func backupEventReconcile(obj interface{}, client *kubeClient, cfg Config) {
+// attachClusterHandlers expands ClusterBackupPolicies when they are created or
+// their spec changes. Namespace and PVC changes are picked up by the periodic
+// reconcile.
+func attachClusterHandlers(ctx context.Context, informer cache.SharedIndexInformer, client *kubeClient, cfg Config) error {
+	_, err := informer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc: func(obj interface{}) {
+			clusterEventReconcile(ctx, client, cfg)
+		},
+		UpdateFunc: func(oldObj, newObj interface{}) {
+			oldPolicy, oldOK := oldObj.(*unstructured.Unstructured)
+			newPolicy, newOK := newObj.(*unstructured.Unstructured)
+			if oldOK && newOK && oldPolicy.GetGeneration() == newPolicy.GetGeneration() {
+				return
+			}
+			clusterEventReconcile(ctx, client, cfg)
+		},
+	})
+	return err
+}
+
+func clusterEventReconcile(ctx context.Context, client *kubeClient, cfg Config) {
+	if err := (&ClusterBackupPolicyHandler{}).Reconcile(ctx, client, cfg); err != nil {
+		reconcileHealthy.Store(false)
+	}
+}
+
+func backupEventReconcile(ctx context.Context, obj interface{}, client *kubeClient, cfg Config) {
 	unstructuredObj, ok := obj.(*unstructured.Unstructured)
 	if !ok {
-		fmt.Println("backup event: unexpected object type")
+		slog.Error("backup event: unexpected object type")
 		return
 	}
 
 	var policy BackupPolicy
 	if err := runtime.DefaultUnstructuredConverter.FromUnstructured(unstructuredObj.Object, &policy); err != nil {
-		fmt.Printf("backup event: failed to decode policy: %v\n", err)
+		slog.Error("backup event: failed to decode policy", logError, err)
 		reconcileHealthy.Store(false)
 		return
 	}
 
 	hash, err := policySpecHash(policy.Spec)
 	if err != nil {
-		fmt.Printf("backup event: failed to hash policy: %v\n", err)
+		slog.Error("backup event: failed to hash policy", logError, err)
 		reconcileHealthy.Store(false)
 		return
 	}
@@ -113,48 +147,48 @@ func backupEventReconcile(obj interface{}, client *kubeClient, cfg Config) {
 		return
 	}
 
-	volStatus, lastSnapshotSync, err := reconcileBackupPolicy(client, cfg, policy)
+	volStatus, lastSnapshotSync, err := reconcileBackupPolicy(ctx, client, cfg, policy)
 	if err != nil {
-		fmt.Printf("backup reconcile failed for %s/%s: %v\n", policy.Metadata.Namespace, policy.Metadata.Name, err)
-		if err := updateBackupPolicyStatus(client, policy, "False", "ReconcileError", err.Error(), volStatus, lastSnapshotSync); err != nil {
-			fmt.Printf("backup status update failed for %s/%s: %v\n", policy.Metadata.Namespace, policy.Metadata.Name, err)
+		policyLog(policy.Metadata.Namespace, policy.Metadata.Name).Error("backup reconcile failed", logError, err)
+		if err := updateBackupPolicyStatus(ctx, client, policy, "False", "ReconcileError", err.Error(), volStatus, lastSnapshotSync); err != nil {
+			policyLog(policy.Metadata.Namespace, policy.Metadata.Name).Error("backup status update failed", logError, err)
 		}
-		if err := updateProcessedHash(client, "backuppolicies", policy.Metadata.Namespace, policy.Metadata.Name, hash); err != nil {
-			fmt.Printf("backup processed hash update failed for %s/%s: %v\n", policy.Metadata.Namespace, policy.Metadata.Name, err)
+		if err := updateProcessedHash(ctx, client, "backuppolicies", policy.Metadata.Namespace, policy.Metadata.Name, hash); err != nil {
+			policyLog(policy.Metadata.Namespace, policy.Metadata.Name).Error("backup processed hash update failed", logError, err)
 		}
 		reconcileHealthy.Store(false)
 		return
 	}
-	if err := updateBackupPolicyStatus(client, policy, "True", "Reconciled", "Reconcile successful", volStatus, lastSnapshotSync); err != nil {
-		fmt.Printf("backup status update failed for %s/%s: %v\n", policy.Metadata.Namespace, policy.Metadata.Name, err)
+	if err := updateBackupPolicyStatus(ctx, client, policy, "True", "Reconciled", "Reconcile successful", volStatus, lastSnapshotSync); err != nil {
+		policyLog(policy.Metadata.Namespace, policy.Metadata.Name).Error("backup status update failed", logError, err)
 		reconcileHealthy.Store(false)
 		return
 	}
-	if err := updateProcessedHash(client, "backuppolicies", policy.Metadata.Namespace, policy.Metadata.Name, hash); err != nil {
-		fmt.Printf("backup processed hash update failed for %s/%s: %v\n", policy.Metadata.Namespace, policy.Metadata.Name, err)
+	if err := updateProcessedHash(ctx, client, "backuppolicies", policy.Metadata.Namespace, policy.Metadata.Name, hash); err != nil {
+		policyLog(policy.Metadata.Namespace, policy.Metadata.Name).Error("backup processed hash update failed", logError, err)
 		reconcileHealthy.Store(false)
 		return
 	}
 	reconcileHealthy.Store(true)
 }
 
-func restoreEventReconcile(obj interface{}, client *kubeClient, cfg Config) {
+func restoreEventReconcile(ctx context.Context, obj interface{}, client *kubeClient, cfg Config) {
 	unstructuredObj, ok := obj.(*unstructured.Unstructured)
 	if !ok {
-		fmt.Println("restore event: unexpected object type")
+		slog.Error("restore event: unexpected object type")
 		return
 	}
 
 	var policy RestorePolicy
 	if err := runtime.DefaultUnstructuredConverter.FromUnstructured(unstructuredObj.Object, &policy); err != nil {
-		fmt.Printf("restore event: failed to decode policy: %v\n", err)
+		slog.Error("restore event: failed to decode policy", logError, err)
 		reconcileHealthy.Store(false)
 		return
 	}
 
 	hash, err := policySpecHash(policy.Spec)
 	if err != nil {
-		fmt.Printf("restore event: failed to hash policy: %v\n", err)
+		slog.Error("restore event: failed to hash policy", logError, err)
 		reconcileHealthy.Store(false)
 		return
 	}
@@ -162,24 +196,27 @@ func restoreEventReconcile(obj interface{}, client *kubeClient, cfg Config) {
 		return
 	}
 
-	if err := reconcileRestorePolicy(client, cfg, policy); err != nil {
-		fmt.Printf("restore reconcile failed for %s/%s: %v\n", policy.Metadata.Namespace, policy.Metadata.Name, err)
-		if err := updateRestoreStatus(client, policy, "False", "ReconcileError", err.Error()); err != nil {
-			fmt.Printf("restore status update failed for %s/%s: %v\n", policy.Metadata.Namespace, policy.Metadata.Name, err)
+	if err := reconcileRestorePolicy(ctx, client, cfg, policy); restorePendingReason(err) != "" {
+		markRestorePending(ctx, client, policy, err)
+		return
+	} else if err != nil {
+		policyLog(policy.Metadata.Namespace, policy.Metadata.Name).Error("restore reconcile failed", logError, err)
+		if err := updateRestoreStatus(ctx, client, policy, "False", "ReconcileError", err.Error()); err != nil {
+			policyLog(policy.Metadata.Namespace, policy.Metadata.Name).Error("restore status update failed", logError, err)
 		}
-		if err := updateProcessedHash(client, "restorepolicies", policy.Metadata.Namespace, policy.Metadata.Name, hash); err != nil {
-			fmt.Printf("restore processed hash update failed for %s/%s: %v\n", policy.Metadata.Namespace, policy.Metadata.Name, err)
+		if err := updateProcessedHash(ctx, client, "restorepolicies", policy.Metadata.Namespace, policy.Metadata.Name, hash); err != nil {
+			policyLog(policy.Metadata.Namespace, policy.Metadata.Name).Error("restore processed hash update failed", logError, err)
 		}
 		reconcileHealthy.Store(false)
 		return
 	}
-	if err := updateRestoreStatus(client, policy, "True", "Reconciled", "Reconcile successful"); err != nil {
-		fmt.Printf("restore status update failed for %s/%s: %v\n", policy.Metadata.Namespace, policy.Metadata.Name, err)
+	if err := updateRestoreStatus(ctx, client, policy, "False", "Restoring", "Waiting for the restore to finish"); err != nil {
+		policyLog(policy.Metadata.Namespace, policy.Metadata.Name).Error("restore status update failed", logError, err)
 		reconcileHealthy.Store(false)
 		return
 	}
-	if err := updateProcessedHash(client, "restorepolicies", policy.Metadata.Namespace, policy.Metadata.Name, hash); err != nil {
-		fmt.Printf("restore processed hash update failed for %s/%s: %v\n", policy.Metadata.Namespace, policy.Metadata.Name, err)
+	if err := updateProcessedHash(ctx, client, "restorepolicies", policy.Metadata.Namespace, policy.Metadata.Name, hash); err != nil {
+		policyLog(policy.Metadata.Namespace, policy.Metadata.Name).Error("restore processed hash update failed", logError, err)
 		reconcileHealthy.Store(false)
 		return
 	}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	coordinationv1 "k8s.io/client-go/kubernetes/typed/coordination/v1"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/leaderelection"
+	"k8s.io/client-go/tools/leaderelection/resourcelock"
+)
+
+// leaseName is the Lease in the controller's namespace that replicas compete
+// for. Only its holder reconciles and creates Jobs.
+const leaseName = "backup-controller"
+
+const (
+	leaseDuration = 15 * time.Second
+	renewDeadline = 10 * time.Second
+	retryPeriod   = 2 * time.Second
+)
+
+// leaderLabel marks the controller pod holding the Lease. The Service selects
+// it, so the snapshot API and the webhook are served by the leader while
+// readiness only tells whether a replica can serve.
+const leaderLabel = "backup.homelab/leader"
+
+// leading is true while this replica holds the Lease. The leader label and
+// the backup_controller_leader metric follow it.
+var leading atomic.Bool
+
+// runLeaderElection runs lead while this replica holds the Lease, until ctx
+// is cancelled. lead's context ends when ctx is cancelled or the Lease is
+// lost. On shutdown the Lease is released only after lead returned, so a
+// standby takes over at once without overlapping with the work in flight.
+func runLeaderElection(ctx context.Context, client *kubeClient, cfg Config, lead func(context.Context)) error {
+	config, err := rest.InClusterConfig()
+	if err != nil {
+		return err
+	}
+	leases, err := coordinationv1.NewForConfig(config)
+	if err != nil {
+		return err
+	}
+	identity := controllerPod
+	// A restarted container keeps its pod, and with it the label of an
+	// earlier term.
+	if err := labelLeader(ctx, client, cfg, false); err != nil {
+		return err
+	}
+
+	// term holds a slot while lead runs, so a new term waits for the previous
+	// one and the shutdown below waits for the current one.
+	term := make(chan struct{}, 1)
+	electionCtx, stopElection := context.WithCancel(context.Background())
+	defer stopElection()
+	go func() {
+		<-ctx.Done()
+		select {
+		case term <- struct{}{}:
+		case <-time.After(shutdownTimeout):
+			slog.Warn("leader election: work did not stop, releasing the lease anyway", logDuration, shutdownTimeout)
+		}
+		stopElection()
+	}()
+
+	for electionCtx.Err() == nil {
+		leaderelection.RunOrDie(electionCtx, leaderelection.LeaderElectionConfig{
+			Lock: &resourcelock.LeaseLock{
+				LeaseMeta:  metav1.ObjectMeta{Namespace: cfg.Namespace, Name: leaseName},
+				Client:     leases,
+				LockConfig: resourcelock.ResourceLockConfig{Identity: identity},
+			},
+			LeaseDuration:   leaseDuration,
+			RenewDeadline:   renewDeadline,
+			RetryPeriod:     retryPeriod,
+			ReleaseOnCancel: true,
+			Name:            leaseName,
+			Callbacks:       leaderCallbacks(ctx, client, cfg, identity, term, lead),
+		})
+	}
+	return nil
+}
+
+// leaderCallbacks runs lead for each term of identity, one term at a time
+// through the term slot. The leader label is set once lead starts and cleared
+// as soon as the Lease is lost, while lead may still be winding down, so the
+// Service stops routing to this pod before a new leader labels itself.
+func leaderCallbacks(ctx context.Context, client *kubeClient, cfg Config, identity string, term chan struct{}, lead func(context.Context)) leaderelection.LeaderCallbacks {
+	return leaderelection.LeaderCallbacks{
+		OnStartedLeading: func(leaseCtx context.Context) {
+			select {
+			case term <- struct{}{}:
+			case <-leaseCtx.Done():
+				return
+			}
+			defer func() { <-term }()
+
+			workCtx, cancel := context.WithCancel(ctx)
+			defer cancel()
+			stop := context.AfterFunc(leaseCtx, cancel)
+			defer stop()
+
+			slog.Info("leader election: acquired the lease", "identity", identity)
+			leading.Store(true)
+			if err := labelLeader(workCtx, client, cfg, true); err != nil {
+				slog.Error("leader election: labelling the pod failed", logError, err)
+			}
+			// On shutdown the Lease is still held here; a lost Lease
+			// already cleared the label in OnStoppedLeading.
+			defer func() {
+				if leading.Swap(false) {
+					unlabelLeader(client, cfg)
+				}
+			}()
+			lead(workCtx)
+		},
+		OnStoppedLeading: func() {
+			if leading.Swap(false) {
+				unlabelLeader(client, cfg)
+			}
+			slog.Info("leader election: not leading", "identity", identity)
+		},
+		OnNewLeader: func(holder string) {
+			if holder != identity {
+				slog.Info("leader election: following", "leader", holder)
+			}
+		},
+	}
+}
+
+// unlabelLeader clears the leader label of this controller pod, also after
+// the controller's context was cancelled.
+func unlabelLeader(client *kubeClient, cfg Config) {
+	ctx, cancel := cleanupContext()
+	defer cancel()
+	if err := labelLeader(ctx, client, cfg, false); err != nil {
+		slog.Error("leader election: unlabelling the pod failed", logError, err)
+	}
+}
+
+// labelLeader sets the leader label of this controller pod.
+func labelLeader(ctx context.Context, client *kubeClient, cfg Config, leader bool) error {
+	itemPath := namespacedPath("/api/v1", cfg.Namespace, "pods", controllerPod)
+	payload := map[string]interface{}{
+		"metadata": map[string]interface{}{
+			"labels": map[string]interface{}{
+				leaderLabel: strconv.FormatBool(leader),
+			},
+		},
+	}
+	respBody, status, err := client.doRequestWithContentType(ctx, "PATCH", itemPath, "application/merge-patch+json", payload)
+	if err != nil {
+		return err
+	}
+	if status != http.StatusOK {
+		return fmt.Errorf("leader label update failed: %s status=%d body=%s", itemPath, status, strings.TrimSpace(string(respBody)))
+	}
+	return nil
+}
+
+// podName returns the name of the controller pod from POD_NAME, falling back
+// to the hostname, which Kubernetes sets to the pod name.
+func podName() string {
+	if name := os.Getenv("POD_NAME"); name != "" {
+		return name
+	}
+	name, _ := os.Hostname()
+	return name
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakePodLabels serves merge patches of the controller pod and records the
+// leader label values it was sent.
+type fakePodLabels struct {
+	mu     sync.Mutex
+	values []string
+}
+
+func (f *fakePodLabels) get() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]string(nil), f.values...)
+}
+
+func newFakePodLabels(t *testing.T) (*kubeClient, *fakePodLabels) {
+	labels := &fakePodLabels{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "PATCH" || r.URL.Path != "/api/v1/namespaces/backup/pods/controller-a" || r.Header.Get("Content-Type") != "application/merge-patch+json" {
+			http.NotFound(w, r)
+			return
+		}
+		var patch struct {
+			Metadata struct {
+				Labels map[string]string `json:"labels"`
+			} `json:"metadata"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&patch); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		labels.mu.Lock()
+		labels.values = append(labels.values, patch.Metadata.Labels[leaderLabel])
+		labels.mu.Unlock()
+		w.Write([]byte(`{}`))
+	}))
+	t.Cleanup(server.Close)
+	previous := controllerPod
+	controllerPod = "controller-a"
+	t.Cleanup(func() { controllerPod = previous })
+	return &kubeClient{baseURL: server.URL, client: server.Client()}, labels
+}
+
+func TestLabelLeader(t *testing.T) {
+	client, labels := newFakePodLabels(t)
+	cfg := Config{Namespace: "backup"}
+	for _, leader := range []bool{true, false} {
+		if err := labelLeader(context.Background(), client, cfg, leader); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got := labels.get(); !reflect.DeepEqual(got, []string{"true", "false"}) {
+		t.Errorf("labels = %q, want true then false", got)
+	}
+	if err := labelLeader(context.Background(), client, Config{Namespace: "other"}, true); err == nil {
+		t.Error("a failed patch was not reported")
+	}
+}
+
+func TestLeaderCallbacks(t *testing.T) {
+	client, labels := newFakePodLabels(t)
+	ctx, shutdown := context.WithCancel(context.Background())
+	defer shutdown()
+	term := make(chan struct{}, 1)
+	started := make(chan context.Context)
+	release := make(chan struct{})
+	lead := func(workCtx context.Context) {
+		started <- workCtx
+		<-workCtx.Done()
+		<-release
+	}
+	callbacks := leaderCallbacks(ctx, client, Config{Namespace: "backup"}, "controller-a", term, lead)
+	waitForLabels := func(want ...string) {
+		t.Helper()
+		deadline := time.Now().Add(5 * time.Second)
+		for !reflect.DeepEqual(labels.get(), want) {
+			if time.Now().After(deadline) {
+				t.Fatalf("labels = %q, want %q", labels.get(), want)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+
+	// First term: the Lease is acquired, then lost while lead winds down.
+	leaseCtx, loseLease := context.WithCancel(context.Background())
+	firstDone := make(chan struct{})
+	go func() {
+		callbacks.OnStartedLeading(leaseCtx)
+		close(firstDone)
+	}()
+	workCtx := <-started
+	waitForLabels("true")
+	if !leading.Load() {
+		t.Error("not leading after acquiring the lease")
+	}
+	loseLease()
+	<-workCtx.Done()
+	callbacks.OnStoppedLeading()
+	waitForLabels("true", "false")
+	if leading.Load() {
+		t.Error("still leading after losing the lease")
+	}
+
+	// The next term waits until the previous lead returned.
+	secondDone := make(chan struct{})
+	go func() {
+		callbacks.OnStartedLeading(context.Background())
+		close(secondDone)
+	}()
+	select {
+	case <-started:
+		t.Fatal("a new term started while the previous one was still running")
+	case <-time.After(50 * time.Millisecond):
+	}
+	close(release)
+	<-firstDone
+	workCtx = <-started
+	waitForLabels("true", "false", "true")
+
+	// Shutdown: the label is cleared once lead returned, and only once.
+	shutdown()
+	<-workCtx.Done()
+	<-secondDone
+	callbacks.OnStoppedLeading()
+	waitForLabels("true", "false", "true", "false")
+	if leading.Load() {
+		t.Error("still leading after shutdown")
+	}
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"strings"
+)
+
+// Controller log lines are JSON objects with a shared set of fields, so a
+// run can be followed across the controller and its runner Jobs in Loki:
+//
+//	namespace, policy   the policy being reconciled
+//	volume              the PVC a line is about
+//	trigger_id          the backup run, as annotated on the runner Job
+//	resource            the API path of a request
+//	http_status         the status of an API response
+//	duration            how long an operation took, as a Go duration string
+//	error               the error, on failures
+const (
+	logNamespace  = "namespace"
+	logPolicy     = "policy"
+	logVolume     = "volume"
+	logTriggerID  = "trigger_id"
+	logResource   = "resource"
+	logHTTPStatus = "http_status"
+	logDuration   = "duration"
+	logError      = "error"
+)
+
+func mustLogLevel(value string) slog.Level {
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(strings.TrimSpace(value))); err != nil {
+		panic(fmt.Errorf("invalid LOG_LEVEL %q: %w", value, err))
+	}
+	return level
+}
+
+// newLogger returns a JSON logger writing to w. Durations are written as
+// strings such as "1.5s", which Loki label filters compare directly.
+func newLogger(w io.Writer, level slog.Level) *slog.Logger {
+	return slog.New(slog.NewJSONHandler(w, &slog.HandlerOptions{
+		Level: level,
+		ReplaceAttr: func(groups []string, a slog.Attr) slog.Attr {
+			if a.Value.Kind() == slog.KindDuration {
+				return slog.String(a.Key, a.Value.Duration().String())
+			}
+			return a
+		},
+	}))
+}
+
+// policyLog returns the default logger with the fields of a policy.
+func policyLog(ns, name string) *slog.Logger {
+	return slog.With(logNamespace, ns, logPolicy, name)
+}
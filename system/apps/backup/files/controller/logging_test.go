@@ -0,0 +1,46 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"log/slog"
+	"testing"
+	"time"
+)
+
+func TestNewLoggerWritesJSON(t *testing.T) {
+	var buf bytes.Buffer
+	logger := newLogger(&buf, mustLogLevel("info"))
+	logger.Debug("hidden")
+	logger.With(logNamespace, "gitea", logPolicy, "gitea").Info("reconcile completed", logDuration, 1500*time.Millisecond, logTriggerID, "20240501030000")
+
+	var line map[string]interface{}
+	if err := json.Unmarshal(buf.Bytes(), &line); err != nil {
+		t.Fatalf("got %q, want a single JSON line: %v", buf.String(), err)
+	}
+	want := map[string]interface{}{
+		"level":      "INFO",
+		"msg":        "reconcile completed",
+		"namespace":  "gitea",
+		"policy":     "gitea",
+		"duration":   "1.5s",
+		"trigger_id": "20240501030000",
+	}
+	for key, value := range want {
+		if line[key] != value {
+			t.Errorf("%s = %v, want %v", key, line[key], value)
+		}
+	}
+}
+
+func TestMustLogLevel(t *testing.T) {
+	if got := mustLogLevel("DEBUG"); got != slog.LevelDebug {
+		t.Errorf("got %v, want debug", got)
+	}
+	defer func() {
+		if recover() == nil {
+			t.Error("want a panic for an invalid level")
+		}
+	}()
+	mustLogLevel("verbose")
+}
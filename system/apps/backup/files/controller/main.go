@@ -2,32 +2,41 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"crypto/sha256"
-	"crypto/tls"
-	"crypto/x509"
 	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"log/slog"
+	"net"
 	"net/http"
 	"os"
+	"os/signal"
 	"regexp"
 	"strconv"
 	"strings"
+	"sync"
 	"sync/atomic"
+	"syscall"
 	"time"
+
+	"k8s.io/client-go/rest"
 )
 
 type BackupPolicy struct {
 	APIVersion string `json:"apiVersion"`
 	Kind       string `json:"kind"`
 	Metadata   struct {
-		Name            string            `json:"name"`
-		Namespace       string            `json:"namespace"`
-		Annotations     map[string]string `json:"annotations,omitempty"`
-		UID             string            `json:"uid"`
-		ResourceVersion string            `json:"resourceVersion"`
-		Generation      int64             `json:"generation"`
+		Name              string            `json:"name"`
+		Namespace         string            `json:"namespace"`
+		Labels            map[string]string `json:"labels,omitempty"`
+		Annotations       map[string]string `json:"annotations,omitempty"`
+		UID               string            `json:"uid"`
+		ResourceVersion   string            `json:"resourceVersion"`
+		Generation        int64             `json:"generation"`
+		CreationTimestamp string            `json:"creationTimestamp,omitempty"`
 	} `json:"metadata"`
 	Spec   BackupPolicySpec   `json:"spec"`
 	Status BackupPolicyStatus `json:"status,omitempty"`
@@ -48,7 +57,21 @@ type RestorePolicy struct {
 		ResourceVersion string            `json:"resourceVersion"`
 		Generation      int64             `json:"generation"`
 	} `json:"metadata"`
-	Spec RestorePolicySpec `json:"spec"`
+	Spec   RestorePolicySpec   `json:"spec"`
+	Status RestorePolicyStatus `json:"status,omitempty"`
+}
+
+type RestorePolicyStatus struct {
+	ObservedGeneration int64       `json:"observedGeneration,omitempty"`
+	Conditions         []Condition `json:"conditions,omitempty"`
+}
+
+type Condition struct {
+	Type               string `json:"type"`
+	Status             string `json:"status"`
+	Reason             string `json:"reason,omitempty"`
+	Message            string `json:"message,omitempty"`
+	LastTransitionTime string `json:"lastTransitionTime,omitempty"`
 }
 
 type RestorePolicyList struct {
@@ -56,79 +79,173 @@ type RestorePolicyList struct {
 }
 
 type BackupPolicySpec struct {
-	Schedule string `json:"schedule"`
-	TimeZone string `json:"timeZone,omitempty"`
-	Volumes  []struct {
-		PVC string `json:"pvc"`
-	} `json:"volumes"`
-	Quiesce *struct {
+	Schedule string         `json:"schedule"`
+	TimeZone string         `json:"timeZone,omitempty"`
+	Volumes  []BackupVolume `json:"volumes"`
+	// VolumeSelector adds the PVCs of the namespace it matches to Volumes.
+	VolumeSelector *VolumeSelector `json:"volumeSelector,omitempty"`
+	Quiesce        *struct {
 		ScaleDown []struct {
 			Kind string `json:"kind"`
 			Name string `json:"name"`
 		} `json:"scaleDown"`
 	} `json:"quiesce,omitempty"`
-	Export *struct {
-		JobRef *struct {
-			Name string `json:"name"`
-		} `json:"jobRef"`
-	} `json:"export,omitempty"`
+	Export        *ExportSpec           `json:"export,omitempty"`
+	Retention     *RetentionSpec        `json:"retention,omitempty"`
+	RestoreTest   *RestoreTestSpec      `json:"restoreTest,omitempty"`
+	Notifications *NotificationOverride `json:"notifications,omitempty"`
+	// MaxAge is the oldest a volume's last successful sync may be, as a Go
+	// duration such as 26h, before the policy is reported as stale.
+	MaxAge string `json:"maxAge,omitempty"`
+	// Offsite overrides backupController.offsite.enabled for the policy.
+	Offsite *bool      `json:"offsite,omitempty"`
+	Mover   *MoverSpec `json:"mover,omitempty"`
+}
+
+type RetentionSpec struct {
+	Hourly   *int64   `json:"hourly,omitempty"`
+	Daily    *int64   `json:"daily,omitempty"`
+	Weekly   *int64   `json:"weekly,omitempty"`
+	Monthly  *int64   `json:"monthly,omitempty"`
+	Yearly   *int64   `json:"yearly,omitempty"`
+	KeepTags []string `json:"keepTags,omitempty"`
+}
+
+type RestoreTestSpec struct {
+	Schedule   string                 `json:"schedule"`
+	TimeZone   string                 `json:"timeZone,omitempty"`
+	Validation *RestoreTestValidation `json:"validation,omitempty"`
+}
+
+type RestoreTestValidation struct {
+	Image     string   `json:"image"`
+	Command   []string `json:"command,omitempty"`
+	Args      []string `json:"args,omitempty"`
+	MountPath string   `json:"mountPath,omitempty"`
 }
 
 type BackupPolicyStatus struct {
+	Conditions       []Condition                `json:"conditions,omitempty"`
 	LastSnapshotSync string                     `json:"lastSnapshotSync,omitempty"`
 	Volumes          []BackupPolicyVolumeStatus `json:"volumes,omitempty"`
+	RestoreTest      *RestoreTestStatus         `json:"restoreTest,omitempty"`
+	DriftCorrected   int64                      `json:"driftCorrected,omitempty"`
+	Export           *ExportStatus              `json:"export,omitempty"`
+}
+
+type RestoreTestStatus struct {
+	Schedule string                    `json:"schedule,omitempty"`
+	TimeZone string                    `json:"timeZone,omitempty"`
+	NextRun  string                    `json:"nextRun,omitempty"`
+	LastRun  string                    `json:"lastRun,omitempty"`
+	Result   string                    `json:"result,omitempty"`
+	Message  string                    `json:"message,omitempty"`
+	Volumes  []RestoreTestVolumeStatus `json:"volumes,omitempty"`
+}
+
+type RestoreTestVolumeStatus struct {
+	PVC     string `json:"pvc"`
+	Result  string `json:"result"`
+	Message string `json:"message,omitempty"`
 }
 
 type BackupPolicyVolumeStatus struct {
-	PVC       string           `json:"pvc"`
-	LastSync  string           `json:"lastSync,omitempty"`
+	PVC            string `json:"pvc"`
+	CopyMethod     string `json:"copyMethod,omitempty"`
+	LastSync       string `json:"lastSync,omitempty"`
+	SnapshotCount  int    `json:"snapshotCount,omitempty"`
+	OldestSnapshot string `json:"oldestSnapshot,omitempty"`
+	NewestSnapshot string `json:"newestSnapshot,omitempty"`
+	TotalSize      uint64 `json:"totalSize,omitempty"`
+	// SnapshotCatalog is the ConfigMap with every snapshot of the volume.
+	SnapshotCatalog string `json:"snapshotCatalog,omitempty"`
+	// Snapshots are the newest statusSnapshots snapshots, oldest first.
 	Snapshots []BackupSnapshot `json:"snapshots,omitempty"`
 }
 
 type BackupSnapshot struct {
-	ID      string `json:"id"`
-	Time    string `json:"time"`
-	Size    uint64 `json:"size"`
-	Snippet string `json:"snippet"`
+	ID       string           `json:"id"`
+	Time     string           `json:"time"`
+	Size     uint64           `json:"size"`
+	Hostname string           `json:"hostname,omitempty"`
+	Paths    []string         `json:"paths,omitempty"`
+	Tags     []string         `json:"tags,omitempty"`
+	Summary  *SnapshotSummary `json:"summary,omitempty"`
+	Snippet  string           `json:"snippet,omitempty"`
+}
+
+type SnapshotSummary struct {
+	FilesNew            uint64 `json:"filesNew"`
+	FilesChanged        uint64 `json:"filesChanged"`
+	FilesUnmodified     uint64 `json:"filesUnmodified"`
+	DataAdded           uint64 `json:"dataAdded"`
+	TotalFilesProcessed uint64 `json:"totalFilesProcessed"`
+	TotalBytesProcessed uint64 `json:"totalBytesProcessed"`
 }
 
 type RestorePolicySpec struct {
-	SourceNamespace string `json:"sourceNamespace"`
-	Volumes         []struct {
-		SourcePVC   string `json:"sourcePVC"`
-		TargetPVC   string `json:"targetPVC"`
-		RestoreAsOf string `json:"restoreAsOf,omitempty"`
-	} `json:"volumes"`
+	SourceNamespace string                `json:"sourceNamespace"`
+	Volumes         []RestoreVolume       `json:"volumes"`
+	Notifications   *NotificationOverride `json:"notifications,omitempty"`
+}
+
+type RestoreVolume struct {
+	SourcePVC     string   `json:"sourcePVC"`
+	TargetPVC     string   `json:"targetPVC"`
+	RestoreAsOf   string   `json:"restoreAsOf,omitempty"`
+	IncludePaths  []string `json:"includePaths,omitempty"`
+	ExcludePaths  []string `json:"excludePaths,omitempty"`
+	TargetSubPath string   `json:"targetSubPath,omitempty"`
+}
+
+// partial reports whether the volume restores a subset of the snapshot or into
+// a subdirectory, which VolSync's ReplicationDestination cannot express.
+func (v RestoreVolume) partial() bool {
+	return len(v.IncludePaths) > 0 || len(v.ExcludePaths) > 0 || v.TargetSubPath != ""
 }
 
 type Config struct {
-	ReconcileInterval       time.Duration
-	RepoPVCName             string
-	RepoPVCSize             string
-	RepoStorageClass        string
-	RepoMountPath           string
-	PruneIntervalDays       int64
-	RetainHourly            int64
-	RetainDaily             int64
-	RetainWeekly            int64
-	RetainMonthly           int64
-	RetainYearly            int64
-	ExternalSecretStoreName string
-	ExternalSecretStoreKind string
-	ExternalSecretKey       string
-	ResticPasswordProperty  string
-	ResticS3BucketProperty  string
-	ResticS3AccessKeyProp   string
-	ResticS3SecretKeyProp   string
-	RunnerImage             string
-	RunnerImagePullPolicy   string
-	ResticImage             string
-	ScaleDownTimeoutSeconds int64
-	ExportTimeoutSeconds    int64
-	BackupTimeoutSeconds    int64
-	OffsiteEnabled          bool
-	OffsiteSchedule         string
-	OffsiteTimeZone         string
+	ReconcileInterval         time.Duration
+	RepoPVCName               string
+	RepoPVCSize               string
+	RepoStorageClass          string
+	RepoMountPath             string
+	PruneIntervalDays         int64
+	RetainHourly              int64
+	RetainDaily               int64
+	RetainWeekly              int64
+	RetainMonthly             int64
+	RetainYearly              int64
+	ExternalSecretStoreName   string
+	ExternalSecretStoreKind   string
+	ExternalSecretKey         string
+	ResticPasswordProperty    string
+	ResticS3BucketProperty    string
+	ResticS3AccessKeyProp     string
+	ResticS3SecretKeyProp     string
+	RunnerImage               string
+	RunnerImagePullPolicy     string
+	ResticImage               string
+	ScaleDownTimeoutSeconds   int64
+	ExportTimeoutSeconds      int64
+	BackupTimeoutSeconds      int64
+	QueueTimeoutSeconds       int64
+	RestoreTestTimeoutSeconds int64
+	APIAddr                   string
+	OffsiteEnabled            bool
+	OffsiteSchedule           string
+	OffsiteTimeZone           string
+	Namespace                 string
+	Notifications             NotificationConfig
+	WebhookAddr               string
+	WebhookCertDir            string
+	BackupTiers               map[string]BackupTier
+	Concurrency               ConcurrencyConfig
+	CopyMethods               CopyMethodConfig
+	ExportImages              map[string]string
+	LogLevel                  slog.Level
+	CatalogConcurrency        int64
+	CatalogTTL                time.Duration
 }
 
 const (
@@ -138,75 +255,191 @@ const (
 
 const processedHashAnnotation = "backup.homelab/processed-hash"
 
+// shutdownTimeout bounds how long the controller waits for in-flight work
+// after SIGTERM, within the pod's termination grace period.
+const shutdownTimeout = 20 * time.Second
+
+// cleanupTimeout bounds the requests made by cleanupContext.
+const cleanupTimeout = 10 * time.Second
+
+// fieldManager is the server-side apply field manager of generated objects.
+const fieldManager = "backup-controller"
+
+// legacyFieldManagers are the managers of fields written by PUT requests
+// before the controller used server-side apply. The API server names them
+// after the user agent, which defaults to Go-http-client. Other Go clients
+// share that name, so conflicts with it are only forced on objects the
+// controller created itself (see createdByController).
+var legacyFieldManagers = map[string]bool{
+	"Go-http-client": true,
+}
+
+var conflictManagerPattern = regexp.MustCompile(`conflict with "([^"]+)"`)
+
 var reconcileHealthy atomic.Bool
 
 type PolicyHandler interface {
-	Reconcile(client *kubeClient, cfg Config) error
+	Reconcile(ctx context.Context, client *kubeClient, cfg Config) error
 }
 
 func main() {
+	if runCLI(os.Args[1:]) {
+		return
+	}
+
 	cfg := loadConfig()
+	slog.SetDefault(newLogger(os.Stdout, cfg.LogLevel))
 	client, err := newKubeClient()
 	if err != nil {
 		panic(err)
 	}
 
-	go startHealthServer()
+	// SIGTERM cancels ctx, which stops the loops and servers and cancels the
+	// requests and Jobs they have in flight.
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
 
-	if err := startInformers(client, cfg); err != nil {
+	notifications = newNotifier(cfg.Notifications, secretReader(ctx, client, cfg.Namespace, cfg.Notifications.SecretName))
+	controllerPod = podName()
+	catalog = newSnapshotCatalog(client, cfg)
+	pvcMetadataRecords = newPVCMetadataCache(client, cfg)
+	if err := collectResticJobs(ctx, client, cfg); err != nil {
+		slog.Warn("collecting leftover restic jobs failed", logError, err)
+	}
+
+	// Every replica serves health, the snapshot API and the webhook; only the
+	// leader reconciles and runs the loops that create Jobs.
+	var wg sync.WaitGroup
+	startAll(ctx, &wg,
+		startHealthServer,
+		func(ctx context.Context) { startAPIServer(ctx, client, cfg) },
+		func(ctx context.Context) { startWebhookServer(ctx, client, cfg) },
+	)
+
+	lead := func(ctx context.Context) {
+		var wg sync.WaitGroup
+		startAll(ctx, &wg,
+			func(ctx context.Context) { startRestoreTestScheduler(ctx, client, cfg) },
+			func(ctx context.Context) { startResyncLoop(ctx, client, cfg) },
+			func(ctx context.Context) { startTriggerQueue(ctx, client, cfg) },
+		)
+		if err := startInformers(ctx, client, cfg); err != nil {
+			slog.Error("informers failed", logError, err)
+			reconcileHealthy.Store(false)
+			<-ctx.Done()
+		}
+		wg.Wait()
+		catalog.wait()
+		pvcMetadataRecords.wait()
+	}
+	if err := runLeaderElection(ctx, client, cfg, lead); err != nil {
 		panic(err)
 	}
+
+	slog.Info("shutdown: waiting for in-flight work")
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		slog.Info("shutdown complete")
+	case <-time.After(shutdownTimeout):
+		slog.Warn("shutdown timed out", logDuration, shutdownTimeout)
+	}
+}
+
+// startAll runs each start function in its own goroutine, tracked by wg.
+func startAll(ctx context.Context, wg *sync.WaitGroup, starts ...func(context.Context)) {
+	for _, start := range starts {
+		wg.Add(1)
+		go func(start func(context.Context)) {
+			defer wg.Done()
+			start(ctx)
+		}(start)
+	}
 }
 
 func loadConfig() Config {
+	return loadConfigFrom(os.Getenv)
+}
+
+// loadConfigFrom reads the configuration through lookup, which returns an
+// empty string for unset keys.
+func loadConfigFrom(lookup func(string) string) Config {
+	get := func(key, fallback string) string {
+		if value := lookup(key); value != "" {
+			return value
+		}
+		return fallback
+	}
 	return Config{
-		ReconcileInterval:       mustDuration(getenv("RECONCILE_INTERVAL", "5m")),
-		RepoPVCName:             getenv("REPO_PVC_NAME", "backup-repo"),
-		RepoPVCSize:             getenv("REPO_PVC_SIZE", "100Gi"),
-		RepoStorageClass:        getenv("REPO_STORAGE_CLASS", "nas-nfs-backup"),
-		RepoMountPath:           strings.Trim(getenv("REPO_MOUNT_PATH", "restic-repo"), "/"),
-		PruneIntervalDays:       mustInt64(getenv("PRUNE_INTERVAL_DAYS", "14")),
-		RetainHourly:            mustInt64(getenv("RETAIN_HOURLY", "6")),
-		RetainDaily:             mustInt64(getenv("RETAIN_DAILY", "5")),
-		RetainWeekly:            mustInt64(getenv("RETAIN_WEEKLY", "4")),
-		RetainMonthly:           mustInt64(getenv("RETAIN_MONTHLY", "2")),
-		RetainYearly:            mustInt64(getenv("RETAIN_YEARLY", "1")),
-		ExternalSecretStoreName: getenv("EXTERNAL_SECRET_STORE_NAME", "global-secrets"),
-		ExternalSecretStoreKind: getenv("EXTERNAL_SECRET_STORE_KIND", "ClusterSecretStore"),
-		ExternalSecretKey:       getenv("EXTERNAL_SECRET_KEY", "external"),
-		ResticPasswordProperty:  getenv("RESTIC_PASSWORD_PROPERTY", "restic-password"),
-		ResticS3BucketProperty:  getenv("RESTIC_S3_BUCKET_PROPERTY", "restic-s3-bucket"),
-		ResticS3AccessKeyProp:   getenv("RESTIC_S3_ACCESS_KEY_PROPERTY", "restic-s3-access-key"),
-		ResticS3SecretKeyProp:   getenv("RESTIC_S3_SECRET_KEY_PROPERTY", "restic-s3-secret-key"),
-		RunnerImage:             getenv("RUNNER_IMAGE", "bitnami/kubectl:latest"),
-		RunnerImagePullPolicy:   getenv("RUNNER_IMAGE_PULL_POLICY", "IfNotPresent"),
-		ResticImage:             getenv("RESTIC_IMAGE", "restic/restic:0.18.0"),
-		ScaleDownTimeoutSeconds: mustInt64(getenv("SCALE_DOWN_TIMEOUT_SECONDS", "600")),
-		ExportTimeoutSeconds:    mustInt64(getenv("EXPORT_TIMEOUT_SECONDS", "3600")),
-		BackupTimeoutSeconds:    mustInt64(getenv("BACKUP_TIMEOUT_SECONDS", "7200")),
-		OffsiteEnabled:          getenv("OFFSITE_ENABLED", "false") == "true",
-		OffsiteSchedule:         getenv("OFFSITE_SCHEDULE", "0 3 * * 0"),
-		OffsiteTimeZone:         getenv("OFFSITE_TIME_ZONE", "UTC"),
-	}
-}
-
-func reconcile(client *kubeClient, cfg Config) {
+		ReconcileInterval:         mustDuration(get("RECONCILE_INTERVAL", "5m")),
+		RepoPVCName:               get("REPO_PVC_NAME", "backup-repo"),
+		RepoPVCSize:               get("REPO_PVC_SIZE", "100Gi"),
+		RepoStorageClass:          get("REPO_STORAGE_CLASS", "nas-nfs-backup"),
+		RepoMountPath:             strings.Trim(get("REPO_MOUNT_PATH", "restic-repo"), "/"),
+		PruneIntervalDays:         mustInt64(get("PRUNE_INTERVAL_DAYS", "14")),
+		RetainHourly:              mustInt64(get("RETAIN_HOURLY", "6")),
+		RetainDaily:               mustInt64(get("RETAIN_DAILY", "5")),
+		RetainWeekly:              mustInt64(get("RETAIN_WEEKLY", "4")),
+		RetainMonthly:             mustInt64(get("RETAIN_MONTHLY", "2")),
+		RetainYearly:              mustInt64(get("RETAIN_YEARLY", "1")),
+		ExternalSecretStoreName:   get("EXTERNAL_SECRET_STORE_NAME", "global-secrets"),
+		ExternalSecretStoreKind:   get("EXTERNAL_SECRET_STORE_KIND", "ClusterSecretStore"),
+		ExternalSecretKey:         get("EXTERNAL_SECRET_KEY", "external"),
+		ResticPasswordProperty:    get("RESTIC_PASSWORD_PROPERTY", "restic-password"),
+		ResticS3BucketProperty:    get("RESTIC_S3_BUCKET_PROPERTY", "restic-s3-bucket"),
+		ResticS3AccessKeyProp:     get("RESTIC_S3_ACCESS_KEY_PROPERTY", "restic-s3-access-key"),
+		ResticS3SecretKeyProp:     get("RESTIC_S3_SECRET_KEY_PROPERTY", "restic-s3-secret-key"),
+		RunnerImage:               get("RUNNER_IMAGE", "bitnami/kubectl:latest"),
+		RunnerImagePullPolicy:     get("RUNNER_IMAGE_PULL_POLICY", "IfNotPresent"),
+		ResticImage:               get("RESTIC_IMAGE", "restic/restic:0.18.0"),
+		ScaleDownTimeoutSeconds:   mustInt64(get("SCALE_DOWN_TIMEOUT_SECONDS", "600")),
+		ExportTimeoutSeconds:      mustInt64(get("EXPORT_TIMEOUT_SECONDS", "3600")),
+		BackupTimeoutSeconds:      mustInt64(get("BACKUP_TIMEOUT_SECONDS", "7200")),
+		QueueTimeoutSeconds:       mustInt64(get("QUEUE_TIMEOUT_SECONDS", "21600")),
+		RestoreTestTimeoutSeconds: mustInt64(get("RESTORE_TEST_TIMEOUT_SECONDS", "3600")),
+		APIAddr:                   get("API_ADDR", ":8081"),
+		OffsiteEnabled:            get("OFFSITE_ENABLED", "false") == "true",
+		OffsiteSchedule:           get("OFFSITE_SCHEDULE", "0 3 * * 0"),
+		OffsiteTimeZone:           get("OFFSITE_TIME_ZONE", "UTC"),
+		Namespace:                 get("POD_NAMESPACE", "backup"),
+		Notifications:             mustNotificationConfig(get("NOTIFICATIONS", "{}")),
+		WebhookAddr:               get("WEBHOOK_ADDR", ":9443"),
+		WebhookCertDir:            get("WEBHOOK_CERT_DIR", "/tmp/webhook-certs"),
+		BackupTiers:               mustBackupTiers(get("BACKUP_TIERS", "{}")),
+		Concurrency:               mustConcurrencyConfig(get("CONCURRENCY", "{}")),
+		CopyMethods:               mustCopyMethodConfig(get("COPY_METHODS", "{}")),
+		ExportImages:              mustExportImages(get("EXPORT_IMAGES", "{}")),
+		LogLevel:                  mustLogLevel(get("LOG_LEVEL", "info")),
+		CatalogConcurrency:        mustInt64(get("CATALOG_CONCURRENCY", "2")),
+		CatalogTTL:                mustDuration(get("CATALOG_TTL", "1h")),
+	}
+}
+
+func reconcile(ctx context.Context, client *kubeClient, cfg Config) {
 	start := time.Now()
-	fmt.Println("reconcile: starting")
+	slog.Debug("reconcile starting")
 	ok := true
 
+	// Generated BackupPolicies are written before BackupPolicyHandler runs, so
+	// it reconciles them in the same pass.
 	handlers := []PolicyHandler{
+		&ClusterBackupPolicyHandler{},
+		&DiscoveryHandler{},
 		&BackupPolicyHandler{},
 		&RestorePolicyHandler{},
 	}
 
 	for _, handler := range handlers {
-		if err := handler.Reconcile(client, cfg); err != nil {
+		if err := handler.Reconcile(ctx, client, cfg); err != nil {
 			ok = false
 		}
 	}
 
-	fmt.Printf("reconcile: completed in %s\n", time.Since(start).Truncate(time.Millisecond))
+	slog.Info("reconcile completed", logDuration, time.Since(start).Truncate(time.Millisecond))
 	reconcileHealthy.Store(ok)
 }
 
@@ -219,7 +452,7 @@ func policySpecHash(spec interface{}) (string, error) {
 	return hex.EncodeToString(sum[:]), nil
 }
 
-func updateProcessedHash(client *kubeClient, resource, ns, name, hash string) error {
+func updateProcessedHash(ctx context.Context, client *kubeClient, resource, ns, name, hash string) error {
 	itemPath := namespacedPath(
 		fmt.Sprintf("/apis/%s/%s", backupPolicyGroup, backupPolicyVersion),
 		ns,
@@ -235,7 +468,7 @@ func updateProcessedHash(client *kubeClient, resource, ns, name, hash string) er
 		},
 	}
 
-	respBody, status, err := client.doRequestWithContentType("PATCH", itemPath, "application/merge-patch+json", payload)
+	respBody, status, err := client.doRequestWithContentType(ctx, "PATCH", itemPath, "application/merge-patch+json", payload)
 	if err != nil {
 		return err
 	}
@@ -246,131 +479,307 @@ func updateProcessedHash(client *kubeClient, resource, ns, name, hash string) er
 }
 
 type kubeClient struct {
-	baseURL string
-	token   string
-	client  *http.Client
+	baseURL      string
+	client       *http.Client
+	streamClient *http.Client
 }
 
-func newKubeClient() (*kubeClient, error) {
-	host := os.Getenv("KUBERNETES_SERVICE_HOST")
-	port := os.Getenv("KUBERNETES_SERVICE_PORT")
-	if host == "" || port == "" {
-		return nil, fmt.Errorf("missing KUBERNETES_SERVICE_HOST or KUBERNETES_SERVICE_PORT")
-	}
+// Requests to the API server are retried on throttling, server errors and
+// broken connections, with exponential backoff between attempts.
+const (
+	requestTimeout    = 30 * time.Second
+	requestAttempts   = 5
+	requestBackoff    = 200 * time.Millisecond
+	requestMaxBackoff = 5 * time.Second
+)
 
-	token, err := os.ReadFile("/var/run/secrets/kubernetes.io/serviceaccount/token")
+// newKubeClient builds the controller's client from the in-cluster config. Its
+// transport re-reads the service account token, which is rotated hourly.
+func newKubeClient() (*kubeClient, error) {
+	config, err := rest.InClusterConfig()
 	if err != nil {
 		return nil, err
 	}
+	return newKubeClientFor(config)
+}
 
-	caCert, err := os.ReadFile("/var/run/secrets/kubernetes.io/serviceaccount/ca.crt")
+func newKubeClientFor(config *rest.Config) (*kubeClient, error) {
+	httpClient, err := rest.HTTPClientFor(config)
 	if err != nil {
 		return nil, err
 	}
-
-	pool := x509.NewCertPool()
-	if !pool.AppendCertsFromPEM(caCert) {
-		return nil, fmt.Errorf("failed to parse CA certificate")
-	}
-
-	transport := &http.Transport{
-		TLSClientConfig: &tls.Config{RootCAs: pool},
-	}
-
 	return &kubeClient{
-		baseURL: fmt.Sprintf("https://%s:%s", host, port),
-		token:   strings.TrimSpace(string(token)),
-		client:  &http.Client{Transport: transport, Timeout: 30 * time.Second},
+		baseURL:      strings.TrimRight(config.Host, "/"),
+		client:       httpClient,
+		streamClient: httpClient,
 	}, nil
 }
 
-func (c *kubeClient) doRequest(method, path string, body interface{}) ([]byte, int, error) {
-	return c.doRequestWithContentType(method, path, "application/json", body)
+func (c *kubeClient) doRequest(ctx context.Context, method, path string, body interface{}) ([]byte, int, error) {
+	return c.doRequestWithContentType(ctx, method, path, "application/json", body)
 }
 
-func (c *kubeClient) doRequestWithContentType(method, path, contentType string, body interface{}) ([]byte, int, error) {
-	var reader io.Reader
+func (c *kubeClient) doRequestWithContentType(ctx context.Context, method, path, contentType string, body interface{}) ([]byte, int, error) {
+	var payload []byte
 	if body != nil {
-		payload, err := json.Marshal(body)
-		if err != nil {
+		var err error
+		if payload, err = json.Marshal(body); err != nil {
 			return nil, 0, err
 		}
-		reader = bytes.NewReader(payload)
 	}
 
-	req, err := http.NewRequest(method, c.baseURL+path, reader)
+	for attempt := 1; ; attempt++ {
+		respBody, status, retryAfter, err := c.attempt(ctx, method, path, contentType, payload)
+		if attempt == requestAttempts || ctx.Err() != nil || !retryable(method, status, err) {
+			return respBody, status, err
+		}
+		delay := backoff(attempt, retryAfter)
+		slog.Warn("api request failed, retrying", "method", method, logResource, path, logHTTPStatus, status, logError, err, "retry_in", delay)
+		if err := sleepContext(ctx, delay); err != nil {
+			return nil, 0, err
+		}
+	}
+}
+
+// attempt sends one request, bounded by requestTimeout. It returns the
+// Retry-After header of throttled responses.
+func (c *kubeClient) attempt(ctx context.Context, method, path, contentType string, payload []byte) ([]byte, int, time.Duration, error) {
+	ctx, cancel := context.WithTimeout(ctx, requestTimeout)
+	defer cancel()
+
+	var reader io.Reader
+	if payload != nil {
+		reader = bytes.NewReader(payload)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, c.baseURL+path, reader)
 	if err != nil {
-		return nil, 0, err
+		return nil, 0, 0, err
 	}
-	req.Header.Set("Authorization", "Bearer "+c.token)
 	req.Header.Set("Accept", "application/json")
-	if body != nil {
+	if payload != nil {
 		req.Header.Set("Content-Type", contentType)
 	}
 
 	resp, err := c.client.Do(req)
 	if err != nil {
-		return nil, 0, err
+		return nil, 0, 0, err
 	}
 	defer resp.Body.Close()
 
+	var retryAfter time.Duration
+	if seconds, err := strconv.Atoi(resp.Header.Get("Retry-After")); err == nil && seconds > 0 {
+		retryAfter = time.Duration(seconds) * time.Second
+	}
 	respBody, err := io.ReadAll(resp.Body)
 	if err != nil {
-		return nil, resp.StatusCode, err
+		return nil, resp.StatusCode, retryAfter, err
 	}
+	return respBody, resp.StatusCode, retryAfter, nil
+}
 
-	return respBody, resp.StatusCode, nil
+// retryable reports whether a failed attempt may be repeated. Throttled
+// requests were not processed, so they are always retried. POSTs are not
+// retried after server errors or broken connections, which may have created
+// the object already.
+func retryable(method string, status int, err error) bool {
+	if status == http.StatusTooManyRequests {
+		return true
+	}
+	if method == http.MethodPost {
+		return false
+	}
+	if err != nil {
+		return !errors.Is(err, context.Canceled)
+	}
+	return status >= 500 && status != http.StatusNotImplemented
 }
 
-func (c *kubeClient) upsert(itemPath, collectionPath string, obj map[string]interface{}, owner *BackupPolicy) error {
-	body, status, err := c.doRequest("GET", itemPath, nil)
+// backoff is the delay before the next attempt: the server's Retry-After when
+// given, else doubling from requestBackoff, both capped at requestMaxBackoff.
+func backoff(attempt int, retryAfter time.Duration) time.Duration {
+	delay := retryAfter
+	if delay == 0 {
+		delay = requestBackoff << (attempt - 1)
+	}
+	if delay > requestMaxBackoff {
+		delay = requestMaxBackoff
+	}
+	return delay
+}
+
+// getJSON GETs itemPath and decodes the response into out.
+func getJSON(ctx context.Context, client *kubeClient, itemPath string, out interface{}) error {
+	body, status, err := client.doRequest(ctx, "GET", itemPath, nil)
 	if err != nil {
 		return err
 	}
+	if status != http.StatusOK {
+		return fmt.Errorf("get failed: %s status=%d", itemPath, status)
+	}
+	return json.Unmarshal(body, out)
+}
 
-	if status == http.StatusNotFound {
-		if owner != nil {
-			setOwnerRef(obj, owner)
+// stream issues a GET without the request timeout and returns the open
+// body, for long-running reads such as following pod logs. Cancelling ctx
+// closes the body.
+func (c *kubeClient) stream(ctx context.Context, path string) (io.ReadCloser, int, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", c.baseURL+path, nil)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	resp, err := c.streamClient.Do(req)
+	if err != nil {
+		return nil, 0, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, resp.StatusCode, nil
+	}
+	return resp.Body, resp.StatusCode, nil
+}
+
+// apply writes obj with server-side apply under the controller's field
+// manager, so fields set by other managers are left alone. Conflicts are only
+// forced when every conflicting field belongs to a legacy manager and the
+// object was created by the controller, i.e. the fields were written by its
+// former GET-then-PUT updates.
+func (c *kubeClient) apply(ctx context.Context, itemPath string, obj map[string]interface{}, owner *BackupPolicy) error {
+	if owner != nil {
+		setOwnerRef(obj, owner)
+	}
+	applyPath := itemPath + "?fieldManager=" + fieldManager
+	body, status, err := c.doRequestWithContentType(ctx, "PATCH", applyPath, "application/apply-patch+yaml", obj)
+	if err != nil {
+		return err
+	}
+	if status == http.StatusConflict {
+		conflictErr := fmt.Errorf("apply conflict: %s: %s", itemPath, conflictMessage(body))
+		managers := conflictingManagers(body)
+		if len(managers) == 0 {
+			return conflictErr
 		}
-		_, createStatus, err := c.doRequest("POST", collectionPath, obj)
+		for _, manager := range managers {
+			if !legacyFieldManagers[manager] {
+				return conflictErr
+			}
+		}
+		created, err := c.createdByController(ctx, itemPath)
 		if err != nil {
 			return err
 		}
-		if createStatus < 200 || createStatus >= 300 {
-			return fmt.Errorf("create failed: %s status=%d", collectionPath, createStatus)
+		if !created {
+			return conflictErr
+		}
+		body, status, err = c.doRequestWithContentType(ctx, "PATCH", applyPath+"&force=true", "application/apply-patch+yaml", obj)
+		if err != nil {
+			return err
 		}
-		return nil
 	}
-	if status != http.StatusOK {
-		return fmt.Errorf("get failed: %s status=%d", itemPath, status)
+	if status < 200 || status >= 300 {
+		return fmt.Errorf("apply failed: %s status=%d body=%s", itemPath, status, strings.TrimSpace(string(body)))
 	}
+	return nil
+}
 
-	var existing map[string]interface{}
-	if err := json.Unmarshal(body, &existing); err != nil {
-		return err
+// conflictingManagers returns the field managers named in an apply conflict,
+// or nil when a cause does not name one, so the conflict is not forced.
+func conflictingManagers(body []byte) []string {
+	var resp struct {
+		Details struct {
+			Causes []struct {
+				Message string `json:"message"`
+			} `json:"causes"`
+		} `json:"details"`
+	}
+	if err := json.Unmarshal(body, &resp); err != nil {
+		return nil
+	}
+	var managers []string
+	for _, cause := range resp.Details.Causes {
+		match := conflictManagerPattern.FindStringSubmatch(cause.Message)
+		if match == nil {
+			return nil
+		}
+		managers = append(managers, match[1])
 	}
+	return managers
+}
 
-	metadata, _ := existing["metadata"].(map[string]interface{})
-	resourceVersion, _ := metadata["resourceVersion"].(string)
-	if resourceVersion != "" {
-		objMetadata, _ := obj["metadata"].(map[string]interface{})
-		if objMetadata == nil {
-			objMetadata = map[string]interface{}{}
-			obj["metadata"] = objMetadata
+// createdByController reports whether the object at itemPath is owned by a
+// policy or carries the controller's managed-by label.
+func (c *kubeClient) createdByController(ctx context.Context, itemPath string) (bool, error) {
+	var live struct {
+		Metadata struct {
+			Labels          map[string]string `json:"labels"`
+			OwnerReferences []struct {
+				APIVersion string `json:"apiVersion"`
+			} `json:"ownerReferences"`
+		} `json:"metadata"`
+	}
+	if err := getJSON(ctx, c, itemPath, &live); err != nil {
+		return false, err
+	}
+	for _, owner := range live.Metadata.OwnerReferences {
+		if strings.HasPrefix(owner.APIVersion, backupPolicyGroup+"/") {
+			return true, nil
 		}
-		objMetadata["resourceVersion"] = resourceVersion
 	}
+	return live.Metadata.Labels[managedLabel] == fieldManager || live.Metadata.Labels["app.kubernetes.io/managed-by"] == fieldManager, nil
+}
 
-	if owner != nil {
-		setOwnerRef(obj, owner)
+func conflictMessage(body []byte) string {
+	var resp struct {
+		Message string `json:"message"`
+	}
+	if err := json.Unmarshal(body, &resp); err != nil || resp.Message == "" {
+		return strings.TrimSpace(string(body))
 	}
+	return resp.Message
+}
+
+// createIfMissing creates obj unless it already exists. It is used for objects
+// the controller must never update, such as PVCs and Jobs.
+func (c *kubeClient) createIfMissing(ctx context.Context, itemPath, collectionPath string, obj map[string]interface{}) error {
+	exists, err := objectExists(ctx, c, itemPath)
+	if err != nil || exists {
+		return err
+	}
+	_, createStatus, err := c.doRequest(ctx, "POST", collectionPath, obj)
+	if err != nil {
+		return err
+	}
+	if createStatus < 200 || createStatus >= 300 {
+		return fmt.Errorf("create failed: %s status=%d", collectionPath, createStatus)
+	}
+	return nil
+}
+
+func objectExists(ctx context.Context, c *kubeClient, itemPath string) (bool, error) {
+	_, status, err := c.doRequest(ctx, "GET", itemPath, nil)
+	if err != nil {
+		return false, err
+	}
+	switch status {
+	case http.StatusOK:
+		return true, nil
+	case http.StatusNotFound:
+		return false, nil
+	default:
+		return false, fmt.Errorf("get failed: %s status=%d", itemPath, status)
+	}
+}
 
-	_, updateStatus, err := c.doRequest("PUT", itemPath, obj)
+func (c *kubeClient) delete(ctx context.Context, itemPath string) error {
+	_, status, err := c.doRequest(ctx, "DELETE", itemPath+"?propagationPolicy=Background", nil)
 	if err != nil {
 		return err
 	}
-	if updateStatus < 200 || updateStatus >= 300 {
-		return fmt.Errorf("update failed: %s status=%d", itemPath, updateStatus)
+	if status == http.StatusNotFound {
+		return nil
+	}
+	if status < 200 || status >= 300 {
+		return fmt.Errorf("delete failed: %s status=%d", itemPath, status)
 	}
 	return nil
 }
@@ -428,6 +837,41 @@ func mustDuration(value string) time.Duration {
 	return dur
 }
 
+func mustConcurrencyConfig(value string) ConcurrencyConfig {
+	var config ConcurrencyConfig
+	if err := json.Unmarshal([]byte(value), &config); err != nil {
+		panic(fmt.Errorf("CONCURRENCY: %w", err))
+	}
+	return config
+}
+
+func mustCopyMethodConfig(value string) CopyMethodConfig {
+	var config CopyMethodConfig
+	if err := json.Unmarshal([]byte(value), &config); err != nil {
+		panic(fmt.Errorf("COPY_METHODS: %w", err))
+	}
+	if err := config.validate(); err != nil {
+		panic(fmt.Errorf("COPY_METHODS: %w", err))
+	}
+	return config
+}
+
+func mustBackupTiers(value string) map[string]BackupTier {
+	var tiers map[string]BackupTier
+	if err := json.Unmarshal([]byte(value), &tiers); err != nil {
+		panic(fmt.Errorf("BACKUP_TIERS: %w", err))
+	}
+	return tiers
+}
+
+func mustNotificationConfig(value string) NotificationConfig {
+	var config NotificationConfig
+	if err := json.Unmarshal([]byte(value), &config); err != nil {
+		panic(fmt.Errorf("NOTIFICATIONS: %w", err))
+	}
+	return config
+}
+
 func mustInt64(value string) int64 {
 	parsed, err := strconv.ParseInt(value, 10, 64)
 	if err != nil {
@@ -436,22 +880,69 @@ func mustInt64(value string) int64 {
 	return parsed
 }
 
-func startHealthServer() {
+func startHealthServer(ctx context.Context) {
 	mux := http.NewServeMux()
+	// A standby is alive without reconciling; a leader whose reconciles fail
+	// is restarted so a standby can take over.
 	mux.HandleFunc("/healthz", func(w http.ResponseWriter, _ *http.Request) {
-		if reconcileHealthy.Load() {
+		if !leading.Load() || reconcileHealthy.Load() {
 			w.WriteHeader(http.StatusOK)
 			return
 		}
 		w.WriteHeader(http.StatusServiceUnavailable)
 	})
+	// Readiness doesn't follow the Lease: a rollout starts the new replicas
+	// as standbys and only stops the old leader once they are ready, so a
+	// Lease-bound readiness would never let it progress. The Service selects
+	// the leader by its label instead, which is cleared as soon as the Lease
+	// is lost, so a replica is ready once its servers are up.
+	mux.HandleFunc("/readyz", func(w http.ResponseWriter, _ *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+	mux.HandleFunc("/metrics", serveMetrics)
 	server := &http.Server{
 		Addr:              ":8080",
 		Handler:           mux,
 		ReadHeaderTimeout: 5 * time.Second,
 	}
-	fmt.Println("health server starting on :8080")
-	if err := server.ListenAndServe(); err != nil {
-		fmt.Printf("health server stopped: %v\n", err)
+	slog.Info("health server starting", "addr", ":8080")
+	if err := serveUntilDone(ctx, server, server.ListenAndServe); err != nil {
+		slog.Error("health server stopped", logError, err)
 	}
 }
+
+// serveUntilDone runs serve until it fails or ctx is cancelled, then shuts
+// server down. Requests are served with ctx, so their handlers stop too.
+func serveUntilDone(ctx context.Context, server *http.Server, serve func() error) error {
+	server.BaseContext = func(net.Listener) context.Context { return ctx }
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- serve()
+	}()
+	select {
+	case err := <-errCh:
+		return err
+	case <-ctx.Done():
+	}
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	return server.Shutdown(shutdownCtx)
+}
+
+// sleepContext waits for d, or returns ctx.Err() when ctx is cancelled first.
+func sleepContext(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+// cleanupContext is for requests that undo work after ctx was cancelled, such
+// as deleting a Job the controller started.
+func cleanupContext() (context.Context, context.CancelFunc) {
+	return context.WithTimeout(context.Background(), cleanupTimeout)
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestKubeClientRetriesTransientErrors(t *testing.T) {
+	var calls int
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		if calls < 3 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.Write([]byte(`{}`))
+	}))
+	defer server.Close()
+
+	client := &kubeClient{baseURL: server.URL, client: server.Client()}
+	_, status, err := client.doRequest(context.Background(), "GET", "/api/v1/namespaces", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status != http.StatusOK || calls != 3 {
+		t.Fatalf("got status=%d after %d calls, want 200 after 3", status, calls)
+	}
+}
+
+func TestKubeClientDoesNotRetryFailedPosts(t *testing.T) {
+	var calls int
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer server.Close()
+
+	client := &kubeClient{baseURL: server.URL, client: server.Client()}
+	_, status, err := client.doRequest(context.Background(), "POST", "/api/v1/namespaces/backup/events", map[string]string{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status != http.StatusInternalServerError || calls != 1 {
+		t.Fatalf("got status=%d after %d calls, want 500 after 1", status, calls)
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	cases := []struct {
+		attempt    int
+		retryAfter int
+		want       string
+	}{
+		{1, 0, "200ms"},
+		{3, 0, "800ms"},
+		{10, 0, "5s"},
+		{1, 2, "2s"},
+		{1, 60, "5s"},
+	}
+	for _, c := range cases {
+		got := backoff(c.attempt, time.Duration(c.retryAfter)*time.Second).String()
+		if got != c.want {
+			t.Errorf("backoff(%d, %ds) = %s, want %s", c.attempt, c.retryAfter, got, c.want)
+		}
+	}
+}
+
+func TestConflictingManagers(t *testing.T) {
+	cases := []struct {
+		body string
+		want []string
+	}{
+		{`{"details": {"causes": [{"message": "conflict with \"Go-http-client\" using v1: .spec.foo"}, {"message": "conflict with \"volsync\" using volsync.backube/v1alpha1: .spec.trigger"}]}}`, []string{"Go-http-client", "volsync"}},
+		{`{"details": {"causes": [{"message": "conflict with \"Go-http-client\" using v1: .spec.foo"}, {"message": "field is owned by someone else"}]}}`, nil},
+		{`{"details": {"causes": []}}`, nil},
+		{`not json`, nil},
+	}
+	for _, c := range cases {
+		got := conflictingManagers([]byte(c.body))
+		if strings.Join(got, ",") != strings.Join(c.want, ",") {
+			t.Errorf("conflictingManagers(%s) = %q, want %q", c.body, got, c.want)
+		}
+	}
+}
+
+func TestApplyForcesLegacyConflictsOnControllerObjects(t *testing.T) {
+	legacyConflict := `{"message": "Apply failed with 1 conflict", "details": {"causes": [{"message": "conflict with \"Go-http-client\" using v1: .data.key"}]}}`
+	cases := []struct {
+		name     string
+		conflict string
+		live     string
+		forced   bool
+	}{
+		{"owned by a policy", legacyConflict, `{"metadata": {"ownerReferences": [{"apiVersion": "backup.homelab/v1alpha1"}]}}`, true},
+		{"managed-by label", legacyConflict, `{"metadata": {"labels": {"app.kubernetes.io/managed-by": "backup-controller"}}}`, true},
+		{"foreign object", legacyConflict, `{"metadata": {"ownerReferences": [{"apiVersion": "apps/v1"}]}}`, false},
+		{"other manager", `{"details": {"causes": [{"message": "conflict with \"helm\" using v1: .data.key"}]}}`, `{"metadata": {"labels": {"app.kubernetes.io/managed-by": "backup-controller"}}}`, false},
+		{"unexpected message", `{"details": {"causes": [{"message": "conflicting field .data.key"}]}}`, `{"metadata": {"labels": {"app.kubernetes.io/managed-by": "backup-controller"}}}`, false},
+	}
+	for _, c := range cases {
+		var forced bool
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			switch {
+			case r.Method == "GET":
+				w.Write([]byte(c.live))
+			case r.URL.Query().Get("force") == "true":
+				forced = true
+				w.Write([]byte(`{}`))
+			default:
+				w.WriteHeader(http.StatusConflict)
+				w.Write([]byte(c.conflict))
+			}
+		}))
+		client := &kubeClient{baseURL: server.URL, client: server.Client()}
+		err := client.apply(context.Background(), "/api/v1/namespaces/apps/configmaps/data", map[string]interface{}{}, nil)
+		server.Close()
+		if forced != c.forced || (err == nil) != c.forced {
+			t.Errorf("%s: forced=%v err=%v, want forced=%v", c.name, forced, err, c.forced)
+		}
+	}
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// policyFreshness is the last freshness check of one BackupPolicy.
+type policyFreshness struct {
+	maxAge    time.Duration
+	stale     bool
+	lastSyncs map[string]time.Time
+}
+
+// metricsStore holds the values served on /metrics in the Prometheus text
+// format.
+type metricsStore struct {
+	mu       sync.Mutex
+	policies map[string]policyFreshness
+	// queued and running count backup syncs per repository while the trigger
+	// queue is enabled.
+	queued  map[string]int
+	running map[string]int
+}
+
+var backupMetrics = &metricsStore{policies: map[string]policyFreshness{}}
+
+func (m *metricsStore) setPolicy(ns, name string, maxAge time.Duration, stale bool, lastSyncs map[string]time.Time) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.policies[ns+"/"+name] = policyFreshness{maxAge: maxAge, stale: stale, lastSyncs: lastSyncs}
+}
+
+// setQueue records the trigger queue after a pass of the queue.
+func (m *metricsStore) setQueue(sources []queuedSource, waiting map[string]int, now time.Time) {
+	running := map[string]int{}
+	for _, source := range sources {
+		if source.running(now) {
+			running[source.Repository]++
+		}
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.queued = waiting
+	m.running = running
+}
+
+// retainPolicies drops policies that are not in keep, keyed by namespace/name.
+func (m *metricsStore) retainPolicies(keep map[string]bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for key := range m.policies {
+		if !keep[key] {
+			delete(m.policies, key)
+		}
+	}
+}
+
+func (m *metricsStore) write(w io.Writer) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	keys := make([]string, 0, len(m.policies))
+	for key := range m.policies {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	leader := 0
+	if leading.Load() {
+		leader = 1
+	}
+	fmt.Fprintln(w, "# HELP backup_controller_leader Whether this replica holds the controller Lease.")
+	fmt.Fprintln(w, "# TYPE backup_controller_leader gauge")
+	fmt.Fprintf(w, "backup_controller_leader %d\n", leader)
+
+	fmt.Fprintln(w, "# HELP backup_volume_last_success_timestamp_seconds Time of the last successful sync of a volume.")
+	fmt.Fprintln(w, "# TYPE backup_volume_last_success_timestamp_seconds gauge")
+	for _, key := range keys {
+		ns, name, _ := strings.Cut(key, "/")
+		pvcs := make([]string, 0, len(m.policies[key].lastSyncs))
+		for pvc := range m.policies[key].lastSyncs {
+			pvcs = append(pvcs, pvc)
+		}
+		sort.Strings(pvcs)
+		for _, pvc := range pvcs {
+			fmt.Fprintf(w, "backup_volume_last_success_timestamp_seconds{namespace=%q,policy=%q,pvc=%q} %d\n",
+				ns, name, pvc, m.policies[key].lastSyncs[pvc].Unix())
+		}
+	}
+
+	fmt.Fprintln(w, "# HELP backup_policy_max_age_seconds The spec.maxAge of a BackupPolicy.")
+	fmt.Fprintln(w, "# TYPE backup_policy_max_age_seconds gauge")
+	for _, key := range keys {
+		if m.policies[key].maxAge == 0 {
+			continue
+		}
+		ns, name, _ := strings.Cut(key, "/")
+		fmt.Fprintf(w, "backup_policy_max_age_seconds{namespace=%q,policy=%q} %g\n", ns, name, m.policies[key].maxAge.Seconds())
+	}
+
+	fmt.Fprintln(w, "# HELP backup_policy_stale Whether a volume of the BackupPolicy was last synced longer than spec.maxAge ago.")
+	fmt.Fprintln(w, "# TYPE backup_policy_stale gauge")
+	for _, key := range keys {
+		if m.policies[key].maxAge == 0 {
+			continue
+		}
+		ns, name, _ := strings.Cut(key, "/")
+		stale := 0
+		if m.policies[key].stale {
+			stale = 1
+		}
+		fmt.Fprintf(w, "backup_policy_stale{namespace=%q,policy=%q} %d\n", ns, name, stale)
+	}
+
+	if m.running == nil {
+		return
+	}
+	repos := map[string]bool{}
+	for repo := range m.running {
+		repos[repo] = true
+	}
+	for repo := range m.queued {
+		repos[repo] = true
+	}
+	repoNames := make([]string, 0, len(repos))
+	for repo := range repos {
+		repoNames = append(repoNames, repo)
+	}
+	sort.Strings(repoNames)
+	fmt.Fprintln(w, "# HELP backup_syncs_running Backup syncs running per repository.")
+	fmt.Fprintln(w, "# TYPE backup_syncs_running gauge")
+	for _, repo := range repoNames {
+		fmt.Fprintf(w, "backup_syncs_running{repository=%q} %d\n", repo, m.running[repo])
+	}
+	fmt.Fprintln(w, "# HELP backup_syncs_queued Backup syncs waiting for a concurrency slot per repository.")
+	fmt.Fprintln(w, "# TYPE backup_syncs_queued gauge")
+	for _, repo := range repoNames {
+		fmt.Fprintf(w, "backup_syncs_queued{repository=%q} %d\n", repo, m.queued[repo])
+	}
+}
+
+func serveMetrics(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	backupMetrics.write(w)
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// MoverSpec sets the resources and placement of the pods that move a policy's
+// data. Resources, securityContext and affinity use the Kubernetes pod field
+// schemas.
+type MoverSpec struct {
+	Resources       map[string]interface{} `json:"resources,omitempty"`
+	SecurityContext map[string]interface{} `json:"securityContext,omitempty"`
+	Affinity        map[string]interface{} `json:"affinity,omitempty"`
+	NodeSelector    map[string]string      `json:"nodeSelector,omitempty"`
+	// Tolerations and PriorityClassName only reach the runner and restic Jobs
+	// the controller creates; VolSync has no mover fields for them.
+	Tolerations       []map[string]interface{} `json:"tolerations,omitempty"`
+	PriorityClassName string                   `json:"priorityClassName,omitempty"`
+	// LimitUploadKiB and LimitDownloadKiB are restic's --limit-upload and
+	// --limit-download in KiB/s for the restic Jobs the controller runs. The
+	// VolSync mover takes no restic flags, so they do not reach it.
+	LimitUploadKiB   int64 `json:"limitUploadKiB,omitempty"`
+	LimitDownloadKiB int64 `json:"limitDownloadKiB,omitempty"`
+}
+
+// setMoverFields sets the VolSync restic mover fields of resticSpec from
+// mover. The node selector is added to the mover affinity, since VolSync only
+// takes node placement through moverAffinity.
+func setMoverFields(resticSpec map[string]interface{}, mover *MoverSpec) {
+	if mover == nil {
+		return
+	}
+	if len(mover.Resources) > 0 {
+		resticSpec["moverResources"] = mover.Resources
+	}
+	if len(mover.SecurityContext) > 0 {
+		resticSpec["moverSecurityContext"] = mover.SecurityContext
+	}
+	if affinity := moverAffinity(mover); len(affinity) > 0 {
+		resticSpec["moverAffinity"] = affinity
+	}
+}
+
+// moverAffinity returns mover.Affinity with mover.NodeSelector added as a
+// required node affinity. Every node selector term gets the selector, so it
+// applies whichever term matches.
+func moverAffinity(mover *MoverSpec) map[string]interface{} {
+	affinity := map[string]interface{}{}
+	if len(mover.Affinity) > 0 {
+		// Copy so the policy spec is not modified.
+		data, _ := json.Marshal(mover.Affinity)
+		_ = json.Unmarshal(data, &affinity)
+	}
+	if len(mover.NodeSelector) == 0 {
+		return affinity
+	}
+
+	keys := make([]string, 0, len(mover.NodeSelector))
+	for key := range mover.NodeSelector {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	var expressions []interface{}
+	for _, key := range keys {
+		expressions = append(expressions, map[string]interface{}{
+			"key":      key,
+			"operator": "In",
+			"values":   []interface{}{mover.NodeSelector[key]},
+		})
+	}
+
+	nodeAffinity, _ := affinity["nodeAffinity"].(map[string]interface{})
+	if nodeAffinity == nil {
+		nodeAffinity = map[string]interface{}{}
+		affinity["nodeAffinity"] = nodeAffinity
+	}
+	required, _ := nodeAffinity["requiredDuringSchedulingIgnoredDuringExecution"].(map[string]interface{})
+	if required == nil {
+		required = map[string]interface{}{}
+		nodeAffinity["requiredDuringSchedulingIgnoredDuringExecution"] = required
+	}
+	terms, _ := required["nodeSelectorTerms"].([]interface{})
+	if len(terms) == 0 {
+		terms = []interface{}{map[string]interface{}{}}
+	}
+	for _, term := range terms {
+		termMap, ok := term.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		existing, _ := termMap["matchExpressions"].([]interface{})
+		termMap["matchExpressions"] = append(existing, expressions...)
+	}
+	required["nodeSelectorTerms"] = terms
+	return affinity
+}
+
+// setPodPlacement sets the node selector, affinity, tolerations and priority
+// class of mover on a pod spec the controller creates.
+func setPodPlacement(podSpec map[string]interface{}, mover *MoverSpec) {
+	if mover == nil {
+		return
+	}
+	if len(mover.NodeSelector) > 0 {
+		podSpec["nodeSelector"] = mover.NodeSelector
+	}
+	if len(mover.Affinity) > 0 {
+		podSpec["affinity"] = mover.Affinity
+	}
+	if len(mover.Tolerations) > 0 {
+		podSpec["tolerations"] = mover.Tolerations
+	}
+	if mover.PriorityClassName != "" {
+		podSpec["priorityClassName"] = mover.PriorityClassName
+	}
+}
+
+// resticLimitEnv carries resticLimitArgs into the controller's restic Jobs,
+// whose scripts expand it unquoted after `restic`.
+const resticLimitEnv = "RESTIC_LIMIT_ARGS"
+
+// resticLimitArgs returns the restic bandwidth flags of mover.
+func resticLimitArgs(mover *MoverSpec) string {
+	if mover == nil {
+		return ""
+	}
+	var args []string
+	if mover.LimitUploadKiB > 0 {
+		args = append(args, fmt.Sprintf("--limit-upload=%d", mover.LimitUploadKiB))
+	}
+	if mover.LimitDownloadKiB > 0 {
+		args = append(args, fmt.Sprintf("--limit-download=%d", mover.LimitDownloadKiB))
+	}
+	return strings.Join(args, " ")
+}
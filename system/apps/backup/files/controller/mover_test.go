@@ -0,0 +1,44 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestMoverAffinity(t *testing.T) {
+	var mover MoverSpec
+	mustUnmarshal(t, `{
+		"nodeSelector": {"kubernetes.io/arch": "amd64", "disk": "ssd"},
+		"affinity": {"nodeAffinity": {"requiredDuringSchedulingIgnoredDuringExecution": {"nodeSelectorTerms": [
+			{"matchExpressions": [{"key": "zone", "operator": "In", "values": ["a"]}]},
+			{"matchExpressions": [{"key": "zone", "operator": "In", "values": ["b"]}]}
+		]}}}
+	}`, &mover)
+
+	resticSpec := map[string]interface{}{}
+	setMoverFields(resticSpec, &mover)
+	got, err := json.Marshal(resticSpec["moverAffinity"])
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `{"nodeAffinity":{"requiredDuringSchedulingIgnoredDuringExecution":{"nodeSelectorTerms":[` +
+		`{"matchExpressions":[{"key":"zone","operator":"In","values":["a"]},{"key":"disk","operator":"In","values":["ssd"]},{"key":"kubernetes.io/arch","operator":"In","values":["amd64"]}]},` +
+		`{"matchExpressions":[{"key":"zone","operator":"In","values":["b"]},{"key":"disk","operator":"In","values":["ssd"]},{"key":"kubernetes.io/arch","operator":"In","values":["amd64"]}]}]}}}`
+	if string(got) != want {
+		t.Errorf("moverAffinity\n got %s\nwant %s", got, want)
+	}
+
+	terms := mover.Affinity["nodeAffinity"].(map[string]interface{})["requiredDuringSchedulingIgnoredDuringExecution"].(map[string]interface{})["nodeSelectorTerms"].([]interface{})
+	if expressions := terms[0].(map[string]interface{})["matchExpressions"].([]interface{}); len(expressions) != 1 {
+		t.Errorf("policy affinity was modified: %v", expressions)
+	}
+}
+
+func TestResticLimitArgs(t *testing.T) {
+	if got := resticLimitArgs(&MoverSpec{LimitUploadKiB: 2048, LimitDownloadKiB: 4096}); got != "--limit-upload=2048 --limit-download=4096" {
+		t.Errorf("unexpected args %q", got)
+	}
+	if got := resticLimitArgs(nil); got != "" {
+		t.Errorf("unexpected args %q", got)
+	}
+}
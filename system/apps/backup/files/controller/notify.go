@@ -0,0 +1,262 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	notifyRunFailed            = "RunFailed"
+	notifyBackupStale          = "BackupStale"
+	notifyIntegrityCheckFailed = "IntegrityCheckFailed"
+	notifyRestoreCompleted     = "RestoreCompleted"
+	notifyRestoreFailed        = "RestoreFailed"
+)
+
+// NotificationConfig is the cluster-level notification configuration, set
+// from backupController.notifications in the chart values.
+type NotificationConfig struct {
+	// SecretName is a Secret in the controller namespace holding the values
+	// targets reference with urlKey and tokenKey.
+	SecretName string `json:"secretName,omitempty"`
+	// RateLimit is the minimum time between two messages about the same
+	// issue of a policy.
+	RateLimit string               `json:"rateLimit,omitempty"`
+	Targets   []NotificationTarget `json:"targets,omitempty"`
+}
+
+type NotificationTarget struct {
+	Name string `json:"name"`
+	// Type is webhook, ntfy or matrix.
+	Type string `json:"type"`
+	// URL is the webhook URL, the ntfy server or the Matrix homeserver.
+	URL      string   `json:"url,omitempty"`
+	URLKey   string   `json:"urlKey,omitempty"`
+	Topic    string   `json:"topic,omitempty"`
+	RoomID   string   `json:"roomID,omitempty"`
+	TokenKey string   `json:"tokenKey,omitempty"`
+	Events   []string `json:"events,omitempty"`
+}
+
+// NotificationOverride narrows the cluster notifications for one policy.
+type NotificationOverride struct {
+	Disabled bool     `json:"disabled,omitempty"`
+	Targets  []string `json:"targets,omitempty"`
+	Events   []string `json:"events,omitempty"`
+}
+
+type notification struct {
+	Event     string
+	Kind      string
+	Namespace string
+	Name      string
+	Message   string
+	// Resolved marks the recovery message of an earlier notification.
+	Resolved bool
+}
+
+func (n notification) title() string {
+	subject := fmt.Sprintf("%s %s/%s", n.Kind, n.Namespace, n.Name)
+	switch {
+	case n.Resolved:
+		return fmt.Sprintf("Resolved: %s %s", n.Event, subject)
+	case n.Event == notifyRestoreCompleted:
+		return fmt.Sprintf("Restore completed: %s", subject)
+	}
+	return fmt.Sprintf("%s: %s", n.Event, subject)
+}
+
+func policyNotification(policy BackupPolicy, event, message string, resolved bool) notification {
+	return notification{
+		Event:     event,
+		Kind:      "BackupPolicy",
+		Namespace: policy.Metadata.Namespace,
+		Name:      policy.Metadata.Name,
+		Message:   message,
+		Resolved:  resolved,
+	}
+}
+
+type notifier struct {
+	config     NotificationConfig
+	rateLimit  time.Duration
+	secret     func(key string) (string, error)
+	httpClient *http.Client
+	now        func() time.Time
+
+	mu   sync.Mutex
+	sent map[string]time.Time
+}
+
+var notifications = newNotifier(NotificationConfig{}, nil)
+
+// newNotifier returns a notifier reading secret values through secret.
+func newNotifier(config NotificationConfig, secret func(key string) (string, error)) *notifier {
+	rateLimit := time.Hour
+	if config.RateLimit != "" {
+		rateLimit = mustDuration(config.RateLimit)
+	}
+	return &notifier{
+		config:     config,
+		rateLimit:  rateLimit,
+		secret:     secret,
+		httpClient: &http.Client{Timeout: 10 * time.Second},
+		now:        time.Now,
+		sent:       map[string]time.Time{},
+	}
+}
+
+// secretReader reads keys of the notification Secret in namespace.
+func secretReader(ctx context.Context, client *kubeClient, namespace, name string) func(string) (string, error) {
+	return func(key string) (string, error) {
+		var secret struct {
+			Data map[string]string `json:"data"`
+		}
+		if err := getJSON(ctx, client, namespacedPath("/api/v1", namespace, "secrets", name), &secret); err != nil {
+			return "", err
+		}
+		encoded, ok := secret.Data[key]
+		if !ok {
+			return "", fmt.Errorf("secret %s/%s has no key %s", namespace, name, key)
+		}
+		value, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			return "", err
+		}
+		return strings.TrimSpace(string(value)), nil
+	}
+}
+
+// notify sends note to every target that accepts it. The same issue of a
+// policy is sent at most once per rate limit; failures are only logged.
+func (n *notifier) notify(note notification, override *NotificationOverride) {
+	if len(n.config.Targets) == 0 || (override != nil && override.Disabled) {
+		return
+	}
+	if override != nil && len(override.Events) > 0 && !containsString(override.Events, note.Event) {
+		return
+	}
+
+	key := fmt.Sprintf("%s/%s/%s/%s/%t", note.Kind, note.Namespace, note.Name, note.Event, note.Resolved)
+	n.mu.Lock()
+	if last, ok := n.sent[key]; ok && n.now().Sub(last) < n.rateLimit {
+		n.mu.Unlock()
+		policyLog(note.Namespace, note.Name).Debug("notification suppressed", "event", note.Event, "last_sent", last.UTC().Format(time.RFC3339))
+		return
+	}
+	n.sent[key] = n.now()
+	n.mu.Unlock()
+
+	for _, target := range n.config.Targets {
+		if len(target.Events) > 0 && !containsString(target.Events, note.Event) {
+			continue
+		}
+		if override != nil && len(override.Targets) > 0 && !containsString(override.Targets, target.Name) {
+			continue
+		}
+		if err := n.send(target, note); err != nil {
+			policyLog(note.Namespace, note.Name).Error("notification failed", "event", note.Event, "target", target.Name, logError, err)
+		}
+	}
+}
+
+func (n *notifier) send(target NotificationTarget, note notification) error {
+	endpoint := target.URL
+	if target.URLKey != "" {
+		value, err := n.secret(target.URLKey)
+		if err != nil {
+			return err
+		}
+		endpoint = value
+	}
+	token := ""
+	if target.TokenKey != "" {
+		value, err := n.secret(target.TokenKey)
+		if err != nil {
+			return err
+		}
+		token = value
+	}
+	if endpoint == "" {
+		return fmt.Errorf("no url configured")
+	}
+
+	var req *http.Request
+	var err error
+	switch target.Type {
+	case "webhook":
+		payload, _ := json.Marshal(map[string]interface{}{
+			"event":     note.Event,
+			"kind":      note.Kind,
+			"namespace": note.Namespace,
+			"name":      note.Name,
+			"title":     note.title(),
+			"message":   note.Message,
+			"resolved":  note.Resolved,
+			"time":      n.now().UTC().Format(time.RFC3339),
+		})
+		req, err = http.NewRequest("POST", endpoint, bytes.NewReader(payload))
+		if err == nil {
+			req.Header.Set("Content-Type", "application/json")
+		}
+	case "ntfy":
+		req, err = http.NewRequest("POST", strings.TrimRight(endpoint, "/")+"/"+url.PathEscape(target.Topic), strings.NewReader(note.Message))
+		if err == nil {
+			req.Header.Set("Title", note.title())
+			if note.Resolved || note.Event == notifyRestoreCompleted {
+				req.Header.Set("Tags", "white_check_mark")
+			} else {
+				req.Header.Set("Tags", "warning")
+				req.Header.Set("Priority", "high")
+			}
+		}
+	case "matrix":
+		payload, _ := json.Marshal(map[string]interface{}{
+			"msgtype": "m.text",
+			"body":    note.title() + "\n" + note.Message,
+		})
+		txnID := fmt.Sprintf("backup-%d", n.now().UnixNano())
+		sendPath := fmt.Sprintf("/_matrix/client/v3/rooms/%s/send/m.room.message/%s", url.PathEscape(target.RoomID), txnID)
+		req, err = http.NewRequest("PUT", strings.TrimRight(endpoint, "/")+sendPath, bytes.NewReader(payload))
+		if err == nil {
+			req.Header.Set("Content-Type", "application/json")
+		}
+	default:
+		return fmt.Errorf("unknown notification type %q", target.Type)
+	}
+	if err != nil {
+		return err
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	resp, err := n.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("%s status=%d body=%s", target.Type, resp.StatusCode, strings.TrimSpace(string(body)))
+	}
+	return nil
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+type receivedRequest struct {
+	Method string
+	Path   string
+	Header http.Header
+	Body   string
+}
+
+func TestNotifierSendsToTargets(t *testing.T) {
+	var mu sync.Mutex
+	var received []receivedRequest
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		mu.Lock()
+		received = append(received, receivedRequest{Method: r.Method, Path: r.URL.EscapedPath(), Header: r.Header, Body: string(body)})
+		mu.Unlock()
+	}))
+	defer server.Close()
+
+	secrets := map[string]string{"webhook-url": server.URL + "/hook", "matrix-token": "secret-token"}
+	n := newNotifier(NotificationConfig{
+		RateLimit: "1h",
+		Targets: []NotificationTarget{
+			{Name: "hook", Type: "webhook", URLKey: "webhook-url"},
+			{Name: "ntfy", Type: "ntfy", URL: server.URL, Topic: "backups", Events: []string{notifyRunFailed}},
+			{Name: "matrix", Type: "matrix", URL: server.URL, RoomID: "!room:example.com", TokenKey: "matrix-token"},
+		},
+	}, func(key string) (string, error) { return secrets[key], nil })
+	now := time.Date(2024, 5, 1, 3, 0, 0, 0, time.UTC)
+	n.now = func() time.Time { return now }
+
+	failed := notification{Event: notifyRunFailed, Kind: "BackupPolicy", Namespace: "gitea", Name: "gitea", Message: "job backup-gitea-1 failed"}
+	n.notify(failed, nil)
+	if len(received) != 3 {
+		t.Fatalf("got %d requests, want 3", len(received))
+	}
+
+	var hook map[string]interface{}
+	if err := json.Unmarshal([]byte(received[0].Body), &hook); err != nil {
+		t.Fatal(err)
+	}
+	if received[0].Path != "/hook" || hook["event"] != notifyRunFailed || hook["namespace"] != "gitea" || hook["resolved"] != false {
+		t.Errorf("unexpected webhook request %s %s", received[0].Path, received[0].Body)
+	}
+	if received[1].Path != "/backups" || received[1].Body != failed.Message || received[1].Header.Get("Title") != "RunFailed: BackupPolicy gitea/gitea" {
+		t.Errorf("unexpected ntfy request %s %v %s", received[1].Path, received[1].Header, received[1].Body)
+	}
+	matrix := received[2]
+	if matrix.Method != "PUT" || matrix.Header.Get("Authorization") != "Bearer secret-token" {
+		t.Errorf("unexpected matrix request %s %v", matrix.Method, matrix.Header)
+	}
+	if want := "/_matrix/client/v3/rooms/%21room:example.com/send/m.room.message/"; len(matrix.Path) <= len(want) || matrix.Path[:len(want)] != want {
+		t.Errorf("matrix path = %s, want prefix %s", matrix.Path, want)
+	}
+
+	// Repeats of the same issue are rate limited, the recovery is not.
+	received = nil
+	n.notify(failed, nil)
+	if len(received) != 0 {
+		t.Fatalf("got %d requests within the rate limit, want 0", len(received))
+	}
+	resolved := failed
+	resolved.Resolved = true
+	n.notify(resolved, nil)
+	if len(received) != 3 || received[1].Header.Get("Title") != "Resolved: RunFailed BackupPolicy gitea/gitea" {
+		t.Fatalf("recovery not sent to all targets: %d requests", len(received))
+	}
+
+	now = now.Add(time.Hour)
+	received = nil
+	n.notify(failed, nil)
+	if len(received) != 3 {
+		t.Fatalf("got %d requests after the rate limit, want 3", len(received))
+	}
+}
+
+func TestNotifierOverrides(t *testing.T) {
+	var paths []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		paths = append(paths, r.URL.Path)
+	}))
+	defer server.Close()
+
+	n := newNotifier(NotificationConfig{
+		Targets: []NotificationTarget{
+			{Name: "a", Type: "webhook", URL: server.URL + "/a"},
+			{Name: "b", Type: "webhook", URL: server.URL + "/b"},
+		},
+	}, nil)
+
+	stale := notification{Event: notifyBackupStale, Kind: "BackupPolicy", Namespace: "ns", Name: "p"}
+	n.notify(stale, &NotificationOverride{Disabled: true})
+	n.notify(stale, &NotificationOverride{Events: []string{notifyRunFailed}})
+	if len(paths) != 0 {
+		t.Fatalf("disabled or filtered notification was sent to %v", paths)
+	}
+	n.notify(stale, &NotificationOverride{Targets: []string{"b"}})
+	if len(paths) != 1 || paths[0] != "/b" {
+		t.Fatalf("sent to %v, want [/b]", paths)
+	}
+}
@@ -0,0 +1,266 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+// pvcMetadataDir holds the recorded metadata of backed up PVCs on the
+// repository PVC, next to the <namespace>/<pvc> restic repositories.
+// Namespaces cannot start with a dot, so it never clashes with one of them.
+const pvcMetadataDir = ".pvc-metadata"
+
+// pvcMetadataHost is the restic host of the snapshots that hold the recorded
+// metadata of a PVC in its offsite repository.
+const pvcMetadataHost = "pvc-metadata"
+
+// pvcMetadata is a source PVC and the workloads mounting it, as recorded with
+// its backups. A restore recreates the PVC from it when the source is gone.
+type pvcMetadata struct {
+	Namespace        string            `json:"namespace"`
+	Name             string            `json:"name"`
+	Labels           map[string]string `json:"labels,omitempty"`
+	Storage          string            `json:"storage"`
+	AccessModes      []string          `json:"accessModes"`
+	StorageClassName string            `json:"storageClassName,omitempty"`
+	VolumeMode       string            `json:"volumeMode,omitempty"`
+	Workloads        []workloadRef     `json:"workloads,omitempty"`
+	RecordedAt       string            `json:"recordedAt"`
+}
+
+// workloadRef names a workload whose pods mount a PVC.
+type workloadRef struct {
+	Kind string `json:"kind"`
+	Name string `json:"name"`
+}
+
+// pvcMetadataPath is where the metadata of ns/pvc is recorded in a restic Job.
+func pvcMetadataPath(cfg Config, ns, pvc string) string {
+	return fmt.Sprintf("/mnt/%s/%s/%s/%s.json", cfg.RepoMountPath, pvcMetadataDir, ns, pvc)
+}
+
+// podClaimsJSONPath prints one line per pod with its name, pod-template-hash,
+// controlling owner and the PVCs it mounts, for pvc_workloads.
+const podClaimsJSONPath = `{range .items[*]}{.metadata.name};{.metadata.labels.pod-template-hash};{.metadata.ownerReferences[?(@.controller==true)].kind};{.metadata.ownerReferences[?(@.controller==true)].name};{range .spec.volumes[*]}{.persistentVolumeClaim.claimName} {end}{"\n"}{end}`
+
+// pvcMetadataPlaceholder stands for the recorded metadata of the i-th source
+// in the tag Job manifest. The runner replaces it with the base64-encoded
+// output of pvc_metadata.
+func pvcMetadataPlaceholder(i int) string {
+	return fmt.Sprintf("__PVC_METADATA_%d__", i)
+}
+
+// sourcePVCs lists the PVCs of sources for the runner, in the order of the
+// tag Job's containers and their placeholders.
+func sourcePVCs(sources []backupSource) string {
+	pvcs := make([]string, 0, len(sources))
+	for _, source := range sources {
+		pvcs = append(pvcs, source.PVC)
+	}
+	return strings.Join(pvcs, " ")
+}
+
+// pvcMetadataFunctions are the runner's shell functions that record a PVC as
+// a pvcMetadata document.
+//
+// pvc_workloads reads the output of podClaimsJSONPath and prints the workloads
+// owning the pods that mount PVC $1 as JSON objects, sorted and joined by
+// commas. Pods of a ReplicaSet are reported as its Deployment, whose name the
+// ReplicaSet's carries with the pod-template-hash appended.
+//
+// pvc_metadata prints the spec, labels and workloads of PVC $1 base64-encoded
+// on one line. Label keys and values cannot hold the ; separating the fields.
+func pvcMetadataFunctions() string {
+	return strings.TrimSpace(`
+pvc_workloads() {
+  while IFS=';' read -r name hash kind owner claims; do
+    case " ${claims}" in
+      *" $1 "*) ;;
+      *) continue ;;
+    esac
+    if [ -z "${kind}" ]; then
+      kind=Pod
+      owner="${name}"
+    elif [ "${kind}" = ReplicaSet ] && [ -n "${hash}" ] && [ "${owner%-"${hash}"}" != "${owner}" ]; then
+      kind=Deployment
+      owner="${owner%-"${hash}"}"
+    fi
+    printf '{"kind":"%s","name":"%s"}\n' "${kind}" "${owner}"
+  done | sort -u | paste -sd, -
+}
+
+pvc_metadata() {
+  spec="$(kubectl -n "${NAMESPACE}" get pvc "$1" -o jsonpath='{.spec.resources.requests.storage};{.spec.storageClassName};{.spec.volumeMode};{.spec.accessModes};{.metadata.labels}')" || return 1
+  workloads="$(kubectl -n "${NAMESPACE}" get pods -o jsonpath='` + podClaimsJSONPath + `' | pvc_workloads "$1")" || return 1
+  storage="${spec%%;*}"
+  spec="${spec#*;}"
+  storage_class="${spec%%;*}"
+  spec="${spec#*;}"
+  volume_mode="${spec%%;*}"
+  spec="${spec#*;}"
+  access_modes="${spec%%;*}"
+  labels="${spec#*;}"
+  printf '{"namespace":"%s","name":"%s","labels":%s,"storage":"%s","accessModes":%s,"storageClassName":"%s","volumeMode":"%s","workloads":[%s],"recordedAt":"%s"}' \
+    "${NAMESPACE}" "$1" "${labels:-null}" "${storage}" "${access_modes:-[]}" "${storage_class}" "${volume_mode}" "${workloads}" "$(date -u +%Y-%m-%dT%H:%M:%SZ)" \
+    | base64 | tr -d '\n'
+}
+`)
+}
+
+// object returns the recorded PVC in the shape of the API object, for
+// targetPVCObject.
+func (m pvcMetadata) object() map[string]interface{} {
+	accessModes := make([]interface{}, 0, len(m.AccessModes))
+	for _, mode := range m.AccessModes {
+		accessModes = append(accessModes, mode)
+	}
+	spec := map[string]interface{}{
+		"accessModes": accessModes,
+		"resources": map[string]interface{}{
+			"requests": map[string]interface{}{
+				"storage": m.Storage,
+			},
+		},
+	}
+	if m.StorageClassName != "" {
+		spec["storageClassName"] = m.StorageClassName
+	}
+	if m.VolumeMode != "" {
+		spec["volumeMode"] = m.VolumeMode
+	}
+	return map[string]interface{}{
+		"metadata": map[string]interface{}{
+			"name":      m.Name,
+			"namespace": m.Namespace,
+		},
+		"spec": spec,
+	}
+}
+
+// readPVCMetadata reads the metadata recorded for sourceNamespace/sourcePVC
+// with a Job in ns that mounts the repository PVC.
+func readPVCMetadata(ctx context.Context, client *kubeClient, cfg Config, ns, sourceNamespace, sourcePVC string) (*pvcMetadata, error) {
+	if err := client.createIfMissing(ctx, namespacedPath("/api/v1", ns, "persistentvolumeclaims", cfg.RepoPVCName), namespacedPath("/api/v1", ns, "persistentvolumeclaims"), repoPVCObject(cfg, ns)); err != nil {
+		return nil, err
+	}
+	jobName := sanitizeName(fmt.Sprintf("pvc-metadata-%s-%d", sourcePVC, time.Now().UTC().Unix()))
+	env := map[string]string{"PVC_METADATA_FILE": pvcMetadataPath(cfg, sourceNamespace, sourcePVC)}
+	if err := ensureResticJob(ctx, client, cfg, ns, jobName, "", `cat "$PVC_METADATA_FILE"`, env); err != nil {
+		return nil, err
+	}
+	defer cleanupJob(client, ns, jobName)
+
+	if err := waitForJobCompletion(ctx, client, ns, jobName, snapshotJobTimeout); err != nil {
+		return nil, fmt.Errorf("no metadata recorded for %s/%s: %w", sourceNamespace, sourcePVC, err)
+	}
+	logs, err := getJobLogs(ctx, client, ns, jobName)
+	if err != nil {
+		return nil, err
+	}
+	var meta pvcMetadata
+	if err := json.Unmarshal([]byte(logs), &meta); err != nil {
+		return nil, fmt.Errorf("failed to parse metadata of %s/%s: %w", sourceNamespace, sourcePVC, err)
+	}
+	return &meta, nil
+}
+
+// errPVCMetadataPending is returned while the recorded metadata of a PVC is
+// being read.
+var errPVCMetadataPending = errors.New("reading recorded pvc metadata")
+
+// pvcMetadataKey identifies the metadata of SourceNamespace/PVC read with a
+// Job in Namespace.
+type pvcMetadataKey struct {
+	Namespace       string
+	SourceNamespace string
+	PVC             string
+}
+
+type pvcMetadataResult struct {
+	Meta *pvcMetadata
+	Err  error
+}
+
+// pvcMetadataCache reads recorded PVC metadata in the background, so a
+// reconcile does not wait for the Job that reads it.
+type pvcMetadataCache struct {
+	fetch func(ctx context.Context, key pvcMetadataKey) (*pvcMetadata, error)
+
+	mu      sync.Mutex
+	results map[pvcMetadataKey]pvcMetadataResult
+	pending map[pvcMetadataKey]bool
+	running sync.WaitGroup
+}
+
+var pvcMetadataRecords = newPVCMetadataCache(nil, Config{})
+
+func newPVCMetadataCache(client *kubeClient, cfg Config) *pvcMetadataCache {
+	return &pvcMetadataCache{
+		fetch: func(ctx context.Context, key pvcMetadataKey) (*pvcMetadata, error) {
+			return readPVCMetadata(ctx, client, cfg, key.Namespace, key.SourceNamespace, key.PVC)
+		},
+		results: map[pvcMetadataKey]pvcMetadataResult{},
+		pending: map[pvcMetadataKey]bool{},
+	}
+}
+
+// lookup returns the metadata of key once it was read, and takes it out of
+// the cache, so a later lookup reads it again. Until then it starts the read
+// and returns errPVCMetadataPending.
+func (c *pvcMetadataCache) lookup(ctx context.Context, key pvcMetadataKey) (*pvcMetadata, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if result, ok := c.results[key]; ok {
+		delete(c.results, key)
+		return result.Meta, result.Err
+	}
+	if c.pending[key] {
+		return nil, errPVCMetadataPending
+	}
+	c.pending[key] = true
+	c.running.Add(1)
+	go func() {
+		defer c.running.Done()
+		meta, err := c.fetch(ctx, key)
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		delete(c.pending, key)
+		if ctx.Err() == nil {
+			c.results[key] = pvcMetadataResult{Meta: meta, Err: err}
+		}
+	}()
+	return nil, errPVCMetadataPending
+}
+
+// wait blocks until the running reads returned.
+func (c *pvcMetadataCache) wait() {
+	c.running.Wait()
+}
+
+// sourcePVCObject returns the source PVC of a restore, or the metadata
+// recorded with its backups, read by readMetadata, when the PVC no longer
+// exists.
+func sourcePVCObject(ctx context.Context, client *kubeClient, ns, sourceNamespace, sourcePVC string, readMetadata func(ctx context.Context, key pvcMetadataKey) (*pvcMetadata, error)) (map[string]interface{}, error) {
+	itemPath := namespacedPath("/api/v1", sourceNamespace, "persistentvolumeclaims", sourcePVC)
+	exists, err := objectExists(ctx, client, itemPath)
+	if err != nil {
+		return nil, err
+	}
+	if exists {
+		var src map[string]interface{}
+		if err := getJSON(ctx, client, itemPath, &src); err != nil {
+			return nil, err
+		}
+		return src, nil
+	}
+	meta, err := readMetadata(ctx, pvcMetadataKey{Namespace: ns, SourceNamespace: sourceNamespace, PVC: sourcePVC})
+	if err != nil {
+		return nil, fmt.Errorf("source pvc %s/%s does not exist: %w", sourceNamespace, sourcePVC, err)
+	}
+	return meta.object(), nil
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"k8s.io/client-go/util/jsonpath"
+)
+
+func TestPVCMetadataFunctions(t *testing.T) {
+	var pods interface{}
+	mustUnmarshal(t, `{"items": [
+		{"metadata": {"name": "web-7d4b9c-x2k", "labels": {"pod-template-hash": "7d4b9c"},
+			"ownerReferences": [{"kind": "ReplicaSet", "name": "web-7d4b9c", "controller": true}]},
+			"spec": {"volumes": [{"name": "data", "persistentVolumeClaim": {"claimName": "data"}}]}},
+		{"metadata": {"name": "web-7d4b9c-q8z", "labels": {"pod-template-hash": "7d4b9c"},
+			"ownerReferences": [{"kind": "ReplicaSet", "name": "web-7d4b9c", "controller": true}]},
+			"spec": {"volumes": [{"name": "data", "persistentVolumeClaim": {"claimName": "data"}}]}},
+		{"metadata": {"name": "db-0",
+			"ownerReferences": [{"kind": "StatefulSet", "name": "db", "controller": true}]},
+			"spec": {"volumes": [{"name": "tmp", "emptyDir": {}}, {"name": "data", "persistentVolumeClaim": {"claimName": "data"}}]}},
+		{"metadata": {"name": "debug"},
+			"spec": {"volumes": [{"name": "data", "persistentVolumeClaim": {"claimName": "data"}}]}},
+		{"metadata": {"name": "other-0",
+			"ownerReferences": [{"kind": "StatefulSet", "name": "other", "controller": true}]},
+			"spec": {"volumes": [{"name": "data", "persistentVolumeClaim": {"claimName": "data-other"}}]}}
+	]}`, &pods)
+	// kubectl evaluates the template the same way, missing keys included.
+	template := jsonpath.New("pods").AllowMissingKeys(true)
+	if err := template.Parse(podClaimsJSONPath); err != nil {
+		t.Fatal(err)
+	}
+	var claims bytes.Buffer
+	if err := template.Execute(&claims, pods); err != nil {
+		t.Fatal(err)
+	}
+
+	// A fake kubectl prints the PVC fields and the pods' claims.
+	bin := t.TempDir()
+	os.WriteFile(filepath.Join(bin, "claims"), claims.Bytes(), 0o644)
+	kubectl := `#!/bin/sh
+case "$*" in
+  *" get pvc data "*) printf '%s' '5Gi;local-path;Filesystem;["ReadWriteOnce"];{"app":"web"}' ;;
+  *" get pvc bare "*) printf '%s' '1Gi;;;;' ;;
+  *" get pods "*) cat "$(dirname "$0")/claims" ;;
+  *) exit 1 ;;
+esac
+`
+	if err := os.WriteFile(filepath.Join(bin, "kubectl"), []byte(kubectl), 0o755); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		pvc  string
+		want pvcMetadata
+	}{
+		{"data", pvcMetadata{
+			Namespace:        "apps",
+			Name:             "data",
+			Labels:           map[string]string{"app": "web"},
+			Storage:          "5Gi",
+			AccessModes:      []string{"ReadWriteOnce"},
+			StorageClassName: "local-path",
+			VolumeMode:       "Filesystem",
+			Workloads:        []workloadRef{{Kind: "Deployment", Name: "web"}, {Kind: "Pod", Name: "debug"}, {Kind: "StatefulSet", Name: "db"}},
+		}},
+		{"bare", pvcMetadata{Namespace: "apps", Name: "bare", Storage: "1Gi", AccessModes: []string{}, Workloads: []workloadRef{}}},
+	} {
+		cmd := exec.Command("sh", "-c", pvcMetadataFunctions()+"\npvc_metadata \"$1\" | base64 -d", "sh", tc.pvc)
+		cmd.Env = append(os.Environ(), "PATH="+bin+string(os.PathListSeparator)+os.Getenv("PATH"), "NAMESPACE=apps")
+		output, err := cmd.Output()
+		if err != nil {
+			t.Fatalf("%s: %v", tc.pvc, err)
+		}
+		var got pvcMetadata
+		if err := json.Unmarshal(output, &got); err != nil {
+			t.Fatalf("%s: %v\n%s", tc.pvc, err, output)
+		}
+		if _, err := time.Parse(time.RFC3339, got.RecordedAt); err != nil {
+			t.Errorf("%s: recordedAt %q: %v", tc.pvc, got.RecordedAt, err)
+		}
+		got.RecordedAt = ""
+		if !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("%s: got %+v, want %+v", tc.pvc, got, tc.want)
+		}
+	}
+
+	cmd := exec.Command("sh", "-c", pvcMetadataFunctions()+"\npvc_metadata missing")
+	cmd.Env = append(os.Environ(), "PATH="+bin+string(os.PathListSeparator)+os.Getenv("PATH"), "NAMESPACE=apps")
+	if output, err := cmd.Output(); err == nil || len(output) != 0 {
+		t.Errorf("missing pvc: %v, output %q", err, output)
+	}
+}
+
+func TestTargetPVCObjectFromMetadata(t *testing.T) {
+	var src map[string]interface{}
+	mustUnmarshal(t, `{"metadata": {"name": "data", "namespace": "apps"}, "spec": {
+		"accessModes": ["ReadWriteOnce"],
+		"storageClassName": "local-path",
+		"resources": {"requests": {"storage": "5Gi"}}
+	}}`, &src)
+	meta := pvcMetadata{
+		Namespace:        "apps",
+		Name:             "data",
+		Storage:          "5Gi",
+		AccessModes:      []string{"ReadWriteOnce"},
+		StorageClassName: "local-path",
+	}
+
+	got := targetPVCObject(meta.object(), "restore", "data-restored")
+	want := targetPVCObject(src, "restore", "data-restored")
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("target %+v, want %+v", got, want)
+	}
+}
+
+func TestPVCMetadataCache(t *testing.T) {
+	release := make(chan struct{})
+	calls := 0
+	c := newPVCMetadataCache(nil, Config{})
+	c.fetch = func(ctx context.Context, key pvcMetadataKey) (*pvcMetadata, error) {
+		calls++
+		<-release
+		if key.PVC == "missing" {
+			return nil, errors.New("no metadata recorded")
+		}
+		return &pvcMetadata{Namespace: key.SourceNamespace, Name: key.PVC}, nil
+	}
+	key := pvcMetadataKey{Namespace: "restore", SourceNamespace: "apps", PVC: "data"}
+
+	for i := 0; i < 2; i++ {
+		if _, err := c.lookup(context.Background(), key); !errors.Is(err, errPVCMetadataPending) {
+			t.Fatalf("lookup %d before the read finished: %v", i, err)
+		}
+	}
+	close(release)
+	c.wait()
+	if calls != 1 {
+		t.Errorf("read %d times, want once", calls)
+	}
+	meta, err := c.lookup(context.Background(), key)
+	if err != nil || meta == nil || meta.Name != "data" {
+		t.Fatalf("lookup after the read: %+v, %v", meta, err)
+	}
+	if _, err := c.lookup(context.Background(), key); !errors.Is(err, errPVCMetadataPending) {
+		t.Errorf("taken result was returned again: %v", err)
+	}
+	c.wait()
+
+	missing := pvcMetadataKey{Namespace: "restore", SourceNamespace: "apps", PVC: "missing"}
+	c.lookup(context.Background(), missing)
+	c.wait()
+	if _, err := c.lookup(context.Background(), missing); err == nil || errors.Is(err, errPVCMetadataPending) {
+		t.Errorf("failed read returned %v", err)
+	}
+}
@@ -0,0 +1,325 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+)
+
+// renderedObject is one object the controller applies for a policy.
+type renderedObject struct {
+	Object map[string]interface{}
+	// Owned objects get an owner reference to the BackupPolicy when applied.
+	Owned bool
+	// CreateOnly objects are created when missing and never updated.
+	CreateOnly bool
+	// KeepTrigger objects keep the live spec.trigger.manual and spec.paused.
+	// Backup runs patch them to start a sync, so applying the rendered values
+	// would start another or pause a running one.
+	KeepTrigger bool
+}
+
+// offsiteEnabled reports whether policy gets offsite copies.
+func offsiteEnabled(cfg Config, policy BackupPolicy) bool {
+	if policy.Spec.Offsite != nil {
+		return *policy.Spec.Offsite
+	}
+	return cfg.OffsiteEnabled
+}
+
+// renderBackupPolicy returns every object reconcileBackupPolicy applies for
+// policy, in apply order. It does not talk to the cluster.
+func renderBackupPolicy(cfg Config, policy BackupPolicy) ([]renderedObject, error) {
+	ns := policy.Metadata.Namespace
+	name := policy.Metadata.Name
+
+	objects := []renderedObject{{Object: repoPVCObject(cfg, ns), CreateOnly: true}}
+	for _, obj := range runnerRBACObjects(ns) {
+		objects = append(objects, renderedObject{Object: obj})
+	}
+	objects = append(objects, exportObjects(cfg, policy)...)
+
+	primarySources := make([]backupSource, 0, len(policy.Spec.Volumes))
+	offsiteSources := make([]backupSource, 0, len(policy.Spec.Volumes))
+	for _, vol := range policy.Spec.Volumes {
+		if vol.PVC == "" {
+			continue
+		}
+		if err := filterCopyError(cfg, vol); err != nil {
+			return nil, err
+		}
+		primary := volumeSource(cfg, backupSourceName(name, vol.PVC, false), repoSecretName(name, vol.PVC, false), vol)
+		objects = append(objects,
+			renderedObject{Object: externalSecretObject(cfg, ns, primary.Secret, vol.PVC, false, policy), Owned: true},
+			renderedObject{Object: replicationSourceObject(cfg, ns, primary, policy, true), Owned: true, KeepTrigger: true},
+		)
+		primarySources = append(primarySources, primary)
+
+		if offsiteEnabled(cfg, policy) {
+			offsite := volumeSource(cfg, backupSourceName(name, vol.PVC, true), repoSecretName(name, vol.PVC, true), vol)
+			objects = append(objects,
+				renderedObject{Object: externalSecretObject(cfg, ns, offsite.Secret, vol.PVC, true, policy), Owned: true},
+				renderedObject{Object: replicationSourceObject(cfg, ns, offsite, policy, false), Owned: true, KeepTrigger: true},
+			)
+			offsiteSources = append(offsiteSources, offsite)
+		}
+	}
+
+	for _, offsite := range []bool{false, true} {
+		sources := primarySources
+		if offsite {
+			sources = offsiteSources
+		}
+		if len(sources) == 0 {
+			continue
+		}
+		cron, err := cronJobObject(cfg, ns, policy, sources, offsite)
+		if err != nil {
+			return nil, err
+		}
+		objects = append(objects, renderedObject{Object: cron, Owned: true})
+	}
+	return objects, nil
+}
+
+// backupSourceName is the ReplicationSource that backs up pvc for the policy,
+// to the offsite repository when offsite is set.
+func backupSourceName(policyName, pvc string, offsite bool) string {
+	if offsite {
+		return sanitizeName(fmt.Sprintf("backup-offsite-%s-%s", policyName, pvc))
+	}
+	return sanitizeName(fmt.Sprintf("backup-%s-%s", policyName, pvc))
+}
+
+// repoSecretName is the restic repository secret of that ReplicationSource.
+func repoSecretName(policyName, pvc string, offsite bool) string {
+	if offsite {
+		return sanitizeName(fmt.Sprintf("backup-repo-offsite-%s-%s", policyName, pvc))
+	}
+	return sanitizeName(fmt.Sprintf("backup-repo-%s-%s", policyName, pvc))
+}
+
+// volumeSource returns the ReplicationSource of vol. Filtered volumes are
+// synced directly from a clone the backup run prepares; filterCopyError
+// rejects them when their storage class can't be cloned.
+func volumeSource(cfg Config, name, secret string, vol BackupVolume) backupSource {
+	source := backupSource{Name: name, Secret: secret, PVC: vol.PVC, Filter: vol.VolumeFilter, Copy: copyMethodFor(cfg, vol)}
+	if !vol.VolumeFilter.empty() {
+		source.Clone = cloneName(name)
+		source.Copy = CopyMethod{Method: copyMethodDirect}
+	}
+	return source
+}
+
+// volumeCopyMethod is the copy method reported in the status of vol.
+func volumeCopyMethod(cfg Config, vol BackupVolume) string {
+	if !vol.VolumeFilter.empty() {
+		return copyMethodClone
+	}
+	return copyMethodFor(cfg, vol).Method
+}
+
+// renderRestorePolicy returns every object reconcileRestorePolicy applies.
+// Target PVCs are sized like their source PVC, so they are only rendered for
+// sources present in sourcePVCs, keyed by namespace/name. Partial restores
+// restore the snapshot in snapshots keyed by target PVC, with the restic flags
+// in limitArgs keyed by source PVC.
+func renderRestorePolicy(cfg Config, policy RestorePolicy, sourcePVCs map[string]map[string]interface{}, snapshots, limitArgs map[string]string) ([]renderedObject, error) {
+	ns := policy.Metadata.Namespace
+	name := policy.Metadata.Name
+	if policy.Spec.SourceNamespace == "" {
+		return nil, fmt.Errorf("spec.sourceNamespace is required")
+	}
+
+	var objects []renderedObject
+	for _, vol := range policy.Spec.Volumes {
+		if vol.SourcePVC == "" || vol.TargetPVC == "" {
+			continue
+		}
+		secretName := restoreSecretName(name, vol.SourcePVC)
+		objects = append(objects, renderedObject{Object: restoreExternalSecretObject(cfg, ns, secretName, policy.Spec.SourceNamespace, vol.SourcePVC, policy)})
+
+		if src, ok := sourcePVCs[policy.Spec.SourceNamespace+"/"+vol.SourcePVC]; ok {
+			objects = append(objects, renderedObject{Object: targetPVCObject(src, ns, vol.TargetPVC), CreateOnly: true})
+		}
+
+		restoreName := restoreResourceName(name, vol.TargetPVC)
+		labels := restoreLabels(policy)
+		if vol.partial() {
+			job, err := partialRestoreJobObject(cfg, ns, restoreName, secretName, snapshots[vol.TargetPVC], limitArgs[vol.SourcePVC], vol, labels)
+			if err != nil {
+				return nil, err
+			}
+			objects = append(objects, renderedObject{Object: job, CreateOnly: true})
+			continue
+		}
+		objects = append(objects, renderedObject{Object: replicationDestinationObject(cfg, ns, restoreName, secretName, vol.TargetPVC, vol.RestoreAsOf, "init", labels)})
+	}
+	return objects, nil
+}
+
+// kindResources maps the kinds the controller writes to their API resources.
+// Plurals are irregular (NetworkPolicy, Ingress), so they are not derived.
+var kindResources = map[string]string{
+	"BackupPolicy":           "backuppolicies",
+	"ConfigMap":              "configmaps",
+	"CronJob":                "cronjobs",
+	"ExternalSecret":         "externalsecrets",
+	"Ingress":                "ingresses",
+	"Job":                    "jobs",
+	"NetworkPolicy":          "networkpolicies",
+	"PersistentVolumeClaim":  "persistentvolumeclaims",
+	"ReplicationDestination": "replicationdestinations",
+	"ReplicationSource":      "replicationsources",
+	"RestorePolicy":          "restorepolicies",
+	"Role":                   "roles",
+	"RoleBinding":            "rolebindings",
+	"Secret":                 "secrets",
+	"ServiceAccount":         "serviceaccounts",
+}
+
+// objectPaths returns the item and collection API paths of a rendered object.
+func objectPaths(obj map[string]interface{}) (string, string, error) {
+	apiVersion, _ := obj["apiVersion"].(string)
+	kind, _ := obj["kind"].(string)
+	metadata, _ := obj["metadata"].(map[string]interface{})
+	name, _ := metadata["name"].(string)
+	ns, _ := metadata["namespace"].(string)
+
+	base := "/apis/" + apiVersion
+	if apiVersion == "v1" {
+		base = "/api/v1"
+	}
+	resource, ok := kindResources[kind]
+	if !ok {
+		return "", "", fmt.Errorf("unknown kind %q of %s", kind, name)
+	}
+	return namespacedPath(base, ns, resource, name), namespacedPath(base, ns, resource), nil
+}
+
+func objectRef(obj map[string]interface{}) string {
+	kind, _ := obj["kind"].(string)
+	metadata, _ := obj["metadata"].(map[string]interface{})
+	name, _ := metadata["name"].(string)
+	ns, _ := metadata["namespace"].(string)
+	return fmt.Sprintf("%s %s/%s", kind, ns, name)
+}
+
+func applyRendered(ctx context.Context, client *kubeClient, objects []renderedObject, owner *BackupPolicy) error {
+	for _, rendered := range objects {
+		itemPath, collectionPath, err := objectPaths(rendered.Object)
+		if err != nil {
+			return err
+		}
+		if rendered.CreateOnly {
+			if err := client.createIfMissing(ctx, itemPath, collectionPath, rendered.Object); err != nil {
+				return err
+			}
+			continue
+		}
+		if rendered.KeepTrigger {
+			if err := keepLiveTrigger(ctx, client, itemPath, rendered.Object); err != nil {
+				return err
+			}
+		}
+		var objOwner *BackupPolicy
+		if rendered.Owned {
+			objOwner = owner
+		}
+		if err := client.apply(ctx, itemPath, rendered.Object, objOwner); err != nil {
+			return fmt.Errorf("%s: %w", objectRef(rendered.Object), err)
+		}
+	}
+	return nil
+}
+
+// keepLiveTrigger copies spec.trigger.manual and spec.paused of the live
+// object into obj.
+func keepLiveTrigger(ctx context.Context, client *kubeClient, itemPath string, obj map[string]interface{}) error {
+	body, status, err := client.doRequest(ctx, "GET", itemPath, nil)
+	if err != nil {
+		return err
+	}
+	if status == http.StatusNotFound {
+		return nil
+	}
+	if status != http.StatusOK {
+		return fmt.Errorf("get failed: %s status=%d", itemPath, status)
+	}
+	var live map[string]interface{}
+	if err := json.Unmarshal(body, &live); err != nil {
+		return err
+	}
+	copyLiveTrigger(live, obj)
+	return nil
+}
+
+func copyLiveTrigger(live, obj map[string]interface{}) {
+	liveSpec, _ := live["spec"].(map[string]interface{})
+	liveTrigger, _ := liveSpec["trigger"].(map[string]interface{})
+	manual, _ := liveTrigger["manual"].(string)
+	if manual == "" {
+		return
+	}
+	spec, _ := obj["spec"].(map[string]interface{})
+	trigger, _ := spec["trigger"].(map[string]interface{})
+	if trigger != nil {
+		trigger["manual"] = manual
+	}
+	if paused, ok := liveSpec["paused"].(bool); ok && spec["paused"] != nil {
+		spec["paused"] = paused
+	}
+}
+
+// pruneToShape drops every field of live the desired object does not set, so
+// defaults and fields owned by other controllers do not show up as changes.
+// Lists are pruned element by element when both have the same length.
+func pruneToShape(live, desired interface{}) interface{} {
+	if obj, ok := desired.(map[string]interface{}); ok {
+		desired = normalizeObject(obj)
+	}
+	return pruneValue(live, desired)
+}
+
+func pruneValue(live, desired interface{}) interface{} {
+	switch d := desired.(type) {
+	case map[string]interface{}:
+		l, ok := live.(map[string]interface{})
+		if !ok {
+			return live
+		}
+		out := map[string]interface{}{}
+		for key, value := range d {
+			if liveValue, ok := l[key]; ok {
+				out[key] = pruneValue(liveValue, value)
+			}
+		}
+		return out
+	case []interface{}:
+		l, ok := live.([]interface{})
+		if !ok || len(l) != len(d) {
+			return live
+		}
+		out := make([]interface{}, len(l))
+		for i := range l {
+			out[i] = pruneValue(l[i], d[i])
+		}
+		return out
+	}
+	return live
+}
+
+// normalizeObject converts typed slices and maps into the generic JSON shapes
+// decoded API responses have.
+func normalizeObject(obj map[string]interface{}) map[string]interface{} {
+	payload, err := json.Marshal(obj)
+	if err != nil {
+		return obj
+	}
+	var out map[string]interface{}
+	if err := json.Unmarshal(payload, &out); err != nil {
+		return obj
+	}
+	return out
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"os"
+	"testing"
+)
+
+var updateGolden = flag.Bool("update", false, "rewrite the golden files in testdata")
+
+func TestRenderGolden(t *testing.T) {
+	values, err := os.ReadFile("testdata/values.yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := configFromValues(values)
+	if err != nil {
+		t.Fatal(err)
+	}
+	input, err := os.ReadFile("testdata/policies.yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	backups, restores, pvcs, err := renderInputs(input)
+	if err != nil {
+		t.Fatal(err)
+	}
+	objects, err := renderAll(cfg, backups, restores, pvcs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, rendered := range objects {
+		if _, _, err := objectPaths(rendered.Object); err != nil {
+			t.Error(err)
+		}
+	}
+
+	var got bytes.Buffer
+	if err := writeRenderedYAML(&got, objects); err != nil {
+		t.Fatal(err)
+	}
+
+	const golden = "testdata/policies.golden.yaml"
+	if *updateGolden {
+		if err := os.WriteFile(golden, got.Bytes(), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	want, err := os.ReadFile(golden)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got.Bytes(), want) {
+		t.Errorf("rendered objects differ from %s, rerun with -update and review the diff:\n%s", golden, got.String())
+	}
+}
+
+func TestObjectPaths(t *testing.T) {
+	for _, tc := range []struct {
+		apiVersion, kind string
+		item, collection string
+	}{
+		{"v1", "PersistentVolumeClaim", "/api/v1/namespaces/apps/persistentvolumeclaims/data", "/api/v1/namespaces/apps/persistentvolumeclaims"},
+		{"batch/v1", "CronJob", "/apis/batch/v1/namespaces/apps/cronjobs/data", "/apis/batch/v1/namespaces/apps/cronjobs"},
+		{"networking.k8s.io/v1", "NetworkPolicy", "/apis/networking.k8s.io/v1/namespaces/apps/networkpolicies/data", "/apis/networking.k8s.io/v1/namespaces/apps/networkpolicies"},
+		{"networking.k8s.io/v1", "Ingress", "/apis/networking.k8s.io/v1/namespaces/apps/ingresses/data", "/apis/networking.k8s.io/v1/namespaces/apps/ingresses"},
+		{"backup.homelab/v1alpha1", "BackupPolicy", "/apis/backup.homelab/v1alpha1/namespaces/apps/backuppolicies/data", "/apis/backup.homelab/v1alpha1/namespaces/apps/backuppolicies"},
+	} {
+		obj := map[string]interface{}{
+			"apiVersion": tc.apiVersion,
+			"kind":       tc.kind,
+			"metadata":   map[string]interface{}{"name": "data", "namespace": "apps"},
+		}
+		item, collection, err := objectPaths(obj)
+		if err != nil || item != tc.item || collection != tc.collection {
+			t.Errorf("objectPaths(%s) = %s, %s, %v, want %s, %s", tc.kind, item, collection, err, tc.item, tc.collection)
+		}
+	}
+
+	if _, _, err := objectPaths(map[string]interface{}{"apiVersion": "v1", "kind": "Endpoints"}); err == nil {
+		t.Error("objectPaths accepted a kind without a known resource")
+	}
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+const backupRunFailedCondition = "BackupRunFailed"
+
+// triggerIDAnnotation is set by the runner on the Jobs of a backup run.
+const triggerIDAnnotation = "backup.homelab/trigger-id"
+
+// runTypeAnnotation is set by the runner on its own Job only, next to the
+// trigger id.
+const runTypeAnnotation = "backup.homelab/run-type"
+
+type jobList struct {
+	Items []struct {
+		Metadata struct {
+			Name            string            `json:"name"`
+			Namespace       string            `json:"namespace"`
+			Annotations     map[string]string `json:"annotations"`
+			OwnerReferences []struct {
+				Kind string `json:"kind"`
+				Name string `json:"name"`
+			} `json:"ownerReferences"`
+		} `json:"metadata"`
+		Status struct {
+			Conditions []struct {
+				Type               string `json:"type"`
+				Status             string `json:"status"`
+				Reason             string `json:"reason"`
+				Message            string `json:"message"`
+				LastTransitionTime string `json:"lastTransitionTime"`
+			} `json:"conditions"`
+		} `json:"status"`
+	} `json:"items"`
+}
+
+// finishedRun is the outcome of a backup Job.
+type finishedRun struct {
+	Job string
+	// TriggerID is the trigger the runner annotated the Job with.
+	TriggerID string
+	Failed    bool
+	Reason    string
+	Message   string
+	Finished  time.Time
+}
+
+// lastFinishedRun returns the most recently finished Job created from the
+// policy's CronJobs, scheduled or manual, or nil when none finished yet.
+func lastFinishedRun(ctx context.Context, client *kubeClient, policy BackupPolicy) (*finishedRun, error) {
+	return lastFinishedJob(ctx, client, policy.Metadata.Namespace, map[string]bool{
+		sanitizeName(fmt.Sprintf("backup-%s", policy.Metadata.Name)):         true,
+		sanitizeName(fmt.Sprintf("backup-%s-offsite", policy.Metadata.Name)): true,
+	})
+}
+
+// lastFinishedJob returns the most recently finished Job in ns owned by one
+// of cronJobs, or nil when none finished yet.
+func lastFinishedJob(ctx context.Context, client *kubeClient, ns string, cronJobs map[string]bool) (*finishedRun, error) {
+	var jobs jobList
+	if err := getJSON(ctx, client, namespacedPath("/apis/batch/v1", ns, "jobs"), &jobs); err != nil {
+		return nil, err
+	}
+
+	var last *finishedRun
+	for _, job := range jobs.Items {
+		owned := false
+		for _, ref := range job.Metadata.OwnerReferences {
+			if ref.Kind == "CronJob" && cronJobs[ref.Name] {
+				owned = true
+			}
+		}
+		if !owned {
+			continue
+		}
+		for _, condition := range job.Status.Conditions {
+			if condition.Status != "True" || (condition.Type != "Complete" && condition.Type != "Failed") {
+				continue
+			}
+			finished, err := time.Parse(time.RFC3339, condition.LastTransitionTime)
+			if err != nil {
+				continue
+			}
+			if last == nil || finished.After(last.Finished) {
+				last = &finishedRun{
+					Job:       job.Metadata.Name,
+					TriggerID: job.Metadata.Annotations[triggerIDAnnotation],
+					Failed:    condition.Type == "Failed",
+					Reason:    condition.Reason,
+					Message:   condition.Message,
+					Finished:  finished,
+				}
+			}
+		}
+	}
+	return last, nil
+}
+
+// checkLastRun sets the BackupRunFailed condition from the last finished
+// backup Job and notifies when a run failed or the runs recovered. It returns
+// the policy's conditions after the check.
+func checkLastRun(ctx context.Context, client *kubeClient, policy BackupPolicy, now time.Time) ([]Condition, error) {
+	run, err := lastFinishedRun(ctx, client, policy)
+	if err != nil || run == nil {
+		return policy.Status.Conditions, err
+	}
+
+	condition := Condition{
+		Type:    backupRunFailedCondition,
+		Status:  "False",
+		Reason:  "RunSucceeded",
+		Message: fmt.Sprintf("job %s succeeded at %s", run.Job, run.Finished.UTC().Format(time.RFC3339)),
+	}
+	if run.Failed {
+		condition.Status = "True"
+		condition.Reason = "RunFailed"
+		condition.Message = fmt.Sprintf("job %s failed at %s", run.Job, run.Finished.UTC().Format(time.RFC3339))
+		if run.Message != "" {
+			condition.Message += ": " + run.Message
+		}
+	}
+	existing := findCondition(policy.Status.Conditions, backupRunFailedCondition)
+	if existing != nil && existing.Status == condition.Status && existing.Message == condition.Message {
+		return policy.Status.Conditions, nil
+	}
+
+	conditions := setCondition(policy.Status.Conditions, condition, now)
+	if err := patchBackupPolicyStatus(ctx, client, policy.Metadata.Namespace, policy.Metadata.Name, map[string]interface{}{
+		"conditions": conditions,
+	}); err != nil {
+		return policy.Status.Conditions, err
+	}
+
+	switch {
+	case run.Failed:
+		policyLog(policy.Metadata.Namespace, policy.Metadata.Name).Warn("backup run failed", "job", run.Job, logTriggerID, run.TriggerID, "reason", run.Reason, "message", run.Message)
+		notifications.notify(policyNotification(policy, notifyRunFailed, condition.Message, false), policy.Spec.Notifications)
+	case existing != nil && existing.Status == "True":
+		notifications.notify(policyNotification(policy, notifyRunFailed, condition.Message, true), policy.Spec.Notifications)
+	}
+	return conditions, nil
+}
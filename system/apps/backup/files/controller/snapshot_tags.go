@@ -0,0 +1,246 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// Placeholders in the tag Job manifest that the runner replaces per run.
+const (
+	triggerIDPlaceholder = "__TRIGGER_ID__"
+	runTypePlaceholder   = "__RUN_TYPE__"
+)
+
+// backupSource is a ReplicationSource generated for one volume of a policy.
+type backupSource struct {
+	Name   string
+	Secret string
+	PVC    string
+	// Clone is the PVC the runner copies a filtered volume to, empty when the
+	// source syncs the PVC itself.
+	Clone  string
+	Filter VolumeFilter
+	Copy   CopyMethod
+}
+
+type snapshotRetention struct {
+	Hourly   int64
+	Daily    int64
+	Weekly   int64
+	Monthly  int64
+	Yearly   int64
+	KeepTags []string
+}
+
+func retentionFor(cfg Config, policy BackupPolicy) snapshotRetention {
+	retention := snapshotRetention{
+		Hourly:  cfg.RetainHourly,
+		Daily:   cfg.RetainDaily,
+		Weekly:  cfg.RetainWeekly,
+		Monthly: cfg.RetainMonthly,
+		Yearly:  cfg.RetainYearly,
+	}
+	spec := policy.Spec.Retention
+	if spec == nil {
+		return retention
+	}
+	if spec.Hourly != nil {
+		retention.Hourly = *spec.Hourly
+	}
+	if spec.Daily != nil {
+		retention.Daily = *spec.Daily
+	}
+	if spec.Weekly != nil {
+		retention.Weekly = *spec.Weekly
+	}
+	if spec.Monthly != nil {
+		retention.Monthly = *spec.Monthly
+	}
+	if spec.Yearly != nil {
+		retention.Yearly = *spec.Yearly
+	}
+	for _, tag := range spec.KeepTags {
+		if tag = strings.TrimSpace(tag); tag != "" {
+			retention.KeepTags = append(retention.KeepTags, tag)
+		}
+	}
+	return retention
+}
+
+// volsyncManaged reports whether VolSync can apply the retention itself. The
+// restic mover has no notion of tags, so keep-tag rules are enforced by the
+// tag Job instead.
+func (r snapshotRetention) volsyncManaged() bool {
+	return len(r.KeepTags) == 0
+}
+
+func (r snapshotRetention) retainSpec() map[string]interface{} {
+	return map[string]interface{}{
+		"hourly":  r.Hourly,
+		"daily":   r.Daily,
+		"weekly":  r.Weekly,
+		"monthly": r.Monthly,
+		"yearly":  r.Yearly,
+	}
+}
+
+func (r snapshotRetention) forgetArgs() string {
+	if r.volsyncManaged() {
+		return ""
+	}
+	args := []string{
+		fmt.Sprintf("--keep-hourly %d", r.Hourly),
+		fmt.Sprintf("--keep-daily %d", r.Daily),
+		fmt.Sprintf("--keep-weekly %d", r.Weekly),
+		fmt.Sprintf("--keep-monthly %d", r.Monthly),
+		fmt.Sprintf("--keep-yearly %d", r.Yearly),
+	}
+	for _, tag := range r.KeepTags {
+		args = append(args, fmt.Sprintf("--keep-tag %s", tag))
+	}
+	return strings.Join(args, " ")
+}
+
+func snapshotTags(policy BackupPolicy, offsite bool) string {
+	target := "primary"
+	if offsite {
+		target = "offsite"
+	}
+	return strings.Join([]string{
+		"policy=" + policy.Metadata.Name,
+		"trigger=" + triggerIDPlaceholder,
+		"target=" + target,
+		runTypePlaceholder,
+	}, ",")
+}
+
+// tagJobManifest renders the Job the runner creates after all sources synced.
+// It tags the newest VolSync snapshot of every volume with the policy, trigger
+// and run type, and applies keep-tag retention when the policy asks for it.
+// It also records the PVC metadata the runner captured: next to the
+// repository on the repository PVC, or in the offsite repository as the
+// latest snapshot of host pvcMetadataHost.
+func tagJobManifest(cfg Config, ns string, policy BackupPolicy, sources []backupSource, offsite bool) (string, error) {
+	retention := retentionFor(cfg, policy)
+	mountPath := fmt.Sprintf("/mnt/%s", cfg.RepoMountPath)
+
+	containers := make([]map[string]interface{}, 0, len(sources))
+	for i, source := range sources {
+		container := map[string]interface{}{
+			"name":            fmt.Sprintf("tag-%d", i),
+			"image":           cfg.ResticImage,
+			"imagePullPolicy": "IfNotPresent",
+			"envFrom": []map[string]interface{}{
+				{
+					"secretRef": map[string]interface{}{
+						"name": source.Secret,
+					},
+				},
+			},
+			"env": []map[string]interface{}{
+				{"name": "PVC_NAME", "value": source.PVC},
+				{"name": "RESTIC_TAGS", "value": snapshotTags(policy, offsite)},
+				{"name": "FORGET_ARGS", "value": retention.forgetArgs()},
+				{"name": resticLimitEnv, "value": resticLimitArgs(policy.Spec.Mover)},
+				{"name": "PVC_METADATA", "value": pvcMetadataPlaceholder(i)},
+			},
+			"command": []string{"/bin/sh", "-c"},
+			"args":    []string{tagScript()},
+		}
+		if !offsite {
+			env := container["env"].([]map[string]interface{})
+			container["env"] = append(env, map[string]interface{}{"name": "PVC_METADATA_FILE", "value": pvcMetadataPath(cfg, ns, source.PVC)})
+			container["volumeMounts"] = []map[string]interface{}{
+				{
+					"name":      "repo",
+					"mountPath": mountPath,
+				},
+			}
+		}
+		containers = append(containers, container)
+	}
+
+	podSpec := map[string]interface{}{
+		"serviceAccountName": "backup-runner",
+		"restartPolicy":      "Never",
+		"containers":         containers,
+	}
+	setPodPlacement(podSpec, policy.Spec.Mover)
+	if !offsite {
+		podSpec["volumes"] = []map[string]interface{}{
+			{
+				"name": "repo",
+				"persistentVolumeClaim": map[string]interface{}{
+					"claimName": cfg.RepoPVCName,
+					"readOnly":  false,
+				},
+			},
+		}
+	}
+
+	jobPrefix := sanitizeName(fmt.Sprintf("backup-%s-tag", policy.Metadata.Name))
+	if offsite {
+		jobPrefix = sanitizeName(fmt.Sprintf("backup-%s-offsite-tag", policy.Metadata.Name))
+	}
+
+	job := map[string]interface{}{
+		"apiVersion": "batch/v1",
+		"kind":       "Job",
+		"metadata": map[string]interface{}{
+			"generateName": jobPrefix + "-",
+			"namespace":    ns,
+			"labels": map[string]interface{}{
+				"backup-policy/name":      policy.Metadata.Name,
+				"backup-policy/namespace": ns,
+			},
+			"annotations": map[string]interface{}{
+				"backup.homelab/trigger-id": triggerIDPlaceholder,
+				runTypeAnnotation:           runTypePlaceholder,
+			},
+		},
+		"spec": map[string]interface{}{
+			"backoffLimit":            0,
+			"ttlSecondsAfterFinished": 86400,
+			"template": map[string]interface{}{
+				"spec": podSpec,
+			},
+		},
+	}
+
+	payload, err := json.Marshal(job)
+	if err != nil {
+		return "", err
+	}
+	return string(payload), nil
+}
+
+func tagScript() string {
+	return strings.TrimSpace(`
+set -eu
+
+echo "Tagging latest snapshot of ${PVC_NAME} with ${RESTIC_TAGS}"
+restic ${RESTIC_LIMIT_ARGS} tag --host volsync --add "${RESTIC_TAGS}" latest
+
+if [ -n "${FORGET_ARGS}" ]; then
+  echo "Applying retention to ${PVC_NAME}: ${FORGET_ARGS}"
+  restic ${RESTIC_LIMIT_ARGS} forget --host volsync ${FORGET_ARGS}
+fi
+
+if [ -z "${PVC_METADATA}" ]; then
+  echo "No metadata captured for ${PVC_NAME}" >&2
+elif [ -n "${PVC_METADATA_FILE:-}" ]; then
+  if ! { mkdir -p "$(dirname "${PVC_METADATA_FILE}")" \
+      && printf '%s' "${PVC_METADATA}" | base64 -d > "${PVC_METADATA_FILE}.tmp" \
+      && mv "${PVC_METADATA_FILE}.tmp" "${PVC_METADATA_FILE}"; }; then
+    rm -f "${PVC_METADATA_FILE}.tmp"
+    echo "Failed to record the metadata of ${PVC_NAME}" >&2
+  fi
+elif printf '%s' "${PVC_METADATA}" | base64 -d \
+    | restic ${RESTIC_LIMIT_ARGS} backup --host ` + pvcMetadataHost + ` --tag "pvc=${PVC_NAME}" --stdin --stdin-filename pvc-metadata.json; then
+  restic ${RESTIC_LIMIT_ARGS} forget --host ` + pvcMetadataHost + ` --keep-last 1 || true
+else
+  echo "Failed to record the metadata of ${PVC_NAME}" >&2
+fi
+`)
+}
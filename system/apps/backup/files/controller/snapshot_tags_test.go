@@ -0,0 +1,46 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestRetentionFor(t *testing.T) {
+	cfg := Config{RetainHourly: 6, RetainDaily: 5, RetainWeekly: 4, RetainMonthly: 2, RetainYearly: 1}
+	zero, three := int64(0), int64(3)
+
+	for _, tc := range []struct {
+		name string
+		spec *RetentionSpec
+		want snapshotRetention
+	}{
+		{"defaults", nil, snapshotRetention{Hourly: 6, Daily: 5, Weekly: 4, Monthly: 2, Yearly: 1}},
+		{"empty spec", &RetentionSpec{}, snapshotRetention{Hourly: 6, Daily: 5, Weekly: 4, Monthly: 2, Yearly: 1}},
+		{"overrides", &RetentionSpec{Hourly: &zero, Daily: &three, Yearly: &zero}, snapshotRetention{Hourly: 0, Daily: 3, Weekly: 4, Monthly: 2, Yearly: 0}},
+		{"keep tags", &RetentionSpec{KeepTags: []string{" manual ", "", "pre-upgrade"}}, snapshotRetention{Hourly: 6, Daily: 5, Weekly: 4, Monthly: 2, Yearly: 1, KeepTags: []string{"manual", "pre-upgrade"}}},
+	} {
+		policy := testBackupPolicy("app", "data")
+		policy.Spec.Retention = tc.spec
+		if got := retentionFor(cfg, policy); !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("%s: got %+v, want %+v", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestForgetArgs(t *testing.T) {
+	for _, tc := range []struct {
+		retention snapshotRetention
+		want      string
+	}{
+		{snapshotRetention{Hourly: 6, Daily: 5}, ""},
+		{snapshotRetention{Daily: 7, KeepTags: []string{"manual"}}, "--keep-hourly 0 --keep-daily 7 --keep-weekly 0 --keep-monthly 0 --keep-yearly 0 --keep-tag manual"},
+		{snapshotRetention{Hourly: 1, Daily: 2, Weekly: 3, Monthly: 4, Yearly: 5, KeepTags: []string{"manual", "pre-upgrade"}}, "--keep-hourly 1 --keep-daily 2 --keep-weekly 3 --keep-monthly 4 --keep-yearly 5 --keep-tag manual --keep-tag pre-upgrade"},
+	} {
+		if got := tc.retention.forgetArgs(); got != tc.want {
+			t.Errorf("forgetArgs(%+v) = %q, want %q", tc.retention, got, tc.want)
+		}
+		if got := tc.retention.volsyncManaged(); got != (tc.want == "") {
+			t.Errorf("volsyncManaged(%+v) = %v", tc.retention, got)
+		}
+	}
+}
@@ -0,0 +1,237 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/url"
+	"sort"
+	"time"
+)
+
+const (
+	// triggerRequestAnnotation is set by backup runs on a ReplicationSource
+	// instead of the manual trigger when concurrency limits are configured.
+	triggerRequestAnnotation = "backup.homelab/trigger-request"
+	triggerGrantedAnnotation = "backup.homelab/trigger-granted-at"
+	// repositoryLabel names the repository a ReplicationSource writes to: the
+	// repository storage class, or offsite.
+	repositoryLabel   = "backup.homelab/repository"
+	offsiteRepository = "offsite"
+	// grantGracePeriod counts a granted trigger as running until VolSync
+	// reports the sync.
+	grantGracePeriod     = 2 * time.Minute
+	triggerQueueInterval = 10 * time.Second
+)
+
+// ConcurrencyConfig limits how many backup syncs run at once, set from
+// backupController.concurrency in the chart values. Zero means unlimited.
+type ConcurrencyConfig struct {
+	Global int `json:"global,omitempty"`
+	// PerRepository limits syncs per repository storage class, or offsite.
+	PerRepository map[string]int `json:"perRepository,omitempty"`
+}
+
+func (c ConcurrencyConfig) enabled() bool {
+	return c.Global > 0 || len(c.PerRepository) > 0
+}
+
+type replicationSourceList struct {
+	Items []struct {
+		Metadata struct {
+			Name        string            `json:"name"`
+			Namespace   string            `json:"namespace"`
+			Labels      map[string]string `json:"labels"`
+			Annotations map[string]string `json:"annotations"`
+		} `json:"metadata"`
+		Spec struct {
+			Trigger struct {
+				Manual string `json:"manual"`
+			} `json:"trigger"`
+		} `json:"spec"`
+		Status struct {
+			LastManualSync string `json:"lastManualSync"`
+			Conditions     []struct {
+				Type   string `json:"type"`
+				Status string `json:"status"`
+			} `json:"conditions"`
+		} `json:"status"`
+	} `json:"items"`
+}
+
+// queuedSource is the trigger state of one ReplicationSource.
+type queuedSource struct {
+	Namespace  string
+	Name       string
+	Repository string
+	// Request is the trigger a backup run asked for, empty when none.
+	Request   string
+	Trigger   string
+	LastSync  string
+	Syncing   bool
+	GrantedAt time.Time
+}
+
+func (s queuedSource) running(now time.Time) bool {
+	if s.Syncing {
+		return true
+	}
+	return s.Trigger != s.LastSync && now.Sub(s.GrantedAt) < grantGracePeriod
+}
+
+func (s queuedSource) pending() bool {
+	return s.Request != "" && s.Request != s.Trigger && s.Request != s.LastSync
+}
+
+// activeRuns returns the namespace/trigger id of the backup runs whose runner
+// Job exists and hasn't finished.
+func activeRuns(jobs jobList) map[string]bool {
+	active := map[string]bool{}
+	for _, job := range jobs.Items {
+		triggerID := job.Metadata.Annotations[triggerIDAnnotation]
+		if triggerID == "" || job.Metadata.Annotations[runTypeAnnotation] == "" {
+			continue
+		}
+		finished := false
+		for _, condition := range job.Status.Conditions {
+			if condition.Status == "True" && (condition.Type == "Complete" || condition.Type == "Failed") {
+				finished = true
+			}
+		}
+		if !finished {
+			active[job.Metadata.Namespace+"/"+triggerID] = true
+		}
+	}
+	return active
+}
+
+// queuedSources returns the trigger state of the ReplicationSources. Requests
+// of runs not in active are left out, so a sync is never started for a run
+// that gave up waiting for it.
+func queuedSources(list replicationSourceList, active map[string]bool) []queuedSource {
+	sources := make([]queuedSource, 0, len(list.Items))
+	for _, item := range list.Items {
+		source := queuedSource{
+			Namespace:  item.Metadata.Namespace,
+			Name:       item.Metadata.Name,
+			Repository: item.Metadata.Labels[repositoryLabel],
+			Request:    item.Metadata.Annotations[triggerRequestAnnotation],
+			Trigger:    item.Spec.Trigger.Manual,
+			LastSync:   item.Status.LastManualSync,
+		}
+		if source.Request != "" && !active[source.Namespace+"/"+source.Request] {
+			source.Request = ""
+		}
+		if granted, err := time.Parse(time.RFC3339, item.Metadata.Annotations[triggerGrantedAnnotation]); err == nil {
+			source.GrantedAt = granted
+		}
+		for _, condition := range item.Status.Conditions {
+			if condition.Type == "Synchronizing" && condition.Status == "True" {
+				source.Syncing = true
+			}
+		}
+		sources = append(sources, source)
+	}
+	return sources
+}
+
+// planGrants returns the pending sources that fit in the limits next to the
+// running ones, oldest request first, and the number left waiting per
+// repository.
+func planGrants(sources []queuedSource, limits ConcurrencyConfig, now time.Time) ([]queuedSource, map[string]int) {
+	running := 0
+	runningPerRepo := map[string]int{}
+	var pending []queuedSource
+	for _, source := range sources {
+		if source.running(now) {
+			running++
+			runningPerRepo[source.Repository]++
+		}
+		if source.pending() {
+			pending = append(pending, source)
+		}
+	}
+	// Requests are trigger ids, UTC timestamps that sort by time.
+	sort.Slice(pending, func(i, j int) bool {
+		if pending[i].Request != pending[j].Request {
+			return pending[i].Request < pending[j].Request
+		}
+		if pending[i].Namespace != pending[j].Namespace {
+			return pending[i].Namespace < pending[j].Namespace
+		}
+		return pending[i].Name < pending[j].Name
+	})
+
+	var grants []queuedSource
+	waiting := map[string]int{}
+	for _, source := range pending {
+		repoLimit := limits.PerRepository[source.Repository]
+		if (limits.Global > 0 && running >= limits.Global) || (repoLimit > 0 && runningPerRepo[source.Repository] >= repoLimit) {
+			waiting[source.Repository]++
+			continue
+		}
+		grants = append(grants, source)
+		running++
+		runningPerRepo[source.Repository]++
+	}
+	return grants, waiting
+}
+
+// startTriggerQueue starts queued backup triggers within cfg.Concurrency. It
+// does nothing when no limits are configured, as backup runs then trigger
+// their ReplicationSources directly.
+func startTriggerQueue(ctx context.Context, client *kubeClient, cfg Config) {
+	if !cfg.Concurrency.enabled() {
+		return
+	}
+	ticker := time.NewTicker(triggerQueueInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		if err := processTriggerQueue(ctx, client, cfg); err != nil {
+			slog.Error("trigger queue failed", logError, err)
+		}
+	}
+}
+
+func processTriggerQueue(ctx context.Context, client *kubeClient, cfg Config) error {
+	var list replicationSourceList
+	if err := getJSON(ctx, client, "/apis/volsync.backube/v1alpha1/replicationsources?labelSelector="+url.QueryEscape(repositoryLabel), &list); err != nil {
+		return err
+	}
+	var jobs jobList
+	if err := getJSON(ctx, client, "/apis/batch/v1/jobs?labelSelector="+url.QueryEscape(runnerJobLabel+"=true"), &jobs); err != nil {
+		return err
+	}
+	now := time.Now()
+	sources := queuedSources(list, activeRuns(jobs))
+	grants, waiting := planGrants(sources, cfg.Concurrency, now)
+	backupMetrics.setQueue(sources, waiting, now)
+
+	for _, source := range grants {
+		slog.Info("trigger queue starting sync", logNamespace, source.Namespace, logResource, source.Name, logTriggerID, source.Request)
+		patch := map[string]interface{}{
+			"metadata": map[string]interface{}{
+				"annotations": map[string]interface{}{
+					triggerGrantedAnnotation: now.UTC().Format(time.RFC3339),
+				},
+			},
+			"spec": map[string]interface{}{
+				"trigger": map[string]interface{}{"manual": source.Request},
+			},
+		}
+		itemPath := namespacedPath("/apis/volsync.backube/v1alpha1", source.Namespace, "replicationsources", source.Name)
+		_, status, err := client.doRequestWithContentType(ctx, "PATCH", itemPath, "application/merge-patch+json", patch)
+		if err != nil {
+			return err
+		}
+		if status < 200 || status >= 300 {
+			return fmt.Errorf("patch failed: %s status=%d", itemPath, status)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestPlanGrants(t *testing.T) {
+	now := time.Date(2024, 5, 1, 2, 0, 30, 0, time.UTC)
+	sources := []queuedSource{
+		{Namespace: "a", Name: "running", Repository: "nas", Trigger: "20240501015500", LastSync: "20240501000000", Syncing: true},
+		{Namespace: "b", Name: "granted", Repository: "nas", Trigger: "20240501020000", LastSync: "20240501000000", GrantedAt: now.Add(-time.Minute)},
+		{Namespace: "c", Name: "done", Repository: "nas", Request: "20240501010000", Trigger: "20240501010000", LastSync: "20240501010000"},
+		{Namespace: "d", Name: "late", Repository: "nas", Request: "20240501020010"},
+		{Namespace: "e", Name: "early", Repository: "nas", Request: "20240501020000"},
+		{Namespace: "f", Name: "offsite", Repository: offsiteRepository, Request: "20240501020020"},
+	}
+
+	grants, waiting := planGrants(sources, ConcurrencyConfig{Global: 4, PerRepository: map[string]int{"nas": 3}}, now)
+	var granted []string
+	for _, source := range grants {
+		granted = append(granted, source.Namespace+"/"+source.Name)
+	}
+	if want := []string{"e/early", "f/offsite"}; !reflect.DeepEqual(granted, want) {
+		t.Errorf("granted %v, want %v", granted, want)
+	}
+	if want := map[string]int{"nas": 1}; !reflect.DeepEqual(waiting, want) {
+		t.Errorf("waiting %v, want %v", waiting, want)
+	}
+
+	grants, _ = planGrants(sources, ConcurrencyConfig{Global: 2}, now)
+	if len(grants) != 0 {
+		t.Errorf("granted %d triggers with the global limit reached", len(grants))
+	}
+}
+
+func TestQueuedSourcesDropsAbandonedRequests(t *testing.T) {
+	var jobs jobList
+	mustUnmarshal(t, `{"items": [
+		{"metadata": {"name": "backup-app-1", "namespace": "a", "annotations": {"backup.homelab/trigger-id": "20240501020000", "backup.homelab/run-type": "scheduled"}}},
+		{"metadata": {"name": "backup-app-2", "namespace": "b", "annotations": {"backup.homelab/trigger-id": "20240501020000", "backup.homelab/run-type": "scheduled"}},
+			"status": {"conditions": [{"type": "Failed", "status": "True"}]}},
+		{"metadata": {"name": "export-app-run", "namespace": "c", "annotations": {"backup.homelab/trigger-id": "20240501020000"}}}
+	]}`, &jobs)
+	var list replicationSourceList
+	mustUnmarshal(t, `{"items": [
+		{"metadata": {"name": "backup-app-data", "namespace": "a", "annotations": {"backup.homelab/trigger-request": "20240501020000"}}},
+		{"metadata": {"name": "backup-app-data", "namespace": "b", "annotations": {"backup.homelab/trigger-request": "20240501020000"}}},
+		{"metadata": {"name": "backup-app-data", "namespace": "c", "annotations": {"backup.homelab/trigger-request": "20240501020000"}}}
+	]}`, &list)
+
+	var requests []string
+	for _, source := range queuedSources(list, activeRuns(jobs)) {
+		requests = append(requests, source.Namespace+"="+source.Request)
+	}
+	if want := []string{"a=20240501020000", "b=", "c="}; !reflect.DeepEqual(requests, want) {
+		t.Errorf("requests %v, want %v", requests, want)
+	}
+}
+
+func TestExpandHashedSchedule(t *testing.T) {
+	first, err := expandHashedSchedule("H H(1-4) * * *", "gitea/gitea")
+	if err != nil {
+		t.Fatal(err)
+	}
+	again, _ := expandHashedSchedule("H H(1-4) * * *", "gitea/gitea")
+	if first != again {
+		t.Errorf("expansion is not stable: %q and %q", first, again)
+	}
+	sched, err := parseCronSchedule(first, "")
+	if err != nil {
+		t.Fatalf("expanded schedule %q: %v", first, err)
+	}
+	if sched.hour&^(1<<1|1<<2|1<<3|1<<4) != 0 {
+		t.Errorf("expanded schedule %q is outside H(1-4)", first)
+	}
+
+	spread := map[string]bool{}
+	for _, seed := range []string{"a/a", "b/b", "c/c", "d/d", "e/e", "f/f"} {
+		expanded, _ := expandHashedSchedule("H 2 * * *", seed)
+		spread[expanded] = true
+	}
+	if len(spread) < 2 {
+		t.Errorf("H picked the same minute for every policy: %v", spread)
+	}
+
+	if expanded, _ := expandHashedSchedule("0 2 * * *", "gitea/gitea"); expanded != "0 2 * * *" {
+		t.Errorf("schedule without H changed to %q", expanded)
+	}
+	for _, invalid := range []string{"H(5) 2 * * *", "0 H(20-30) * * *", "Hx 2 * * *"} {
+		if _, err := expandHashedSchedule(invalid, "x"); err == nil {
+			t.Errorf("expandHashedSchedule(%q) succeeded", invalid)
+		}
+	}
+}
+
+func TestRunnerDeadlineSeconds(t *testing.T) {
+	cfg := Config{ScaleDownTimeoutSeconds: 600, ExportTimeoutSeconds: 3600, BackupTimeoutSeconds: 7200, QueueTimeoutSeconds: 21600}
+	policy := testBackupPolicy("app", "data")
+	sources := []backupSource{{Name: "backup-app-data"}, {Name: "backup-app-media", Clone: "backup-app-media-clone"}}
+
+	direct := runnerDeadlineSeconds(cfg, policy, sources)
+	if want := int64(600 + 2*3600 + 7200 + 2*(300+7200) + 7200); direct != want {
+		t.Errorf("deadline %d, want %d", direct, want)
+	}
+	cfg.Concurrency.Global = 2
+	if queued := runnerDeadlineSeconds(cfg, policy, sources); queued != direct+2*21600 {
+		t.Errorf("queued deadline %d does not include the queue wait of both sources", queued)
+	}
+}
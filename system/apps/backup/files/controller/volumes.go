@@ -0,0 +1,234 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+)
+
+// cloneOfLabel marks the PVCs backup runs clone filtered volumes to.
+const cloneOfLabel = "backup.homelab/clone-of"
+
+// VolumeFilter leaves files out of a volume's backups. Exclude takes restic
+// style globs: patterns starting with / are anchored to the volume root, others
+// match at any depth. Directories holding an ExcludeIfPresent file are left out.
+type VolumeFilter struct {
+	Exclude          []string `json:"exclude,omitempty"`
+	ExcludeIfPresent []string `json:"excludeIfPresent,omitempty"`
+}
+
+func (f VolumeFilter) empty() bool {
+	return len(f.Exclude) == 0 && len(f.ExcludeIfPresent) == 0
+}
+
+// BackupVolume is one PVC a BackupPolicy backs up.
+type BackupVolume struct {
+	PVC string `json:"pvc"`
+	VolumeFilter
+	// CopyMethod and VolumeSnapshotClassName override the copy method
+	// configured for the PVC's storage class.
+	CopyMethod              string `json:"copyMethod,omitempty"`
+	VolumeSnapshotClassName string `json:"volumeSnapshotClassName,omitempty"`
+	// StorageClass is the storage class of the PVC, set by policyVolumes.
+	StorageClass string `json:"-"`
+}
+
+// VolumeSelector picks the PVCs of the policy's namespace by label. The filter
+// applies to every selected PVC.
+type VolumeSelector struct {
+	metav1.LabelSelector
+	VolumeFilter
+}
+
+// policyVolumes returns spec.volumes, the dump volume of a built-in export
+// and the PVCs in the policy's namespace that spec.volumeSelector matches and
+// that are not listed, sorted by name, with the storage class of each PVC.
+func policyVolumes(policy BackupPolicy, pvcs pvcList) ([]BackupVolume, error) {
+	storageClasses := map[string]string{}
+	for _, pvc := range pvcs.Items {
+		if pvc.Metadata.Namespace == policy.Metadata.Namespace {
+			storageClasses[pvc.Metadata.Name] = pvc.Spec.StorageClassName
+		}
+	}
+	volumes := append([]BackupVolume(nil), policy.Spec.Volumes...)
+	listed := map[string]bool{}
+	for _, vol := range volumes {
+		listed[vol.PVC] = true
+	}
+	if dump := exportVolumePVC(policy); dump != "" && !listed[dump] {
+		volumes = append(volumes, BackupVolume{PVC: dump})
+		listed[dump] = true
+	}
+	for i := range volumes {
+		volumes[i].StorageClass = storageClasses[volumes[i].PVC]
+	}
+	selector := policy.Spec.VolumeSelector
+	if selector == nil {
+		return volumes, nil
+	}
+	matcher, err := selectorFor(&selector.LabelSelector)
+	if err != nil {
+		return volumes, fmt.Errorf("spec.volumeSelector: %w", err)
+	}
+
+	var selected []string
+	for _, pvc := range pvcs.Items {
+		if pvc.Metadata.Namespace != policy.Metadata.Namespace || listed[pvc.Metadata.Name] || ignoredPVC(pvc.Metadata.Name, pvc.Metadata.Labels) {
+			continue
+		}
+		if matcher.Matches(labels.Set(pvc.Metadata.Labels)) {
+			selected = append(selected, pvc.Metadata.Name)
+		}
+	}
+	sort.Strings(selected)
+	for _, name := range selected {
+		volumes = append(volumes, BackupVolume{PVC: name, VolumeFilter: selector.VolumeFilter, StorageClass: storageClasses[name]})
+	}
+	return volumes, nil
+}
+
+// resolveVolumes returns policy with the PVCs its volume selector matches
+// added to spec.volumes and the storage class of every volume set.
+func resolveVolumes(ctx context.Context, client *kubeClient, policy BackupPolicy) (BackupPolicy, error) {
+	var pvcs pvcList
+	if err := getJSON(ctx, client, namespacedPath("/api/v1", policy.Metadata.Namespace, "persistentvolumeclaims"), &pvcs); err != nil {
+		return policy, err
+	}
+	volumes, err := policyVolumes(policy, pvcs)
+	if err != nil {
+		return policy, err
+	}
+	policy.Spec.Volumes = volumes
+	return policy, nil
+}
+
+// cloneName is the PVC a filtered volume is copied to before source syncs it.
+func cloneName(source string) string {
+	return sanitizeName(source + "-clone")
+}
+
+// prepareJobsManifest renders the Jobs the runner creates after cloning the
+// filtered volumes of sources. Each removes the excluded files from one clone
+// before the ReplicationSource copies it.
+func prepareJobsManifest(cfg Config, ns string, policy BackupPolicy, sources []backupSource) (string, error) {
+	var jobs []map[string]interface{}
+	for _, source := range sources {
+		if source.Clone == "" {
+			continue
+		}
+		podSpec := map[string]interface{}{
+			"restartPolicy": "Never",
+			"containers": []map[string]interface{}{
+				{
+					"name":            "prepare",
+					"image":           cfg.ResticImage,
+					"imagePullPolicy": "IfNotPresent",
+					"command":         []string{"/bin/sh", "-c"},
+					"args":            []string{prepareScript()},
+					"env": []map[string]interface{}{
+						{"name": "PVC_NAME", "value": source.PVC},
+						{"name": "EXCLUDE", "value": strings.Join(source.Filter.Exclude, "\n")},
+						{"name": "EXCLUDE_IF_PRESENT", "value": strings.Join(source.Filter.ExcludeIfPresent, "\n")},
+					},
+					"volumeMounts": []map[string]interface{}{
+						{"name": "data", "mountPath": "/data"},
+					},
+				},
+			},
+			"volumes": []map[string]interface{}{
+				{
+					"name": "data",
+					"persistentVolumeClaim": map[string]interface{}{
+						"claimName": source.Clone,
+					},
+				},
+			},
+		}
+		setPodPlacement(podSpec, policy.Spec.Mover)
+
+		jobs = append(jobs, map[string]interface{}{
+			"apiVersion": "batch/v1",
+			"kind":       "Job",
+			"metadata": map[string]interface{}{
+				"generateName": source.Clone + "-",
+				"namespace":    ns,
+				"labels": map[string]interface{}{
+					"backup-policy/name":      policy.Metadata.Name,
+					"backup-policy/namespace": ns,
+				},
+				"annotations": map[string]interface{}{
+					"backup.homelab/trigger-id": triggerIDPlaceholder,
+				},
+			},
+			"spec": map[string]interface{}{
+				"backoffLimit":            0,
+				"ttlSecondsAfterFinished": 86400,
+				"template": map[string]interface{}{
+					"spec": podSpec,
+				},
+			},
+		})
+	}
+	if len(jobs) == 0 {
+		return "", nil
+	}
+
+	payload, err := json.Marshal(map[string]interface{}{
+		"apiVersion": "v1",
+		"kind":       "List",
+		"items":      jobs,
+	})
+	if err != nil {
+		return "", err
+	}
+	return string(payload), nil
+}
+
+// cloneVolumes lists the filtered volumes of sources for the runner as
+// source:pvc:clone entries.
+func cloneVolumes(sources []backupSource) string {
+	var entries []string
+	for _, source := range sources {
+		if source.Clone != "" {
+			entries = append(entries, fmt.Sprintf("%s:%s:%s", source.Name, source.PVC, source.Clone))
+		}
+	}
+	return strings.Join(entries, " ")
+}
+
+func prepareScript() string {
+	return strings.TrimSpace(`
+set -eu
+
+printf '%s\n' "${EXCLUDE}" | while IFS= read -r pattern; do
+  [ -n "${pattern}" ] || continue
+  case "${pattern}" in
+    /*) match="/data${pattern}" ;;
+    *) match="*/${pattern}" ;;
+  esac
+  match="$(printf '%s' "${match}" | sed 's/\*\*/*/g')"
+  echo "Excluding ${pattern} from ${PVC_NAME}"
+  find /data -mindepth 1 -path "${match}" -prune -exec rm -rf {} +
+done
+
+printf '%s\n' "${EXCLUDE_IF_PRESENT}" | while IFS= read -r marker; do
+  [ -n "${marker}" ] || continue
+  echo "Excluding directories of ${PVC_NAME} containing ${marker}"
+  find /data -type f -name "${marker}" | while IFS= read -r file; do
+    dir="$(dirname "${file}")"
+    if [ "${dir}" = /data ]; then
+      # The mount point itself can't go, so a marker at the root empties it.
+      echo "Excluding all of ${PVC_NAME}"
+      find /data -mindepth 1 -maxdepth 1 -exec rm -rf {} +
+    else
+      rm -rf "${dir}"
+    fi
+  done
+done
+`)
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"io/fs"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestPolicyVolumes(t *testing.T) {
+	var policy BackupPolicy
+	mustUnmarshal(t, `{"metadata": {"name": "app", "namespace": "apps"}, "spec": {
+		"volumes": [{"pvc": "data-app-1", "exclude": ["*.tmp"]}],
+		"volumeSelector": {"matchLabels": {"app": "app"}, "exclude": ["/cache"]}
+	}}`, &policy)
+	var pvcs pvcList
+	mustUnmarshal(t, `{"items": [
+		{"metadata": {"name": "data-app-2", "namespace": "apps", "labels": {"app": "app"}}},
+		{"metadata": {"name": "data-app-1", "namespace": "apps", "labels": {"app": "app"}}},
+		{"metadata": {"name": "data-app-0", "namespace": "apps", "labels": {"app": "app"}}},
+		{"metadata": {"name": "backup-app-data-app-0-clone", "namespace": "apps", "labels": {"app": "app", "backup.homelab/clone-of": "data-app-0"}}},
+		{"metadata": {"name": "data-app-0", "namespace": "other", "labels": {"app": "app"}}},
+		{"metadata": {"name": "logs", "namespace": "apps"}}
+	]}`, &pvcs)
+
+	volumes, err := policyVolumes(policy, pvcs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []BackupVolume{
+		{PVC: "data-app-1", VolumeFilter: VolumeFilter{Exclude: []string{"*.tmp"}}},
+		{PVC: "data-app-0", VolumeFilter: VolumeFilter{Exclude: []string{"/cache"}}},
+		{PVC: "data-app-2", VolumeFilter: VolumeFilter{Exclude: []string{"/cache"}}},
+	}
+	if !reflect.DeepEqual(volumes, want) {
+		t.Errorf("volumes %+v, want %+v", volumes, want)
+	}
+}
+
+func TestPrepareScript(t *testing.T) {
+	if _, err := exec.LookPath("sh"); err != nil {
+		t.Skip("no shell")
+	}
+	for _, tc := range []struct {
+		name  string
+		files []string
+		want  []string
+	}{
+		{"nested marker", []string{"keep/a", "cache/.nobackup", "cache/b", "app/tmp/.nobackup", "app/c"}, []string{"app/c", "keep/a"}},
+		{"root marker", []string{".nobackup", "keep/a", "cache/.nobackup"}, nil},
+	} {
+		data := t.TempDir()
+		for _, file := range tc.files {
+			os.MkdirAll(filepath.Join(data, filepath.Dir(file)), 0o755)
+			if err := os.WriteFile(filepath.Join(data, file), nil, 0o644); err != nil {
+				t.Fatal(err)
+			}
+		}
+		cmd := exec.Command("sh", "-c", strings.ReplaceAll(prepareScript(), "/data", data))
+		cmd.Env = append(os.Environ(), "PVC_NAME=data", "EXCLUDE=", "EXCLUDE_IF_PRESENT=.nobackup")
+		if output, err := cmd.CombinedOutput(); err != nil {
+			t.Fatalf("%s: %v\n%s", tc.name, err, output)
+		}
+		var got []string
+		filepath.WalkDir(data, func(path string, entry fs.DirEntry, err error) error {
+			if err == nil && !entry.IsDir() {
+				rel, _ := filepath.Rel(data, path)
+				got = append(got, rel)
+			}
+			return err
+		})
+		if _, err := os.Stat(data); err != nil {
+			t.Errorf("%s: the volume root was removed", tc.name)
+		}
+		if !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("%s: kept %q, want %q", tc.name, got, tc.want)
+		}
+	}
+}
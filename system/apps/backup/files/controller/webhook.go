@@ -0,0 +1,545 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	// cronJobNameLimit leaves room for the 11 characters the CronJob
+	// controller appends to Job names.
+	cronJobNameLimit = 52
+	// jobNameLimit is the limit of the job-name label on the Job's pods.
+	jobNameLimit = 63
+	// volsyncNameLimit leaves room for the volsync-src-/volsync-dst- prefix
+	// VolSync puts in front of mover names.
+	volsyncNameLimit = 51
+)
+
+// admissionReview is the subset of admission.k8s.io/v1 AdmissionReview the
+// webhook reads and writes.
+type admissionReview struct {
+	APIVersion string             `json:"apiVersion"`
+	Kind       string             `json:"kind"`
+	Request    *admissionRequest  `json:"request,omitempty"`
+	Response   *admissionResponse `json:"response,omitempty"`
+}
+
+type admissionRequest struct {
+	UID       string                `json:"uid"`
+	Kind      struct{ Kind string } `json:"kind"`
+	Namespace string                `json:"namespace"`
+	Operation string                `json:"operation"`
+	Object    json.RawMessage       `json:"object"`
+	OldObject json.RawMessage       `json:"oldObject"`
+}
+
+type admissionResponse struct {
+	UID      string   `json:"uid"`
+	Allowed  bool     `json:"allowed"`
+	Warnings []string `json:"warnings,omitempty"`
+	Status   *struct {
+		Code    int    `json:"code"`
+		Message string `json:"message"`
+	} `json:"status,omitempty"`
+}
+
+// validationLookup is the cluster state validation compares policies with.
+type validationLookup interface {
+	pvcExists(ns, name string) (bool, error)
+	listPVCs(ns string) (pvcList, error)
+	backupPolicies(ns string) ([]BackupPolicy, error)
+	restorePolicies(ns string) ([]RestorePolicy, error)
+}
+
+// clusterLookup reads the cluster state with the context of the admission
+// request.
+type clusterLookup struct {
+	ctx    context.Context
+	client *kubeClient
+}
+
+func (l clusterLookup) pvcExists(ns, name string) (bool, error) {
+	return objectExists(l.ctx, l.client, namespacedPath("/api/v1", ns, "persistentvolumeclaims", name))
+}
+
+func (l clusterLookup) listPVCs(ns string) (pvcList, error) {
+	var list pvcList
+	err := getJSON(l.ctx, l.client, namespacedPath("/api/v1", ns, "persistentvolumeclaims"), &list)
+	return list, err
+}
+
+func (l clusterLookup) backupPolicies(ns string) ([]BackupPolicy, error) {
+	var list BackupPolicyList
+	err := getJSON(l.ctx, l.client, namespacedPath(fmt.Sprintf("/apis/%s/%s", backupPolicyGroup, backupPolicyVersion), ns, "backuppolicies"), &list)
+	return list.Items, err
+}
+
+func (l clusterLookup) restorePolicies(ns string) ([]RestorePolicy, error) {
+	var list RestorePolicyList
+	err := getJSON(l.ctx, l.client, namespacedPath(fmt.Sprintf("/apis/%s/%s", backupPolicyGroup, backupPolicyVersion), ns, "restorepolicies"), &list)
+	return list.Items, err
+}
+
+// startWebhookServer serves the validating webhook over TLS with the
+// certificate in cfg.WebhookCertDir. It does nothing when no certificate is
+// mounted.
+func startWebhookServer(ctx context.Context, client *kubeClient, cfg Config) {
+	certFile := filepath.Join(cfg.WebhookCertDir, "tls.crt")
+	keyFile := filepath.Join(cfg.WebhookCertDir, "tls.key")
+	if _, err := os.Stat(certFile); err != nil {
+		slog.Warn("webhook server disabled", logError, err)
+		return
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/validate", func(w http.ResponseWriter, r *http.Request) {
+		handleValidate(cfg, clusterLookup{ctx: r.Context(), client: client}, w, r)
+	})
+	server := &http.Server{
+		Addr:              cfg.WebhookAddr,
+		Handler:           mux,
+		ReadHeaderTimeout: 5 * time.Second,
+	}
+	slog.Info("webhook server starting", "addr", cfg.WebhookAddr)
+	serve := func() error { return server.ListenAndServeTLS(certFile, keyFile) }
+	if err := serveUntilDone(ctx, server, serve); err != nil {
+		slog.Error("webhook server stopped", logError, err)
+	}
+}
+
+func handleValidate(cfg Config, lookup validationLookup, w http.ResponseWriter, r *http.Request) {
+	body, err := io.ReadAll(io.LimitReader(r.Body, 1<<20))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	var review admissionReview
+	if err := json.Unmarshal(body, &review); err != nil || review.Request == nil {
+		http.Error(w, "invalid AdmissionReview", http.StatusBadRequest)
+		return
+	}
+
+	req := review.Request
+	var errs, warnings []string
+	switch {
+	case specUnchanged(req):
+		// Status, label and annotation updates, most of them by the
+		// controller itself, are admitted without looking up the cluster.
+	case req.Kind.Kind == "BackupPolicy":
+		var policy BackupPolicy
+		if err = json.Unmarshal(req.Object, &policy); err == nil {
+			errs, warnings, err = validateBackupPolicy(cfg, lookup, policy)
+		}
+	case req.Kind.Kind == "RestorePolicy":
+		var policy RestorePolicy
+		if err = json.Unmarshal(req.Object, &policy); err == nil {
+			errs, warnings, err = validateRestorePolicy(lookup, policy)
+		}
+	}
+	if err != nil {
+		// Lookup failures should not block changes to policies.
+		warnings = append(warnings, fmt.Sprintf("validation incomplete: %v", err))
+	}
+
+	response := &admissionResponse{UID: req.UID, Allowed: len(errs) == 0, Warnings: warnings}
+	if len(errs) > 0 {
+		response.Status = &struct {
+			Code    int    `json:"code"`
+			Message string `json:"message"`
+		}{Code: http.StatusUnprocessableEntity, Message: strings.Join(errs, "; ")}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(admissionReview{
+		APIVersion: "admission.k8s.io/v1",
+		Kind:       "AdmissionReview",
+		Response:   response,
+	})
+}
+
+// specUnchanged reports whether req is an UPDATE that leaves the spec as it
+// was.
+func specUnchanged(req *admissionRequest) bool {
+	if req.Operation != "UPDATE" || len(req.OldObject) == 0 {
+		return false
+	}
+	var object, oldObject struct {
+		Spec interface{} `json:"spec"`
+	}
+	if err := json.Unmarshal(req.Object, &object); err != nil {
+		return false
+	}
+	if err := json.Unmarshal(req.OldObject, &oldObject); err != nil {
+		return false
+	}
+	return reflect.DeepEqual(object.Spec, oldObject.Spec)
+}
+
+// validateBackupPolicy returns the errors that reject policy and warnings
+// that are shown but let it through.
+func validateBackupPolicy(cfg Config, lookup validationLookup, policy BackupPolicy) ([]string, []string, error) {
+	var errs, warnings []string
+	ns := policy.Metadata.Namespace
+	name := policy.Metadata.Name
+	spec := policy.Spec
+
+	if err := validateSchedule(spec.Schedule, spec.TimeZone); err != nil {
+		errs = append(errs, fmt.Sprintf("spec.schedule/spec.timeZone: %v; use five cron fields such as \"0 2 * * *\" or \"H 2 * * *\" and an IANA time zone such as \"Europe/Amsterdam\"", err))
+	}
+	if spec.RestoreTest != nil {
+		if err := validateSchedule(spec.RestoreTest.Schedule, spec.RestoreTest.TimeZone); err != nil {
+			errs = append(errs, fmt.Sprintf("spec.restoreTest: %v", err))
+		}
+	}
+	if spec.MaxAge != "" {
+		if maxAge, err := time.ParseDuration(spec.MaxAge); err != nil || maxAge <= 0 {
+			errs = append(errs, fmt.Sprintf("spec.maxAge: %q is not a positive duration such as \"26h\"", spec.MaxAge))
+		}
+	}
+
+	pvcs, err := lookup.listPVCs(ns)
+	if err != nil {
+		return errs, warnings, err
+	}
+	generated := generatedBackupNames(name, policyPVCs(policy, pvcs))
+	if len(name) > 0 {
+		for _, cronJob := range []string{sanitizeName("backup-" + name), sanitizeName("backup-" + name + "-offsite")} {
+			if len(cronJob) > cronJobNameLimit {
+				errs = append(errs, fmt.Sprintf("metadata.name: the generated CronJob name %q is longer than %d characters; shorten the policy name", cronJob, cronJobNameLimit))
+				break
+			}
+		}
+	}
+
+	seen := map[string]int{}
+	for i, vol := range spec.Volumes {
+		if vol.PVC == "" {
+			errs = append(errs, fmt.Sprintf("spec.volumes[%d].pvc is empty", i))
+			continue
+		}
+		if first, ok := seen[vol.PVC]; ok {
+			errs = append(errs, fmt.Sprintf("spec.volumes[%d]: PVC %q is already listed in spec.volumes[%d]; remove the duplicate", i, vol.PVC, first))
+			continue
+		}
+		seen[vol.PVC] = i
+		errs = append(errs, validateVolumeFilter(fmt.Sprintf("spec.volumes[%d]", i), vol.VolumeFilter)...)
+
+		for _, generatedName := range generated[vol.PVC] {
+			if len(generatedName) > volsyncNameLimit {
+				warnings = append(warnings, fmt.Sprintf("spec.volumes[%d]: the generated ReplicationSource name %q is longer than %d characters, VolSync may fail to create its mover; shorten the policy name", i, generatedName, volsyncNameLimit))
+				break
+			}
+		}
+
+		exists, err := lookup.pvcExists(ns, vol.PVC)
+		if err != nil {
+			return errs, warnings, err
+		}
+		if !exists {
+			warnings = append(warnings, fmt.Sprintf("spec.volumes[%d]: PVC %s/%s does not exist yet; backups of it fail until it is created", i, ns, vol.PVC))
+		}
+	}
+
+	if spec.Export != nil {
+		errs = append(errs, validateExport(spec.Export, spec.Volumes)...)
+	}
+	if len(spec.Volumes) == 0 && spec.VolumeSelector == nil && exportVolumePVC(policy) == "" {
+		errs = append(errs, "spec.volumes or spec.volumeSelector is required")
+	}
+	if selector := spec.VolumeSelector; selector != nil {
+		if _, err := selectorFor(&selector.LabelSelector); err != nil {
+			errs = append(errs, fmt.Sprintf("spec.volumeSelector: %v", err))
+		}
+		errs = append(errs, validateVolumeFilter("spec.volumeSelector", selector.VolumeFilter)...)
+	}
+
+	if volumes, err := policyVolumes(policy, pvcs); err == nil {
+		for _, vol := range volumes {
+			if err := filterCopyError(cfg, vol); err != nil {
+				errs = append(errs, fmt.Sprintf("%v; remove the filters or back the PVC with a storage class that supports cloning", err))
+			}
+		}
+	}
+
+	for _, collision := range nameCollisions(generated) {
+		errs = append(errs, fmt.Sprintf("PVCs %s generate the same object name %q after sanitizing; rename one of the PVCs or split the policy", collision.owners, collision.name))
+	}
+
+	others, err := lookup.backupPolicies(ns)
+	if err != nil {
+		return errs, warnings, err
+	}
+	own := map[string]bool{}
+	for _, generatedName := range flattenNames(generated) {
+		own[generatedName] = true
+	}
+	for _, other := range others {
+		if other.Metadata.Name == name {
+			continue
+		}
+		for _, otherName := range flattenNames(generatedBackupNames(other.Metadata.Name, policyPVCs(other, pvcs))) {
+			if own[otherName] {
+				errs = append(errs, fmt.Sprintf("generated name %q is also generated by BackupPolicy %s/%s; rename the policy", otherName, ns, other.Metadata.Name))
+			}
+		}
+		for _, vol := range other.Spec.Volumes {
+			if _, ok := seen[vol.PVC]; ok {
+				warnings = append(warnings, fmt.Sprintf("PVC %s is also backed up by BackupPolicy %s/%s", vol.PVC, ns, other.Metadata.Name))
+			}
+		}
+	}
+	return errs, warnings, nil
+}
+
+// validateRestorePolicy returns the errors that reject policy and warnings
+// that are shown but let it through.
+func validateRestorePolicy(lookup validationLookup, policy RestorePolicy) ([]string, []string, error) {
+	var errs, warnings []string
+	ns := policy.Metadata.Namespace
+	name := policy.Metadata.Name
+
+	if policy.Spec.SourceNamespace == "" {
+		errs = append(errs, "spec.sourceNamespace is required; set it to the namespace of the backed up PVCs")
+	}
+
+	targets := map[string]int{}
+	generated := map[string][]string{}
+	for i, vol := range policy.Spec.Volumes {
+		if vol.SourcePVC == "" || vol.TargetPVC == "" {
+			errs = append(errs, fmt.Sprintf("spec.volumes[%d]: sourcePVC and targetPVC are required", i))
+			continue
+		}
+		if first, ok := targets[vol.TargetPVC]; ok {
+			errs = append(errs, fmt.Sprintf("spec.volumes[%d]: targetPVC %q is already restored by spec.volumes[%d]; restore each PVC once", i, vol.TargetPVC, first))
+			continue
+		}
+		targets[vol.TargetPVC] = i
+		if vol.RestoreAsOf != "" {
+			if _, err := time.Parse(time.RFC3339, vol.RestoreAsOf); err != nil {
+				errs = append(errs, fmt.Sprintf("spec.volumes[%d].restoreAsOf: %q is not an RFC 3339 time such as \"2024-05-01T03:00:00Z\"", i, vol.RestoreAsOf))
+			}
+		}
+
+		restoreName := restoreResourceName(name, vol.TargetPVC)
+		generated[vol.TargetPVC] = []string{restoreName, restoreSecretName(name, vol.SourcePVC)}
+		if vol.partial() {
+			jobName, err := partialRestoreJobName(restoreName, vol)
+			if err != nil {
+				return errs, warnings, err
+			}
+			if len(jobName) > jobNameLimit {
+				errs = append(errs, fmt.Sprintf("spec.volumes[%d]: the generated Job name %q is longer than %d characters; shorten the policy name or targetPVC", i, jobName, jobNameLimit))
+			}
+		} else if len(restoreName) > volsyncNameLimit {
+			warnings = append(warnings, fmt.Sprintf("spec.volumes[%d]: the generated ReplicationDestination name %q is longer than %d characters, VolSync may fail to create its mover; shorten the policy name or targetPVC", i, restoreName, volsyncNameLimit))
+		}
+
+		if policy.Spec.SourceNamespace != "" {
+			exists, err := lookup.pvcExists(policy.Spec.SourceNamespace, vol.SourcePVC)
+			if err != nil {
+				return errs, warnings, err
+			}
+			if !exists {
+				warnings = append(warnings, fmt.Sprintf("spec.volumes[%d]: source PVC %s/%s does not exist; the target PVC is only created when its source exists", i, policy.Spec.SourceNamespace, vol.SourcePVC))
+			}
+		}
+	}
+
+	for _, collision := range nameCollisions(generated) {
+		errs = append(errs, fmt.Sprintf("targetPVCs %s generate the same object name %q after sanitizing; rename one of the target PVCs", collision.owners, collision.name))
+	}
+
+	others, err := lookup.restorePolicies(ns)
+	if err != nil {
+		return errs, warnings, err
+	}
+	for _, other := range others {
+		if other.Metadata.Name == name || findCondition(other.Status.Conditions, restoredCondition) != nil {
+			continue
+		}
+		for _, vol := range other.Spec.Volumes {
+			if i, ok := targets[vol.TargetPVC]; ok {
+				errs = append(errs, fmt.Sprintf("spec.volumes[%d]: PVC %s/%s is the target of RestorePolicy %s, which is still restoring; wait for its Restored condition or delete it", i, ns, vol.TargetPVC, other.Metadata.Name))
+			}
+		}
+	}
+	return errs, warnings, nil
+}
+
+// validateSchedule checks expr and timeZone the way CronJobs and the restore
+// test scheduler read them, after H fields are expanded.
+func validateSchedule(expr, timeZone string) error {
+	expanded, err := expandHashedSchedule(expr, "")
+	if err != nil {
+		return err
+	}
+	_, err = parseCronSchedule(expanded, timeZone)
+	return err
+}
+
+// policyPVCs returns the PVCs policy backs up: spec.volumes, the dump volume
+// of a built-in export and the PVCs its volume selector matches in pvcs.
+func policyPVCs(policy BackupPolicy, pvcs pvcList) []string {
+	volumes, _ := policyVolumes(policy, pvcs)
+	names := make([]string, 0, len(volumes))
+	for _, vol := range volumes {
+		if vol.PVC != "" {
+			names = append(names, vol.PVC)
+		}
+	}
+	return names
+}
+
+// generatedBackupNames returns the per-volume object names renderBackupPolicy
+// generates, keyed by PVC.
+func generatedBackupNames(policyName string, pvcs []string) map[string][]string {
+	names := map[string][]string{}
+	for _, pvc := range pvcs {
+		names[pvc] = []string{
+			backupSourceName(policyName, pvc, false),
+			backupSourceName(policyName, pvc, true),
+		}
+	}
+	return names
+}
+
+func flattenNames(names map[string][]string) []string {
+	var out []string
+	for _, values := range names {
+		out = append(out, values...)
+	}
+	sort.Strings(out)
+	return out
+}
+
+type nameCollision struct {
+	name   string
+	owners string
+}
+
+// nameCollisions returns generated names that more than one key produces,
+// one per group of colliding keys.
+func nameCollisions(names map[string][]string) []nameCollision {
+	owners := map[string][]string{}
+	for owner, values := range names {
+		for _, value := range values {
+			if !containsString(owners[value], owner) {
+				owners[value] = append(owners[value], owner)
+			}
+		}
+	}
+	values := make([]string, 0, len(owners))
+	for value := range owners {
+		values = append(values, value)
+	}
+	sort.Strings(values)
+
+	var collisions []nameCollision
+	reported := map[string]bool{}
+	for _, value := range values {
+		keys := owners[value]
+		sort.Strings(keys)
+		ownerList := strings.Join(keys, ", ")
+		if len(keys) > 1 && !reported[ownerList] {
+			reported[ownerList] = true
+			collisions = append(collisions, nameCollision{name: value, owners: ownerList})
+		}
+	}
+	return collisions
+}
+
+// validateVolumeFilter rejects empty patterns and markers that are paths.
+func validateVolumeFilter(field string, filter VolumeFilter) []string {
+	var errs []string
+	for i, pattern := range filter.Exclude {
+		if strings.TrimSpace(pattern) == "" {
+			errs = append(errs, fmt.Sprintf("%s.exclude[%d] is empty", field, i))
+		}
+	}
+	for i, marker := range filter.ExcludeIfPresent {
+		if strings.TrimSpace(marker) == "" || strings.Contains(marker, "/") {
+			errs = append(errs, fmt.Sprintf("%s.excludeIfPresent[%d]: %q must be a file name", field, i, marker))
+		}
+	}
+	return errs
+}
+
+// validateExport requires exactly one export and the fields its kind needs.
+// Rotated artifacts must be on a volume of their own, not one of the volumes
+// of the policy.
+func validateExport(export *ExportSpec, volumes []BackupVolume) []string {
+	kinds := export.kinds()
+	switch {
+	case len(kinds) == 0:
+		return []string{"spec.export: set one of jobRef, template, postgres, mysql, sqlite or redis"}
+	case len(kinds) > 1:
+		return []string{fmt.Sprintf("spec.export: only one export may be set, found %s", strings.Join(kinds, ", "))}
+	}
+
+	var errs []string
+	kind := export.kind()
+	if export.builtIn() {
+		if export.Volume == nil || export.Volume.PVC == "" {
+			errs = append(errs, fmt.Sprintf("spec.export.volume.pvc is required for %s exports", kind))
+		}
+		if export.ArtifactVolume != nil || export.KeepLast != 0 {
+			errs = append(errs, fmt.Sprintf("spec.export: %s exports write to volume and replace the previous dump; remove artifactVolume and keepLast", kind))
+		}
+	} else if export.KeepLast > 0 && (export.ArtifactVolume == nil || export.ArtifactVolume.PVC == "") {
+		errs = append(errs, "spec.export.keepLast requires artifactVolume.pvc")
+	} else if export.KeepLast > 0 {
+		artifacts := export.ArtifactVolume
+		if artifacts.Pattern == "" {
+			errs = append(errs, "spec.export.keepLast requires artifactVolume.pattern, such as \"gitea-dump-*.zip\"")
+		}
+		for i, vol := range volumes {
+			if vol.PVC == artifacts.PVC {
+				errs = append(errs, fmt.Sprintf("spec.volumes[%d]: %s is the artifact volume keepLast deletes files on; use a dedicated PVC, which is backed up without being listed", i, vol.PVC))
+			}
+		}
+	}
+	if artifacts := export.ArtifactVolume; artifacts != nil && strings.Contains(artifacts.Pattern, "/") {
+		errs = append(errs, fmt.Sprintf("spec.export.artifactVolume.pattern: %q must be a file name pattern", artifacts.Pattern))
+	}
+	if artifacts := export.ArtifactVolume; artifacts != nil && strings.Contains("/"+artifacts.Path+"/", "/../") {
+		errs = append(errs, fmt.Sprintf("spec.export.artifactVolume.path: %q must stay on the volume", artifacts.Path))
+	}
+
+	switch kind {
+	case exportJobRef:
+		if export.JobRef.Name == "" {
+			errs = append(errs, "spec.export.jobRef.name is empty")
+		}
+	case exportTemplate:
+		podSpec, _ := export.Template["spec"].(map[string]interface{})
+		if containers, _ := podSpec["containers"].([]interface{}); len(containers) == 0 {
+			errs = append(errs, "spec.export.template.spec.containers is required")
+		}
+	case exportSQLite:
+		if export.SQLite.PVC == "" || export.SQLite.Path == "" {
+			errs = append(errs, "spec.export.sqlite: pvc and path are required")
+		}
+		if export.Volume != nil && export.SQLite.PVC == export.Volume.PVC {
+			errs = append(errs, "spec.export.sqlite.pvc: dump to a different PVC than the database is on")
+		}
+	default:
+		db := map[string]*DatabaseExport{exportPostgres: export.Postgres, exportMySQL: export.MySQL, exportRedis: export.Redis}[kind]
+		if db.Service == "" {
+			errs = append(errs, fmt.Sprintf("spec.export.%s.service is required", kind))
+		}
+		if db.SecretRef != nil && db.SecretRef.Name == "" {
+			errs = append(errs, fmt.Sprintf("spec.export.%s.secretRef.name is empty", kind))
+		}
+	}
+	return errs
+}
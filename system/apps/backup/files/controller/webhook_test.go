@@ -0,0 +1,253 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+type fakeLookup struct {
+	pvcs     map[string]bool
+	pvcList  pvcList
+	backups  []BackupPolicy
+	restores []RestorePolicy
+}
+
+func (f fakeLookup) pvcExists(ns, name string) (bool, error) {
+	return f.pvcs[ns+"/"+name], nil
+}
+
+func (f fakeLookup) listPVCs(ns string) (pvcList, error) {
+	return f.pvcList, nil
+}
+
+func (f fakeLookup) backupPolicies(ns string) ([]BackupPolicy, error) {
+	return f.backups, nil
+}
+
+func (f fakeLookup) restorePolicies(ns string) ([]RestorePolicy, error) {
+	return f.restores, nil
+}
+
+func testBackupPolicy(name string, pvcs ...string) BackupPolicy {
+	policy := BackupPolicy{}
+	policy.Metadata.Name = name
+	policy.Metadata.Namespace = "apps"
+	policy.Spec.Schedule = "0 2 * * *"
+	for _, pvc := range pvcs {
+		policy.Spec.Volumes = append(policy.Spec.Volumes, BackupVolume{PVC: pvc})
+	}
+	return policy
+}
+
+func joined(messages []string) string {
+	return strings.Join(messages, "\n")
+}
+
+func TestValidateBackupPolicy(t *testing.T) {
+	lookup := fakeLookup{pvcs: map[string]bool{"apps/data": true, "apps/Data": true, "apps/media": true}}
+
+	errs, warnings, err := validateBackupPolicy(Config{}, lookup, testBackupPolicy("app", "data", "media"))
+	if err != nil || len(errs) != 0 || len(warnings) != 0 {
+		t.Fatalf("valid policy: errs=%v warnings=%v err=%v", errs, warnings, err)
+	}
+
+	policy := testBackupPolicy("app", "data", "data", "Data", "missing")
+	policy.Spec.Schedule = "0 25 * * *"
+	policy.Spec.TimeZone = "Mars/Olympus"
+	errs, warnings, _ = validateBackupPolicy(Config{}, lookup, policy)
+	for _, want := range []string{"spec.schedule/spec.timeZone", "spec.volumes[1]: PVC \"data\" is already listed in spec.volumes[0]", "PVCs Data, data generate the same object name \"backup-app-data\""} {
+		if !strings.Contains(joined(errs), want) {
+			t.Errorf("errors %q do not contain %q", errs, want)
+		}
+	}
+	if !strings.Contains(joined(warnings), "PVC apps/missing does not exist") {
+		t.Errorf("warnings %q do not report the missing PVC", warnings)
+	}
+
+	errs, _, _ = validateBackupPolicy(Config{}, lookup, testBackupPolicy(strings.Repeat("a", 50), "data"))
+	if !strings.Contains(joined(errs), "generated CronJob name") {
+		t.Errorf("errors %q do not report the long CronJob name", errs)
+	}
+
+	policy = testBackupPolicy("app", "data")
+	policy.Spec.Volumes[0].Exclude = []string{"/cache", " "}
+	mustUnmarshal(t, `{"matchExpressions": [{"key": "app", "operator": "Equals"}], "excludeIfPresent": ["cache/.nobackup"]}`, &policy.Spec.VolumeSelector)
+	errs, _, _ = validateBackupPolicy(Config{}, lookup, policy)
+	for _, want := range []string{"spec.volumes[0].exclude[1] is empty", "spec.volumeSelector: \"Equals\" is not a valid label selector operator", "spec.volumeSelector.excludeIfPresent[0]: \"cache/.nobackup\" must be a file name"} {
+		if !strings.Contains(joined(errs), want) {
+			t.Errorf("errors %q do not contain %q", errs, want)
+		}
+	}
+}
+
+func TestValidateBackupPolicyFiltersOnDirectClasses(t *testing.T) {
+	var cfg Config
+	mustUnmarshal(t, `{"storageClasses": {"nfs-client": {"method": "Direct"}}}`, &cfg.CopyMethods)
+	lookup := fakeLookup{pvcs: map[string]bool{"apps/data": true}}
+	mustUnmarshal(t, `{"items": [
+		{"metadata": {"name": "data", "namespace": "apps"}, "spec": {"storageClassName": "longhorn"}},
+		{"metadata": {"name": "media", "namespace": "apps", "labels": {"app": "app"}}, "spec": {"storageClassName": "nfs-client"}}
+	]}`, &lookup.pvcList)
+
+	policy := testBackupPolicy("app", "data")
+	policy.Spec.Volumes[0].Exclude = []string{"/cache"}
+	errs, _, _ := validateBackupPolicy(cfg, lookup, policy)
+	if len(errs) != 0 {
+		t.Errorf("filters on a cloneable class: %v", errs)
+	}
+
+	mustUnmarshal(t, `{"matchLabels": {"app": "app"}, "exclude": ["/tmp"]}`, &policy.Spec.VolumeSelector)
+	errs, _, _ = validateBackupPolicy(cfg, lookup, policy)
+	if !strings.Contains(joined(errs), "PVC media uses the Direct copy method") {
+		t.Errorf("errors %q do not reject the filters of the selected Direct PVC", errs)
+	}
+}
+
+func TestValidateBackupPolicyAgainstOtherPolicies(t *testing.T) {
+	lookup := fakeLookup{
+		pvcs:    map[string]bool{"apps/b-data": true, "apps/data": true},
+		backups: []BackupPolicy{testBackupPolicy("a-b", "data"), testBackupPolicy("other", "b-data")},
+	}
+	errs, warnings, _ := validateBackupPolicy(Config{}, lookup, testBackupPolicy("a", "b-data"))
+	if !strings.Contains(joined(errs), "generated name \"backup-a-b-data\" is also generated by BackupPolicy apps/a-b") {
+		t.Errorf("errors %q do not report the collision with a-b", errs)
+	}
+	if !strings.Contains(joined(warnings), "PVC b-data is also backed up by BackupPolicy apps/other") {
+		t.Errorf("warnings %q do not report the shared PVC", warnings)
+	}
+
+	// PVCs matched by a volume selector generate names as well, on both sides.
+	mustUnmarshal(t, `{"items": [
+		{"metadata": {"name": "b-data", "namespace": "apps", "labels": {"app": "b"}}},
+		{"metadata": {"name": "cache", "namespace": "apps", "labels": {"app": "c"}}}
+	]}`, &lookup.pvcList)
+	policy := testBackupPolicy("a")
+	mustUnmarshal(t, `{"matchLabels": {"app": "b"}}`, &policy.Spec.VolumeSelector)
+	lookup.backups = []BackupPolicy{testBackupPolicy("a-b", "data")}
+	errs, _, _ = validateBackupPolicy(Config{}, lookup, policy)
+	if !strings.Contains(joined(errs), "generated name \"backup-a-b-data\" is also generated by BackupPolicy apps/a-b") {
+		t.Errorf("errors %q do not report the collision of the selected PVC", errs)
+	}
+
+	other := testBackupPolicy("a-c")
+	mustUnmarshal(t, `{"matchLabels": {"app": "c"}}`, &other.Spec.VolumeSelector)
+	lookup.backups = []BackupPolicy{other}
+	errs, _, _ = validateBackupPolicy(Config{}, lookup, testBackupPolicy("a", "c-cache"))
+	if !strings.Contains(joined(errs), "generated name \"backup-a-c-cache\" is also generated by BackupPolicy apps/a-c") {
+		t.Errorf("errors %q do not report the collision with the PVC the other policy selects", errs)
+	}
+}
+
+func TestValidateRestorePolicy(t *testing.T) {
+	running := RestorePolicy{}
+	running.Metadata.Name = "running"
+	running.Spec.Volumes = []RestoreVolume{{SourcePVC: "data", TargetPVC: "busy"}}
+	done := RestorePolicy{}
+	done.Metadata.Name = "done"
+	done.Spec.Volumes = []RestoreVolume{{SourcePVC: "data", TargetPVC: "data"}}
+	done.Status.Conditions = []Condition{{Type: restoredCondition, Status: "True"}}
+	lookup := fakeLookup{pvcs: map[string]bool{"apps/data": true}, restores: []RestorePolicy{running, done}}
+
+	policy := RestorePolicy{}
+	policy.Metadata.Name = "restore"
+	policy.Metadata.Namespace = "apps"
+	policy.Spec.SourceNamespace = "apps"
+	policy.Spec.Volumes = []RestoreVolume{{SourcePVC: "data", TargetPVC: "data"}}
+	errs, warnings, err := validateRestorePolicy(lookup, policy)
+	if err != nil || len(errs) != 0 || len(warnings) != 0 {
+		t.Fatalf("valid policy: errs=%v warnings=%v err=%v", errs, warnings, err)
+	}
+
+	policy.Spec.Volumes = []RestoreVolume{
+		{SourcePVC: "data", TargetPVC: "busy", RestoreAsOf: "yesterday"},
+		{SourcePVC: "gone", TargetPVC: "busy"},
+	}
+	errs, _, _ = validateRestorePolicy(lookup, policy)
+	for _, want := range []string{"restoreAsOf: \"yesterday\" is not an RFC 3339 time", "targetPVC \"busy\" is already restored by spec.volumes[0]", "PVC apps/busy is the target of RestorePolicy running"} {
+		if !strings.Contains(joined(errs), want) {
+			t.Errorf("errors %q do not contain %q", errs, want)
+		}
+	}
+}
+
+func TestHandleValidate(t *testing.T) {
+	policy := testBackupPolicy("app", "data")
+	policy.Spec.Schedule = "every night"
+	object, _ := json.Marshal(policy)
+	review, _ := json.Marshal(map[string]interface{}{
+		"apiVersion": "admission.k8s.io/v1",
+		"kind":       "AdmissionReview",
+		"request": map[string]interface{}{
+			"uid":       "1234",
+			"kind":      map[string]string{"group": backupPolicyGroup, "version": backupPolicyVersion, "kind": "BackupPolicy"},
+			"namespace": "apps",
+			"operation": "CREATE",
+			"object":    json.RawMessage(object),
+		},
+	})
+
+	recorder := httptest.NewRecorder()
+	handleValidate(Config{}, fakeLookup{}, recorder, httptest.NewRequest("POST", "/validate", bytes.NewReader(review)))
+
+	var response admissionReview
+	if err := json.Unmarshal(recorder.Body.Bytes(), &response); err != nil {
+		t.Fatal(err)
+	}
+	if response.Response == nil || response.Response.UID != "1234" || response.Response.Allowed {
+		t.Fatalf("unexpected response %s", recorder.Body.String())
+	}
+	if !strings.Contains(response.Response.Status.Message, "spec.schedule") || len(response.Response.Warnings) != 1 {
+		t.Errorf("unexpected message %q or warnings %q", response.Response.Status.Message, response.Response.Warnings)
+	}
+
+	// An UPDATE that leaves the spec alone, such as a status or annotation
+	// patch, is admitted even though the spec would be rejected.
+	policy.Metadata.Annotations = map[string]string{processedHashAnnotation: "abc"}
+	updated, _ := json.Marshal(policy)
+	review, _ = json.Marshal(map[string]interface{}{
+		"apiVersion": "admission.k8s.io/v1",
+		"kind":       "AdmissionReview",
+		"request": map[string]interface{}{
+			"uid":       "5678",
+			"kind":      map[string]string{"group": backupPolicyGroup, "version": backupPolicyVersion, "kind": "BackupPolicy"},
+			"namespace": "apps",
+			"operation": "UPDATE",
+			"object":    json.RawMessage(updated),
+			"oldObject": json.RawMessage(object),
+		},
+	})
+	recorder = httptest.NewRecorder()
+	handleValidate(Config{}, fakeLookup{}, recorder, httptest.NewRequest("POST", "/validate", bytes.NewReader(review)))
+	response = admissionReview{}
+	if err := json.Unmarshal(recorder.Body.Bytes(), &response); err != nil {
+		t.Fatal(err)
+	}
+	if response.Response == nil || !response.Response.Allowed || len(response.Response.Warnings) != 0 {
+		t.Errorf("unchanged spec was not admitted: %s", recorder.Body.String())
+	}
+}
+
+func TestSpecUnchanged(t *testing.T) {
+	for _, tc := range []struct {
+		operation string
+		object    string
+		oldObject string
+		want      bool
+	}{
+		{"UPDATE", `{"metadata": {"annotations": {"a": "b"}}, "spec": {"schedule": "0 2 * * *"}}`, `{"spec": {"schedule": "0 2 * * *"}, "status": {}}`, true},
+		{"UPDATE", `{"spec": {"schedule": "0 3 * * *"}}`, `{"spec": {"schedule": "0 2 * * *"}}`, false},
+		{"UPDATE", `{"spec": {"schedule": "0 2 * * *"}}`, ``, false},
+		{"CREATE", `{"spec": {"schedule": "0 2 * * *"}}`, `{"spec": {"schedule": "0 2 * * *"}}`, false},
+	} {
+		req := &admissionRequest{Operation: tc.operation, Object: json.RawMessage(tc.object)}
+		if tc.oldObject != "" {
+			req.OldObject = json.RawMessage(tc.oldObject)
+		}
+		if got := specUnchanged(req); got != tc.want {
+			t.Errorf("specUnchanged(%s %s, %s) = %v, want %v", tc.operation, tc.object, tc.oldObject, got, tc.want)
+		}
+	}
+}